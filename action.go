@@ -2,17 +2,20 @@ package peco
 
 import (
 	"bytes"
-	"fmt"
+	"io/ioutil"
 	"math"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 	"unicode"
 
 	"context"
 
-	"github.com/google/btree"
 	"github.com/lestrrat-go/pdebug"
 	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/filter"
+	"github.com/peco/peco/internal/i18n"
 	"github.com/peco/peco/internal/keyseq"
 	"github.com/peco/peco/internal/util"
 	"github.com/peco/peco/line"
@@ -25,13 +28,18 @@ var nameToActions map[string]Action
 // This is the default keybinding used by NewKeymap()
 var defaultKeyBinding map[string]Action
 
+// defaultKeyBindingNames maps the keys in defaultKeyBinding to the
+// names of their actions, so that the keymap can be introspected
+var defaultKeyBindingNames map[string]string
+
 // Execute fulfills the Action interface for AfterFunc
 func (a ActionFunc) Execute(ctx context.Context, state *Peco, e termbox.Event) {
 	a(ctx, state, e)
 }
 
-func (a ActionFunc) registerKeySequence(k keyseq.KeyList) {
+func (a ActionFunc) registerKeySequence(name string, k keyseq.KeyList) {
 	defaultKeyBinding[k.String()] = a
+	defaultKeyBindingNames[k.String()] = name
 }
 
 // Register fulfills the Action interface for AfterFunc. Registers `a`
@@ -40,7 +48,7 @@ func (a ActionFunc) registerKeySequence(k keyseq.KeyList) {
 func (a ActionFunc) Register(name string, defaultKeys ...termbox.Key) {
 	nameToActions["peco."+name] = a
 	for _, k := range defaultKeys {
-		a.registerKeySequence(keyseq.KeyList{keyseq.NewKeyFromKey(k)})
+		a.registerKeySequence("peco."+name, keyseq.KeyList{keyseq.NewKeyFromKey(k)})
 	}
 }
 
@@ -48,12 +56,12 @@ func (a ActionFunc) Register(name string, defaultKeys ...termbox.Key) {
 // Registers the action to be mapped against a key sequence
 func (a ActionFunc) RegisterKeySequence(name string, k keyseq.KeyList) {
 	nameToActions["peco."+name] = a
-	a.registerKeySequence(k)
+	a.registerKeySequence("peco."+name, k)
 }
 
 func wrapDeprecated(fn func(context.Context, *Peco, termbox.Event), oldName, newName string) ActionFunc {
 	return ActionFunc(func(ctx context.Context, state *Peco, e termbox.Event) {
-		state.Hub().SendStatusMsg(ctx, fmt.Sprintf("%s is deprecated. Use %s", oldName, newName))
+		state.SendStatus(ctx, StatusInfo, i18n.Sprintf("%s is deprecated. Use %s", oldName, newName))
 		fn(ctx, state, e)
 	})
 }
@@ -62,6 +70,7 @@ func init() {
 	// Build the global maps
 	nameToActions = map[string]Action{}
 	defaultKeyBinding = map[string]Action{}
+	defaultKeyBindingNames = map[string]string{}
 
 	ActionFunc(doInvertSelection).Register("InvertSelection")
 	ActionFunc(doBeginningOfLine).Register("BeginningOfLine", termbox.KeyCtrlA)
@@ -85,11 +94,18 @@ func init() {
 	ActionFunc(doFinish).Register("Finish", termbox.KeyEnter)
 	ActionFunc(doForwardChar).Register("ForwardChar", termbox.KeyCtrlF)
 	ActionFunc(doForwardWord).Register("ForwardWord")
+	ActionFunc(doTransposeChars).Register("TransposeChars")
+	ActionFunc(doTransposeWords).Register("TransposeWords")
+	ActionFunc(doUpcaseWord).Register("UpcaseWord")
+	ActionFunc(doDowncaseWord).Register("DowncaseWord")
+	ActionFunc(doCapitalizeWord).Register("CapitalizeWord")
 	ActionFunc(doKillEndOfLine).Register("KillEndOfLine", termbox.KeyCtrlK)
 	ActionFunc(doKillBeginningOfLine).Register("KillBeginningOfLine", termbox.KeyCtrlU)
 	ActionFunc(doRotateFilter).Register("RotateFilter", termbox.KeyCtrlR)
 	wrapDeprecated(doRotateFilter, "RotateMatcher", "RotateFilter").Register("RotateMatcher")
 	ActionFunc(doBackToInitialFilter).Register("BackToInitialFilter")
+	ActionFunc(doToggleExactMatch).Register("ToggleExactMatch")
+	ActionFunc(doToggleCaseSensitivity).Register("ToggleCaseSensitivity")
 
 	ActionFunc(doSelectUp).Register("SelectUp", termbox.KeyArrowUp, termbox.KeyCtrlP)
 	wrapDeprecated(doSelectDown, "SelectNext", "SelectUp/SelectDown").Register("SelectNext")
@@ -103,6 +119,23 @@ func init() {
 	ActionFunc(doScrollPageUp).Register("ScrollPageUp", termbox.KeyArrowLeft)
 	wrapDeprecated(doScrollPageUp, "SelectPreviousPage", "ScrollPageDown/ScrollPageUp").Register("SelectPreviousPage")
 
+	ActionFunc(doScrollHalfPageDown).Register("ScrollHalfPageDown")
+	ActionFunc(doScrollHalfPageUp).Register("ScrollHalfPageUp")
+	ActionFunc(doCountPrefix).Register("CountPrefix")
+	ActionFunc(doLeaveLayer).Register("LeaveLayer")
+	ActionFunc(doPinSelected).Register("PinSelected")
+
+	ActionFunc(doEditQueryInEditor).Register("EditQueryInEditor")
+	ActionFunc(doViewInPager).Register("ViewInPager")
+	ActionFunc(doSearchInResults).Register("SearchInResults")
+	ActionFunc(doSearchNext).Register("SearchNext")
+	ActionFunc(doSearchPrevious).Register("SearchPrevious")
+	ActionFunc(doJumpBack).Register("JumpBack")
+	ActionFunc(doJumpForward).Register("JumpForward")
+	ActionFunc(doSelectBetweenBookmarks).Register("SelectBetweenBookmarks")
+	ActionFunc(doDiffSelectionWithFile).Register("DiffSelectionWithFile")
+	ActionFunc(doAppendSelectionToFile).Register("AppendSelectionToFile")
+
 	ActionFunc(doScrollLeft).Register("ScrollLeft")
 	ActionFunc(doScrollRight).Register("ScrollRight")
 
@@ -120,6 +153,8 @@ func init() {
 	)
 	ActionFunc(doSelectAll).Register("SelectAll")
 	ActionFunc(doSelectVisible).Register("SelectVisible")
+	ActionFunc(doSelectPage).Register("SelectPage")
+	ActionFunc(doDeselectPage).Register("DeselectPage")
 	wrapDeprecated(doToggleRangeMode, "ToggleSelectMode", "ToggleRangeMode").Register("ToggleSelectMode")
 	wrapDeprecated(doCancelRangeMode, "CancelSelectMode", "CancelRangeMode").Register("CancelSelectMode")
 	ActionFunc(doToggleRangeMode).Register("ToggleRangeMode")
@@ -127,6 +162,17 @@ func init() {
 	ActionFunc(doToggleQuery).Register("ToggleQuery", termbox.KeyCtrlT)
 	ActionFunc(doRefreshScreen).Register("RefreshScreen", termbox.KeyCtrlL)
 	ActionFunc(doToggleSingleKeyJump).Register("ToggleSingleKeyJump")
+	ActionFunc(doToggleFollow).Register("ToggleFollow")
+	ActionFunc(doTakeSnapshot).Register("TakeSnapshot")
+	ActionFunc(doPreviousSnapshot).Register("PreviousSnapshot")
+	ActionFunc(doNextSnapshot).Register("NextSnapshot")
+	ActionFunc(doReturnToLive).Register("ReturnToLive")
+	ActionFunc(doReloadInput).Register("ReloadInput")
+	ActionFunc(doDeleteLine).Register("DeleteLine")
+	ActionFunc(doDeleteSelected).Register("DeleteSelected")
+	ActionFunc(doToggleSort).Register("ToggleSort")
+	ActionFunc(doAnnotate).Register("Annotate")
+	ActionFunc(doTmuxBuffer).Register("TmuxBuffer")
 
 	ActionFunc(doToggleViewArround).Register("ViewArround", termbox.KeyCtrlV)
 
@@ -171,9 +217,41 @@ func doAcceptChar(ctx context.Context, state *Peco, e termbox.Event) {
 		return
 	}
 
+	if state.SearchMode() {
+		sq := state.SearchQuery()
+		sq.InsertAt(ch, sq.Len())
+		updateSearchPattern(ctx, state)
+		return
+	}
+
+	if state.AnnotateMode() {
+		aq := state.AnnotationQuery()
+		aq.InsertAt(ch, aq.Len())
+		updateAnnotationPrompt(ctx, state)
+		return
+	}
+
+	if state.CountPrefixMode() {
+		if ch >= '0' && ch <= '9' {
+			n := state.AppendCountPrefix(int(ch - '0'))
+			state.Hub().SendStatusMsg(ctx, i18n.Sprintf("Count: %d", n))
+			return
+		}
+
+		// Anything other than a digit cancels the count prefix, and
+		// is handled as usual
+		state.SetCountPrefixMode(false)
+		state.Hub().SendStatusMsg(ctx, "")
+	}
+
 	q := state.Query()
 	c := state.Caret()
 
+	if max := state.maxQueryLength; max > 0 && q.Len() >= max {
+		state.SendStatusAndClear(ctx, StatusWarn, i18n.Sprintf("The query is limited to %d characters", max), 2*time.Second)
+		return
+	}
+
 	q.InsertAt(ch, c.Pos())
 	c.Move(1)
 
@@ -198,6 +276,73 @@ func doRotateFilter(ctx context.Context, state *Peco, e termbox.Event) {
 	state.Hub().SendDrawPrompt(ctx)
 }
 
+// resolveSelectFilterAction resolves peco.SelectFilter.<name>. The
+// second return value is false if the action name is not one of these
+func resolveSelectFilterAction(name string) (Action, bool, error) {
+	if !strings.HasPrefix(name, selectFilterPrefix) {
+		return nil, false, nil
+	}
+
+	// Filters are not known until the config has been applied, so
+	// unknown names are reported when the action is executed
+	filterName := strings.TrimPrefix(name, selectFilterPrefix)
+	if filterName == "" {
+		return nil, true, errors.Errorf("could not resolve %s: filter name is missing", name)
+	}
+
+	return ActionFunc(func(ctx context.Context, state *Peco, _ termbox.Event) {
+		doSelectFilter(ctx, state, filterName)
+	}), true, nil
+}
+
+// doSelectFilter switches to the filter with the given name, instead
+// of rotating through the filters until it is reached
+func doSelectFilter(ctx context.Context, state *Peco, name string) {
+	if err := state.Filters().SetCurrentByName(name); err != nil {
+		state.SendStatusAndClear(ctx, StatusError, i18n.Sprintf("No such filter: %s", name), 2*time.Second)
+		return
+	}
+	state.SendStatusAndClear(ctx, StatusInfo, i18n.Sprintf("Filter: %s", name), 500*time.Millisecond)
+
+	if state.ExecQuery(nil) {
+		return
+	}
+	state.Hub().SendDrawPrompt(ctx)
+}
+
+// doToggleExactMatch switches the current filter between its usual
+// behavior and matching the query as an exact substring, without
+// rotating to a different filter
+func doToggleExactMatch(ctx context.Context, state *Peco, e termbox.Event) {
+	f, ok := state.Filters().Current().(filter.ExactMatcher)
+	if !ok {
+		state.SendStatusAndClear(ctx, StatusWarn, i18n.Sprintf("ToggleExactMatch is not supported by %s", state.Filters().Current()), 2*time.Second)
+		return
+	}
+	f.SetExact(!f.Exact())
+
+	if state.ExecQuery(nil) {
+		return
+	}
+	state.Hub().SendDrawPrompt(ctx)
+}
+
+// doToggleCaseSensitivity switches the current filter between ignoring
+// case and matching it, without rotating to a different filter
+func doToggleCaseSensitivity(ctx context.Context, state *Peco, e termbox.Event) {
+	f, ok := state.Filters().Current().(filter.CaseToggler)
+	if !ok {
+		state.SendStatusAndClear(ctx, StatusWarn, i18n.Sprintf("ToggleCaseSensitivity is not supported by %s", state.Filters().Current()), 2*time.Second)
+		return
+	}
+	f.ToggleCase(state.Query().String())
+
+	if state.ExecQuery(nil) {
+		return
+	}
+	state.Hub().SendDrawPrompt(ctx)
+}
+
 func doBackToInitialFilter(ctx context.Context, state *Peco, e termbox.Event) {
 	if pdebug.Enabled {
 		g := pdebug.Marker("doBackToInitialFilter")
@@ -229,9 +374,19 @@ func doToggleSelection(ctx context.Context, state *Peco, _ termbox.Event) {
 		selection.Remove(l)
 		return
 	}
+
+	if selection.IsFull() {
+		notifySelectionLimit(ctx, state)
+		return
+	}
 	selection.Add(l)
 }
 
+// notifySelectionLimit tells the user that no more lines can be selected
+func notifySelectionLimit(ctx context.Context, state *Peco) {
+	state.SendStatusAndClear(ctx, StatusWarn, i18n.Sprintf("Cannot select more than %d lines", state.maxSelect), 2*time.Second)
+}
+
 func doToggleRangeMode(ctx context.Context, state *Peco, _ termbox.Event) {
 	if pdebug.Enabled {
 		g := pdebug.Marker("doToggleRangeMode")
@@ -262,14 +417,20 @@ func doSelectNone(ctx context.Context, state *Peco, _ termbox.Event) {
 func doSelectAll(ctx context.Context, state *Peco, _ termbox.Event) {
 	selection := state.Selection()
 	b := state.CurrentLineBuffer()
+	full := false
 	for x := 0; x < b.Size(); x++ {
 		if l, err := b.LineAt(x); err == nil {
 			l.SetDirty(true)
-			selection.Add(l)
+			if !selection.Add(l) {
+				full = true
+			}
 		} else {
 			selection.Remove(l)
 		}
 	}
+	if full {
+		notifySelectionLimit(ctx, state)
+	}
 	state.Hub().SendDraw(ctx, nil)
 }
 
@@ -284,13 +445,80 @@ func doSelectVisible(ctx context.Context, state *Peco, _ termbox.Event) {
 	loc := state.Location()
 	pc := loc.PageCrop()
 	lb := pc.Crop(b)
+	full := false
 	for x := 0; x < lb.Size(); x++ {
 		l, err := lb.LineAt(x)
 		if err != nil {
 			continue
 		}
 		l.SetDirty(true)
-		selection.Add(l)
+		if !selection.Add(l) {
+			full = true
+		}
+	}
+	if full {
+		notifySelectionLimit(ctx, state)
+	}
+	state.Hub().SendDraw(ctx, nil)
+}
+
+// pageLines returns the lines on the current page. They are read from
+// the buffer all at once, so that they stay consistent even if the
+// filter replaces, or releases, the buffer meanwhile
+func pageLines(state *Peco) []line.Line {
+	pc := state.Location().PageCrop()
+	start := pc.perPage * (pc.currentPage - 1)
+	if start < 0 {
+		start = 0
+	}
+	return state.CurrentLineBuffer().linesInRange(start, start+pc.perPage)
+}
+
+// doSelectPage selects the lines on the current page, unless all of
+// them are selected already, in which case they are deselected
+func doSelectPage(ctx context.Context, state *Peco, _ termbox.Event) {
+	if pdebug.Enabled {
+		g := pdebug.Marker("doSelectPage")
+		defer g.End()
+	}
+
+	lines := pageLines(state)
+	selection := state.Selection()
+	selected := true
+	for _, l := range lines {
+		if !isGroupHeader(l) && !selection.Has(l) {
+			selected = false
+			break
+		}
+	}
+
+	full := false
+	for _, l := range lines {
+		l.SetDirty(true)
+		if selected {
+			selection.Remove(l)
+		} else if !selection.Add(l) {
+			full = true
+		}
+	}
+	if full {
+		notifySelectionLimit(ctx, state)
+	}
+	state.Hub().SendDraw(ctx, nil)
+}
+
+// doDeselectPage deselects the lines on the current page, leaving
+// those on other pages selected
+func doDeselectPage(ctx context.Context, state *Peco, _ termbox.Event) {
+	if pdebug.Enabled {
+		g := pdebug.Marker("doDeselectPage")
+		defer g.End()
+	}
+
+	selection := state.Selection()
+	for _, l := range pageLines(state) {
+		l.SetDirty(true)
+		selection.Remove(l)
 	}
 	state.Hub().SendDraw(ctx, nil)
 }
@@ -309,74 +537,164 @@ func doFinish(ctx context.Context, state *Peco, _ termbox.Event) {
 		defer g.End()
 	}
 
+	if state.SearchMode() {
+		// Enter confirms the pattern, instead of finishing
+		state.SetSearchMode(false)
+		state.Hub().SendStatusMsg(ctx, "")
+		jumpToSearchMatch(ctx, state, 1)
+		return
+	}
+
+	if state.AnnotateMode() {
+		// Enter attaches the note, instead of finishing
+		finishAnnotation(ctx, state, true)
+		return
+	}
+
+	if err := state.checkSelectionCount(); err != nil {
+		state.SendStatusAndClear(ctx, StatusError, err.Error(), 2*time.Second)
+		return
+	}
+
 	ccarg := state.execOnFinish
-	if len(ccarg) == 0 {
+	if ccarg.IsEmpty() {
 		state.Exit(errCollectResults{})
 		return
 	}
 
-	sel := NewSelection()
-	state.Selection().Copy(sel)
-	if sel.Len() == 0 {
-		if l, err := state.CurrentLineBuffer().LineAt(state.Location().LineNumber()); err == nil {
-			sel.Add(l)
+	if state.tmuxOpen != "" && state.insideTmux() {
+		// The command runs in tmux, and peco finishes as usual
+		_, accepted := commandInput(state, selectedOrCurrent(state))
+		if err := state.recordFrecency(accepted); err != nil {
+			state.SendStatusAndClear(ctx, StatusError, err.Error(), 2*time.Second)
 		}
+		if err := state.openInTmux(ccarg, accepted); err != nil {
+			state.SendStatusAndClear(ctx, StatusError, err.Error(), 2*time.Second)
+			return
+		}
+		state.Exit(errCollectResults{})
+		return
 	}
 
-	var stdin bytes.Buffer
-	sel.Ascend(func(it btree.Item) bool {
-		line := it.(line.Line)
-		stdin.WriteString(line.Buffer())
-		stdin.WriteRune('\n')
-		return true
-	})
+	sel := selectedOrCurrent(state)
+	stdin, accepted := commandInput(state, sel)
+	if err := state.recordFrecency(accepted); err != nil {
+		state.SendStatusAndClear(ctx, StatusError, err.Error(), 2*time.Second)
+	}
 
-	var err error
-	state.Hub().SendStatusMsg(ctx, "Executing " + ccarg)
-	cmd := util.Shell(ccarg)
-	cmd.Stdin = &stdin
+	idsEnv, removeIDs, err := matchedIDsEnv(accepted)
+	if err != nil {
+		state.SendStatusAndClear(ctx, StatusError, err.Error(), 2*time.Second)
+		return
+	}
+	defer removeIDs()
+
+	state.SendStatus(ctx, StatusInfo, i18n.Sprintf("Executing %s", ccarg))
+	cmd := ccarg.command(accepted)
+	cmd.Stdin = stdin
 	cmd.Stdout = state.Stdout
 	cmd.Stderr = state.Stderr
-	// Setup some environment variables. Start with a copy of the current
-	// environment...
-	env := os.Environ()
-
-	// Add some PECO specific ones...
-	// PECO_QUERY: current query value
-	// PECO_FILENAME: input file name, if any. "-" for stdin
-	// PECO_LINE_COUNT: number of lines in the original input
-	// PECO_MATCHED_LINE_COUNT: number of lines matched (number of lines being
-	//     sent to stdin of the command being executed)
-
-	if s, ok := state.Source().(*Source); ok {
-		env = append(env,
-			`PECO_FILENAME=`+s.Name(),
-			`PECO_LINE_COUNT=`+strconv.Itoa(s.Size()),
-		)
-	}
-
-	env = append(env,
-		`PECO_QUERY=`+state.Query().String(),
+	// Setup some environment variables (see commandEnv), plus
+	// PECO_MATCHED_LINE_COUNT: number of lines matched (number of lines
+	//     being sent to stdin of the command being executed)
+	// and the IDs of these lines (see matchedIDsEnv)
+	cmd.Env = append(append(state.commandEnv(),
 		`PECO_MATCHED_LINE_COUNT=`+strconv.Itoa(sel.Len()),
-	)
-	cmd.Env = env
+	), idsEnv...)
 
 	state.screen.Suspend()
 
+	hookErr := state.runAcceptHook(accepted)
 	err = cmd.Run()
 	state.screen.Resume()
 	state.Hub().SendDraw(ctx, &DrawOptions{DisableCache: true})
+	if hookErr != nil {
+		state.SendStatusAndClear(ctx, StatusError, hookErr.Error(), 2*time.Second)
+	}
 	if err != nil {
 		// bail out, or otherwise the user cannot know what happened
 		state.Exit(errors.Wrap(err, `failed to execute command`))
 	}
 }
 
+// selectedOrCurrent returns a copy of the selection or, if nothing is
+// selected, a selection that holds the line under the cursor
+func selectedOrCurrent(state *Peco) *Selection {
+	sel := NewSelection()
+	state.Selection().Copy(sel)
+	if sel.Len() == 0 {
+		if l, err := state.CurrentLineBuffer().LineAt(state.Location().LineNumber()); err == nil {
+			sel.Add(l)
+		}
+	}
+	return sel
+}
+
+// commandInput returns what is written to the stdin of commands
+// executed with the lines in sel, along with the lines themselves
+func commandInput(state *Peco, sel *Selection) (*bytes.Buffer, []line.Line) {
+	var stdin bytes.Buffer
+	var lines []line.Line
+	state.ascendSelection(sel, func(l line.Line) bool {
+		stdin.WriteString(l.Buffer())
+		stdin.WriteByte(state.outputSeparator())
+		lines = append(lines, l)
+		return true
+	})
+	return &stdin, lines
+}
+
+// makeExecAction creates the action for a custom action that executes
+// command, as specified by an "exec" key in the config file. Like
+// --exec, the command receives the selected lines (or the line under
+// the cursor) on its stdin, and the environment described in
+// commandEnv. In addition, "{}" in a command line is replaced with the
+// lines, quoted for the shell. Unlike --exec, peco keeps running
+// afterwards
+func makeExecAction(command CommandConfig) ActionFunc {
+	return func(ctx context.Context, state *Peco, _ termbox.Event) {
+		sel := selectedOrCurrent(state)
+		stdin, lines := commandInput(state, sel)
+
+		c := command
+		if c.Line != "" {
+			words := make([]string, len(lines))
+			for i, l := range lines {
+				words[i] = util.ShellQuote(l.Output())
+			}
+			c.Line = strings.Replace(c.Line, commandPlaceholder, strings.Join(words, " "), -1)
+		}
+
+		idsEnv, removeIDs, err := matchedIDsEnv(lines)
+		if err != nil {
+			state.SendStatusAndClear(ctx, StatusError, err.Error(), 2*time.Second)
+			return
+		}
+		defer removeIDs()
+
+		cmd := c.command(lines)
+		cmd.Stdin = stdin
+		cmd.Stdout = state.Stdout
+		cmd.Stderr = state.Stderr
+		cmd.Env = append(append(state.commandEnv(),
+			`PECO_MATCHED_LINE_COUNT=`+strconv.Itoa(len(lines)),
+		), idsEnv...)
+
+		state.screen.Suspend()
+		err = cmd.Run()
+		state.screen.Resume()
+		state.Hub().SendDraw(ctx, &DrawOptions{DisableCache: true})
+		if err != nil {
+			state.SendStatusAndClear(ctx, StatusError, errors.Wrapf(err, "failed to execute %s", command).Error(), 2*time.Second)
+		}
+	}
+}
+
 func doCancel(ctx context.Context, state *Peco, e termbox.Event) {
 	km := state.Keymap()
 
-	if seq := km.Sequence(); seq.InMiddleOfChain() {
-		seq.CancelChain()
+	if km.InMiddleOfChain() {
+		km.CancelChain()
 		return
 	}
 
@@ -385,12 +703,21 @@ func doCancel(ctx context.Context, state *Peco, e termbox.Event) {
 		return
 	}
 
-	// peco.Cancel -> end program, exit with failure
-	err := makeIgnorable(errors.New("user canceled"))
-	if state.onCancel == errorKey {
-		err = setExitStatus(err, 1)
+	if state.SearchMode() {
+		state.SetSearchMode(false)
+		state.SearchQuery().Reset()
+		updateSearchPattern(ctx, state)
+		state.Hub().SendStatusMsg(ctx, "")
+		return
+	}
+
+	if state.AnnotateMode() {
+		finishAnnotation(ctx, state, false)
+		return
 	}
-	state.Exit(err)
+
+	// peco.Cancel -> end program, exit with failure
+	state.cancel(errUserCanceled)
 }
 
 func doSelectDown(ctx context.Context, state *Peco, e termbox.Event) {
@@ -398,7 +725,7 @@ func doSelectDown(ctx context.Context, state *Peco, e termbox.Event) {
 		g := pdebug.Marker("doSelectDown")
 		defer g.End()
 	}
-	state.Hub().SendPaging(ctx, ToLineBelow)
+	sendCountedPaging(ctx, state, ToLineBelow)
 }
 
 func doSelectUp(ctx context.Context, state *Peco, e termbox.Event) {
@@ -406,15 +733,88 @@ func doSelectUp(ctx context.Context, state *Peco, e termbox.Event) {
 		g := pdebug.Marker("doSelectUp")
 		defer g.End()
 	}
-	state.Hub().SendPaging(ctx, ToLineAbove)
+	sendCountedPaging(ctx, state, ToLineAbove)
 }
 
 func doScrollPageUp(ctx context.Context, state *Peco, e termbox.Event) {
-	state.Hub().SendPaging(ctx, ToScrollPageUp)
+	sendCountedPaging(ctx, state, ToScrollPageUp)
 }
 
 func doScrollPageDown(ctx context.Context, state *Peco, e termbox.Event) {
-	state.Hub().SendPaging(ctx, ToScrollPageDown)
+	sendCountedPaging(ctx, state, ToScrollPageDown)
+}
+
+func doScrollHalfPageUp(ctx context.Context, state *Peco, e termbox.Event) {
+	sendCountedPaging(ctx, state, ToScrollHalfPageUp)
+}
+
+func doScrollHalfPageDown(ctx context.Context, state *Peco, e termbox.Event) {
+	sendCountedPaging(ctx, state, ToScrollHalfPageDown)
+}
+
+// sendCountedPaging sends the paging request t, repeated as many
+// times as the count prefix that the user has entered, if any
+func sendCountedPaging(ctx context.Context, state *Peco, t PagingRequestType) {
+	wasCounting := state.CountPrefixMode()
+	n := state.consumeCountPrefix()
+	if wasCounting {
+		state.Hub().SendStatusMsg(ctx, "")
+	}
+
+	if n <= 1 {
+		state.Hub().SendPaging(ctx, t)
+		return
+	}
+	state.Hub().SendPaging(ctx, CountedPagingRequest{Request: t, Count: n})
+}
+
+func doCountPrefix(ctx context.Context, state *Peco, e termbox.Event) {
+	if pdebug.Enabled {
+		g := pdebug.Marker("doCountPrefix")
+		defer g.End()
+	}
+
+	state.SetCountPrefixMode(true)
+	state.Hub().SendStatusMsg(ctx, i18n.T("Count: "))
+}
+
+// setKeymapLayer switches to the named keymap layer, or back to the
+// default key bindings if name is empty
+func setKeymapLayer(ctx context.Context, state *Peco, name string) {
+	if state.KeymapLayer() == name {
+		return
+	}
+
+	state.Keymap().CancelChain()
+	state.SetKeymapLayer(name)
+	if name == "" {
+		state.SendStatusAndClear(ctx, StatusInfo, i18n.T("Left layer"), 500*time.Millisecond)
+	} else {
+		state.SendStatusAndClear(ctx, StatusInfo, i18n.Sprintf("Layer: %s", name), 500*time.Millisecond)
+	}
+	state.Hub().SendDrawPrompt(ctx)
+}
+
+func doLeaveLayer(ctx context.Context, state *Peco, e termbox.Event) {
+	setKeymapLayer(ctx, state, "")
+}
+
+// doPinSelected moves the selected lines to the top of the current
+// buffer, or restores the original order if they already are
+func doPinSelected(ctx context.Context, state *Peco, e termbox.Event) {
+	if pb, ok := state.CurrentLineBuffer().(*PinnedBuffer); ok {
+		state.SetCurrentLineBuffer(pb.Unpinned())
+		state.SendStatusAndClear(ctx, StatusInfo, i18n.T("Unpinned selected lines"), 500*time.Millisecond)
+		return
+	}
+
+	if state.Selection().Len() == 0 {
+		state.SendStatusAndClear(ctx, StatusWarn, i18n.T("No lines selected"), 500*time.Millisecond)
+		return
+	}
+
+	state.SetCurrentLineBuffer(NewPinnedBuffer(state.CurrentLineBuffer(), state.Selection()))
+	state.Hub().SendPaging(ctx, ToScrollFirstItem)
 }
 
 func doScrollLeft(ctx context.Context, state *Peco, e termbox.Event) {
@@ -426,10 +826,12 @@ func doScrollRight(ctx context.Context, state *Peco, e termbox.Event) {
 }
 
 func doScrollFirstItem(ctx context.Context, state *Peco, e termbox.Event) {
+	recordJump(state)
 	state.Hub().SendPaging(ctx, ToScrollFirstItem)
 }
 
 func doScrollLastItem(ctx context.Context, state *Peco, e termbox.Event) {
+	recordJump(state)
 	state.Hub().SendPaging(ctx, ToScrollLastItem)
 }
 
@@ -456,18 +858,22 @@ func doInvertSelection(ctx context.Context, state *Peco, _ termbox.Event) {
 	selection := state.Selection()
 	b := state.CurrentLineBuffer()
 
+	full := false
 	for x := 0; x < b.Size(); x++ {
 		if l, err := b.LineAt(x); err == nil {
 			l.SetDirty(true)
 			if selection.Has(l) {
 				selection.Remove(l)
-			} else {
-				selection.Add(l)
+			} else if !selection.Add(l) {
+				full = true
 			}
 		} else {
 			selection.Remove(l)
 		}
 	}
+	if full {
+		notifySelectionLimit(ctx, state)
+	}
 
 	state.Hub().SendDraw(ctx, nil)
 }
@@ -588,10 +994,11 @@ SEARCH_PREV_WORD:
 
 func doForwardChar(ctx context.Context, state *Peco, _ termbox.Event) {
 	c := state.Caret()
-	if c.Pos() >= state.Query().Len() {
+	q := state.Query()
+	if c.Pos() >= q.Len() {
 		return
 	}
-	c.Move(1)
+	c.SetPos(q.NextGraphemeBoundary(c.Pos()))
 	state.Hub().SendDrawPrompt(ctx)
 }
 
@@ -600,7 +1007,7 @@ func doBackwardChar(ctx context.Context, state *Peco, _ termbox.Event) {
 	if c.Pos() <= 0 {
 		return
 	}
-	c.Move(-1)
+	c.SetPos(state.Query().PrevGraphemeBoundary(c.Pos()))
 	state.Hub().SendDrawPrompt(ctx)
 }
 
@@ -640,6 +1047,43 @@ func doDeleteForwardWord(ctx context.Context, state *Peco, _ termbox.Event) {
 	state.Hub().SendDrawPrompt(ctx)
 }
 
+// editQueryAtCaret applies edit to the query at the position of the caret,
+// and moves the caret to the position that it returns. The query is
+// executed if it was changed
+func editQueryAtCaret(ctx context.Context, state *Peco, edit func(*Query, int) (int, bool)) {
+	c := state.Caret()
+	pos, changed := edit(state.Query(), c.Pos())
+	if !changed {
+		return
+	}
+	c.SetPos(pos)
+
+	if state.ExecQuery(nil) {
+		return
+	}
+	state.Hub().SendDrawPrompt(ctx)
+}
+
+func doTransposeChars(ctx context.Context, state *Peco, _ termbox.Event) {
+	editQueryAtCaret(ctx, state, (*Query).TransposeChars)
+}
+
+func doTransposeWords(ctx context.Context, state *Peco, _ termbox.Event) {
+	editQueryAtCaret(ctx, state, (*Query).TransposeWords)
+}
+
+func doUpcaseWord(ctx context.Context, state *Peco, _ termbox.Event) {
+	editQueryAtCaret(ctx, state, (*Query).UpcaseWord)
+}
+
+func doDowncaseWord(ctx context.Context, state *Peco, _ termbox.Event) {
+	editQueryAtCaret(ctx, state, (*Query).DowncaseWord)
+}
+
+func doCapitalizeWord(ctx context.Context, state *Peco, _ termbox.Event) {
+	editQueryAtCaret(ctx, state, (*Query).CapitalizeWord)
+}
+
 func doBeginningOfLine(ctx context.Context, state *Peco, _ termbox.Event) {
 	state.Caret().SetPos(0)
 	state.Hub().SendDrawPrompt(ctx)
@@ -694,7 +1138,7 @@ func doDeleteForwardChar(ctx context.Context, state *Peco, _ termbox.Event) {
 	}
 
 	pos := c.Pos()
-	q.DeleteRange(pos, pos+1)
+	q.DeleteRange(pos, q.NextGraphemeBoundary(pos))
 
 	if state.ExecQuery(nil) {
 		return
@@ -708,6 +1152,22 @@ func doDeleteBackwardChar(ctx context.Context, state *Peco, e termbox.Event) {
 		defer g.End()
 	}
 
+	if state.SearchMode() {
+		if sq := state.SearchQuery(); sq.Len() > 0 {
+			sq.DeleteRange(sq.PrevGraphemeBoundary(sq.Len()), sq.Len())
+			updateSearchPattern(ctx, state)
+		}
+		return
+	}
+
+	if state.AnnotateMode() {
+		if aq := state.AnnotationQuery(); aq.Len() > 0 {
+			aq.DeleteRange(aq.PrevGraphemeBoundary(aq.Len()), aq.Len())
+			updateAnnotationPrompt(ctx, state)
+		}
+		return
+	}
+
 	q := state.Query()
 	c := state.Caret()
 	qlen := q.Len()
@@ -727,13 +1187,14 @@ func doDeleteBackwardChar(ctx context.Context, state *Peco, e termbox.Event) {
 		return
 	}
 
-	if qlen == 1 {
+	start := q.PrevGraphemeBoundary(pos)
+	if start == 0 && pos == qlen {
 		// Micro optimization
 		q.Reset()
 	} else {
-		q.DeleteRange(pos-1, pos)
+		q.DeleteRange(start, pos)
 	}
-	c.SetPos(pos - 1)
+	c.SetPos(start)
 
 	if state.ExecQuery(nil) {
 		return
@@ -766,7 +1227,7 @@ func doToggleQuery(ctx context.Context, state *Peco, _ termbox.Event) {
 }
 
 func doKonamiCommand(ctx context.Context, state *Peco, e termbox.Event) {
-	state.Hub().SendStatusMsg(ctx, "All your filters are belongs to us")
+	state.SendStatus(ctx, StatusInfo, "All your filters are belongs to us")
 }
 
 func doToggleSingleKeyJump(ctx context.Context, state *Peco, e termbox.Event) {
@@ -777,6 +1238,26 @@ func doToggleSingleKeyJump(ctx context.Context, state *Peco, e termbox.Event) {
 	state.ToggleSingleKeyJumpMode()
 }
 
+// doToggleFollow makes the view follow the newest lines of the input
+// while the query is empty, until the cursor is moved
+func doToggleFollow(ctx context.Context, state *Peco, e termbox.Event) {
+	if pdebug.Enabled {
+		g := pdebug.Marker("doToggleFollow")
+		defer g.End()
+	}
+
+	if state.Following() {
+		state.SetFollowing(false)
+		state.SendStatusAndClear(ctx, StatusInfo, i18n.T("Follow mode off"), 2*time.Second)
+		return
+	}
+
+	recordJump(state)
+	state.SetFollowing(true)
+	state.SendStatusAndClear(ctx, StatusInfo, i18n.T("Follow mode on"), 2*time.Second)
+	state.Hub().SendDraw(ctx, nil)
+}
+
 func doToggleViewArround(ctx context.Context, state *Peco, e termbox.Event) {
 	if pdebug.Enabled {
 		g := pdebug.Marker("doToggleViewArround")
@@ -805,7 +1286,7 @@ func doGoToNextSelection(ctx context.Context, state *Peco, _ termbox.Event) {
 	selection := state.Selection()
 
 	if selection.Len() == 0 {
-		state.Hub().SendStatusMsg(ctx, "No Selection")
+		state.SendStatus(ctx, StatusWarn, i18n.T("No Selection"))
 		return
 	}
 
@@ -814,36 +1295,24 @@ func doGoToNextSelection(ctx context.Context, state *Peco, _ termbox.Event) {
 	if err != nil {
 		return
 	}
-	currentLine := l.ID()
-	nextLine := uint64(math.MaxUint64)
-	firstLine := uint64(math.MaxUint64)
-	found := false
-
-	selection.Ascend(func(it btree.Item) bool {
-		selectedLine := it.(line.Line)
-		if selectedLine.ID() > currentLine {
-			if selectedLine.ID() < nextLine {
-				nextLine = selectedLine.ID()
-				found = true
-			}
-		}
-
-		if selectedLine.ID() <= firstLine {
-			firstLine = selectedLine.ID()
-		}
-
-		return true
-	})
 
-	if found {
-		state.Hub().SendStatusMsg(ctx, "Next Selection")
-		state.Hub().SendPaging(ctx, ToScrollFirstItem)
-		state.Hub().SendPaging(ctx, JumpToLineRequest(nextLine))
-	} else {
-		state.Hub().SendStatusMsg(ctx, "Next Selection (first)")
+	recordJump(state)
+	if next, ok := selection.Iterator(l.ID()).Next(); ok {
+		state.SendStatus(ctx, StatusInfo, i18n.T("Next Selection"))
 		state.Hub().SendPaging(ctx, ToScrollFirstItem)
-		state.Hub().SendPaging(ctx, JumpToLineRequest(firstLine))
+		state.Hub().SendPaging(ctx, JumpToLineRequest(next.ID()))
+		return
 	}
+
+	// Wrap around to the first selected line
+	var firstLine uint64
+	selection.AscendGreaterOrEqual(0, func(l line.Line) bool {
+		firstLine = l.ID()
+		return false
+	})
+	state.SendStatus(ctx, StatusInfo, i18n.T("Next Selection (first)"))
+	state.Hub().SendPaging(ctx, ToScrollFirstItem)
+	state.Hub().SendPaging(ctx, JumpToLineRequest(firstLine))
 }
 
 func doGoToPreviousSelection(ctx context.Context, state *Peco, _ termbox.Event) {
@@ -855,7 +1324,7 @@ func doGoToPreviousSelection(ctx context.Context, state *Peco, _ termbox.Event)
 	selection := state.Selection()
 
 	if selection.Len() == 0 {
-		state.Hub().SendStatusMsg(ctx, "No Selection")
+		state.SendStatus(ctx, StatusWarn, i18n.T("No Selection"))
 		return
 	}
 
@@ -864,36 +1333,24 @@ func doGoToPreviousSelection(ctx context.Context, state *Peco, _ termbox.Event)
 	if err != nil {
 		return
 	}
-	currentLine := l.ID()
-	previousLine := uint64(0)
-	lastLine := uint64(math.MaxUint64)
-	found := false
 
-	selection.Ascend(func(it btree.Item) bool {
-		selectedLine := it.(line.Line)
-		if selectedLine.ID() < currentLine {
-			if selectedLine.ID() > previousLine {
-				previousLine = selectedLine.ID()
-				found = true
-			}
-		}
-
-		if selectedLine.ID() >= lastLine {
-			lastLine = selectedLine.ID()
-		}
-
-		return true
-	})
-
-	if found {
-		state.Hub().SendStatusMsg(ctx, "Previous Selection")
+	recordJump(state)
+	if previous, ok := selection.Iterator(l.ID()).Prev(); ok {
+		state.SendStatus(ctx, StatusInfo, i18n.T("Previous Selection"))
 		state.Hub().SendPaging(ctx, ToScrollFirstItem)
-		state.Hub().SendPaging(ctx, JumpToLineRequest(previousLine))
-	} else {
-		state.Hub().SendStatusMsg(ctx, "Previous Selection (first)")
-		state.Hub().SendPaging(ctx, ToScrollFirstItem)
-		state.Hub().SendPaging(ctx, JumpToLineRequest(lastLine))
+		state.Hub().SendPaging(ctx, JumpToLineRequest(previous.ID()))
+		return
 	}
+
+	// Wrap around to the last selected line
+	var lastLine uint64
+	selection.DescendLessThan(math.MaxUint64, func(l line.Line) bool {
+		lastLine = l.ID()
+		return false
+	})
+	state.SendStatus(ctx, StatusInfo, i18n.T("Previous Selection (first)"))
+	state.Hub().SendPaging(ctx, ToScrollFirstItem)
+	state.Hub().SendPaging(ctx, JumpToLineRequest(lastLine))
 }
 
 func doSingleKeyJump(ctx context.Context, state *Peco, e termbox.Event) {
@@ -926,3 +1383,150 @@ func makeCombinedAction(actions ...Action) ActionFunc {
 		}, toplevel)
 	})
 }
+
+func doSearchInResults(ctx context.Context, state *Peco, _ termbox.Event) {
+	if pdebug.Enabled {
+		g := pdebug.Marker("doSearchInResults")
+		defer g.End()
+	}
+
+	if state.SearchMode() {
+		state.SetSearchMode(false)
+		state.Hub().SendStatusMsg(ctx, "")
+		return
+	}
+
+	state.SetSearchMode(true)
+	state.SearchQuery().Reset()
+	updateSearchPattern(ctx, state)
+}
+
+// updateSearchPattern recompiles the SearchInResults pattern from
+// what the user has typed so far, and redraws the screen
+func updateSearchPattern(ctx context.Context, state *Peco) {
+	q := state.SearchQuery().String()
+	state.SetSearchPattern(q)
+	if state.SearchMode() {
+		state.Hub().SendStatusMsg(ctx, i18n.Sprintf("Search: %s", q))
+	}
+	state.Hub().SendDraw(ctx, &DrawOptions{DisableCache: true})
+}
+
+func doSearchNext(ctx context.Context, state *Peco, _ termbox.Event) {
+	jumpToSearchMatch(ctx, state, 1)
+}
+
+func doSearchPrevious(ctx context.Context, state *Peco, _ termbox.Event) {
+	jumpToSearchMatch(ctx, state, -1)
+}
+
+// jumpToSearchMatch moves the cursor to the next line, in the direction
+// of dir, that matches the SearchInResults pattern. The search wraps
+// around at either end of the buffer
+func jumpToSearchMatch(ctx context.Context, state *Peco, dir int) {
+	rx := state.SearchPattern()
+	if rx == nil {
+		state.SendStatus(ctx, StatusWarn, i18n.T("No search pattern"))
+		return
+	}
+
+	b := state.CurrentLineBuffer()
+	size := b.Size()
+	cur := state.Location().LineNumber()
+	for i := 1; i <= size; i++ {
+		n := ((cur+dir*i)%size + size) % size
+		l, err := b.LineAt(n)
+		if err != nil || isGroupHeader(l) {
+			continue
+		}
+		if rx.MatchString(l.DisplayString()) {
+			recordJump(state)
+			state.Hub().SendPaging(ctx, ToScrollFirstItem)
+			state.Hub().SendPaging(ctx, JumpToLineRequest(n))
+			return
+		}
+	}
+	state.SendStatusAndClear(ctx, StatusWarn, i18n.Sprintf("No match for %s", state.SearchQuery().String()), 2*time.Second)
+}
+
+// editorCommand returns the command used to edit the query, taken
+// from $VISUAL or $EDITOR. Defaults to vi
+func editorCommand() string {
+	for _, name := range []string{"VISUAL", "EDITOR"} {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return "vi"
+}
+
+func doEditQueryInEditor(ctx context.Context, state *Peco, _ termbox.Event) {
+	if pdebug.Enabled {
+		g := pdebug.Marker("doEditQueryInEditor")
+		defer g.End()
+	}
+
+	q, err := editQuery(state, state.Query().String())
+	if err != nil {
+		state.SendStatusAndClear(ctx, StatusError, err.Error(), 2*time.Second)
+		state.Hub().SendDraw(ctx, &DrawOptions{DisableCache: true})
+		return
+	}
+
+	if tq, ok := state.truncateQuery(q); !ok {
+		q = tq
+		state.SendStatusAndClear(ctx, StatusWarn, i18n.Sprintf("The query is limited to %d characters", state.maxQueryLength), 2*time.Second)
+	}
+
+	state.Query().Set(q)
+	state.Caret().SetPos(len([]rune(q)))
+	state.Hub().SendDraw(ctx, &DrawOptions{DisableCache: true})
+	if state.ExecQuery(nil) {
+		return
+	}
+	state.Hub().SendDrawPrompt(ctx)
+}
+
+// editQuery writes q to a temporary file, opens it in the user's
+// editor, and returns the contents of the file once the editor exits.
+// The query is a single line, so line breaks are replaced by spaces
+func editQuery(state *Peco, q string) (string, error) {
+	f, err := ioutil.TempFile("", "peco-query-")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create temporary file")
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(q)
+	f.Close()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to write query to temporary file")
+	}
+
+	cmd := util.Shell(editorCommand() + ` ` + util.ShellQuote(f.Name()))
+
+	// The editor needs to talk to the terminal, but our stdin may be
+	// a pipe that we are reading lines from
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0); err == nil {
+		defer tty.Close()
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+	}
+
+	state.screen.Suspend()
+	err = cmd.Run()
+	state.screen.Resume()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to run editor")
+	}
+
+	buf, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read query from temporary file")
+	}
+
+	s := strings.TrimRight(string(buf), "\r\n")
+	s = strings.Replace(s, "\r\n", " ", -1)
+	s = strings.Replace(s, "\n", " ", -1)
+	return s, nil
+}
@@ -1,14 +1,23 @@
 package peco
 
 import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
 	"testing"
 	"time"
 	"unicode/utf8"
 
 	"context"
 
+	"github.com/google/btree"
 	"github.com/nsf/termbox-go"
 	"github.com/peco/peco/filter"
+	"github.com/peco/peco/line"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -37,6 +46,11 @@ func TestActionNames(t *testing.T) {
 		"peco.DeleteBackwardChar",
 		"peco.DeleteForwardWord",
 		"peco.DeleteBackwardWord",
+		"peco.TransposeChars",
+		"peco.TransposeWords",
+		"peco.UpcaseWord",
+		"peco.DowncaseWord",
+		"peco.CapitalizeWord",
 		"peco.KillEndOfLine",
 		"peco.DeleteAll",
 		"peco.SelectPreviousPage",
@@ -314,6 +328,34 @@ func TestRotateFilter(t *testing.T) {
 	// TODO toggle ExecQuery()
 }
 
+func TestSelectFilter(t *testing.T) {
+	state := newPeco()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go state.Run(ctx)
+	defer cancel()
+
+	<-state.Ready()
+
+	km := state.Keymap()
+	a, err := km.resolveActionName("peco.SelectFilter.Regexp", 0)
+	if !assert.NoError(t, err, "resolving peco.SelectFilter.Regexp should succeed") {
+		return
+	}
+	a.Execute(ctx, state, termbox.Event{})
+	assert.Equal(t, "Regexp", state.Filters().Current().String(), "filter should be switched to Regexp")
+
+	a, err = km.resolveActionName("peco.SelectFilter.Bogus", 0)
+	if !assert.NoError(t, err, "unknown filters should only be reported when executed") {
+		return
+	}
+	a.Execute(ctx, state, termbox.Event{})
+	assert.Equal(t, "Regexp", state.Filters().Current().String(), "unknown filters should not change the filter")
+
+	_, err = km.resolveActionName("peco.SelectFilter.", 0)
+	assert.Error(t, err, "filter name should be required")
+}
+
 func TestBeginningOfLineAndEndOfLine(t *testing.T) {
 	state := newPeco()
 
@@ -371,3 +413,654 @@ func TestBackToInitialFilter(t *testing.T) {
 		return
 	}
 }
+
+func TestToggleExactMatch(t *testing.T) {
+	state := newPeco()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go state.Run(ctx)
+	defer cancel()
+
+	<-state.Ready()
+
+	toggle := func() {
+		nameToActions["peco.ToggleExactMatch"].Execute(ctx, state, termbox.Event{})
+	}
+
+	// IgnoreCase does not support exact matching
+	toggle()
+	if !assert.Equal(t, "IgnoreCase", filterLabel(state.Filters().Current(), ""), "IgnoreCase should not change") {
+		return
+	}
+
+	if !assert.NoError(t, state.Filters().SetCurrentByName("Fuzzy"), "SetCurrentByName should succeed") {
+		return
+	}
+	toggle()
+	if !assert.Equal(t, "Fuzzy(exact)", filterLabel(state.Filters().Current(), ""), "prompt should indicate exact matching") {
+		return
+	}
+	if !assert.Equal(t, "Fuzzy", state.Filters().Current().String(), "filter should not be rotated") {
+		return
+	}
+	toggle()
+	assert.Equal(t, "Fuzzy", filterLabel(state.Filters().Current(), ""), "prompt should indicate fuzzy matching")
+}
+
+func TestToggleCaseSensitivity(t *testing.T) {
+	state := newPeco()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go state.Run(ctx)
+	defer cancel()
+
+	<-state.Ready()
+
+	toggle := func() {
+		nameToActions["peco.ToggleCaseSensitivity"].Execute(ctx, state, termbox.Event{})
+	}
+
+	toggle()
+	if !assert.Equal(t, "IgnoreCase[s]", filterLabel(state.Filters().Current(), ""), "prompt should indicate case sensitive matching") {
+		return
+	}
+	if !assert.Equal(t, "IgnoreCase", state.Filters().Current().String(), "filter should not be rotated") {
+		return
+	}
+	toggle()
+	assert.Equal(t, "IgnoreCase", filterLabel(state.Filters().Current(), ""), "prompt should indicate the usual matching")
+
+	// Fuzzy does not support switching case sensitivity
+	if !assert.NoError(t, state.Filters().SetCurrentByName("Fuzzy"), "SetCurrentByName should succeed") {
+		return
+	}
+	toggle()
+	assert.Equal(t, "Fuzzy", filterLabel(state.Filters().Current(), ""), "Fuzzy should not change")
+}
+
+func TestSearchInResults(t *testing.T) {
+	state := newPeco()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go state.Run(ctx)
+	defer cancel()
+
+	<-state.Ready()
+
+	doSearchInResults(ctx, state, termbox.Event{})
+	writeQueryToPrompt(t, state.screen, "Func")
+	time.Sleep(500 * time.Millisecond)
+
+	if qs := state.Query().String(); qs != "" {
+		t.Errorf("Expected query to be untouched, but got '%s'", qs)
+	}
+
+	if sq := state.SearchQuery().String(); sq != "Func" {
+		t.Errorf("Expected search pattern to be 'Func', but got '%s'", sq)
+	}
+
+	rx := state.SearchPattern()
+	if rx == nil {
+		t.Errorf("Expected search pattern to be compiled")
+		return
+	}
+
+	if rx.MatchString("func") {
+		t.Errorf("Expected search pattern with upper case characters to be case sensitive")
+	}
+
+	state.screen.SendEvent(termbox.Event{Key: termbox.KeyEnter})
+	time.Sleep(500 * time.Millisecond)
+
+	if state.SearchMode() {
+		t.Errorf("Expected Finish to leave search mode")
+	}
+
+	if state.SearchPattern() == nil {
+		t.Errorf("Expected search pattern to be kept after leaving search mode")
+	}
+}
+
+func TestEditQuery(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires /bin/sh")
+	}
+
+	old, ok := os.LookupEnv("VISUAL")
+	os.Setenv("VISUAL", `sh -c 'test "$(cat "$1")" = Hello && printf "foo\nbar\n" > "$1"' sh`)
+	defer func() {
+		if ok {
+			os.Setenv("VISUAL", old)
+		} else {
+			os.Unsetenv("VISUAL")
+		}
+	}()
+
+	state := newPeco()
+	q, err := editQuery(state, "Hello")
+	if !assert.NoError(t, err, "editQuery should succeed") {
+		return
+	}
+
+	if !assert.Equal(t, "foo bar", q, "line breaks should be replaced by spaces") {
+		return
+	}
+}
+
+func TestKeymapLayers(t *testing.T) {
+	state := newPeco()
+	ctx, cancel := context.WithCancel(context.Background())
+	go state.Run(ctx)
+	defer cancel()
+
+	<-state.Ready()
+
+	km := NewKeymap(map[string]string{
+		"M-n": "peco.ToggleLayer.normal",
+		"M-s": "peco.EnterLayer.strict",
+	}, nil)
+	km.Layers = map[string]KeymapLayerConfig{
+		"normal": {
+			Keymap: map[string]string{
+				"j":   "peco.BeginningOfLine",
+				"x":   "-",
+				"M-l": "peco.LeaveLayer",
+			},
+		},
+		"strict": {
+			Keymap: map[string]string{
+				"M-l": "peco.LeaveLayer",
+			},
+			Strict: true,
+		},
+	}
+	if !assert.NoError(t, km.ApplyKeybinding(), "ApplyKeybinding should succeed") {
+		return
+	}
+
+	q := state.Query()
+	c := state.Caret()
+	send := func(ev termbox.Event) {
+		km.ExecuteAction(ctx, state, ev)
+	}
+	alt := func(ch rune) termbox.Event {
+		return termbox.Event{Type: termbox.EventKey, Ch: ch, Mod: termbox.ModAlt}
+	}
+	char := func(ch rune) termbox.Event {
+		return termbox.Event{Type: termbox.EventKey, Ch: ch}
+	}
+
+	send(char('j'))
+	send(char('x'))
+	expectQueryString(t, q, "jx")
+
+	send(alt('n'))
+	if !assert.Equal(t, "normal", state.KeymapLayer(), "layer should be active") {
+		return
+	}
+	send(char('j'))
+	expectCaretPos(t, c, 0)
+	send(char('x'))
+	expectQueryString(t, q, "jx")
+	send(char('k'))
+	expectQueryString(t, q, "kjx")
+
+	send(alt('n'))
+	if !assert.Equal(t, "", state.KeymapLayer(), "layer should be toggled off") {
+		return
+	}
+
+	send(alt('s'))
+	if !assert.Equal(t, "strict", state.KeymapLayer(), "layer should be active") {
+		return
+	}
+	send(char('k'))
+	expectQueryString(t, q, "kjx")
+	send(termbox.Event{Type: termbox.EventKey, Key: termbox.KeyCtrlE})
+	expectCaretPos(t, c, 3)
+	send(alt('l'))
+	if !assert.Equal(t, "", state.KeymapLayer(), "layer should be left") {
+		return
+	}
+
+	km = NewKeymap(map[string]string{"M-n": "peco.EnterLayer.nosuchlayer"}, nil)
+	assert.Error(t, km.ApplyKeybinding(), "unknown layers should be rejected")
+}
+
+func TestSelectionSets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peco-test-selection-sets-")
+	if !assert.NoError(t, err, "TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	state := newPeco()
+	state.Argv = []string{}
+	state.Stdin = bytes.NewBufferString("foo\nbar\nbaz\n")
+	go state.Run(ctx)
+	<-state.Ready()
+	for state.source.Size() < 3 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	state.config.SelectionSetDir = dir
+
+	km := NewKeymap(map[string]string{
+		"M-s": "peco.SaveSelectionAs.mine",
+		"M-l": "peco.LoadSelection.mine",
+		"M-m": "peco.MergeSelection.mine",
+	}, nil)
+	if !assert.NoError(t, km.ApplyKeybinding(), "ApplyKeybinding should succeed") {
+		return
+	}
+	send := func(ch rune) {
+		km.ExecuteAction(ctx, state, termbox.Event{Type: termbox.EventKey, Ch: ch, Mod: termbox.ModAlt})
+	}
+	selected := func(s *Selection) []string {
+		var list []string
+		s.Ascend(func(it btree.Item) bool {
+			list = append(list, it.(line.Line).DisplayString())
+			return true
+		})
+		return list
+	}
+	selectLine := func(n int) {
+		l, err := state.source.LineAt(n)
+		if assert.NoError(t, err, "LineAt should succeed") {
+			state.Selection().Add(l)
+		}
+	}
+
+	selectLine(0)
+	selectLine(2)
+	send('s')
+
+	state.Selection().Reset()
+	selectLine(1)
+	send('m')
+	if !assert.Equal(t, []string{"foo", "bar", "baz"}, selected(state.Selection()), "sets should be merged into the selection") {
+		return
+	}
+
+	send('l')
+	if !assert.Equal(t, []string{"foo", "baz"}, selected(state.Selection()), "set should replace the selection") {
+		return
+	}
+
+	// Sets saved by previous sessions are read from disk
+	state.selectionSets = nil
+	set, err := state.SelectionSet("mine")
+	if !assert.NoError(t, err, "SelectionSet should succeed") {
+		return
+	}
+	if !assert.Equal(t, []string{"foo", "baz"}, selected(set), "set should be loaded from disk") {
+		return
+	}
+
+	_, err = state.SelectionSet("other")
+	assert.Error(t, err, "unknown sets should be an error")
+
+	_, err = km.resolveActionName("peco.LoadSelection.../foo", 0)
+	assert.Error(t, err, "invalid set names should be rejected")
+}
+
+func TestSelectBetweenBookmarks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	state := newPeco()
+	state.Argv = []string{}
+	state.Stdin = bytes.NewBufferString("foo1\nbar1\nfoo2\nbar2\nfoo3\nbar3\n")
+	go state.Run(ctx)
+	<-state.Ready()
+	for state.source.Size() < 6 {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	km := NewKeymap(map[string]string{
+		"M-a": "peco.SetBookmark.a",
+		"M-b": "peco.SetBookmark.b",
+	}, nil)
+	if !assert.NoError(t, km.ApplyKeybinding(), "ApplyKeybinding should succeed") {
+		return
+	}
+	_, err := km.resolveActionName("peco.SetBookmark.c", 0)
+	assert.Error(t, err, "bookmarks other than a and b should be rejected")
+
+	nameToActions["peco.SelectBetweenBookmarks"].Execute(ctx, state, termbox.Event{})
+	if !assert.Equal(t, 0, state.Selection().Len(), "nothing should be selected without bookmarks") {
+		return
+	}
+
+	// Bookmark the fifth and the second line, in that order
+	for _, b := range []struct {
+		ch     rune
+		lineno int
+	}{{'a', 4}, {'b', 1}} {
+		state.Location().SetLineNumber(b.lineno)
+		km.ExecuteAction(ctx, state, termbox.Event{Type: termbox.EventKey, Ch: b.ch, Mod: termbox.ModAlt})
+	}
+
+	// Only the lines in the results are selected
+	ch := make(chan struct{})
+	state.Query().Set("foo")
+	state.ExecQuery(func() { close(ch) })
+	<-ch
+
+	nameToActions["peco.SelectBetweenBookmarks"].Execute(ctx, state, termbox.Event{})
+	var selected []string
+	state.Selection().Ascend(func(it btree.Item) bool {
+		selected = append(selected, it.(line.Line).DisplayString())
+		return true
+	})
+	assert.Equal(t, []string{"foo2", "foo3"}, selected, "lines between the bookmarks should be selected")
+}
+
+func TestSelectPage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	state := newPeco()
+	state.Argv = []string{}
+	state.Stdin = bytes.NewBufferString("1\n2\n3\n4\n5\n6\n")
+	go state.Run(ctx)
+	<-state.Ready()
+	for state.source.Size() < 6 || !state.IsIdle() {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// The page is set each time, as the screen is redrawn after each
+	// action
+	executeOnPage := func(name string, perPage, page int) []string {
+		state.Location().SetPerPage(perPage)
+		state.Location().SetPage(page)
+		nameToActions[name].Execute(ctx, state, termbox.Event{})
+		for !state.IsIdle() {
+			time.Sleep(5 * time.Millisecond)
+		}
+
+		var selected []string
+		state.Selection().Ascend(func(it btree.Item) bool {
+			selected = append(selected, it.(line.Line).DisplayString())
+			return true
+		})
+		return selected
+	}
+
+	// The second page holds the third and the fourth lines
+	execute := func(name string) []string {
+		return executeOnPage(name, 2, 2)
+	}
+
+	assert.Equal(t, []string{"3", "4"}, execute("peco.SelectPage"), "lines on the page should be selected")
+	assert.Empty(t, execute("peco.SelectPage"), "lines on the page should be deselected once all are selected")
+
+	l, err := state.CurrentLineBuffer().LineAt(0)
+	if !assert.NoError(t, err, "LineAt should succeed") {
+		return
+	}
+	state.Selection().Add(l)
+	l, err = state.CurrentLineBuffer().LineAt(2)
+	if !assert.NoError(t, err, "LineAt should succeed") {
+		return
+	}
+	state.Selection().Add(l)
+	assert.Equal(t, []string{"1", "3", "4"}, execute("peco.SelectPage"), "the rest of the page should be selected")
+	assert.Equal(t, []string{"1"}, execute("peco.DeselectPage"), "selections on other pages should be kept")
+
+	// The page is larger than the input
+	assert.Equal(t, []string{"1", "2", "3", "4", "5", "6"}, executeOnPage("peco.SelectPage", 20, 1), "all lines should be selected when they fit on the page")
+	assert.Empty(t, executeOnPage("peco.DeselectPage", 20, 1), "all lines should be deselected when they fit on the page")
+}
+
+func TestTermMatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	state := newPeco()
+	state.Argv = []string{}
+	state.Stdin = bytes.NewBufferString("x\n")
+	go state.Run(ctx)
+	<-state.Ready()
+
+	// The second term of the query is only highlighted on the second
+	// and the fourth lines
+	buf := NewMemoryBuffer()
+	for i, terms := range [][]int{{0}, {0, 1}, {0}, {1, 0}} {
+		matches := make([][]int, len(terms))
+		for j := range terms {
+			matches[j] = []int{2 * j, 2*j + 1}
+		}
+		buf.lines = append(buf.lines, line.NewMatchedTerms(line.NewRaw(uint64(i), "a b", false), matches, terms))
+	}
+	state.SetCurrentLineBuffer(buf)
+
+	km := NewKeymap(map[string]string{
+		"M-n": "peco.NextTermMatch.2",
+		"M-p": "peco.PreviousTermMatch.2",
+	}, nil)
+	if !assert.NoError(t, km.ApplyKeybinding(), "ApplyKeybinding should succeed") {
+		return
+	}
+	_, err := km.resolveActionName("peco.NextTermMatch.0", 0)
+	assert.Error(t, err, "terms should be counted from 1")
+
+	expectLine := func(expected int, msg string) bool {
+		deadline := time.Now().Add(2 * time.Second)
+		for state.Location().LineNumber() != expected && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		return assert.Equal(t, expected, state.Location().LineNumber(), msg)
+	}
+
+	for _, step := range []struct {
+		ch       rune
+		expected int
+		msg      string
+	}{
+		{'n', 1, "cursor should move to the next match of the term"},
+		{'n', 3, "cursor should skip lines without matches of the term"},
+		{'n', 1, "cursor should wrap around"},
+		{'p', 3, "cursor should move to the previous match of the term"},
+	} {
+		km.ExecuteAction(ctx, state, termbox.Event{Type: termbox.EventKey, Ch: step.ch, Mod: termbox.ModAlt})
+		if !expectLine(step.expected, step.msg) {
+			return
+		}
+	}
+}
+
+func TestToggleFollow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r, w := io.Pipe()
+	defer w.Close()
+
+	state := newPeco()
+	state.Argv = []string{}
+	state.Stdin = r
+	go state.Run(ctx)
+	// peco is not ready until the first line is read
+	go io.WriteString(w, "1\n2\n3\n")
+	<-state.Ready()
+
+	km := NewKeymap(map[string]string{
+		"M-f": "peco.ToggleFollow",
+	}, nil)
+	if !assert.NoError(t, km.ApplyKeybinding(), "ApplyKeybinding should succeed") {
+		return
+	}
+
+	expectLine := func(expected int, msg string) bool {
+		deadline := time.Now().Add(2 * time.Second)
+		for state.Location().LineNumber() != expected && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		return assert.Equal(t, expected, state.Location().LineNumber(), msg)
+	}
+
+	km.ExecuteAction(ctx, state, termbox.Event{Type: termbox.EventKey, Ch: 'f', Mod: termbox.ModAlt})
+	if !assert.True(t, state.Following(), "follow mode should be enabled") {
+		return
+	}
+	if !expectLine(2, "cursor should move to the newest line") {
+		return
+	}
+
+	io.WriteString(w, "4\n5\n")
+	if !expectLine(4, "cursor should follow new lines") {
+		return
+	}
+
+	state.Hub().SendPaging(ctx, ToLineAbove)
+	if !expectLine(3, "cursor should move") {
+		return
+	}
+	assert.False(t, state.Following(), "moving the cursor should pause follow mode")
+
+	io.WriteString(w, "6\n")
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 3, state.Location().LineNumber(), "cursor should stay after follow mode is paused")
+}
+
+func TestDumpKeymap(t *testing.T) {
+	km := NewKeymap(map[string]string{
+		"C-a":     "-",
+		"C-x,C-c": "myFinish",
+	}, map[string][]string{
+		"myFinish": {"myCancel", "peco.Finish"},
+		"myCancel": {"peco.SelectNone"},
+	})
+	km.Layers = map[string]KeymapLayerConfig{
+		"vi": {
+			Keymap: map[string]string{"j": "peco.SelectDown"},
+		},
+	}
+
+	var buf bytes.Buffer
+	if !assert.NoError(t, km.dump(&buf, keymapDumpJSON), "dump should succeed") {
+		return
+	}
+
+	var list []keymapBinding
+	if !assert.NoError(t, json.Unmarshal(buf.Bytes(), &list), "dump should be valid JSON") {
+		return
+	}
+
+	bindings := map[string]keymapBinding{}
+	for _, b := range list {
+		bindings[b.Layer+":"+b.Key] = b
+	}
+
+	if !assert.Equal(t, keymapBinding{Key: "C-e", Action: "peco.EndOfLine"}, bindings[":C-e"], "default bindings should be listed") {
+		return
+	}
+	if !assert.NotContains(t, bindings, ":C-a", "removed bindings should not be listed") {
+		return
+	}
+	if !assert.Equal(t, keymapBinding{Key: "C-x,C-c", Action: "myFinish", Sequence: []string{"peco.SelectNone", "peco.Finish"}, Custom: true}, bindings[":C-x,C-c"], "custom actions should be expanded") {
+		return
+	}
+	if !assert.Equal(t, keymapBinding{Layer: "vi", Key: "j", Action: "peco.SelectDown", Custom: true}, bindings["vi:j"], "layers should be listed") {
+		return
+	}
+
+	buf.Reset()
+	if !assert.NoError(t, km.dump(&buf, keymapDumpText), "dump should succeed") {
+		return
+	}
+	if !assert.Regexp(t, `(?m)^C-x,C-c +myFinish = peco.SelectNone, peco.Finish +\(config\)$`, buf.String(), "text output should list custom actions") {
+		return
+	}
+}
+
+func TestExecAction(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires /bin/sh")
+	}
+
+	var cfg Config
+	err := json.Unmarshal([]byte(`{"Action": {
+		"Chain": ["peco.SelectDown", "peco.ToggleSelection"],
+		"Save": {"exec": "printf '%s|' {} \"$PECO_MATCHED_LINE_COUNT\" > $PECO_TEST_OUT; cat >> $PECO_TEST_OUT"}
+	}}`), &cfg)
+	if !assert.NoError(t, err, "Unmarshalling actions should succeed") {
+		return
+	}
+	assert.Equal(t, []string{"peco.SelectDown", "peco.ToggleSelection"}, cfg.Action["Chain"].Actions, "lists should be read as chains of actions")
+	assert.Error(t, json.Unmarshal([]byte(`{"Action": {"Bad": {"exec": ""}}}`), &cfg), "empty commands should be rejected")
+
+	dir, err := ioutil.TempDir("", "peco-test-")
+	if !assert.NoError(t, err, "creating temporary directory should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+	defer os.Setenv("PECO_TEST_OUT", os.Getenv("PECO_TEST_OUT"))
+	os.Setenv("PECO_TEST_OUT", out)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	state := newPeco()
+	state.Argv = []string{}
+	state.Stdin = bytes.NewBufferString("foo\nit's\nbaz\n")
+	go state.Run(ctx)
+	<-state.Ready()
+	for state.source.Size() < 3 {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	for _, n := range []int{1, 0} {
+		l, err := state.CurrentLineBuffer().LineAt(n)
+		if !assert.NoError(t, err, "LineAt should succeed") {
+			return
+		}
+		state.Selection().Add(l)
+	}
+
+	km := NewKeymap(map[string]string{"M-s": "Save"}, nil)
+	km.Exec = map[string]CommandConfig{"Save": cfg.Action["Save"].Exec}
+	if !assert.NoError(t, km.ApplyKeybinding(), "ApplyKeybinding should succeed") {
+		return
+	}
+	km.ExecuteAction(ctx, state, termbox.Event{Type: termbox.EventKey, Ch: 's', Mod: termbox.ModAlt})
+
+	buf, err := ioutil.ReadFile(out)
+	if !assert.NoError(t, err, "command should have been executed") {
+		return
+	}
+	assert.Equal(t, "foo|it's|2|foo\nit's\n", string(buf), "command should receive the selected lines as arguments and on stdin")
+}
+
+func TestSelectAllLimit(t *testing.T) {
+	ctx := context.Background()
+
+	p := newPeco()
+	if !assert.NoError(t, p.ApplyConfig(CLIOptions{OptMaxSelect: 2}), "p.ApplyConfig should succeed") {
+		return
+	}
+	h := &statusRecorderHub{}
+	p.hub = h
+
+	buf := NewMemoryBuffer()
+	for i, s := range []string{"foo", "bar"} {
+		buf.lines = append(buf.lines, line.NewRaw(uint64(i), s, false))
+	}
+	p.currentLineBuffer = buf
+	doSelectAll(ctx, p, termbox.Event{})
+	if !assert.Equal(t, 2, p.Selection().Len(), "all lines should be selected") {
+		return
+	}
+	if !assert.Empty(t, h.messages, "filling the selection exactly should not be reported") {
+		return
+	}
+
+	p.Selection().Reset()
+	buf.lines = append(buf.lines, line.NewRaw(2, "baz", false))
+	doSelectAll(ctx, p, termbox.Event{})
+	assert.Equal(t, []string{"Cannot select more than 2 lines"}, h.messages, "rejected lines should be reported")
+}
@@ -0,0 +1,147 @@
+package peco
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/lestrrat-go/pdebug"
+	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/internal/i18n"
+	"github.com/peco/peco/line"
+	"github.com/pkg/errors"
+)
+
+// readAnnotations reads the notes saved in the file given by
+// --annotations, by the text of the lines they are attached to. A
+// file that does not exist yet has no notes
+func readAnnotations(filename string) (map[string]string, error) {
+	notes := make(map[string]string)
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return notes, nil
+		}
+		return nil, errors.Wrap(err, "failed to read annotations")
+	}
+
+	if err := json.Unmarshal(buf, &notes); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode annotations %s", filename)
+	}
+	return notes, nil
+}
+
+// writeAnnotations saves notes to the file given by --annotations.
+// Must be called with annotationsMutex held
+func (p *Peco) writeAnnotations() error {
+	buf, err := json.MarshalIndent(p.savedAnnotations, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode annotations")
+	}
+
+	// Notes are about the input, which may be sensitive, so the file
+	// is only readable by its owner
+	if err := ioutil.WriteFile(p.annotationsFile, append(buf, '\n'), 0600); err != nil {
+		return errors.Wrap(err, "failed to write annotations")
+	}
+	return nil
+}
+
+// Annotation returns the note attached to l, or an empty string if
+// there is none
+func (p *Peco) Annotation(l line.Line) string {
+	p.annotationsMutex.Lock()
+	defer p.annotationsMutex.Unlock()
+
+	if note, ok := p.annotations[l.ID()]; ok {
+		return note
+	}
+	return p.savedAnnotations[l.Buffer()]
+}
+
+// SetAnnotation attaches note to l, replacing the previous one. An
+// empty note removes it. With --annotations, the notes are saved to
+// the file, so that they are attached to the same lines next time
+func (p *Peco) SetAnnotation(l line.Line, note string) error {
+	p.annotationsMutex.Lock()
+	defer p.annotationsMutex.Unlock()
+
+	if p.annotations == nil {
+		p.annotations = make(map[uint64]string)
+	}
+	// An empty note is kept, so that it hides the one saved for
+	// lines with the same text
+	p.annotations[l.ID()] = note
+
+	if p.annotationsFile == "" {
+		return nil
+	}
+	if p.savedAnnotations == nil {
+		p.savedAnnotations = make(map[string]string)
+	}
+	if note == "" {
+		delete(p.savedAnnotations, l.Buffer())
+	} else {
+		p.savedAnnotations[l.Buffer()] = note
+	}
+	return p.writeAnnotations()
+}
+
+// AnnotateMode returns true while a note is being typed. Typed
+// characters then go to the note instead of the query
+func (p *Peco) AnnotateMode() bool {
+	p.annotationsMutex.Lock()
+	defer p.annotationsMutex.Unlock()
+	return p.annotationTarget != nil
+}
+
+// AnnotationQuery returns the note being typed
+func (p *Peco) AnnotationQuery() *Query {
+	return &p.annotationQuery
+}
+
+// updateAnnotationPrompt displays the note being typed
+func updateAnnotationPrompt(ctx context.Context, state *Peco) {
+	state.Hub().SendStatusMsg(ctx, i18n.Sprintf("Note: %s", state.AnnotationQuery().String()))
+}
+
+// finishAnnotation leaves the mode where a note is being typed. If
+// save is true, the note is attached to the line it was typed for
+func finishAnnotation(ctx context.Context, state *Peco, save bool) {
+	state.annotationsMutex.Lock()
+	target := state.annotationTarget
+	state.annotationTarget = nil
+	state.annotationsMutex.Unlock()
+
+	state.Hub().SendStatusMsg(ctx, "")
+	if !save || target == nil {
+		return
+	}
+
+	if err := state.SetAnnotation(target, state.AnnotationQuery().String()); err != nil {
+		state.SendStatus(ctx, StatusError, err.Error())
+	}
+	state.Hub().SendDraw(ctx, &DrawOptions{DisableCache: true})
+}
+
+// doAnnotate starts typing a note for the line under the cursor,
+// starting from its current note. Enter attaches the note to the line,
+// and Esc leaves it as it was. An empty note removes it
+func doAnnotate(ctx context.Context, state *Peco, _ termbox.Event) {
+	if pdebug.Enabled {
+		g := pdebug.Marker("doAnnotate")
+		defer g.End()
+	}
+
+	l, err := state.CurrentLineBuffer().LineAt(state.Location().LineNumber())
+	if err != nil || isGroupHeader(l) {
+		return
+	}
+
+	state.AnnotationQuery().Set(state.Annotation(l))
+	state.annotationsMutex.Lock()
+	state.annotationTarget = l
+	state.annotationsMutex.Unlock()
+	updateAnnotationPrompt(ctx, state)
+}
@@ -0,0 +1,104 @@
+package peco
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/line"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnnotate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "peco-annotations-")
+	if !assert.NoError(t, err, "creating temporary directory should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "notes.json")
+	if !assert.NoError(t, ioutil.WriteFile(filename, []byte(`{"bar": "old note"}`), 0600), "writing annotations should succeed") {
+		return
+	}
+
+	state := newPeco()
+	state.Argv = []string{"--annotations", filename, "--annotate-output"}
+	state.Stdin = bytes.NewBufferString("foo\nbar\n")
+	go state.Run(ctx)
+	<-state.Ready()
+	<-state.source.SetupDone()
+
+	foo, _ := state.source.LineAt(0)
+	bar, _ := state.source.LineAt(1)
+	if !assert.Equal(t, "old note", state.Annotation(bar), "saved notes should be attached to lines with the same text") {
+		return
+	}
+
+	typeNote := func(n int, note string) {
+		state.Location().SetLineNumber(n)
+		doAnnotate(ctx, state, termbox.Event{})
+		for _, ch := range note {
+			doAcceptChar(ctx, state, termbox.Event{Ch: ch})
+		}
+	}
+
+	typeNote(0, "todo")
+	doDeleteBackwardChar(ctx, state, termbox.Event{})
+	doFinish(ctx, state, termbox.Event{})
+	if !assert.False(t, state.AnnotateMode(), "Enter should leave the note prompt") {
+		return
+	}
+	if !assert.Equal(t, "tod", state.Annotation(foo), "Enter should attach the note") {
+		return
+	}
+	if !assert.Equal(t, "foo\ttod", state.formatResult(foo, nil), "notes should be printed with --annotate-output") {
+		return
+	}
+
+	// The current note is edited, and Esc leaves it as it was
+	typeNote(1, "!")
+	if !assert.Equal(t, "old note!", state.AnnotationQuery().String(), "the current note should be edited") {
+		return
+	}
+	doCancel(ctx, state, termbox.Event{})
+	if !assert.Equal(t, "old note", state.Annotation(bar), "Esc should not change the note") {
+		return
+	}
+
+	saved, err := readAnnotations(filename)
+	if !assert.NoError(t, err, "reading annotations should succeed") {
+		return
+	}
+	if !assert.Equal(t, map[string]string{"foo": "tod", "bar": "old note"}, saved, "notes should be saved to --annotations") {
+		return
+	}
+}
+
+func TestDrawAnnotation(t *testing.T) {
+	state := newPeco()
+	screen := NewMemoryScreen(20, 4)
+	state.screen = screen
+	state.styles.Init()
+	buf := NewMemoryBuffer()
+	buf.lines = append(buf.lines, line.NewRaw(0, "foo", false))
+	state.currentLineBuffer = buf
+	if !assert.NoError(t, state.SetAnnotation(buf.lines[0], "note"), "SetAnnotation should succeed") {
+		return
+	}
+
+	NewDefaultLayout(state).DrawScreen(state, nil)
+	if !assert.True(t, strings.HasSuffix(screen.Line(1), " note"), "the note should be drawn at the end of the row, got %q", screen.Line(1)) {
+		return
+	}
+	if !assert.Equal(t, state.styles.Annotation.fg, screen.Cell(19, 1).Fg, "the note should be drawn in the Annotation style") {
+		return
+	}
+}
@@ -0,0 +1,101 @@
+package peco
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/internal/i18n"
+	"github.com/pkg/errors"
+)
+
+// bookmarkNames are the names that can be given to bookmarks. The
+// lines between the two are selected by SelectBetweenBookmarks
+var bookmarkNames = [2]string{"a", "b"}
+
+// resolveBookmarkAction resolves peco.SetBookmark.a and
+// peco.SetBookmark.b. The second return value is false if the action
+// name is not one of these
+func resolveBookmarkAction(name string) (Action, bool, error) {
+	if !strings.HasPrefix(name, setBookmarkPrefix) {
+		return nil, false, nil
+	}
+
+	bookmark := strings.TrimPrefix(name, setBookmarkPrefix)
+	if bookmark != bookmarkNames[0] && bookmark != bookmarkNames[1] {
+		return nil, true, errors.Errorf("could not resolve %s: bookmark name must be '%s' or '%s'", name, bookmarkNames[0], bookmarkNames[1])
+	}
+
+	return ActionFunc(func(ctx context.Context, state *Peco, _ termbox.Event) {
+		doSetBookmark(ctx, state, bookmark)
+	}), true, nil
+}
+
+// SetBookmark bookmarks the line with the given ID as name
+func (p *Peco) SetBookmark(name string, id uint64) {
+	p.bookmarksMutex.Lock()
+	defer p.bookmarksMutex.Unlock()
+	if p.bookmarks == nil {
+		p.bookmarks = make(map[string]uint64)
+	}
+	p.bookmarks[name] = id
+}
+
+// Bookmark returns the ID of the line bookmarked as name
+func (p *Peco) Bookmark(name string) (uint64, bool) {
+	p.bookmarksMutex.Lock()
+	defer p.bookmarksMutex.Unlock()
+	id, ok := p.bookmarks[name]
+	return id, ok
+}
+
+func doSetBookmark(ctx context.Context, state *Peco, name string) {
+	id, ok := currentLineID(state)
+	if !ok {
+		return
+	}
+	state.SetBookmark(name, id)
+	state.SendStatusAndClear(ctx, StatusInfo, i18n.Sprintf("Bookmark '%s' set", name), 500*time.Millisecond)
+}
+
+// doSelectBetweenBookmarks adds the lines in the current results whose
+// IDs are between the two bookmarks, inclusive, to the selection. As
+// IDs follow the order of the input, the bookmarked lines themselves
+// don't need to be in the results
+func doSelectBetweenBookmarks(ctx context.Context, state *Peco, _ termbox.Event) {
+	from, okFrom := state.Bookmark(bookmarkNames[0])
+	to, okTo := state.Bookmark(bookmarkNames[1])
+	if !okFrom || !okTo {
+		state.SendStatusAndClear(ctx, StatusWarn, i18n.Sprintf("Set bookmarks '%s' and '%s' first", bookmarkNames[0], bookmarkNames[1]), 2*time.Second)
+		return
+	}
+	if from > to {
+		from, to = to, from
+	}
+
+	sel := state.Selection()
+	b := state.CurrentLineBuffer()
+	n := 0
+	full := false
+	for i := 0; i < b.Size(); i++ {
+		l, err := b.LineAt(i)
+		if err != nil || isGroupHeader(l) || l.ID() < from || l.ID() > to {
+			continue
+		}
+		if sel.IsFull() && !sel.Has(l) {
+			full = true
+			break
+		}
+		l.SetDirty(true)
+		sel.Add(l)
+		n++
+	}
+
+	if full {
+		notifySelectionLimit(ctx, state)
+	} else {
+		state.SendStatusAndClear(ctx, StatusInfo, i18n.Sprintf("Selected %d lines between bookmarks", n), 500*time.Millisecond)
+	}
+	state.Hub().SendDraw(ctx, &DrawOptions{DisableCache: true})
+}
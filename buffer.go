@@ -1,12 +1,16 @@
 package peco
 
 import (
+	"math"
+	"regexp"
+	"runtime/debug"
+	"sync/atomic"
 	"time"
 
 	"context"
 
+	"github.com/google/btree"
 	"github.com/lestrrat-go/pdebug"
-	runewidth "github.com/mattn/go-runewidth"
 	"github.com/peco/peco/line"
 	"github.com/peco/peco/pipeline"
 	"github.com/pkg/errors"
@@ -33,11 +37,12 @@ func NewFilteredBuffer(src Buffer, page, perPage int) *FilteredBuffer {
 		end = src.Size()
 	}
 
+	// There may be fewer lines, if src has been released meanwhile
 	lines := src.linesInRange(start, end)
 	var maxcols int
-	for i := start; i < end; i++ {
+	for i := start; i < start+len(lines); i++ {
 		selection = append(selection, i)
-		cols := runewidth.StringWidth(lines[i-start].DisplayString())
+		cols := displayWidth(lines[i-start].DisplayString(), 0)
 		if cols > maxcols {
 			maxcols = cols
 		}
@@ -94,6 +99,7 @@ func (mb *MemoryBuffer) Reset() {
 	}
 	mb.done = make(chan struct{})
 	mb.lines = []line.Line(nil)
+	mb.gen = newBufferGen()
 }
 
 func (mb *MemoryBuffer) Done() <-chan struct{} {
@@ -132,7 +138,9 @@ func (mb *MemoryBuffer) Accept(ctx context.Context, in chan interface{}, _ pipel
 				}
 			case line.Line:
 				mb.mutex.Lock()
-				mb.lines = append(mb.lines, v.(line.Line))
+				if !mb.released {
+					mb.lines = append(mb.lines, v.(line.Line))
+				}
 				mb.mutex.Unlock()
 			}
 		}
@@ -148,7 +156,115 @@ func (mb *MemoryBuffer) LineAt(n int) (line.Line, error) {
 func (mb *MemoryBuffer) linesInRange(start, end int) []line.Line {
 	mb.mutex.RLock()
 	defer mb.mutex.RUnlock()
-	return mb.lines[start:end]
+	return bufferLinesInRange(mb.lines, start, end)
+}
+
+// release drops the lines of the buffer, and those that are added to
+// it later, once it is no longer displayed. It returns the number of
+// lines that were dropped
+func (mb *MemoryBuffer) release() int {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	n := len(mb.lines)
+	mb.lines = nil
+	mb.released = true
+	mb.gen = newBufferGen()
+	return n
+}
+
+// versionedLines returns the lines of the buffer, which are only
+// ever appended to until it is reset or released
+func (mb *MemoryBuffer) versionedLines() ([]line.Line, bufferVersion) {
+	mb.mutex.RLock()
+	defer mb.mutex.RUnlock()
+	n := len(mb.lines)
+	return mb.lines[:n:n], bufferVersion{gen: mb.gen, appended: n}
+}
+
+// releaseBuffer releases b, if it can be released
+func releaseBuffer(b Buffer) int {
+	if r, ok := b.(bufferReleaser); ok {
+		return r.release()
+	}
+	return 0
+}
+
+// showResults records displayed as the buffer that holds the results
+// of the latest query, or nil if they are no longer displayed, and
+// releases the buffer of the results that it replaces. These results
+// may still be referenced, e.g. by the display cache, or by Filter to
+// compare them with the next results, but their lines are not
+func (p *Peco) showResults(displayed Buffer) {
+	p.shownResultsMutex.Lock()
+	prev := p.shownResults
+	p.shownResults = displayed
+	p.shownResultsMutex.Unlock()
+
+	if prev == nil || prev == displayed {
+		return
+	}
+	n := releaseBuffer(prev)
+	if max := p.config.FreeMemoryThreshold; max > 0 && n >= max {
+		p.freeOSMemory()
+	}
+}
+
+// freeOSMemory returns as much memory as possible to the OS in the
+// background, unless it is already being done
+func (p *Peco) freeOSMemory() {
+	if !atomic.CompareAndSwapInt32(&p.freeingMemory, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&p.freeingMemory, 0)
+		debug.FreeOSMemory()
+	}()
+}
+
+// bufferGen is the last generation given to the lines of a buffer
+var bufferGen uint64
+
+// newBufferGen returns a generation that no lines have had before,
+// for bufferVersion
+func newBufferGen() uint64 {
+	return atomic.AddUint64(&bufferGen, 1)
+}
+
+// versionedLines returns the lines of b, and their version. Buffers
+// that do not keep track of their versions are assumed to only grow
+func versionedLines(b Buffer) ([]line.Line, bufferVersion) {
+	if vb, ok := b.(versionedBuffer); ok {
+		return vb.versionedLines()
+	}
+	lines := b.linesInRange(0, b.Size())
+	return lines, bufferVersion{appended: len(lines)}
+}
+
+// update takes the current lines of b. If they have only changed by
+// lines being dropped from the beginning, and added at the end, since
+// the last update, these lines are returned along with them, and ok is
+// true. Otherwise, as on the first update, whatever is derived from
+// the lines has to be recalculated
+func (t *bufferTracker) update(b Buffer) (lines, dropped, added []line.Line, ok bool) {
+	lines, ver := versionedLines(b)
+	prev, prevVer, valid := t.lines, t.ver, t.valid
+	t.lines, t.ver, t.valid = lines, ver, true
+	if !valid || ver.gen != prevVer.gen {
+		return lines, nil, nil, false
+	}
+
+	// Lines are numbered from the first one that was ever appended
+	d := (ver.appended - len(lines)) - (prevVer.appended - len(prev))
+	a := ver.appended - prevVer.appended
+	if d < 0 || a < 0 || d > len(prev) || a > len(lines) {
+		return lines, nil, nil, false
+	}
+	return lines, prev[:d], lines[len(lines)-a:], true
+}
+
+// reset forgets the lines, so that the next update starts over
+func (t *bufferTracker) reset() {
+	*t = bufferTracker{}
 }
 
 func bufferLineAt(lines []line.Line, n int) (line.Line, error) {
@@ -158,3 +274,250 @@ func bufferLineAt(lines []line.Line, n int) (line.Line, error) {
 
 	return lines[n], nil
 }
+
+// bufferLinesInRange returns lines[start:end], cut short if the buffer
+// has been released since its size was taken
+func bufferLinesInRange(lines []line.Line, start, end int) []line.Line {
+	if end > len(lines) {
+		end = len(lines)
+	}
+	if start > end {
+		start = end
+	}
+	return lines[start:end]
+}
+
+// NewGroupedBuffer creates a new GroupedBuffer that groups the lines
+// in `src` by the key extracted using `rx`. If `rx` contains a capture
+// group, the first group is used as the key. Otherwise the entire match
+// is used. Lines that do not match `rx` are placed at the end, without
+// a header
+func NewGroupedBuffer(src Buffer, rx *regexp.Regexp) *GroupedBuffer {
+	return &GroupedBuffer{
+		rx:  rx,
+		src: src,
+	}
+}
+
+func groupKey(rx *regexp.Regexp, s string) string {
+	m := rx.FindStringSubmatch(s)
+	switch len(m) {
+	case 0:
+		return ""
+	case 1:
+		return m[0]
+	default:
+		return m[1]
+	}
+}
+
+// rebuild recalculates the grouped lines if the underlying
+// buffer has changed since the last time we looked at it.
+// Must be called with the mutex held
+func (gb *GroupedBuffer) rebuild() {
+	lines, dropped, added, ok := gb.tracker.update(gb.src)
+	if ok && len(dropped) == 0 && len(added) == 0 {
+		return
+	}
+
+	var keys []string
+	groups := make(map[string][]line.Line)
+	for _, l := range lines {
+		key := groupKey(gb.rx, l.DisplayString())
+		if _, ok := groups[key]; !ok && key != "" {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], l)
+	}
+
+	grouped := make([]line.Line, 0, len(lines)+len(keys))
+	for i, key := range keys {
+		grouped = append(grouped, &groupHeader{id: groupHeaderID(i), key: key, dirty: true})
+		grouped = append(grouped, groups[key]...)
+	}
+	grouped = append(grouped, groups[""]...)
+
+	gb.lines = grouped
+	gb.ver = bufferVersion{gen: newBufferGen(), appended: len(grouped)}
+}
+
+// Size returns the number of lines in the buffer, including
+// the group headers
+func (gb *GroupedBuffer) Size() int {
+	gb.mutex.Lock()
+	defer gb.mutex.Unlock()
+	gb.rebuild()
+	return bufferSize(gb.lines)
+}
+
+// LineAt returns the line at index `n`. The returned line may
+// be a group header
+func (gb *GroupedBuffer) LineAt(n int) (line.Line, error) {
+	gb.mutex.Lock()
+	defer gb.mutex.Unlock()
+	gb.rebuild()
+	return bufferLineAt(gb.lines, n)
+}
+
+func (gb *GroupedBuffer) linesInRange(start, end int) []line.Line {
+	gb.mutex.Lock()
+	defer gb.mutex.Unlock()
+	gb.rebuild()
+	return bufferLinesInRange(gb.lines, start, end)
+}
+
+// versionedLines returns the grouped lines, and their version
+func (gb *GroupedBuffer) versionedLines() ([]line.Line, bufferVersion) {
+	gb.mutex.Lock()
+	defer gb.mutex.Unlock()
+	gb.rebuild()
+	n := len(gb.lines)
+	return gb.lines[:n:n], gb.ver
+}
+
+// release drops the grouped lines, and releases the buffer that this
+// GroupedBuffer decorates
+func (gb *GroupedBuffer) release() int {
+	gb.mutex.Lock()
+	gb.lines = nil
+	gb.tracker.reset()
+	gb.mutex.Unlock()
+	return releaseBuffer(gb.src)
+}
+
+// NewPinnedBuffer creates a new PinnedBuffer that places the lines
+// in `src` that are currently in `sel` before all other lines.
+// Changes to `sel` after this call do not affect the order
+func NewPinnedBuffer(src Buffer, sel *Selection) *PinnedBuffer {
+	pinned := NewSelection()
+	sel.Copy(pinned)
+	return &PinnedBuffer{
+		pinned: pinned,
+		src:    src,
+	}
+}
+
+// rebuild recalculates the order of the lines if the underlying
+// buffer has changed since the last time we looked at it.
+// Must be called with the mutex held
+func (pb *PinnedBuffer) rebuild() {
+	lines, dropped, added, ok := pb.tracker.update(pb.src)
+	if ok && len(dropped) == 0 {
+		// New lines go last, unless one of them is pinned
+		var pinned bool
+		for _, l := range added {
+			if pb.pinned.Has(l) {
+				pinned = true
+				break
+			}
+		}
+		if !pinned {
+			pb.lines = append(pb.lines, added...)
+			pb.ver.appended += len(added)
+			return
+		}
+	}
+
+	ordered := make([]line.Line, 0, len(lines))
+	rest := make([]line.Line, 0, len(lines))
+	for _, l := range lines {
+		if pb.pinned.Has(l) {
+			ordered = append(ordered, l)
+		} else {
+			rest = append(rest, l)
+		}
+	}
+
+	pb.lines = append(ordered, rest...)
+	pb.ver = bufferVersion{gen: newBufferGen(), appended: len(pb.lines)}
+}
+
+// Unpinned returns the buffer that this PinnedBuffer decorates
+func (pb *PinnedBuffer) Unpinned() Buffer {
+	return pb.src
+}
+
+// Size returns the number of lines in the buffer
+func (pb *PinnedBuffer) Size() int {
+	pb.mutex.Lock()
+	defer pb.mutex.Unlock()
+	pb.rebuild()
+	return bufferSize(pb.lines)
+}
+
+// LineAt returns the line at index `n`
+func (pb *PinnedBuffer) LineAt(n int) (line.Line, error) {
+	pb.mutex.Lock()
+	defer pb.mutex.Unlock()
+	pb.rebuild()
+	return bufferLineAt(pb.lines, n)
+}
+
+func (pb *PinnedBuffer) linesInRange(start, end int) []line.Line {
+	pb.mutex.Lock()
+	defer pb.mutex.Unlock()
+	pb.rebuild()
+	return bufferLinesInRange(pb.lines, start, end)
+}
+
+// versionedLines returns the rearranged lines, and their version
+func (pb *PinnedBuffer) versionedLines() ([]line.Line, bufferVersion) {
+	pb.mutex.Lock()
+	defer pb.mutex.Unlock()
+	pb.rebuild()
+	n := len(pb.lines)
+	return pb.lines[:n:n], pb.ver
+}
+
+// release drops the rearranged lines, and releases the buffer that
+// this PinnedBuffer decorates
+func (pb *PinnedBuffer) release() int {
+	pb.mutex.Lock()
+	pb.lines = nil
+	pb.tracker.reset()
+	pb.mutex.Unlock()
+	return releaseBuffer(pb.src)
+}
+
+func isGroupHeader(l line.Line) bool {
+	_, ok := l.(*groupHeader)
+	return ok
+}
+
+// Less implements the btree.Item interface
+func (gh *groupHeader) Less(b btree.Item) bool {
+	return gh.ID() < b.(line.Line).ID()
+}
+
+// groupHeaderID returns the ID of the header of the n-th group.
+// Headers are numbered down from the largest ID, so that they never
+// have the ID of a line of the input
+func groupHeaderID(n int) uint64 {
+	return math.MaxUint64 - uint64(n)
+}
+
+// ID returns the ID of the header, which tells it apart from the
+// other headers. Headers are never stored in a Selection
+func (gh *groupHeader) ID() uint64 {
+	return gh.id
+}
+
+func (gh *groupHeader) Buffer() string {
+	return gh.key
+}
+
+func (gh *groupHeader) DisplayString() string {
+	return gh.key
+}
+
+func (gh *groupHeader) Output() string {
+	return gh.key
+}
+
+func (gh *groupHeader) IsDirty() bool {
+	return gh.dirty
+}
+
+func (gh *groupHeader) SetDirty(b bool) {
+	gh.dirty = b
+}
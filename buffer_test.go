@@ -0,0 +1,162 @@
+package peco
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/peco/peco/line"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupedBuffer(t *testing.T) {
+	src := NewMemoryBuffer()
+	for i, s := range []string{
+		"foo.go:1:hello",
+		"bar.go:10:hello",
+		"no match here",
+		"foo.go:20:hello",
+	} {
+		src.lines = append(src.lines, line.NewRaw(uint64(i), s, false))
+	}
+
+	gb := NewGroupedBuffer(src, regexp.MustCompile(`^([^:]+):`))
+	expected := []string{
+		"foo.go",
+		"foo.go:1:hello",
+		"foo.go:20:hello",
+		"bar.go",
+		"bar.go:10:hello",
+		"no match here",
+	}
+
+	if !assert.Equal(t, len(expected), gb.Size(), "Size() should include group headers") {
+		return
+	}
+
+	for i, s := range expected {
+		l, err := gb.LineAt(i)
+		if !assert.NoError(t, err, "LineAt(%d) should succeed", i) {
+			return
+		}
+		if !assert.Equal(t, s, l.DisplayString(), "line %d should match", i) {
+			return
+		}
+	}
+
+	header, _ := gb.LineAt(0)
+	sel := NewSelection()
+	sel.Add(header)
+	if !assert.Equal(t, 0, sel.Len(), "group headers should not be selectable") {
+		return
+	}
+
+	other, _ := gb.LineAt(3)
+	assert.NotEqual(t, header.ID(), other.ID(), "group headers should have distinct IDs")
+}
+
+func TestGroupedBufferFollowsSource(t *testing.T) {
+	src := NewSource("-", strings.NewReader(""), false, nil, 2, false)
+	gb := NewGroupedBuffer(src, regexp.MustCompile(`^([^:]+):`))
+	src.Append(line.NewRaw(0, "foo.go:1", false))
+	src.Append(line.NewRaw(1, "bar.go:2", false))
+	if !assert.Equal(t, []string{"foo.go", "foo.go:1", "bar.go", "bar.go:2"}, bufferStrings(gb), "lines should be grouped") {
+		return
+	}
+
+	// The source stays the same size once it is full
+	src.Append(line.NewRaw(2, "baz.go:3", false))
+	assert.Equal(t, []string{"bar.go", "bar.go:2", "baz.go", "baz.go:3"}, bufferStrings(gb), "groups should follow the source once it is full")
+}
+
+func TestPinnedBuffer(t *testing.T) {
+	src := NewMemoryBuffer()
+	for i, s := range []string{"a", "b", "c", "d", "e"} {
+		src.lines = append(src.lines, line.NewRaw(uint64(i), s, false))
+	}
+
+	sel := NewSelection()
+	sel.Add(src.lines[3])
+	sel.Add(src.lines[1])
+
+	pb := NewPinnedBuffer(src, sel)
+	check := func(expected []string) bool {
+		if !assert.Equal(t, len(expected), pb.Size(), "Size() should match") {
+			return false
+		}
+		for i, s := range expected {
+			l, err := pb.LineAt(i)
+			if !assert.NoError(t, err, "LineAt(%d) should succeed", i) {
+				return false
+			}
+			if !assert.Equal(t, s, l.DisplayString(), "line %d should match", i) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if !check([]string{"b", "d", "a", "c", "e"}) {
+		return
+	}
+
+	// Later changes to the selection do not affect the order, but
+	// lines added to the source do
+	sel.Add(src.lines[4])
+	src.lines = append(src.lines, line.NewRaw(5, "f", false))
+	if !check([]string{"b", "d", "a", "c", "e", "f"}) {
+		return
+	}
+
+	assert.Equal(t, Buffer(src), pb.Unpinned(), "Unpinned() should return the source buffer")
+}
+
+func TestPinnedBufferFollowsSource(t *testing.T) {
+	src := NewSource("-", strings.NewReader(""), false, nil, 3, false)
+	for i, s := range []string{"a", "b", "c"} {
+		src.Append(line.NewRaw(uint64(i), s, false))
+	}
+
+	sel := NewSelection()
+	l, _ := src.LineAt(2)
+	sel.Add(l)
+	pb := NewPinnedBuffer(src, sel)
+	if !assert.Equal(t, []string{"c", "a", "b"}, bufferStrings(pb), "selected lines should come first") {
+		return
+	}
+
+	// The source stays the same size once it is full
+	src.Append(line.NewRaw(3, "d", false))
+	assert.Equal(t, []string{"c", "b", "d"}, bufferStrings(pb), "lines should follow the source once it is full")
+}
+
+func TestReleaseBuffer(t *testing.T) {
+	src := NewMemoryBuffer()
+	for i, s := range []string{"foo:1", "bar:2", "foo:3"} {
+		src.lines = append(src.lines, line.NewRaw(uint64(i), s, false))
+	}
+	gb := NewGroupedBuffer(src, regexp.MustCompile(`^([^:]+):`))
+	if !assert.Equal(t, 5, gb.Size(), "Size() should include group headers") {
+		return
+	}
+
+	assert.Equal(t, 3, releaseBuffer(gb), "the lines of the decorated buffer should be dropped")
+	assert.Equal(t, 0, src.Size(), "released buffers should be empty")
+	assert.Equal(t, 0, gb.Size(), "decorators of released buffers should be empty")
+	assert.Empty(t, gb.linesInRange(0, 5), "ranges taken before the release should be cut short")
+	assert.Equal(t, 0, NewFilteredBuffer(src, 1, 10).Size(), "released buffers should be paged safely")
+
+	ch := make(chan interface{}, 1)
+	ch <- line.NewRaw(3, "foo:4", false)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	src.Accept(ctx, ch, nil)
+	assert.Equal(t, 0, src.Size(), "lines that arrive after the release should be dropped")
+
+	assert.Equal(t, 0, releaseBuffer(NewSource("-", nil, false, nil, 0, false)), "the input should never be released")
+}
@@ -0,0 +1,165 @@
+// pecobench measures how quickly peco responds to key presses. It
+// drives peco against an in-memory screen, types a query one key at a
+// time, erases it again, and reports percentiles of the time it took
+// for the screen to settle after each key press. Run it before and
+// after a change to find regressions in filtering as well as drawing.
+//
+//	pecobench -lines 1000000 -query "foo bar" -iterations 5
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/pecotest"
+)
+
+type options struct {
+	config     string
+	input      string
+	iterations int
+	json       bool
+	lines      int
+	query      string
+	timeout    time.Duration
+	width      int
+	height     int
+}
+
+// report is the result of a run. Durations are in nanoseconds when
+// printed as JSON
+type report struct {
+	Lines      int           `json:"lines"`
+	Keystrokes int           `json:"keystrokes"`
+	P50        time.Duration `json:"p50"`
+	P90        time.Duration `json:"p90"`
+	P99        time.Duration `json:"p99"`
+	Max        time.Duration `json:"max"`
+}
+
+func main() {
+	var opts options
+	flag.StringVar(&opts.config, "config", "{}", "contents of the config file used by peco")
+	flag.StringVar(&opts.input, "input", "", "file to read lines from, instead of generating them")
+	flag.IntVar(&opts.iterations, "iterations", 3, "number of times the query is typed and erased")
+	flag.BoolVar(&opts.json, "json", false, "print the results as JSON")
+	flag.IntVar(&opts.lines, "lines", 100000, "number of lines to generate")
+	flag.StringVar(&opts.query, "query", "foo bar", "query to type")
+	flag.DurationVar(&opts.timeout, "timeout", 10*time.Minute, "time limit for the whole run")
+	flag.IntVar(&opts.width, "width", 80, "width of the screen")
+	flag.IntVar(&opts.height, "height", 25, "height of the screen")
+	flag.Parse()
+
+	if err := run(opts); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(opts options) error {
+	if opts.query == "" {
+		return fmt.Errorf("-query must not be empty")
+	}
+
+	data, err := dataset(opts)
+	if err != nil {
+		return err
+	}
+	lines := bytes.Count(data, []byte{'\n'})
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+	defer cancel()
+
+	d := pecotest.New(bytes.NewReader(data),
+		pecotest.WithConfig(opts.config),
+		pecotest.WithSize(opts.width, opts.height),
+		pecotest.WithPollInterval(100*time.Microsecond),
+	)
+	defer d.Close()
+
+	if err := d.Start(ctx); err != nil {
+		return fmt.Errorf("failed to start peco: %s", err)
+	}
+	if err := d.WaitIdle(ctx); err != nil {
+		return fmt.Errorf("failed to read input: %s", err)
+	}
+
+	// Type the query, then erase it one character at a time
+	events := pecotest.KeyEvents(opts.query)
+	for range opts.query {
+		events = append(events, termbox.Event{Type: termbox.EventKey, Key: termbox.KeyBackspace2})
+	}
+
+	var all pecotest.Latencies
+	for i := 0; i < opts.iterations; i++ {
+		l, err := d.Measure(ctx, events...)
+		if err != nil {
+			return fmt.Errorf("failed to measure iteration %d: %s", i+1, err)
+		}
+		all = append(all, l...)
+	}
+
+	r := report{
+		Lines:      lines,
+		Keystrokes: len(all),
+		P50:        all.Percentile(50),
+		P90:        all.Percentile(90),
+		P99:        all.Percentile(99),
+		Max:        all.Percentile(100),
+	}
+	if opts.json {
+		return json.NewEncoder(os.Stdout).Encode(r)
+	}
+	fmt.Printf("lines:      %d\n", r.Lines)
+	fmt.Printf("keystrokes: %d\n", r.Keystrokes)
+	fmt.Printf("p50:        %s\n", r.P50)
+	fmt.Printf("p90:        %s\n", r.P90)
+	fmt.Printf("p99:        %s\n", r.P99)
+	fmt.Printf("max:        %s\n", r.Max)
+	return nil
+}
+
+// dataset returns the lines that peco filters, either read from
+// -input, or generated from a fixed seed so that runs are comparable
+func dataset(opts options) ([]byte, error) {
+	if opts.input != "" {
+		data, err := ioutil.ReadFile(opts.input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read input: %s", err)
+		}
+		return data, nil
+	}
+
+	var buf bytes.Buffer
+	generate(&buf, opts.lines)
+	return buf.Bytes(), nil
+}
+
+var words = strings.Fields("foo bar baz qux quux corge grault garply waldo fred plugh xyzzy thud error warning info debug connection timeout request response")
+
+// generate writes n lines of words, resembling log messages
+func generate(w io.Writer, n int) {
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(bw, "%06d", i)
+		for j := 0; j < 4+rng.Intn(8); j++ {
+			bw.WriteByte(' ')
+			bw.WriteString(words[rng.Intn(len(words))])
+		}
+		bw.WriteByte('\n')
+	}
+}
@@ -0,0 +1,139 @@
+package peco
+
+import (
+	"strings"
+
+	"github.com/nsf/termbox-go"
+)
+
+// colorMask is the part of a termbox.Attribute that holds the color.
+// The rest holds attributes such as termbox.AttrBold
+const colorMask termbox.Attribute = 0x1FF
+
+// basicColors are the colors of termbox.ColorBlack through
+// termbox.ColorWhite, as displayed by most terminals
+var basicColors = [8][3]int{
+	{0, 0, 0},
+	{205, 0, 0},
+	{0, 205, 0},
+	{205, 205, 0},
+	{0, 0, 238},
+	{205, 0, 205},
+	{0, 205, 205},
+	{229, 229, 229},
+}
+
+// isValidColors returns true if s is a value for --colors, or for
+// Colors in the config file
+func isValidColors(s string) bool {
+	switch s {
+	case "", colorsAuto, colors256, colorsBasic, colorsNone:
+		return true
+	}
+	return false
+}
+
+// detectColors resolves the colors that the terminal supports. Unless
+// they are given explicitly, they are guessed from the environment:
+// NO_COLOR, or a missing or dumb $TERM disable colors, and terminals
+// whose $TERM or $COLORTERM mention 256 or true colors, or for which
+// Use256Color is enabled, get 256 colors
+func detectColors(mode string, use256 bool, getenv func(string) string) string {
+	if mode != "" && mode != colorsAuto {
+		return mode
+	}
+
+	if getenv("NO_COLOR") != "" {
+		return colorsNone
+	}
+	term := getenv("TERM")
+	if term == "" || term == "dumb" {
+		return colorsNone
+	}
+	if use256 || strings.Contains(term, "256color") {
+		return colors256
+	}
+	switch getenv("COLORTERM") {
+	case "truecolor", "24bit":
+		return colors256
+	}
+	return colorsBasic
+}
+
+// detectConsoleColors resolves the colors of the Windows console as
+// detectColors does. The console does not set $TERM, but supports the
+// basic colors, and no more
+func detectConsoleColors(mode string, getenv func(string) string) string {
+	colors := detectColors(mode, false, func(k string) string {
+		if v := getenv(k); v != "" || k != "TERM" {
+			return v
+		}
+		return "console"
+	})
+	if colors == colors256 {
+		return colorsBasic
+	}
+	return colors
+}
+
+// degradeColors converts fg and bg to what can be displayed with the
+// given colors. With basic colors, colors from the 256 color palette
+// are replaced by the closest of the 8 basic colors. Without colors,
+// foreground colors are displayed in bold, and background colors in
+// reverse video, so that styles can still be told apart
+func degradeColors(colors string, fg, bg termbox.Attribute) (termbox.Attribute, termbox.Attribute) {
+	switch colors {
+	case colorsBasic:
+		fgColor, fgBright := basicColor(fg & colorMask)
+		bgColor, _ := basicColor(bg & colorMask)
+		fg = fg&^colorMask | fgColor
+		if fgBright {
+			fg |= termbox.AttrBold
+		}
+		bg = bg&^colorMask | bgColor
+	case colorsNone:
+		attrs := fg &^ colorMask
+		if fg&colorMask != termbox.ColorDefault {
+			attrs |= termbox.AttrBold
+		}
+		if bg&colorMask != termbox.ColorDefault {
+			attrs |= termbox.AttrReverse
+		}
+		fg = attrs
+		bg = bg &^ colorMask
+	}
+	return fg, bg
+}
+
+// basicColor returns the basic color that is closest to c, a color
+// of the 256 color palette, and whether c is a bright color
+func basicColor(c termbox.Attribute) (termbox.Attribute, bool) {
+	switch {
+	case c <= termbox.ColorWhite:
+		return c, false
+	case c <= termbox.ColorWhite+8:
+		// The bright variants of the basic colors
+		return c - 8, true
+	case c > 256:
+		return termbox.ColorDefault, false
+	}
+
+	var r, g, b int
+	if index := int(c) - 17; index < 216 {
+		r, g, b = xtermLevels[index/36], xtermLevels[index/6%6], xtermLevels[index%6]
+	} else {
+		l := 8 + 10*(index-216)
+		r, g, b = l, l, l
+	}
+
+	best := 0
+	bestDistance := -1
+	for i, rgb := range basicColors {
+		d := (r-rgb[0])*(r-rgb[0]) + (g-rgb[1])*(g-rgb[1]) + (b-rgb[2])*(b-rgb[2])
+		if bestDistance < 0 || d < bestDistance {
+			best = i
+			bestDistance = d
+		}
+	}
+	return termbox.ColorBlack + termbox.Attribute(best), false
+}
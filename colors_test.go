@@ -0,0 +1,62 @@
+package peco
+
+import (
+	"testing"
+
+	"github.com/nsf/termbox-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectColors(t *testing.T) {
+	env := func(vars ...string) func(string) string {
+		return func(name string) string {
+			for i := 0; i < len(vars); i += 2 {
+				if vars[i] == name {
+					return vars[i+1]
+				}
+			}
+			return ""
+		}
+	}
+
+	assert.Equal(t, colorsBasic, detectColors("", false, env("TERM", "xterm")), "basic terminals should get basic colors")
+	assert.Equal(t, colors256, detectColors(colorsAuto, false, env("TERM", "xterm-256color")), "256 color terminals should be detected")
+	assert.Equal(t, colors256, detectColors("", false, env("TERM", "xterm", "COLORTERM", "truecolor")), "true color terminals should get 256 colors")
+	assert.Equal(t, colors256, detectColors("", true, env("TERM", "xterm")), "Use256Color should enable 256 colors")
+	assert.Equal(t, colorsNone, detectColors("", true, env("TERM", "dumb")), "dumb terminals should get no colors")
+	assert.Equal(t, colorsNone, detectColors("", false, env()), "missing $TERM should disable colors")
+	assert.Equal(t, colorsNone, detectColors("", false, env("TERM", "xterm-256color", "NO_COLOR", "1")), "NO_COLOR should disable colors")
+	assert.Equal(t, colors256, detectColors(colors256, false, env("TERM", "dumb")), "explicit colors should take precedence")
+
+	assert.Equal(t, colorsBasic, detectConsoleColors("", env()), "the console should get basic colors without $TERM")
+	assert.Equal(t, colorsBasic, detectConsoleColors(colors256, env()), "the console should not get 256 colors")
+	assert.Equal(t, colorsNone, detectConsoleColors("", env("NO_COLOR", "1")), "NO_COLOR should disable colors in the console")
+	assert.Equal(t, colorsNone, detectConsoleColors(colorsNone, env()), "explicit colors should take precedence in the console")
+}
+
+func TestDegradeColors(t *testing.T) {
+	red, _ := hexToAttribute("#ff0000")
+	fg, bg := degradeColors(colorsBasic, red|termbox.AttrUnderline, termbox.Attribute(18))
+	assert.Equal(t, termbox.ColorRed|termbox.AttrUnderline, fg, "256 colors should be replaced by the closest basic color, keeping attributes")
+	assert.Equal(t, termbox.ColorBlack, bg, "dark colors should become black")
+
+	fg, bg = degradeColors(colorsBasic, termbox.Attribute(10), termbox.ColorDefault)
+	assert.Equal(t, termbox.ColorRed|termbox.AttrBold, fg, "bright colors should be displayed in bold")
+	assert.Equal(t, termbox.ColorDefault, bg, "default colors should be kept")
+
+	fg, bg = degradeColors(colorsBasic, termbox.Attribute(240), termbox.ColorCyan)
+	assert.Equal(t, termbox.ColorBlack, fg, "dark grays should become black")
+	assert.Equal(t, termbox.ColorCyan, bg, "basic colors should be kept")
+
+	fg, bg = degradeColors(colorsNone, termbox.ColorCyan, termbox.ColorDefault)
+	assert.Equal(t, termbox.AttrBold, fg, "foreground colors should become bold")
+	assert.Equal(t, termbox.ColorDefault, bg)
+
+	fg, bg = degradeColors(colorsNone, termbox.ColorBlack|termbox.AttrUnderline, termbox.ColorMagenta|termbox.AttrBold)
+	assert.Equal(t, termbox.AttrUnderline|termbox.AttrBold|termbox.AttrReverse, fg, "background colors should become reverse video")
+	assert.Equal(t, termbox.AttrBold, bg, "background attributes should be kept")
+
+	fg, bg = degradeColors(colors256, red, termbox.ColorCyan)
+	assert.Equal(t, red, fg, "256 colors should be kept as they are")
+	assert.Equal(t, termbox.ColorCyan, bg)
+}
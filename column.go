@@ -0,0 +1,159 @@
+package peco
+
+import (
+	"context"
+	"strings"
+	"unicode"
+
+	"github.com/peco/peco/filter"
+	"github.com/peco/peco/line"
+	"github.com/peco/peco/pipeline"
+)
+
+// columnLine is a line whose display string has been replaced by
+// one of its columns, so that filters only match against that column
+type columnLine struct {
+	line.Line
+	column string
+	offset int // byte offset of column within the original display string
+}
+
+func (l columnLine) DisplayString() string {
+	return l.column
+}
+
+// columnFilter wraps a filter so that it only matches against a
+// single column of each line. The matches are translated back so
+// that they point into the whole line
+type columnFilter struct {
+	filter.Filter
+	column    int    // 1-based
+	delimiter string // if empty, columns are separated by runs of whitespace
+}
+
+func newColumnFilter(f filter.Filter, column int, delimiter string) *columnFilter {
+	return &columnFilter{
+		Filter:    f,
+		column:    column,
+		delimiter: delimiter,
+	}
+}
+
+// extractColumn returns the n-th (1-based) column of s, and its byte
+// offset within s. If s does not have that many columns, an empty
+// string at the end of s is returned
+func extractColumn(s string, n int, delimiter string) (string, int) {
+	if delimiter != "" {
+		offset := 0
+		for i := 1; i < n; i++ {
+			j := strings.Index(s[offset:], delimiter)
+			if j < 0 {
+				return "", len(s)
+			}
+			offset += j + len(delimiter)
+		}
+		if j := strings.Index(s[offset:], delimiter); j >= 0 {
+			return s[offset : offset+j], offset
+		}
+		return s[offset:], offset
+	}
+
+	i := 0
+	for offset := 0; offset < len(s); {
+		start := strings.IndexFunc(s[offset:], func(r rune) bool { return !unicode.IsSpace(r) })
+		if start < 0 {
+			break
+		}
+		start += offset
+		end := strings.IndexFunc(s[start:], unicode.IsSpace)
+		if end < 0 {
+			end = len(s)
+		} else {
+			end += start
+		}
+
+		if i++; i == n {
+			return s[start:end], start
+		}
+		offset = end
+	}
+	return "", len(s)
+}
+
+func (f *columnFilter) Apply(ctx context.Context, lines []line.Line, out pipeline.ChanOutput) error {
+	wrapped := make([]line.Line, len(lines))
+	for i, l := range lines {
+		column, offset := extractColumn(l.DisplayString(), f.column, f.delimiter)
+		wrapped[i] = columnLine{Line: l, column: column, offset: offset}
+	}
+
+	ch := make(chan interface{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for v := range ch {
+			out.Send(unwrapColumnLine(v))
+		}
+	}()
+
+	err := f.Filter.Apply(ctx, wrapped, pipeline.ChanOutput(ch))
+	close(ch)
+	<-done
+	return err
+}
+
+// Concurrent is forwarded to the wrapped filter, if it implements
+// filter.Concurrent
+func (f *columnFilter) Concurrent() bool {
+	c, ok := f.Filter.(filter.Concurrent)
+	return ok && c.Concurrent()
+}
+
+// Validate is forwarded to the wrapped filter, if it implements
+// filter.Validator
+func (f *columnFilter) Validate(query string) error {
+	if v, ok := f.Filter.(filter.Validator); ok {
+		return v.Validate(query)
+	}
+	return nil
+}
+
+// Finish is forwarded to the wrapped filter, if it implements
+// filter.Finisher
+func (f *columnFilter) Finish(ctx context.Context, out pipeline.ChanOutput) error {
+	if fin, ok := f.Filter.(filter.Finisher); ok {
+		return fin.Finish(ctx, out)
+	}
+	return nil
+}
+
+// unwrapColumnLine replaces columnLines in the results of a filter
+// with the original lines, moving the match indices accordingly
+func unwrapColumnLine(v interface{}) interface{} {
+	switch l := v.(type) {
+	case columnLine:
+		return l.Line
+	case *line.Matched:
+		cl, ok := l.Line.(columnLine)
+		if !ok {
+			return v
+		}
+
+		indices := l.Indices()
+		shifted := make([][]int, len(indices))
+		terms := make([]int, len(indices))
+		for i, m := range indices {
+			s := make([]int, len(m))
+			for j, n := range m {
+				if n >= 0 {
+					n += cl.offset
+				}
+				s[j] = n
+			}
+			shifted[i] = s
+			terms[i] = l.Term(i)
+		}
+		return line.NewMatchedTerms(cl.Line, shifted, terms)
+	}
+	return v
+}
@@ -0,0 +1,77 @@
+package peco
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/peco/peco/filter"
+	"github.com/peco/peco/line"
+	"github.com/peco/peco/pipeline"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractColumn(t *testing.T) {
+	tests := []struct {
+		input     string
+		n         int
+		delimiter string
+		column    string
+		offset    int
+	}{
+		{"root  1234 bash", 1, "", "root", 0},
+		{"root  1234 bash", 2, "", "1234", 6},
+		{"  root  1234 bash", 3, "", "bash", 13},
+		{"root  1234 bash", 4, "", "", 15},
+		{"a\tb c\td", 2, "\t", "b c", 2},
+		{"a\tb c\td", 3, "\t", "d", 6},
+		{"a\t\tc", 2, "\t", "", 2},
+		{"a\tb", 3, "\t", "", 3},
+	}
+
+	for _, test := range tests {
+		column, offset := extractColumn(test.input, test.n, test.delimiter)
+		if !assert.Equal(t, test.column, column, "column %d of %q", test.n, test.input) {
+			return
+		}
+		if !assert.Equal(t, test.offset, offset, "offset of column %d of %q", test.n, test.input) {
+			return
+		}
+	}
+}
+
+func TestColumnFilter(t *testing.T) {
+	f := newColumnFilter(filter.NewRegexp(), 2, "")
+	ctx, cancel := context.WithTimeout(f.NewContext(context.Background(), "bash"), 5*time.Second)
+	defer cancel()
+
+	lines := []line.Line{
+		line.NewRaw(0, "bash 1 foo", false),
+		line.NewRaw(1, "root bash /bin/bash", false),
+	}
+
+	ch := make(chan interface{}, len(lines))
+	if !assert.NoError(t, f.Apply(ctx, lines, pipeline.ChanOutput(ch)), "Apply should succeed") {
+		return
+	}
+	close(ch)
+
+	var results []interface{}
+	for v := range ch {
+		results = append(results, v)
+	}
+	if !assert.Len(t, results, 1, "only lines matching in the column should be returned") {
+		return
+	}
+
+	m, ok := results[0].(*line.Matched)
+	if !assert.True(t, ok, "result should be a *line.Matched") {
+		return
+	}
+	if !assert.Equal(t, "root bash /bin/bash", m.DisplayString(), "the whole line should be displayed") {
+		return
+	}
+	if !assert.Equal(t, [][]int{{5, 9}}, m.Indices(), "indices should point into the whole line") {
+		return
+	}
+}
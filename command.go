@@ -0,0 +1,78 @@
+package peco
+
+import (
+	"os/exec"
+	"strings"
+
+	"github.com/peco/peco/internal/util"
+	"github.com/peco/peco/line"
+)
+
+// commandPlaceholder is replaced with the lines that a command is
+// executed with
+const commandPlaceholder = "{}"
+
+// IsEmpty returns true if no command is specified
+func (c CommandConfig) IsEmpty() bool {
+	return c.Line == "" && len(c.Argv) == 0
+}
+
+// String returns the command line, for messages
+func (c CommandConfig) String() string {
+	if len(c.Argv) == 0 {
+		return c.Line
+	}
+
+	words := make([]string, len(c.Argv))
+	for i, arg := range c.Argv {
+		words[i] = arg
+		if strings.ContainsAny(arg, " \t\"'") {
+			words[i] = util.ShellQuote(arg)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// command creates the command to execute with lines. A command line
+// is run by the shell as it is. Otherwise the program is executed
+// directly, and each argument that is "{}" is replaced with the
+// outputs of lines, one argument per line, so that they need no
+// quoting whatever the platform
+func (c CommandConfig) command(lines []line.Line) *exec.Cmd {
+	if len(c.Argv) == 0 {
+		return util.Shell(c.Line)
+	}
+
+	var args []string
+	for _, arg := range c.Argv[1:] {
+		if arg != commandPlaceholder {
+			args = append(args, arg)
+			continue
+		}
+		for _, l := range lines {
+			args = append(args, l.Output())
+		}
+	}
+	return exec.Command(c.Argv[0], args...)
+}
+
+// shellLine returns the shell command line that runs c with lines.
+// "{}" in the arguments is replaced as it is by command, with each
+// output quoted
+func (c CommandConfig) shellLine(lines []line.Line) string {
+	if len(c.Argv) == 0 {
+		return c.Line
+	}
+
+	words := []string{util.ShellQuote(c.Argv[0])}
+	for _, arg := range c.Argv[1:] {
+		if arg != commandPlaceholder {
+			words = append(words, util.ShellQuote(arg))
+			continue
+		}
+		for _, l := range lines {
+			words = append(words, util.ShellQuote(l.Output()))
+		}
+	}
+	return strings.Join(words, " ")
+}
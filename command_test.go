@@ -0,0 +1,35 @@
+package peco
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/peco/peco/internal/util"
+	"github.com/peco/peco/line"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandConfig(t *testing.T) {
+	var cfg Config
+	if !assert.NoError(t, json.Unmarshal([]byte(`{"Exec": "cat -n"}`), &cfg), "Unmarshalling a command line should succeed") {
+		return
+	}
+	assert.Equal(t, CommandConfig{Line: "cat -n"}, cfg.Exec, "strings should be read as command lines")
+
+	if !assert.NoError(t, json.Unmarshal([]byte(`{"Exec": ["prog", "-a", "{}", "x y"]}`), &cfg), "Unmarshalling a list should succeed") {
+		return
+	}
+	assert.Equal(t, CommandConfig{Argv: []string{"prog", "-a", "{}", "x y"}}, cfg.Exec, "lists should be read as the program and its arguments")
+	assert.Equal(t, "prog -a {} "+util.ShellQuote("x y"), cfg.Exec.String(), "arguments should be quoted for display")
+	assert.Error(t, json.Unmarshal([]byte(`{"Exec": 1}`), &cfg), "other values should be rejected")
+
+	lines := []line.Line{
+		line.NewRaw(0, "it's", false),
+		line.NewRaw(1, "C:\\Program Files\\peco", false),
+	}
+	cmd := cfg.Exec.command(lines)
+	assert.Equal(t, []string{"prog", "-a", "it's", "C:\\Program Files\\peco", "x y"}, cmd.Args, "placeholders should be replaced with one argument per line")
+
+	assert.True(t, CommandConfig{}.IsEmpty(), "zero value should be empty")
+	assert.False(t, CommandConfig{Line: "true"}.IsEmpty(), "command lines should not be empty")
+}
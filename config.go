@@ -3,6 +3,7 @@ package peco
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -16,12 +17,17 @@ import (
 
 var homedirFunc = util.Homedir
 
+// DefaultRPrompt is the template used to draw the right-hand side
+// of the prompt line, unless specified in the config file
+const DefaultRPrompt = "{filter} [{total} ({page}/{maxpage})]"
+
 // NewConfig creates a new Config
 func (c *Config) Init() error {
 	c.Keymap = make(map[string]string)
 	c.InitialMatcher = IgnoreCaseMatch
 	c.Style.Init()
 	c.Prompt = "QUERY>"
+	c.RPrompt = DefaultRPrompt
 	c.Layout = LayoutTypeTopDown
 	c.Use256Color = false
 	return nil
@@ -30,23 +36,34 @@ func (c *Config) Init() error {
 // ReadFilename reads the config from the given file, and
 // does the appropriate processing, if any
 func (c *Config) ReadFilename(filename string) error {
-	f, err := os.Open(filename)
-	if err != nil {
-		return errors.Wrapf(err, "failed to open file %s", filename)
-	}
-	defer f.Close()
-
-	err = json.NewDecoder(f).Decode(c)
-	if err != nil {
-		return errors.Wrap(err, "failed to decode JSON")
+	if err := c.readFile(filename, nil); err != nil {
+		return err
 	}
 
 	if !IsValidLayoutType(LayoutType(c.Layout)) {
 		return errors.Errorf("invalid layout type: %s", c.Layout)
 	}
 
+	// InitialMatcher, and Matcher before it, predate filters. They
+	// are still honored unless InitialFilter is specified. IgnoreCase
+	// is the default of InitialMatcher, as well as that of filters
+	if v := c.InitialMatcher; v != "" && v != IgnoreCaseMatch {
+		c.deprecated = append(c.deprecated, deprecatedKey{"InitialMatcher", "InitialFilter"})
+		if c.InitialFilter == "" {
+			c.InitialFilter = v
+		}
+		c.InitialMatcher = IgnoreCaseMatch
+	}
+	if v := c.Matcher; v != "" {
+		c.deprecated = append(c.deprecated, deprecatedKey{"Matcher", "InitialFilter"})
+		if c.InitialFilter == "" {
+			c.InitialFilter = v
+		}
+		c.Matcher = ""
+	}
+
 	if len(c.CustomMatcher) > 0 {
-		fmt.Fprintf(os.Stderr, "'CustomMatcher' is deprecated. Use CustomFilter instead\n")
+		c.deprecated = append(c.deprecated, deprecatedKey{"CustomMatcher", "CustomFilter"})
 
 		for n, cfg := range c.CustomMatcher {
 			if _, ok := c.CustomFilter[n]; ok {
@@ -59,11 +76,107 @@ func (c *Config) ReadFilename(filename string) error {
 				BufferThreshold: filter.DefaultCustomFilterBufferThreshold,
 			}
 		}
+		// Don't convert them again if another config file is read
+		// on top of this one
+		c.CustomMatcher = nil
 	}
 
 	return nil
 }
 
+// readFile reads the config from filename on top of the current
+// values. The files listed in its Include key are read first, so that
+// the values in the including file take precedence: maps such as
+// Keymap and CustomFilter are merged key by key, and any other value
+// that is present replaces the one read before. including holds the
+// files that are currently being read, to detect include cycles
+func (c *Config) readFile(filename string, including []string) error {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return errors.Wrapf(err, "failed to resolve path %s", filename)
+	}
+	for i, f := range including {
+		if f == abs {
+			return errors.Errorf("include cycle detected: %s", strings.Join(append(including[i:], abs), " -> "))
+		}
+	}
+	including = append(including, abs)
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open file %s", filename)
+	}
+	defer f.Close()
+
+	buf, err := ioutil.ReadAll(f)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read file %s", filename)
+	}
+
+	var raw struct {
+		Include []string `json:"Include"`
+		Theme   *string  `json:"Theme"`
+	}
+	if err := json.Unmarshal(buf, &raw); err != nil {
+		return errors.Wrapf(err, "failed to decode JSON in %s", filename)
+	}
+
+	dir := filepath.Dir(filename)
+	for _, inc := range raw.Include {
+		if !filepath.IsAbs(inc) {
+			inc = filepath.Join(dir, inc)
+		}
+		if err := c.readFile(inc, including); err != nil {
+			return errors.Wrapf(err, "failed to include config file from %s", filename)
+		}
+	}
+
+	err = json.Unmarshal(buf, c)
+	if err != nil {
+		return errors.Wrap(err, "failed to decode JSON")
+	}
+
+	// The theme is applied by the file that specifies it, so that the
+	// Style of that file is applied on top of it
+	if raw.Theme != nil && c.Theme != "" {
+		if err := c.applyTheme(buf, dir); err != nil {
+			return errors.Wrap(err, "failed to apply theme")
+		}
+	}
+	return nil
+}
+
+// locateProjectConfig returns the path to the project specific
+// config file in dir, which is .peco/config.json
+func locateProjectConfig(dir string) (string, error) {
+	return locateRcfileIn(filepath.Join(dir, ".peco"))
+}
+
+// applyTheme replaces the styles with the ones from the theme, and
+// then applies the Style section of the config file (given in buf)
+// on top of them, so that individual styles can be overridden
+func (c *Config) applyTheme(buf []byte, dir string) error {
+	ss, err := LoadTheme(c.Theme, dir)
+	if err != nil {
+		return errors.Wrap(err, "failed to load theme")
+	}
+
+	var raw struct {
+		Style json.RawMessage `json:"Style"`
+	}
+	if err := json.Unmarshal(buf, &raw); err != nil {
+		return errors.Wrap(err, "failed to decode JSON")
+	}
+	if len(raw.Style) > 0 {
+		if err := json.Unmarshal(raw.Style, ss); err != nil {
+			return errors.Wrap(err, "failed to decode Style")
+		}
+	}
+
+	c.Style = *ss
+	return nil
+}
+
 var (
 	stringToFg = map[string]termbox.Attribute{
 		"default": termbox.ColorDefault,
@@ -111,12 +224,47 @@ func (ss *StyleSet) Init() {
 	ss.Query.bg = termbox.ColorDefault
 	ss.Matched.fg = termbox.ColorCyan
 	ss.Matched.bg = termbox.ColorDefault
+	ss.SearchMatched.fg = termbox.ColorBlack
+	ss.SearchMatched.bg = termbox.ColorYellow
+	ss.Escaped.fg = termbox.ColorRed
+	ss.Escaped.bg = termbox.ColorDefault
+	ss.QueryError.fg = termbox.ColorRed | termbox.AttrBold
+	ss.QueryError.bg = termbox.ColorDefault
+	ss.Truncated.fg = termbox.ColorYellow | termbox.AttrBold
+	ss.Truncated.bg = termbox.ColorDefault
+	ss.Annotation.fg = termbox.ColorGreen
+	ss.Annotation.bg = termbox.ColorDefault
 	ss.SavedSelection.fg = termbox.ColorBlack | termbox.AttrBold
 	ss.SavedSelection.bg = termbox.ColorCyan
 	ss.Selected.fg = termbox.ColorDefault | termbox.AttrUnderline
 	ss.Selected.bg = termbox.ColorMagenta
 }
 
+// MatchedStyle returns the style used to highlight matches
+// produced by the given query term
+func (ss *StyleSet) MatchedStyle(term int) Style {
+	if len(ss.MatchedPalette) == 0 || term < 0 {
+		return ss.Matched
+	}
+	return ss.MatchedPalette[term%len(ss.MatchedPalette)]
+}
+
+// matchedColors returns the colors used for the matches produced by
+// the given query term, on a line whose background is bg. On the line
+// under the cursor, MatchedSelected takes precedence if specified.
+// Unlike the other match styles, its background replaces that of the
+// line, unless it has none
+func (ss *StyleSet) matchedColors(term int, bg termbox.Attribute, onCursor bool) (termbox.Attribute, termbox.Attribute) {
+	if s := ss.MatchedSelected; onCursor && s != nil {
+		if s.bg&colorMask == termbox.ColorDefault {
+			return s.fg, bg | s.bg
+		}
+		return s.fg, s.bg
+	}
+	style := ss.MatchedStyle(term)
+	return style.fg, mergeAttribute(bg, style.bg)
+}
+
 // UnmarshalJSON satisfies json.RawMessage.
 func (s *Style) UnmarshalJSON(buf []byte) error {
 	raw := []string{}
@@ -126,6 +274,45 @@ func (s *Style) UnmarshalJSON(buf []byte) error {
 	return stringsToStyle(s, raw)
 }
 
+// UnmarshalJSON accepts either a list of action names, or an object
+// with an "exec" key
+func (a *ActionConfig) UnmarshalJSON(buf []byte) error {
+	var actions []string
+	if err := json.Unmarshal(buf, &actions); err == nil {
+		*a = ActionConfig{Actions: actions}
+		return nil
+	}
+
+	var v struct {
+		Exec CommandConfig `json:"exec"`
+	}
+	if err := json.Unmarshal(buf, &v); err != nil {
+		return errors.Wrap(err, "action must be a list of actions, or an object with an \"exec\" key")
+	}
+	if v.Exec.IsEmpty() {
+		return errors.New("\"exec\" must not be empty")
+	}
+	*a = ActionConfig{Exec: v.Exec}
+	return nil
+}
+
+// UnmarshalJSON accepts either a command line, or a list of the
+// program and its arguments
+func (c *CommandConfig) UnmarshalJSON(buf []byte) error {
+	var s string
+	if err := json.Unmarshal(buf, &s); err == nil {
+		*c = CommandConfig{Line: s}
+		return nil
+	}
+
+	var argv []string
+	if err := json.Unmarshal(buf, &argv); err != nil {
+		return errors.Wrap(err, "command must be a string, or a list of the program and its arguments")
+	}
+	*c = CommandConfig{Argv: argv}
+	return nil
+}
+
 func stringsToStyle(style *Style, raw []string) error {
 	style.fg = termbox.ColorDefault
 	style.bg = termbox.ColorDefault
@@ -137,6 +324,8 @@ func stringsToStyle(style *Style, raw []string) error {
 		} else {
 			if fg, err := strconv.ParseUint(s, 10, 8); err == nil {
 				style.fg = termbox.Attribute(fg+1)
+			} else if fg, ok := hexToAttribute(s); ok {
+				style.fg = fg
 			}
 		}
 
@@ -147,6 +336,8 @@ func stringsToStyle(style *Style, raw []string) error {
 			if strings.HasPrefix(s, "on_") {
 				if bg, err := strconv.ParseUint(s[3:], 10, 8); err == nil {
 					style.bg = termbox.Attribute(bg+1)
+				} else if bg, ok := hexToAttribute(s[3:]); ok {
+					style.bg = bg
 				}
 			}
 		}
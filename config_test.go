@@ -1,6 +1,7 @@
 package peco
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -10,6 +11,7 @@ import (
 	"testing"
 
 	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/internal/i18n"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
@@ -25,7 +27,8 @@ func TestReadRC(t *testing.T) {
 		"Basic": ["on_default", "default"],
 		"Selected": ["underline", "on_cyan", "black"],
 		"Query": ["yellow", "bold"],
-		"Matched": ["cyan", "bold", "on_red"]
+		"Matched": ["cyan", "bold", "on_red"],
+		"MatchedPalette": [["red"], ["green", "on_black"]]
 	},
 	"Prompt": "[peco]"
 }
@@ -47,6 +50,7 @@ func TestReadRC(t *testing.T) {
 		InitialMatcher: IgnoreCaseMatch,
 		Layout:         DefaultLayoutType,
 		Prompt:         "[peco]",
+		RPrompt:        DefaultRPrompt,
 		Style: StyleSet{
 			Matched: Style{
 				fg: termbox.ColorCyan | termbox.AttrBold,
@@ -64,12 +68,40 @@ func TestReadRC(t *testing.T) {
 				fg: termbox.ColorBlack | termbox.AttrBold,
 				bg: termbox.ColorCyan,
 			},
+			SearchMatched: Style{
+				fg: termbox.ColorBlack,
+				bg: termbox.ColorYellow,
+			},
+			Escaped: Style{
+				fg: termbox.ColorRed,
+				bg: termbox.ColorDefault,
+			},
+			QueryError: Style{
+				fg: termbox.ColorRed | termbox.AttrBold,
+				bg: termbox.ColorDefault,
+			},
+			Truncated: Style{
+				fg: termbox.ColorYellow | termbox.AttrBold,
+				bg: termbox.ColorDefault,
+			},
+			Annotation: Style{
+				fg: termbox.ColorGreen,
+				bg: termbox.ColorDefault,
+			},
+			MatchedPalette: []Style{
+				{fg: termbox.ColorRed, bg: termbox.ColorDefault},
+				{fg: termbox.ColorGreen, bg: termbox.ColorBlack},
+			},
 		},
 	}
 
 	if !assert.Equal(t, expected, cfg, "configuration matches expected") {
 		return
 	}
+
+	if !assert.Equal(t, expected.Style.MatchedPalette[0], cfg.Style.MatchedStyle(2), "MatchedStyle should cycle through the palette") {
+		return
+	}
 }
 
 type stringsToStyleTest struct {
@@ -168,3 +200,135 @@ func TestLocateRcfile(t *testing.T) {
 	LocateRcfile(locater)
 
 }
+
+func TestConfigInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peco-")
+	if !assert.NoError(t, err, "Failed to create temporary directory: %s", err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) string {
+		file := filepath.Join(dir, name)
+		if !assert.NoError(t, os.MkdirAll(filepath.Dir(file), 0755), "creating directory should succeed") {
+			t.FailNow()
+		}
+		if !assert.NoError(t, ioutil.WriteFile(file, []byte(content), 0644), "writing config should succeed") {
+			t.FailNow()
+		}
+		return file
+	}
+
+	t.Run("merge", func(t *testing.T) {
+		write("base.json", `{"Keymap": {"C-a": "peco.SelectAll", "C-b": "peco.BackwardChar"}, "Prompt": "[base]", "Layout": "bottom-up"}`)
+		file := write("main.json", `{"Include": ["base.json"], "Keymap": {"C-b": "peco.Finish"}, "Layout": "top-down"}`)
+
+		var cfg Config
+		if !assert.NoError(t, cfg.Init(), "Config.Init should succeed") {
+			return
+		}
+		if !assert.NoError(t, cfg.ReadFilename(file), "reading config should succeed") {
+			return
+		}
+		assert.Equal(t, map[string]string{"C-a": "peco.SelectAll", "C-b": "peco.Finish"}, cfg.Keymap, "keymaps should be merged")
+		assert.Equal(t, "[base]", cfg.Prompt, "values of the included file should be used")
+		assert.Equal(t, "top-down", cfg.Layout, "values of the including file should take precedence")
+	})
+
+	t.Run("cycle", func(t *testing.T) {
+		write("a.json", `{"Include": ["b.json"]}`)
+		file := write("b.json", `{"Include": ["a.json"]}`)
+
+		var cfg Config
+		if !assert.NoError(t, cfg.Init(), "Config.Init should succeed") {
+			return
+		}
+		err := cfg.ReadFilename(file)
+		if assert.Error(t, err, "reading config should fail") {
+			assert.Contains(t, err.Error(), "include cycle detected", "error should mention the cycle")
+		}
+	})
+
+	t.Run("project", func(t *testing.T) {
+		write(filepath.Join("project", ".peco", "config.json"), `{"Prompt": "[project]"}`)
+
+		wd, err := os.Getwd()
+		if !assert.NoError(t, err, "os.Getwd should succeed") {
+			return
+		}
+		defer os.Chdir(wd)
+		if !assert.NoError(t, os.Chdir(filepath.Join(dir, "project")), "os.Chdir should succeed") {
+			return
+		}
+
+		var cfg Config
+		if !assert.NoError(t, cfg.Init(), "Config.Init should succeed") {
+			return
+		}
+		if !assert.NoError(t, readProjectConfig(&cfg), "reading project config should succeed") {
+			return
+		}
+		assert.Equal(t, "[project]", cfg.Prompt, "project config should be read")
+	})
+}
+
+func TestDeprecatedMatcherConfig(t *testing.T) {
+	tests := []struct {
+		config   string
+		expected string
+	}{
+		{`{"Matcher": "Regexp"}`, "Regexp"},
+		{`{"InitialMatcher": "Fuzzy", "Matcher": "Regexp"}`, "Fuzzy"},
+		{`{"InitialMatcher": "Fuzzy", "InitialFilter": "SmartCase"}`, "SmartCase"},
+		{`{}`, ""},
+	}
+
+	for _, test := range tests {
+		file, err := newConfig(test.config)
+		if !assert.NoError(t, err, "writing config should succeed") {
+			return
+		}
+		defer os.Remove(file)
+
+		var cfg Config
+		if !assert.NoError(t, cfg.Init(), "Config.Init should succeed") {
+			return
+		}
+		if !assert.NoError(t, cfg.ReadFilename(file), "reading config should succeed") {
+			return
+		}
+		if !assert.Equal(t, test.expected, cfg.InitialFilter, "%s should give the expected InitialFilter", test.config) {
+			return
+		}
+	}
+}
+
+func TestDeprecatedConfigNotice(t *testing.T) {
+	if os.Getenv("PECO_LANG") != "" {
+		t.Skip("PECO_LANG overrides Language")
+	}
+	defer i18n.SetLanguage(i18n.Language())
+
+	file, err := newConfig(`{"Language": "ja", "CustomFilter": {}, "CustomMatcher": {"Foo": ["foo"]}}`)
+	if !assert.NoError(t, err, "writing config should succeed") {
+		return
+	}
+	defer os.Remove(file)
+
+	p := newPeco()
+	var stderr bytes.Buffer
+	p.Stderr = &stderr
+	if !assert.NoError(t, p.config.Init(), "Config.Init should succeed") {
+		return
+	}
+	if !assert.NoError(t, p.config.ReadFilename(file), "reading config should succeed") {
+		return
+	}
+	if !assert.Empty(t, stderr.String(), "nothing should be reported before the config is applied") {
+		return
+	}
+	if !assert.NoError(t, p.ApplyConfig(CLIOptions{}), "p.ApplyConfig should succeed") {
+		return
+	}
+	assert.Equal(t, "CustomMatcher は非推奨です。CustomFilter を使ってください\n", stderr.String(), "deprecated keys should be reported in the language of the config")
+}
@@ -0,0 +1,434 @@
+package peco
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/internal/keyseq"
+	"github.com/pkg/errors"
+)
+
+// Subcommands of peco doctor
+const (
+	doctorCommand = "doctor"
+	doctorConfig  = "config"
+	doctorSchema  = "schema"
+)
+
+var (
+	actionConfigType  = reflect.TypeOf(ActionConfig{})
+	commandConfigType = reflect.TypeOf(CommandConfig{})
+	styleType         = reflect.TypeOf(Style{})
+	unmarshalerType   = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+)
+
+// isDoctorCommand returns true if args, which start with the name of
+// the program, run "peco doctor <command>". A single argument is still
+// read as the name of the input file, so that a file called "doctor"
+// can be filtered as usual
+func isDoctorCommand(args []string) bool {
+	return len(args) == 3 && args[1] == doctorCommand
+}
+
+// doctor runs "peco doctor config", which checks the config file, or
+// "peco doctor schema", which prints the JSON Schema of the config
+// file. It returns the error that peco exits with
+func (p *Peco) doctor(rcfile, command string) error {
+	switch command {
+	case doctorConfig:
+		if rcfile == "" {
+			fmt.Fprintln(p.Stdout, "No config file found")
+			return makeIgnorable(errors.New("user asked to check the config"))
+		}
+
+		problems := checkConfig(rcfile)
+		for _, problem := range problems {
+			fmt.Fprintln(p.Stdout, problem)
+		}
+		if len(problems) > 0 {
+			return setExitStatus(makeIgnorable(errors.New("config file has problems")), 1)
+		}
+		fmt.Fprintf(p.Stdout, "%s: OK\n", rcfile)
+		return makeIgnorable(errors.New("user asked to check the config"))
+	case doctorSchema:
+		buf, err := json.MarshalIndent(configSchema(), "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "failed to encode schema")
+		}
+		fmt.Fprintf(p.Stdout, "%s\n", buf)
+		return makeIgnorable(errors.New("user asked to print the config schema"))
+	}
+	return errors.Errorf("unknown doctor command '%s'. '%s' or '%s'", command, doctorConfig, doctorSchema)
+}
+
+// checkConfig checks the config file filename, and the files that it
+// includes, for unknown keys, values of the wrong type, and invalid
+// styles. Then the config is read as peco would, and if it can be, the
+// key bindings are checked for unknown keys and actions. Problems are
+// returned as "file: key: message"
+func checkConfig(filename string) []string {
+	problems := checkConfigFile(filename, map[string]struct{}{})
+
+	var cfg Config
+	if err := cfg.Init(); err != nil {
+		return append(problems, fmt.Sprintf("%s: %s", filename, err))
+	}
+	if err := cfg.ReadFilename(filename); err != nil {
+		// The reason has most likely been found already
+		if len(problems) == 0 {
+			problems = append(problems, fmt.Sprintf("%s: %s", filename, err))
+		}
+		return problems
+	}
+
+	for _, problem := range checkKeymap(&cfg) {
+		problems = append(problems, filename+": "+problem)
+	}
+	if err := checkFilters(&cfg); err != nil {
+		problems = append(problems, fmt.Sprintf("%s: Filters: %s", filename, err))
+	}
+	if !isValidColors(cfg.Colors) {
+		problems = append(problems, fmt.Sprintf("%s: Colors: unknown value '%s'", filename, cfg.Colors))
+	}
+	if _, err := newLineRenderer(cfg.LineRenderer); err != nil {
+		problems = append(problems, fmt.Sprintf("%s: LineRenderer: %s", filename, err))
+	}
+	return problems
+}
+
+// checkFilters checks that Filters only names known filters
+func checkFilters(cfg *Config) error {
+	var builtin, custom []string
+	for _, f := range newBuiltinFilters(false) {
+		builtin = append(builtin, f.String())
+	}
+	for name := range cfg.CustomFilter {
+		custom = append(custom, name)
+	}
+	_, err := filterOrder(builtin, custom, cfg.Filters)
+	return err
+}
+
+// checkConfigFile checks the structure of a single config file, and
+// of the files that it includes. seen holds the files that have
+// been checked already
+func checkConfigFile(filename string, seen map[string]struct{}) []string {
+	if abs, err := filepath.Abs(filename); err == nil {
+		if _, ok := seen[abs]; ok {
+			return nil
+		}
+		seen[abs] = struct{}{}
+	}
+
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return []string{fmt.Sprintf("%s: %s", filename, err)}
+	}
+
+	var raw struct {
+		Include []string `json:"Include"`
+	}
+	if err := json.Unmarshal(buf, &raw); err != nil {
+		return []string{fmt.Sprintf("%s: invalid JSON: %s", filename, err)}
+	}
+
+	var problems []string
+	for _, problem := range checkConfigValue("", buf, reflect.TypeOf(Config{})) {
+		problems = append(problems, filename+": "+problem)
+	}
+
+	dir := filepath.Dir(filename)
+	for _, inc := range raw.Include {
+		if !filepath.IsAbs(inc) {
+			inc = filepath.Join(dir, inc)
+		}
+		problems = append(problems, checkConfigFile(inc, seen)...)
+	}
+	return problems
+}
+
+// checkConfigValue checks that buf can be decoded as a value of type
+// t, and that objects only contain known keys. path is the location
+// of buf in the config file, such as "Hooks.OnAccept"
+func checkConfigValue(path string, buf json.RawMessage, t reflect.Type) []string {
+	var problems []string
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, path+": "+fmt.Sprintf(format, args...))
+	}
+
+	// Optional values are written the same way as the values that
+	// they point to
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == styleType:
+		var names []string
+		if err := json.Unmarshal(buf, &names); err != nil {
+			report("expected a list of colors and attributes, got %s", jsonKind(buf))
+			return problems
+		}
+		for _, name := range names {
+			if !isValidStyleString(name) {
+				report("unknown color or attribute '%s'", name)
+			}
+		}
+		return problems
+	case reflect.PtrTo(t).Implements(unmarshalerType):
+		if err := json.Unmarshal(buf, reflect.New(t).Interface()); err != nil {
+			report("%s", errors.Cause(err))
+		}
+		return problems
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal(buf, &m); err != nil {
+			report("expected object, got %s", jsonKind(buf))
+			return problems
+		}
+		for _, key := range sortedRawKeys(m) {
+			f, ok := configField(t, key)
+			if !ok {
+				problems = append(problems, joinConfigPath(path, key)+": unknown key")
+				continue
+			}
+			problems = append(problems, checkConfigValue(joinConfigPath(path, key), m[key], f.Type)...)
+		}
+	case reflect.Map:
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal(buf, &m); err != nil {
+			report("expected object, got %s", jsonKind(buf))
+			return problems
+		}
+		for _, key := range sortedRawKeys(m) {
+			problems = append(problems, checkConfigValue(joinConfigPath(path, key), m[key], t.Elem())...)
+		}
+	case reflect.Slice:
+		var l []json.RawMessage
+		if err := json.Unmarshal(buf, &l); err != nil {
+			report("expected array, got %s", jsonKind(buf))
+			return problems
+		}
+		for i, v := range l {
+			problems = append(problems, checkConfigValue(fmt.Sprintf("%s[%d]", path, i), v, t.Elem())...)
+		}
+	default:
+		if err := json.Unmarshal(buf, reflect.New(t).Interface()); err != nil {
+			report("expected %s, got %s", schemaType(t), jsonKind(buf))
+		}
+	}
+	return problems
+}
+
+// checkKeymap returns the key bindings in cfg whose keys cannot be
+// parsed, or whose actions do not exist
+func checkKeymap(cfg *Config) []string {
+	km := newConfigKeymap(cfg)
+
+	var problems []string
+	check := func(path string, keymap map[string]string) {
+		keys := make([]string, 0, len(keymap))
+		for key := range keymap {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if _, err := keyseq.ToKeyList(key); err != nil {
+				problems = append(problems, fmt.Sprintf("%s.%s: unknown key", path, key))
+				continue
+			}
+			if name := keymap[key]; name != "-" {
+				if _, err := km.resolveActionName(name, 0); err != nil {
+					problems = append(problems, fmt.Sprintf("%s.%s: %s", path, key, err))
+				}
+			}
+		}
+	}
+
+	check("Keymap", cfg.Keymap)
+	names := make([]string, 0, len(cfg.Layers))
+	for name := range cfg.Layers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		check("Layers."+name+".Keymap", cfg.Layers[name].Keymap)
+	}
+	return problems
+}
+
+// configSchema returns the JSON Schema of the config file, so that
+// editors can complete and check it
+func configSchema() map[string]interface{} {
+	schema := typeSchema(reflect.TypeOf(Config{}))
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "peco config file"
+	return schema
+}
+
+// typeSchema returns the JSON Schema of the values of type t
+func typeSchema(t reflect.Type) map[string]interface{} {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t {
+	case styleType:
+		names := make([]string, 0, len(stringToFg)+len(stringToBg)+len(stringToFgAttr)+len(stringToBgAttr))
+		for _, m := range []map[string]termbox.Attribute{stringToFg, stringToBg, stringToFgAttr, stringToBgAttr} {
+			for name := range m {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		return map[string]interface{}{
+			"type": "array",
+			"items": map[string]interface{}{
+				"anyOf": []interface{}{
+					map[string]interface{}{"enum": names},
+					map[string]interface{}{"type": "string", "pattern": "^(on_)?([0-9]+|#[0-9a-fA-F]{6})$"},
+				},
+			},
+		}
+	case actionConfigType:
+		return map[string]interface{}{
+			"oneOf": []interface{}{
+				map[string]interface{}{
+					"type":  "array",
+					"items": map[string]interface{}{"type": "string"},
+				},
+				map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"exec": typeSchema(commandConfigType),
+					},
+					"required":             []string{"exec"},
+					"additionalProperties": false,
+				},
+			},
+		}
+	case commandConfigType:
+		return map[string]interface{}{
+			"oneOf": []interface{}{
+				map[string]interface{}{"type": "string"},
+				map[string]interface{}{
+					"type":     "array",
+					"items":    map[string]interface{}{"type": "string"},
+					"minItems": 1,
+				},
+			},
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); f.PkgPath == "" {
+				properties[configFieldName(f)] = typeSchema(f.Type)
+			}
+		}
+		return map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": typeSchema(t.Elem()),
+		}
+	case reflect.Slice:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": typeSchema(t.Elem()),
+		}
+	}
+	return map[string]interface{}{"type": schemaType(t)}
+}
+
+// schemaType returns the JSON Schema type of the values of type t
+func schemaType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Struct, reflect.Map:
+		return "object"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	}
+	return "null"
+}
+
+// jsonKind describes the type of the JSON value in buf, for messages
+func jsonKind(buf json.RawMessage) string {
+	s := strings.TrimSpace(string(buf))
+	if s == "" {
+		return "nothing"
+	}
+	switch s[0] {
+	case '"':
+		return "string"
+	case '{':
+		return "object"
+	case '[':
+		return "array"
+	case 't', 'f':
+		return "boolean"
+	case 'n':
+		return "null"
+	}
+	return "number"
+}
+
+// configField returns the field of the struct type t that key is
+// decoded into. Like encoding/json, keys are matched case-insensitively
+func configField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath == "" && strings.EqualFold(configFieldName(f), key) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// configFieldName returns the key of the field f in the config file
+func configFieldName(f reflect.StructField) string {
+	if name := strings.Split(f.Tag.Get("json"), ",")[0]; name != "" {
+		return name
+	}
+	return f.Name
+}
+
+func joinConfigPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func sortedRawKeys(m map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
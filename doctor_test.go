@@ -0,0 +1,96 @@
+package peco
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/peco/peco/internal/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peco-doctor-")
+	if !assert.NoError(t, err, "creating temporary directory should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"config.json": `{
+			"Include": ["included.json"],
+			"Keymap": {"C-x": "peco.NoSuchAction", "C-y": "peco.SelectUp", "C-z": "myAction"},
+			"Action": {"myAction": ["peco.SelectDown"]},
+			"Style": {"Basic": ["redd", "on_blue"]},
+			"Hooks": {"OnAcept": "echo"},
+			"Layers": {"vi": {"Keymap": {"j": "peco.Bogus"}}},
+			"Filters": ["Fuzzy", "Fuzy"],
+			"Colors": "mono"
+		}`,
+		"included.json":  `{"Bogus": true}`,
+		"valid.json":     `{"keymap": {"C-j": "peco.Finish"}, "Style": {"Matched": ["#ff0000", "bold"]}}`,
+		"wrongtype.json": `{"MaxLineWidth": "80"}`,
+		"invalid.json":   `{"Keymap": `,
+	}
+	for name, content := range files {
+		if !assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644), "writing %s should succeed", name) {
+			return
+		}
+	}
+
+	config := filepath.Join(dir, "config.json")
+	included := filepath.Join(dir, "included.json")
+	expected := []string{
+		config + ": Hooks.OnAcept: unknown key",
+		config + ": Style.Basic: unknown color or attribute 'redd'",
+		included + ": Bogus: unknown key",
+		config + ": Keymap.C-x: could not resolve peco.NoSuchAction: no such action",
+		config + ": Layers.vi.Keymap.j: could not resolve peco.Bogus: no such action",
+		config + ": Filters: unknown filter 'Fuzy'",
+		config + ": Colors: unknown value 'mono'",
+	}
+	assert.Equal(t, expected, checkConfig(config), "problems should be reported")
+	assert.Empty(t, checkConfig(filepath.Join(dir, "valid.json")), "valid config should have no problems")
+	assert.Len(t, checkConfig(filepath.Join(dir, "invalid.json")), 1, "invalid JSON should be reported")
+
+	wrongtype := filepath.Join(dir, "wrongtype.json")
+	assert.Equal(t, []string{wrongtype + ": MaxLineWidth: expected integer, got string"}, checkConfig(wrongtype), "values of the wrong type should be reported once")
+
+	var out bytes.Buffer
+	state := New()
+	state.Argv = []string{"peco", "--rcfile", config, "doctor", "config"}
+	state.Stdout = &out
+	err = state.Setup()
+	if !assert.True(t, util.IsIgnorableError(err), "peco should exit after checking the config") {
+		return
+	}
+	st, _ := util.GetExitStatus(err)
+	assert.Equal(t, 1, st, "peco should exit with a failure if there are problems")
+	assert.Contains(t, out.String(), "Hooks.OnAcept: unknown key", "problems should be printed")
+}
+
+func TestConfigSchema(t *testing.T) {
+	schema := configSchema()
+	properties, ok := schema["properties"].(map[string]interface{})
+	if !assert.True(t, ok, "schema should describe the properties of the config") {
+		return
+	}
+
+	for key, typ := range map[string]string{
+		"Keymap":       "object",
+		"Layout":       "string",
+		"MaxLineWidth": "integer",
+		"SelectionBar": "boolean",
+		"Include":      "array",
+	} {
+		if !assert.Contains(t, properties, key, "schema should contain %s", key) {
+			continue
+		}
+		assert.Equal(t, typ, properties[key].(map[string]interface{})["type"], "type of %s", key)
+	}
+
+	style := properties["Style"].(map[string]interface{})["properties"].(map[string]interface{})
+	assert.Equal(t, "array", style["Basic"].(map[string]interface{})["type"], "styles should be lists")
+}
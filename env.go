@@ -0,0 +1,134 @@
+package peco
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/peco/peco/line"
+	"github.com/pkg/errors"
+)
+
+// newSessionID creates an identifier that is unique to each
+// invocation of peco, exposed to commands as PECO_SESSION
+func newSessionID() string {
+	return fmt.Sprintf("%d-%d", os.Getpid(), time.Now().UnixNano())
+}
+
+// commandEnv returns the environment for commands executed by peco,
+// which are --exec and custom filters. It is a copy of the current
+// environment, followed by the PECO_ variables describing the state
+// of peco, followed by the entries in Env from the config file.
+//
+// The names of these variables are stable:
+//
+//	PECO_QUERY: current query value
+//	PECO_FILENAME: input file name, if any. "-" for stdin
+//	PECO_INPUT: the --input that the line under the cursor was read
+//	from, if --input is specified
+//	PECO_LINE_COUNT: number of lines in the original input
+//	PECO_SELECTED_COUNT: number of lines currently selected
+//	PECO_FILTER: name of the current filter
+//	PECO_INDEX: index of the line under the cursor, starting from 0
+//	PECO_CURRENT_LINE: the line under the cursor, as it would be
+//	printed if it were selected
+//	PECO_CURRENT_INDEX: index of the line under the cursor in the
+//	original input, starting from 0
+//	PECO_CURRENT_RAW: the line under the cursor, as it was read. NUL
+//	characters are replaced with tabs, as they cannot be passed
+//	through the environment
+//	PECO_SESSION: identifier unique to this invocation of peco
+func (p *Peco) commandEnv() []string {
+	return append(os.Environ(), p.pecoEnv()...)
+}
+
+// pecoEnv returns the variables that commandEnv adds to the current
+// environment. Commands run by tmux do not inherit the environment of
+// peco, so only these are passed on to them
+func (p *Peco) pecoEnv() []string {
+	var env []string
+	if s, ok := p.Source().(*Source); ok && s != nil {
+		env = append(env,
+			`PECO_FILENAME=`+s.Name(),
+			`PECO_LINE_COUNT=`+strconv.Itoa(s.Size()),
+		)
+		if id, ok := currentLineID(p); ok && len(p.inputs) > 0 {
+			env = append(env, `PECO_INPUT=`+s.Origin(id))
+		}
+	}
+
+	env = append(env,
+		`PECO_QUERY=`+p.Query().String(),
+		`PECO_SELECTED_COUNT=`+strconv.Itoa(p.Selection().Len()),
+		`PECO_FILTER=`+p.Filters().Current().String(),
+		`PECO_INDEX=`+strconv.Itoa(p.Location().LineNumber()),
+	)
+	if l, err := p.CurrentLineBuffer().LineAt(p.Location().LineNumber()); err == nil {
+		env = append(env,
+			`PECO_CURRENT_LINE=`+envValue(l.Output()),
+			`PECO_CURRENT_INDEX=`+strconv.FormatUint(l.ID(), 10),
+			`PECO_CURRENT_RAW=`+envValue(l.Buffer()),
+		)
+	}
+	env = append(env, `PECO_SESSION=`+p.sessionID)
+
+	// Sort the names, so that the order does not change between runs
+	names := make([]string, 0, len(p.config.Env))
+	for name := range p.config.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, name+`=`+p.config.Env[name])
+	}
+	return env
+}
+
+// matchedIDsEnv returns the environment variables that list the IDs of
+// lines, the lines sent to a command, so that scripts can join them
+// with their own data. IDs are the indices of the lines in the input,
+// which stay the same whatever the query:
+//
+//	PECO_MATCHED_IDS: the IDs separated by spaces, unless there are
+//	more than maxMatchedIDsEnv lines
+//	PECO_MATCHED_IDS_FILE: a file that lists the IDs, one per line
+//
+// The returned function removes the file, once the command has exited
+func matchedIDsEnv(lines []line.Line) ([]string, func(), error) {
+	var buf bytes.Buffer
+	ids := make([]string, len(lines))
+	for i, l := range lines {
+		ids[i] = strconv.FormatUint(l.ID(), 10)
+		buf.WriteString(ids[i])
+		buf.WriteByte('\n')
+	}
+
+	f, err := ioutil.TempFile("", "peco-ids-")
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to create file for matched IDs")
+	}
+	remove := func() { os.Remove(f.Name()) }
+	_, err = f.Write(buf.Bytes())
+	f.Close()
+	if err != nil {
+		remove()
+		return nil, nil, errors.Wrap(err, "failed to write matched IDs")
+	}
+
+	env := []string{`PECO_MATCHED_IDS_FILE=` + f.Name()}
+	if len(ids) <= maxMatchedIDsEnv {
+		env = append(env, `PECO_MATCHED_IDS=`+strings.Join(ids, " "))
+	}
+	return env, remove, nil
+}
+
+// envValue makes s safe to use as the value of an environment
+// variable, which cannot contain NUL characters
+func envValue(s string) string {
+	return strings.Replace(s, "\x00", "\t", -1)
+}
@@ -0,0 +1,91 @@
+package peco
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/peco/peco/line"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandEnv(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	p := newPeco()
+	p.Argv = []string{"--query", "ba"}
+	p.Stdin = bytes.NewBufferString("foo\nbar\nbaz\n")
+	// Wait for the results of the query, so that the line under the
+	// cursor is known
+	startPeco(ctx, t, p, 3, 2)
+
+	p.config.Env = map[string]string{"FOO": "foo", "BAR": "bar"}
+	if l, err := p.source.LineAt(1); assert.NoError(t, err, "LineAt should succeed") {
+		p.Selection().Add(l)
+	}
+	p.Location().SetLineNumber(1)
+
+	env := p.commandEnv()
+	expected := []string{
+		"PECO_FILENAME=-",
+		"PECO_LINE_COUNT=3",
+		"PECO_QUERY=ba",
+		"PECO_SELECTED_COUNT=1",
+		"PECO_FILTER=IgnoreCase",
+		"PECO_INDEX=1",
+		"PECO_CURRENT_LINE=baz",
+		"PECO_CURRENT_INDEX=2",
+		"PECO_CURRENT_RAW=baz",
+		"PECO_SESSION=" + p.sessionID,
+		"BAR=bar",
+		"FOO=foo",
+	}
+	if !assert.True(t, len(env) >= len(expected), "environment should contain peco variables") {
+		return
+	}
+	assert.Equal(t, expected, env[len(env)-len(expected):], "peco variables should follow the current environment")
+	assert.NotEqual(t, newSessionID(), p.sessionID, "session should be unique")
+	assert.Equal(t, "foo\tbar", envValue("foo\x00bar"), "NUL characters should be replaced")
+}
+
+func TestMatchedIDsEnv(t *testing.T) {
+	lines := []line.Line{
+		line.NewRaw(3, "foo", false),
+		line.NewRaw(1, "bar", false),
+	}
+	env, remove, err := matchedIDsEnv(lines)
+	if !assert.NoError(t, err, "matchedIDsEnv should succeed") {
+		return
+	}
+	if !assert.Len(t, env, 2, "both variables should be set") {
+		return
+	}
+	assert.Equal(t, "PECO_MATCHED_IDS=3 1", env[1], "IDs should be listed in order")
+
+	filename := strings.TrimPrefix(env[0], "PECO_MATCHED_IDS_FILE=")
+	buf, err := ioutil.ReadFile(filename)
+	if !assert.NoError(t, err, "the file should be readable") {
+		return
+	}
+	assert.Equal(t, "3\n1\n", string(buf), "the file should list the IDs one per line")
+
+	remove()
+	_, err = os.Stat(filename)
+	assert.True(t, os.IsNotExist(err), "the file should be removed")
+
+	many := make([]line.Line, maxMatchedIDsEnv+1)
+	for i := range many {
+		many[i] = line.NewRaw(uint64(i), "foo", false)
+	}
+	env, remove, err = matchedIDsEnv(many)
+	if !assert.NoError(t, err, "matchedIDsEnv should succeed") {
+		return
+	}
+	defer remove()
+	assert.Len(t, env, 1, "too many IDs should only be listed in the file")
+}
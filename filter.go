@@ -1,7 +1,11 @@
 package peco
 
 import (
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"context"
@@ -10,24 +14,34 @@ import (
 	"github.com/peco/peco/filter"
 	"github.com/peco/peco/hub"
 	"github.com/peco/peco/internal/buffer"
+	"github.com/peco/peco/internal/i18n"
 	"github.com/peco/peco/line"
 	"github.com/peco/peco/pipeline"
 )
 
-func newFilterProcessor(f filter.Filter, q string) *filterProcessor {
+func newFilterProcessor(f filter.Filter, q string, pool *workerPool, hidden *HiddenLines) *filterProcessor {
 	return &filterProcessor{
 		filter: f,
 		query:  q,
+		pool:   pool,
+		hidden: hidden,
 	}
 }
 
 func (fp *filterProcessor) Accept(ctx context.Context, in chan interface{}, out pipeline.ChanOutput) {
-	acceptAndFilter(ctx, fp.filter, in, out)
+	acceptAndFilter(ctx, fp.filter, fp.pool, fp.hidden, in, out)
+}
+
+// isConcurrent returns true if f can be applied to several chunks of
+// lines at the same time
+func isConcurrent(f filter.Filter) bool {
+	c, ok := f.(filter.Concurrent)
+	return ok && c.Concurrent()
 }
 
 // This flusher is run in a separate goroutine so that the filter can
 // run separately from accepting incoming messages
-func flusher(ctx context.Context, f filter.Filter, incoming chan []line.Line, done chan struct{}, out pipeline.ChanOutput) {
+func flusher(ctx context.Context, f filter.Filter, pool *workerPool, incoming chan []line.Line, done chan struct{}, out pipeline.ChanOutput) {
 	if pdebug.Enabled {
 		g := pdebug.Marker("flusher goroutine")
 		defer g.End()
@@ -36,25 +50,115 @@ func flusher(ctx context.Context, f filter.Filter, incoming chan []line.Line, do
 	defer close(done)
 	defer out.SendEndMark("end of filter")
 
+	if pool != nil && isConcurrent(f) {
+		flushConcurrently(ctx, f, pool, incoming, out)
+		return
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case buf, ok := <-incoming:
 			if !ok {
+				if fin, ok := f.(filter.Finisher); ok {
+					fin.Finish(ctx, out)
+				}
 				return
 			}
 			pdebug.Printf("flusher: %#v", buf)
+			started := time.Now()
 			f.Apply(ctx, buf, out)
+			traceFilteredChunk(ctx, len(buf), started)
 			buffer.ReleaseLineListBuf(buf)
 		}
 	}
 }
 
-func acceptAndFilter(ctx context.Context, f filter.Filter, in chan interface{}, out pipeline.ChanOutput) {
+// flushConcurrently applies f to each chunk of lines on a goroutine
+// from pool, so that several chunks are filtered at the same time.
+// The results of each chunk are collected, and sent to out in the
+// order that the chunks came in, so that the order of the lines is
+// preserved
+func flushConcurrently(ctx context.Context, f filter.Filter, pool *workerPool, incoming chan []line.Line, out pipeline.ChanOutput) {
+	// Holds the results of the chunks that are being filtered, in
+	// order. Its capacity limits how far filtering can run ahead of
+	// sending the results
+	pending := make(chan chan []interface{}, pool.Size())
+	emitted := make(chan struct{})
+	go func() {
+		defer close(emitted)
+		for results := range pending {
+			select {
+			case <-ctx.Done():
+				return
+			case vs := <-results:
+				for _, v := range vs {
+					out.Send(v)
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	wait := func() {
+		once.Do(func() {
+			close(pending)
+			<-emitted
+		})
+	}
+	defer wait()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case buf, ok := <-incoming:
+			if !ok {
+				// Wait for the remaining results to be sent
+				wait()
+				if fin, ok := f.(filter.Finisher); ok {
+					fin.Finish(ctx, out)
+				}
+				return
+			}
+
+			results := make(chan []interface{}, 1)
+			select {
+			case <-ctx.Done():
+				return
+			case pending <- results:
+			}
+
+			job := func() {
+				// f sends at most one result per line, so this never blocks
+				started := time.Now()
+				ch := make(chan interface{}, len(buf))
+				f.Apply(ctx, buf, pipeline.ChanOutput(ch))
+				close(ch)
+				traceFilteredChunk(ctx, len(buf), started)
+
+				vs := make([]interface{}, 0, len(ch))
+				for v := range ch {
+					vs = append(vs, v)
+				}
+				buffer.ReleaseLineListBuf(buf)
+				results <- vs
+			}
+			if !pool.Submit(ctx, job) {
+				return
+			}
+		}
+	}
+}
+
+// acceptAndFilter applies f to the lines received from in, in chunks,
+// and sends the results to out. Lines in hidden, if any, are dropped
+// without being filtered
+func acceptAndFilter(ctx context.Context, f filter.Filter, pool *workerPool, hidden *HiddenLines, in chan interface{}, out pipeline.ChanOutput) {
 	flush := make(chan []line.Line)
 	flushDone := make(chan struct{})
-	go flusher(ctx, f, flush, flushDone, out)
+	go flusher(ctx, f, pool, flush, flushDone, out)
 
 	buf := buffer.GetLineListBuf()
 	bufsiz := f.BufSize()
@@ -64,8 +168,19 @@ func acceptAndFilter(ctx context.Context, f filter.Filter, in chan interface{},
 	defer func() { <-flushDone }() // Wait till the flush goroutine is done
 	defer close(flush)             // Kill the flush goroutine
 
-	flushTicker := time.NewTicker(50 * time.Millisecond)
-	defer flushTicker.Stop()
+	interval := filter.DefaultFlushInterval
+	if fi, ok := f.(filter.FlushIntervaler); ok {
+		interval = fi.FlushInterval()
+	}
+
+	// A nil channel is never ready, so a non-positive interval
+	// disables time based flushing altogether
+	var flushTickerC <-chan time.Time
+	if interval > 0 {
+		flushTicker := time.NewTicker(interval)
+		defer flushTicker.Stop()
+		flushTickerC = flushTicker.C
+	}
 
 	start := time.Now()
 	lines := 0
@@ -76,7 +191,7 @@ func acceptAndFilter(ctx context.Context, f filter.Filter, in chan interface{},
 				pdebug.Printf("filter received done")
 			}
 			return
-		case <-flushTicker.C:
+		case <-flushTickerC:
 			if len(buf) > 0 {
 				flush <- buf
 				buf = buffer.GetLineListBuf()
@@ -99,6 +214,9 @@ func acceptAndFilter(ctx context.Context, f filter.Filter, in chan interface{},
 					pdebug.Printf("incoming line")
 					lines++
 				}
+				if hidden != nil && hidden.Has(v.(line.Line).ID()) {
+					continue
+				}
 				// We buffer the lines so that we can receive more lines to
 				// process while we filter what we already have. The buffer
 				// size is fairly big, because this really only makes a
@@ -116,11 +234,12 @@ func acceptAndFilter(ctx context.Context, f filter.Filter, in chan interface{},
 func NewFilter(state *Peco) *Filter {
 	return &Filter{
 		state: state,
+		pool:  newWorkerPool(0),
 	}
 }
 
 // Work is the actual work horse that that does the matching
-// in a goroutine of its own. It wraps Matcher.Match().
+// in a goroutine of its own. It wraps filter.Filter.Apply().
 func (f *Filter) Work(ctx context.Context, q hub.Payload) {
 	defer q.Done()
 
@@ -135,46 +254,150 @@ func (f *Filter) Work(ctx context.Context, q hub.Payload) {
 	}
 
 	state := f.state
+	anchor := anchorCursor(ctx, state)
 	if query == "" {
+		state.setQueryError(ctx, nil)
 		state.ResetCurrentLineBuffer()
+		restoreCursor(ctx, state, state.CurrentLineBuffer(), anchor)
 		if !state.config.StickySelection {
 			state.Selection().Reset()
 		}
 		return
 	}
 
+	atomic.AddInt32(&state.runningQueries, 1)
+	defer atomic.AddInt32(&state.runningQueries, -1)
+
 	// Create a new pipeline
 	p := pipeline.New()
-	p.SetSource(state.Source())
+	p.SetSource(state.filterSource())
 
 	// Wraps the actual filter
 	selectedFilter := state.Filters().Current()
+	if n := state.matchColumn; n > 0 {
+		// Custom filters emit the output of their command, which
+		// would only contain the column, so they are left alone
+		if _, ok := selectedFilter.(*filter.ExternalCmd); !ok {
+			selectedFilter = newColumnFilter(selectedFilter, n, state.columnDelimiter)
+		}
+	}
+
+	// Keep the previous results on screen while the query is invalid,
+	// which is usually only until the user finishes typing it
+	if v, ok := selectedFilter.(filter.Validator); ok {
+		if err := v.Validate(query); err != nil {
+			state.setQueryError(ctx, err)
+			state.Hub().SendDrawPrompt(ctx)
+			return
+		}
+	}
+	state.setQueryError(ctx, nil)
+
 	ctx = selectedFilter.NewContext(ctx, query)
-	p.Add(newFilterProcessor(selectedFilter, query))
+	p.Add(newFilterProcessor(selectedFilter, query, f.pool, state.HiddenLines()))
 
 	buf := NewMemoryBuffer()
 	p.SetDestination(buf)
-	state.SetCurrentLineBuffer(buf)
+	p.SetTracer(state.tracer)
+	started := state.queryStarted()
+
+	// Pipeline.Done blocks while the pipeline is running, so get
+	// hold of the channel before starting it
+	done := p.Done()
+
+	// Don't return until the goroutines below are done, so that once
+	// the query payload is marked as done, all related draw requests
+	// have been queued
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	// Queries on inputs that are still being read run until the input
+	// ends, so they say nothing about how long queries take
+	src := state.inputSource()
+	timed := src != nil && !src.IsInfinite()
 
+	wg.Add(2)
 	go func(ctx context.Context) {
-		defer state.Hub().SendDraw(ctx, &DrawOptions{RunningQuery: true})
+		defer wg.Done()
+		begin := time.Now()
 		if err := p.Run(ctx); err != nil {
-			state.Hub().SendStatusMsg(ctx, err.Error())
+			state.SendStatus(ctx, StatusError, err.Error())
+			return
+		}
+		if timed && ctx.Err() == nil {
+			state.recordQueryDuration(time.Since(begin))
 		}
 	}(ctx)
 
 	go func() {
+		defer wg.Done()
 		if pdebug.Enabled {
 			g := pdebug.Marker("Periodic draw request for '%s'", query)
 			defer g.End()
 		}
+
+		// Keep the results of the previous query on screen until
+		// either this query is done, or it has exceeded the latency
+		// budget. In the latter case, the partial results are shown
+		// while the rest of the lines are being filtered
+		var finished bool
+		if budget := state.QueryLatencyBudget(); budget > 0 {
+			timer := time.NewTimer(budget)
+			select {
+			case <-done:
+				finished = true
+			case <-timer.C:
+				if pdebug.Enabled {
+					pdebug.Printf("query '%s' exceeded latency budget of %s", query, budget)
+				}
+			}
+			timer.Stop()
+		} else {
+			select {
+			case <-done:
+				finished = true
+			default:
+			}
+		}
+		if ctx.Err() != nil {
+			// This query has been superseded by another one
+			return
+		}
+
+		// If the results are the same as the ones on screen (e.g. a
+		// space was appended to the query), there is nothing to redraw
+		// but the prompt. Unless selections are sticky, they are reset
+		// after the query, which does need a redraw
+		if finished && f.unchanged(state.CurrentLineBuffer(), buf) && (state.config.StickySelection || state.Selection().Len() == 0) {
+			if pdebug.Enabled {
+				pdebug.Printf("results for '%s' are unchanged, skipping redraw", query)
+			}
+			state.SendStatus(ctx, StatusInfo, "")
+			state.Hub().SendDrawPrompt(ctx)
+			return
+		}
+		state.SetCurrentLineBuffer(buf)
+		displayed := state.CurrentLineBuffer() // buf, possibly decorated
+		state.showResults(displayed)
+		if t := state.tracer; t != nil {
+			t.OnBufferSwap(ctx, buf.Size())
+		}
+		if finished {
+			restoreCursor(ctx, state, displayed, anchor)
+		}
+		state.Hub().SendDraw(ctx, &DrawOptions{RunningQuery: true, queryStartedAt: started})
+
 		t := time.NewTicker(5 * time.Millisecond)
 		defer t.Stop()
-		defer state.Hub().SendStatusMsg(ctx, "")
+		defer state.SendStatus(ctx, StatusInfo, "")
 		defer state.Hub().SendDraw(ctx, &DrawOptions{RunningQuery: true})
 		for {
 			select {
-			case <-p.Done():
+			case <-done:
+				f.remember(displayed, buf)
+				if !finished {
+					restoreCursor(ctx, state, displayed, anchor)
+				}
 				return
 			case <-t.C:
 				state.Hub().SendDraw(ctx, &DrawOptions{RunningQuery: true})
@@ -182,11 +405,142 @@ func (f *Filter) Work(ctx context.Context, q hub.Payload) {
 		}
 	}()
 
-	<-p.Done()
+	<-done
 
 	if !state.config.StickySelection {
 		state.Selection().Reset()
 	}
+
+	// The status is cleared once the results have been drawn, so wait
+	// for that before explaining why there are none
+	if buf.Size() == 0 && state.config.TermMatchCounts {
+		wg.Wait()
+		state.reportTermMatchCounts(ctx, selectedFilter, query)
+	}
+}
+
+// anchorCursor has the view remember the line under the cursor in the
+// buffer that is displayed. It waits for the view, as the buffer is
+// released once it is replaced. The returned anchor belongs to the
+// view goroutine, and must only be passed on to restoreCursor
+func anchorCursor(ctx context.Context, state *Peco) *cursorAnchor {
+	a := &cursorAnchor{}
+	req := anchorCursorRequest{anchor: a, buffer: state.CurrentLineBuffer()}
+	state.Hub().Batch(ctx, func(ctx context.Context) {
+		state.Hub().SendPaging(ctx, req)
+	}, false)
+	return a
+}
+
+// restoreCursor has the view move the cursor to the line in b that was
+// under it when a was taken. Paging requests are handled in the order
+// that they are sent, so a has been filled in by then
+func restoreCursor(ctx context.Context, state *Peco, b Buffer, a *cursorAnchor) {
+	state.Hub().SendPaging(ctx, restoreCursorRequest{anchor: a, buffer: b})
+}
+
+// nearestLineIndex returns the index of the line in b whose ID is id,
+// or else the one whose ID is closest to id. It returns -1 if there
+// is no line that the cursor can be moved to
+func nearestLineIndex(b Buffer, id uint64) int {
+	if n, ok := searchLineIndex(b, id); ok {
+		return n
+	}
+
+	nearest := -1
+	var min uint64
+	for i := 0; i < b.Size(); i++ {
+		l, err := b.LineAt(i)
+		if err != nil || isGroupHeader(l) {
+			continue
+		}
+
+		d := l.ID() - id
+		if l.ID() < id {
+			d = id - l.ID()
+		}
+		if d == 0 {
+			return i
+		}
+		if nearest < 0 || d < min {
+			nearest, min = i, d
+		}
+	}
+	return nearest
+}
+
+// searchLineIndex is the fast path of nearestLineIndex, for when the
+// line is still there. Most results are in the order of the input, so
+// the line is looked for with a binary search. The result is only
+// trusted if the line is found, as the lines of some buffers, such as
+// sorted ones, are in a different order
+func searchLineIndex(b Buffer, id uint64) (int, bool) {
+	i := sort.Search(b.Size(), func(i int) bool {
+		l, err := b.LineAt(i)
+		return err != nil || l.ID() >= id
+	})
+	if l, err := b.LineAt(i); err == nil && l.ID() == id && !isGroupHeader(l) {
+		return i, true
+	}
+	return -1, false
+}
+
+// fingerprint returns a hash of the lines in b, along with their
+// matches, which is used to tell if the results of two queries would
+// be displayed the same way
+func fingerprint(b Buffer) uint64 {
+	h := fnv.New64a()
+	var tmp [8]byte
+	write := func(v uint64) {
+		binary.LittleEndian.PutUint64(tmp[:], v)
+		h.Write(tmp[:])
+	}
+
+	write(uint64(b.Size()))
+	for i := 0; i < b.Size(); i++ {
+		l, err := b.LineAt(i)
+		if err != nil {
+			continue
+		}
+		write(l.ID())
+
+		mi, ok := l.(MatchIndexer)
+		if !ok {
+			continue
+		}
+		matches := mi.Indices()
+		write(uint64(len(matches)))
+		ti, hasTerms := l.(MatchTermIndexer)
+		for n, m := range matches {
+			write(uint64(m[0]))
+			write(uint64(m[1]))
+			if hasTerms {
+				write(uint64(ti.Term(n)))
+			}
+		}
+	}
+	return h.Sum64()
+}
+
+// remember records displayed as the buffer that is displayed for the
+// last query, whose complete results are in buf
+func (f *Filter) remember(displayed, buf Buffer) {
+	fp := fingerprint(buf)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.last = displayed
+	f.lastFingerprint = fp
+}
+
+// unchanged returns true if current is the buffer displayed for the
+// last query, and buf has the same results
+func (f *Filter) unchanged(current, buf Buffer) bool {
+	f.mutex.Lock()
+	last, lastFingerprint := f.last, f.lastFingerprint
+	f.mutex.Unlock()
+
+	return last != nil && last == current && lastFingerprint == fingerprint(buf)
 }
 
 // Loop keeps watching for incoming queries, and upon receiving
@@ -196,6 +550,16 @@ func (f *Filter) Work(ctx context.Context, q hub.Payload) {
 func (f *Filter) Loop(ctx context.Context, cancel func()) error {
 	defer cancel()
 
+	// The workers are shared by all queries, instead of being
+	// started for each one of them
+	f.pool.Run(ctx)
+	defer f.pool.Wait()
+
+	// Queries that are still running are waited for, so that none of
+	// them touches the screen once peco has exited
+	var works sync.WaitGroup
+	defer works.Wait()
+
 	// previous holds the function that can cancel the previous
 	// query. This is used when multiple queries come in succession
 	// and the previous query is discarded anyway
@@ -218,9 +582,13 @@ func (f *Filter) Loop(ctx context.Context, cancel func()) error {
 			previous = workcancel
 			mutex.Unlock()
 
-			f.state.Hub().SendStatusMsg(ctx, "Running query...")
+			f.state.SendStatus(ctx, StatusInfo, i18n.T("Running query..."))
 
-			go f.Work(workctx, q)
+			works.Add(1)
+			go func() {
+				defer works.Done()
+				f.Work(workctx, q)
+			}()
 		}
 	}
 }
@@ -0,0 +1,187 @@
+package filter
+
+import (
+	"context"
+	"strings"
+
+	"github.com/peco/peco/line"
+	"github.com/peco/peco/pipeline"
+	"github.com/pkg/errors"
+)
+
+// NewComposite creates a new filter that matches each term of the
+// query with the filter selected by the term's prefix, and only
+// outputs lines that are matched by all of the terms. For example,
+// the query "re:^ERROR fz:conlog" matches lines that begin with ERROR
+// using the Regexp filter, and that contain "conlog" using the Fuzzy
+// filter. Terms without a prefix use the IgnoreCase filter.
+//
+// The prefixes are "re:" (Regexp), "fz:" (Fuzzy), "ic:" (IgnoreCase),
+// "cs:" (CaseSensitive) and "sc:" (SmartCase)
+func NewComposite(sortLongest bool) *Composite {
+	return &Composite{
+		filters: map[string]Filter{
+			"re:": NewRegexp(),
+			"fz:": NewFuzzy(sortLongest),
+			"ic:": NewIgnoreCase(),
+			"cs:": NewCaseSensitive(),
+			"sc:": NewSmartCase(),
+		},
+		defaultFilter: NewIgnoreCase(),
+	}
+}
+
+func (cf *Composite) BufSize() int {
+	return 0
+}
+
+func (cf *Composite) NewContext(ctx context.Context, query string) context.Context {
+	return newContext(ctx, query)
+}
+
+// Concurrent implements the Concurrent interface
+func (cf *Composite) Concurrent() bool {
+	return true
+}
+
+func (cf *Composite) String() string {
+	return "Composite"
+}
+
+// Terms returns the terms of query, along with their prefixes
+func (cf *Composite) Terms(query string) []string {
+	var terms []string
+	for _, s := range strings.Fields(query) {
+		if _, ok := cf.filters[s]; ok {
+			// Only a prefix, as in parse
+			continue
+		}
+		terms = append(terms, s)
+		if len(terms) >= MaxTerms {
+			break
+		}
+	}
+	return terms
+}
+
+// CountTerms returns the number of terms in query, not counting
+// prefixes alone
+func (cf *Composite) CountTerms(query string) int {
+	var n int
+	for _, s := range strings.Fields(query) {
+		if _, ok := cf.filters[s]; !ok {
+			n++
+		}
+	}
+	return n
+}
+
+// compositeTerm is a term in the query, along with the filter that
+// it is matched with
+type compositeTerm struct {
+	filter Filter
+	query  string
+}
+
+// parse splits query into terms
+func (cf *Composite) parse(query string) []compositeTerm {
+	var terms []compositeTerm
+	for _, s := range strings.Fields(query) {
+		f := cf.defaultFilter
+		for prefix, pf := range cf.filters {
+			if strings.HasPrefix(s, prefix) {
+				f = pf
+				s = strings.TrimPrefix(s, prefix)
+				break
+			}
+		}
+
+		// Skip terms that only consist of a prefix, which is what
+		// the query looks like while the user is typing
+		if s == "" {
+			continue
+		}
+		terms = append(terms, compositeTerm{filter: f, query: s})
+		if len(terms) >= MaxTerms {
+			break
+		}
+	}
+	return terms
+}
+
+// applyTerm returns the matches of the lines that match t, keyed by
+// the ID of the line
+func applyTerm(ctx context.Context, t compositeTerm, lines []line.Line) (map[uint64][][]int, error) {
+	ch := make(chan interface{})
+	errCh := make(chan error, 1)
+	go func() {
+		defer close(ch)
+		errCh <- t.filter.Apply(t.filter.NewContext(ctx, t.query), lines, pipeline.ChanOutput(ch))
+	}()
+
+	matched := make(map[uint64][][]int)
+	for v := range ch {
+		l, ok := v.(line.Line)
+		if !ok {
+			continue
+		}
+		var indices [][]int
+		if ml, ok := l.(*line.Matched); ok {
+			indices = ml.Indices()
+		}
+		matched[l.ID()] = indices
+	}
+	return matched, <-errCh
+}
+
+// Validate returns an error if any of the terms of query is rejected
+// by the filter that it is matched with
+func (cf *Composite) Validate(query string) error {
+	for _, t := range cf.parse(query) {
+		v, ok := t.filter.(Validator)
+		if !ok {
+			continue
+		}
+		if err := v.Validate(t.query); err != nil {
+			return errors.Wrapf(err, "invalid term '%s'", t.query)
+		}
+	}
+	return nil
+}
+
+func (cf *Composite) Apply(ctx context.Context, lines []line.Line, out pipeline.ChanOutput) error {
+	terms := cf.parse(ctx.Value(queryKey).(string))
+
+	results := make([]map[uint64][][]int, len(terms))
+	for i, t := range terms {
+		matched, err := applyTerm(ctx, t, lines)
+		if err != nil {
+			return errors.Wrapf(err, "failed to apply filter %s to '%s'", t.filter, t.query)
+		}
+		results[i] = matched
+	}
+
+LINE:
+	for _, l := range lines {
+		matches := [][]int{}
+		termIndices := []int{}
+		for i, matched := range results {
+			m, ok := matched[l.ID()]
+			if !ok {
+				continue LINE
+			}
+			matches = append(matches, m...)
+			for range m {
+				termIndices = append(termIndices, i)
+			}
+		}
+
+		if len(matches) == 0 {
+			out.Send(line.NewMatched(l, nil))
+			continue
+		}
+		deduped, dedupedTerms := dedupeMatches(matches, termIndices)
+		out.Send(line.NewMatchedTerms(l, deduped, dedupedTerms))
+	}
+	return nil
+}
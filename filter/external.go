@@ -4,7 +4,10 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"io"
 	"os/exec"
+	"strings"
+	"time"
 
 	pdebug "github.com/lestrrat-go/pdebug"
 	"github.com/peco/peco/line"
@@ -27,6 +30,7 @@ func NewExternalCmd(name string, cmd string, args []string, threshold int, idgen
 		args:            args,
 		cmd:             cmd,
 		enableSep:       enableSep,
+		flushInterval:   DefaultFlushInterval,
 		idgen:           idgen,
 		name:            name,
 		outCh:           pipeline.ChanOutput(make(chan interface{})),
@@ -34,15 +38,111 @@ func NewExternalCmd(name string, cmd string, args []string, threshold int, idgen
 	}
 }
 
-func (ecf ExternalCmd) BufSize() int {
+func (ecf *ExternalCmd) BufSize() int {
 	return ecf.thresholdBufsiz
 }
 
+// SetFlushInterval sets how often the command is invoked with the
+// lines buffered so far, even if BufferThreshold lines have not been
+// buffered yet. A non-positive value disables time based invocation
+func (ecf *ExternalCmd) SetFlushInterval(d time.Duration) {
+	ecf.flushInterval = d
+}
+
+func (ecf *ExternalCmd) FlushInterval() time.Duration {
+	return ecf.flushInterval
+}
+
+// SetEnv sets the function that returns the environment of the
+// command. It is called every time the command is executed. If it is
+// not set, the command inherits the environment of peco
+func (ecf *ExternalCmd) SetEnv(f func() []string) {
+	ecf.env = f
+}
+
+// SetStderr sets the function that receives each line that the command
+// writes to its standard error, as well as errors starting the
+// command, prefixed by the name of the filter. If it is not set, these
+// are discarded
+func (ecf *ExternalCmd) SetStderr(f func(string)) {
+	ecf.stderr = f
+}
+
+// report passes msg to the function set by SetStderr, if any
+func (ecf *ExternalCmd) report(msg string) {
+	if ecf.stderr != nil {
+		ecf.stderr(ecf.name + ": " + msg)
+	}
+}
+
+// SetIncremental enables or disables incremental mode. In incremental
+// mode, the command is started once per query, and lines are written
+// to its standard input as they become available, instead of starting
+// the command again for every BufferThreshold lines
+func (ecf *ExternalCmd) SetIncremental(b bool) {
+	ecf.incremental = b
+}
+
 func (ecf *ExternalCmd) NewContext(ctx context.Context, query string) context.Context {
-	return newContext(ctx, query)
+	ctx = newContext(ctx, query)
+	if ecf.incremental {
+		ctx = context.WithValue(ctx, externalSessionKey{}, &externalSession{done: make(chan struct{})})
+	}
+	return ctx
 }
 
-func (ecf ExternalCmd) String() string {
+// command creates the command to be executed for query
+func (ecf *ExternalCmd) command(query string) *exec.Cmd {
+	args := append([]string(nil), ecf.args...)
+	for i, v := range args {
+		if v == "$QUERY" {
+			args[i] = query
+		}
+	}
+
+	cmd := exec.Command(ecf.cmd, args...)
+	setProcessGroup(cmd)
+	if ecf.env != nil {
+		cmd.Env = ecf.env()
+	}
+	if ecf.stderr != nil {
+		cmd.Stderr = &lineWriter{emit: ecf.report}
+	}
+	return cmd
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.emitLine(w.buf[:i])
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush emits what has been written after the last newline
+func (w *lineWriter) Flush() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.emitLine(w.buf)
+	w.buf = nil
+}
+
+func (w *lineWriter) emitLine(b []byte) {
+	if s := strings.TrimSpace(string(b)); s != "" {
+		w.emit(s)
+	}
+}
+
+func (ecf *ExternalCmd) String() string {
 	return ecf.name
 }
 
@@ -59,15 +159,11 @@ func (ecf *ExternalCmd) Apply(ctx context.Context, buf []line.Line, out pipeline
 		defer g.End()
 	}
 
-	query := ctx.Value(queryKey).(string)
-	args := append([]string(nil), ecf.args...)
-	for i, v := range args {
-		if v == "$QUERY" {
-			args[i] = query
-		}
+	if s, ok := ctx.Value(externalSessionKey{}).(*externalSession); ok {
+		return ecf.applyIncremental(ctx, s, buf, out)
 	}
 
-	cmd := exec.Command(ecf.cmd, args...)
+	cmd := ecf.command(ctx.Value(queryKey).(string))
 	if pdebug.Enabled {
 		pdebug.Printf("Executing command %s %v", cmd.Path, cmd.Args)
 	}
@@ -85,56 +181,160 @@ func (ecf *ExternalCmd) Apply(ctx context.Context, buf []line.Line, out pipeline
 
 	err = cmd.Start()
 	if err != nil {
+		ecf.report(err.Error())
 		return errors.Wrap(err, `failed to start command`)
 	}
 
-	go cmd.Wait()
-
+	// Lines are sent as soon as the command prints them, so that slow
+	// commands show results early
 	cmdCh := make(chan line.Line)
-	go func(ctx context.Context, cmdCh chan line.Line, rdr *bufio.Reader) {
-		defer func() { recover() }()
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
 		defer close(cmdCh)
-		for {
+		ecf.readLines(r, func(l line.Line) bool {
 			select {
+			case cmdCh <- l:
+				return true
 			case <-ctx.Done():
-				return
-			default:
+				return false
 			}
-
-			b, _, err := rdr.ReadLine()
-			if len(b) > 0 {
-				// TODO: need to redo the spec for custom matchers
-				// This is the ONLY location where we need to actually
-				// RECREATE a Raw, and thus the only place where
-				// ctx.enableSep is required.
-				select {
-				case cmdCh <- line.NewRaw(ecf.idgen.Next(), string(b), ecf.enableSep):
-				case <-ctx.Done():
-					return
-				}
-			}
-			if err != nil {
-				return
-			}
-		}
-	}(ctx, cmdCh, bufio.NewReader(r))
-
-	defer func() {
-		if p := cmd.Process; p != nil {
-			p.Kill()
-		}
+		})
 	}()
+	go waitCommand(ctx, cmd, readDone)
 
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
 		case l, ok := <-cmdCh:
-			if l == nil || !ok {
+			if !ok {
 				return nil
 			}
 			out.Send(l)
 		}
 	}
+}
+
+// readLines reads the output of the command from r, and passes each
+// line to emit until either r is exhausted, or emit returns false
+func (ecf *ExternalCmd) readLines(r io.Reader, emit func(line.Line) bool) {
+	rdr := bufio.NewReader(r)
+	for {
+		s, err := rdr.ReadString('\n')
+		s = strings.TrimSuffix(strings.TrimSuffix(s, "\n"), "\r")
+		if len(s) > 0 {
+			// TODO: need to redo the spec for custom matchers
+			// This is the ONLY location where we need to actually
+			// RECREATE a Raw, and thus the only place where
+			// ctx.enableSep is required.
+			if !emit(line.NewRaw(ecf.idgen.Next(), s, ecf.enableSep)) {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// waitCommand reaps cmd once all of its output has been read, as
+// signaled by closing readDone. If ctx is canceled before that, e.g.
+// because the query has changed, the command is killed right away
+func waitCommand(ctx context.Context, cmd *exec.Cmd, readDone chan struct{}) {
+	select {
+	case <-ctx.Done():
+	case <-readDone:
+	}
+	// Both may be ready by then, and select picks either of them. The
+	// command still has to be killed, as it may keep running after
+	// closing its output
+	if ctx.Err() != nil {
+		killCommand(cmd)
+	}
+	cmd.Wait()
+
+	// Wait returns once all of the standard error has been copied
+	if w, ok := cmd.Stderr.(*lineWriter); ok {
+		w.Flush()
+	}
+}
+
+// applyIncremental writes buf to the command that is kept running
+// for the current query, starting it if necessary. The output of the
+// command is sent to out as it is read
+func (ecf *ExternalCmd) applyIncremental(ctx context.Context, s *externalSession, buf []line.Line, out pipeline.ChanOutput) error {
+	s.once.Do(func() {
+		s.err = ecf.startSession(ctx, s, out)
+	})
+	if s.err != nil {
+		return s.err
+	}
+
+	inbuf := &bytes.Buffer{}
+	for _, l := range buf {
+		inbuf.WriteString(l.DisplayString() + "\n")
+	}
+
+	if _, err := s.stdin.Write(inbuf.Bytes()); err != nil {
+		return errors.Wrap(err, `failed to write to command`)
+	}
+	return nil
+}
+
+func (ecf *ExternalCmd) startSession(ctx context.Context, s *externalSession, out pipeline.ChanOutput) error {
+	cmd := ecf.command(ctx.Value(queryKey).(string))
+	if pdebug.Enabled {
+		pdebug.Printf("Executing command %s %v (incremental)", cmd.Path, cmd.Args)
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return errors.Wrap(err, `failed to get stdin pipe`)
+	}
+
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return errors.Wrap(err, `failed to get stdout pipe`)
+	}
+
+	if err := cmd.Start(); err != nil {
+		ecf.report(err.Error())
+		return errors.Wrap(err, `failed to start command`)
+	}
+	s.cmd = cmd
+	s.stdin = stdin
+
+	go func() {
+		defer close(s.done)
+		ecf.readLines(r, func(l line.Line) bool {
+			if ctx.Err() != nil {
+				return false
+			}
+			out.Send(l)
+			return true
+		})
+	}()
+	go waitCommand(ctx, cmd, s.done)
+	return nil
+}
+
+// Finish tells the command that is kept running in incremental mode
+// that there are no more lines, and waits until all of its output has
+// been sent to out
+func (ecf *ExternalCmd) Finish(ctx context.Context, out pipeline.ChanOutput) error {
+	s, ok := ctx.Value(externalSessionKey{}).(*externalSession)
+	if !ok || s.stdin == nil {
+		return nil
+	}
+
+	if err := s.stdin.Close(); err != nil {
+		return errors.Wrap(err, `failed to close stdin`)
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-s.done:
+	}
 	return nil
 }
@@ -0,0 +1,177 @@
+package filter
+
+import (
+	"context"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/peco/peco/line"
+	"github.com/peco/peco/pipeline"
+	"github.com/stretchr/testify/assert"
+)
+
+type testIDGen struct {
+	id uint64
+}
+
+func (g *testIDGen) Next() uint64 {
+	g.id++
+	return g.id
+}
+
+func TestExternalCmdIncremental(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires /bin/sh")
+	}
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("requires /bin/sh")
+	}
+
+	run := func(incremental bool) []string {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		// The command prints "start" once each time it is invoked
+		f := NewExternalCmd("test", "sh", []string{"-c", `echo start; grep "$0"`, "$QUERY"}, 2, &testIDGen{}, false)
+		f.SetIncremental(incremental)
+		ctx = f.NewContext(ctx, "foo")
+
+		out := pipeline.ChanOutput(make(chan interface{}))
+		resultCh := make(chan []string)
+		go func() {
+			var results []string
+			for v := range out {
+				results = append(results, v.(line.Line).DisplayString())
+			}
+			resultCh <- results
+		}()
+
+		chunks := [][]string{{"foo1", "bar1"}, {"foo2", "bar2"}}
+		for _, chunk := range chunks {
+			var buf []line.Line
+			for _, s := range chunk {
+				buf = append(buf, line.NewRaw(0, s, false))
+			}
+			assert.NoError(t, f.Apply(ctx, buf, out), "Apply should succeed")
+		}
+		assert.NoError(t, f.Finish(ctx, out), "Finish should succeed")
+		close(out)
+
+		results := <-resultCh
+		sort.Strings(results)
+		return results
+	}
+
+	assert.Equal(t, []string{"foo1", "foo2", "start", "start"}, run(false), "command should be invoked for each chunk")
+	assert.Equal(t, []string{"foo1", "foo2", "start"}, run(true), "command should be invoked once")
+}
+
+func TestExternalCmdEnv(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires /bin/sh")
+	}
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("requires /bin/sh")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	calls := 0
+	f := NewExternalCmd("test", "sh", []string{"-c", `echo "$PECO_TEST"`}, 0, &testIDGen{}, false)
+	f.SetEnv(func() []string {
+		calls++
+		return []string{"PECO_TEST=foo"}
+	})
+	ctx = f.NewContext(ctx, "")
+
+	out := pipeline.ChanOutput(make(chan interface{}, 1))
+	if !assert.NoError(t, f.Apply(ctx, []line.Line{line.NewRaw(0, "bar", false)}, out), "Apply should succeed") {
+		return
+	}
+	assert.Equal(t, "foo", (<-out).(line.Line).DisplayString(), "command should see the environment")
+	assert.Equal(t, 1, calls, "environment should be computed per invocation")
+}
+
+func TestExternalCmdStreaming(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires /bin/sh")
+	}
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("requires /bin/sh")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The command prints its input, and then takes a long time to exit
+	f := NewExternalCmd("test", "sh", []string{"-c", `cat; sleep 10`}, 0, &testIDGen{}, false)
+	ctx = f.NewContext(ctx, "")
+
+	long := strings.Repeat("x", 10000)
+	out := pipeline.ChanOutput(make(chan interface{}))
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- f.Apply(ctx, []line.Line{line.NewRaw(0, "foo", false), line.NewRaw(0, long, false)}, out)
+	}()
+
+	for _, expected := range []string{"foo", long} {
+		select {
+		case v := <-out:
+			assert.Equal(t, expected, v.(line.Line).DisplayString(), "lines should be read in full")
+		case <-time.After(2 * time.Second):
+			t.Fatal("output should be sent before the command exits")
+		}
+	}
+
+	cancel()
+	select {
+	case err := <-errCh:
+		assert.NoError(t, err, "Apply should succeed")
+	case <-time.After(time.Second):
+		t.Fatal("Apply should return once the query is canceled")
+	}
+}
+
+func TestExternalCmdStderr(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires /bin/sh")
+	}
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("requires /bin/sh")
+	}
+
+	run := func(f *ExternalCmd) []string {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		msgs := make(chan string, 10)
+		f.SetStderr(func(msg string) { msgs <- msg })
+		ctx = f.NewContext(ctx, "")
+
+		out := pipeline.ChanOutput(make(chan interface{}, 1))
+		f.Apply(ctx, []line.Line{line.NewRaw(0, "foo", false)}, out)
+
+		var received []string
+		for {
+			select {
+			case msg := <-msgs:
+				received = append(received, msg)
+			case <-time.After(500 * time.Millisecond):
+				return received
+			}
+		}
+	}
+
+	f := NewExternalCmd("test", "sh", []string{"-c", `printf 'oops\n\nno newline' >&2`}, 0, &testIDGen{}, false)
+	assert.Equal(t, []string{"test: oops", "test: no newline"}, run(f), "stderr should be reported line by line")
+
+	f = NewExternalCmd("missing", "peco-no-such-command", nil, 0, &testIDGen{}, false)
+	if received := run(f); assert.Len(t, received, 1, "failure to start the command should be reported") {
+		assert.True(t, strings.HasPrefix(received[0], "missing: "), "message should be prefixed by the name of the filter")
+	}
+}
@@ -0,0 +1,16 @@
+// +build windows
+
+package filter
+
+import "os/exec"
+
+// setProcessGroup is a no-op on Windows
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killCommand kills the process of cmd
+func killCommand(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+	cmd.Process.Kill()
+}
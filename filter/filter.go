@@ -1,6 +1,9 @@
 package filter
 
-import "context"
+import (
+	"context"
+	"sort"
+)
 
 // newContext initializes the context so that it is suitable
 // to be passed to `Run()`
@@ -8,6 +11,13 @@ func newContext(ctx context.Context, query string) context.Context {
 	return context.WithValue(ctx, queryKey, query)
 }
 
+// QueryFromContext returns the query that the context was created
+// for by NewContext, if any
+func QueryFromContext(ctx context.Context) (string, bool) {
+	query, ok := ctx.Value(queryKey).(string)
+	return query, ok
+}
+
 // sort related stuff
 type byMatchStart [][]int
 
@@ -30,6 +40,68 @@ func (m byMatchStart) Less(i, j int) bool {
 
 	return false
 }
+
+// byMatchStartWithTerms sorts matches the same way as byMatchStart,
+// while keeping the ordinal of the query term that produced each
+// match alongside it
+type byMatchStartWithTerms struct {
+	matches [][]int
+	terms   []int
+}
+
+func (m byMatchStartWithTerms) Len() int {
+	return len(m.matches)
+}
+
+func (m byMatchStartWithTerms) Swap(i, j int) {
+	m.matches[i], m.matches[j] = m.matches[j], m.matches[i]
+	m.terms[i], m.terms[j] = m.terms[j], m.terms[i]
+}
+
+func (m byMatchStartWithTerms) Less(i, j int) bool {
+	return byMatchStart(m.matches).Less(i, j)
+}
+
+// dedupeMatches sorts matches by their starting position, and merges
+// the ones that overlap. terms holds the ordinal of the query term
+// that produced each match, and is returned in the same order as the
+// deduped matches
+func dedupeMatches(matches [][]int, terms []int) ([][]int, []int) {
+	sort.Sort(byMatchStartWithTerms{matches: matches, terms: terms})
+
+	// We need to "dedupe" the results. For example, if we matched the
+	// same region twice, we don't want that to be drawn
+
+	deduped := make([][]int, 0, len(matches))
+	dedupedTerms := make([]int, 0, len(matches))
+
+	for i, m := range matches {
+		// Always push the first one
+		if i == 0 {
+			deduped = append(deduped, m)
+			dedupedTerms = append(dedupedTerms, terms[i])
+			continue
+		}
+
+		prev := deduped[len(deduped)-1]
+		switch {
+		case matchContains(prev, m):
+			// If the previous match contains this one, then
+			// don't do anything
+			continue
+		case matchOverlaps(prev, m):
+			// If the previous match overlaps with this one,
+			// merge the results and make it a bigger one.
+			// The merged region keeps the term of the earlier match
+			deduped[len(deduped)-1] = mergeMatches(prev, m)
+		default:
+			deduped = append(deduped, m)
+			dedupedTerms = append(dedupedTerms, terms[i])
+		}
+	}
+	return deduped, dedupedTerms
+}
+
 func matchContains(a []int, b []int) bool {
 	return a[0] <= b[0] && a[1] >= b[1]
 }
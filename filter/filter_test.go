@@ -3,6 +3,8 @@ package filter
 import (
 	"context"
 	"fmt"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 
@@ -320,3 +322,252 @@ func testFuzzyMatch(octx context.Context, t *testing.T, filter Filter) {
 		})
 	}
 }
+
+func TestRegexpTerms(t *testing.T) {
+	ctx, cancel := context.WithTimeout(newContext(context.Background(), "bar foo"), 10*time.Second)
+	defer cancel()
+
+	ch := make(chan interface{}, 1)
+	l := line.NewRaw(0, "foo bar xfoo ybar", false)
+	if !assert.NoError(t, NewRegexp().Apply(ctx, []line.Line{l}, pipeline.ChanOutput(ch)), `filter.Apply should succeed`) {
+		return
+	}
+
+	m, ok := (<-ch).(*line.Matched)
+	if !assert.True(t, ok, "result should be a *line.Matched") {
+		return
+	}
+
+	if !assert.Equal(t, [][]int{{0, 3}, {4, 7}, {9, 12}, {14, 17}}, m.Indices(), "result has expected indices") {
+		return
+	}
+
+	for i, term := range []int{1, 0, 1, 0} {
+		if !assert.Equal(t, term, m.Term(i), "match %d should come from term %d", i, term) {
+			return
+		}
+	}
+}
+
+func TestMaxTerms(t *testing.T) {
+	terms := make([]string, MaxTerms+10)
+	for i := range terms {
+		terms[i] = fmt.Sprintf("t%d", i)
+	}
+	query := strings.Join(terms, " ")
+
+	if !assert.Equal(t, MaxTerms+10, NewIgnoreCase().CountTerms(query), "all terms should be counted") {
+		return
+	}
+	if !assert.Equal(t, MaxTerms+10, NewComposite(false).CountTerms(query), "all terms should be counted") {
+		return
+	}
+	if !assert.Equal(t, 3, NewIgnoreCase().CountTerms("foo  bar"), "terms should be counted as the regular expressions split them") {
+		return
+	}
+
+	rxs, err := queryToRegexps(query, defaultFlags, false)
+	if !assert.NoError(t, err, "queryToRegexps should succeed") {
+		return
+	}
+	if !assert.Len(t, rxs, MaxTerms, "terms past MaxTerms should be ignored") {
+		return
+	}
+
+	if !assert.Len(t, NewComposite(false).parse(query), MaxTerms, "terms past MaxTerms should be ignored") {
+		return
+	}
+
+	if !assert.Len(t, NewIgnoreCase().Terms(query), MaxTerms, "terms past MaxTerms should be ignored") {
+		return
+	}
+	if !assert.Len(t, NewComposite(false).Terms(query), MaxTerms, "terms past MaxTerms should be ignored") {
+		return
+	}
+	assert.Equal(t, []string{"re:^ERROR", "log"}, NewComposite(false).Terms("re:^ERROR  fz: log"), "terms should keep their prefixes, and prefixes alone should be skipped")
+}
+
+func TestComposite(t *testing.T) {
+	run := func(t *testing.T, query string) []*line.Matched {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		f := NewComposite(false)
+		ctx = f.NewContext(ctx, query)
+
+		lines := []line.Line{
+			line.NewRaw(1, "ERROR in connection_log", false),
+			line.NewRaw(2, "INFO in connection_log", false),
+			line.NewRaw(3, "ERROR in parser", false),
+		}
+		ch := make(chan interface{}, len(lines))
+		if !assert.NoError(t, f.Apply(ctx, lines, pipeline.ChanOutput(ch)), `filter.Apply should succeed`) {
+			return nil
+		}
+		close(ch)
+
+		var results []*line.Matched
+		for v := range ch {
+			results = append(results, v.(*line.Matched))
+		}
+		return results
+	}
+
+	t.Run("regexp and fuzzy", func(t *testing.T) {
+		results := run(t, "re:^ERR fz:conlog")
+		if !assert.Len(t, results, 1, "only lines matching all terms should be output") {
+			return
+		}
+		m := results[0]
+		if !assert.Equal(t, uint64(1), m.ID(), "the first line should match") {
+			return
+		}
+		if !assert.Equal(t, [][]int{{0, 3}, {9, 12}, {20, 23}}, m.Indices(), "matches of all terms should be highlighted") {
+			return
+		}
+		assert.Equal(t, 0, m.Term(0), "regexp match should come from the first term")
+		assert.Equal(t, 1, m.Term(1), "fuzzy match should come from the second term")
+	})
+	t.Run("default filter", func(t *testing.T) {
+		results := run(t, "error cs:parser")
+		if !assert.Len(t, results, 1, "only lines matching all terms should be output") {
+			return
+		}
+		assert.Equal(t, uint64(3), results[0].ID(), "the third line should match")
+	})
+	t.Run("incomplete term", func(t *testing.T) {
+		assert.Len(t, run(t, "connection re:"), 2, "terms without a query should be ignored")
+	})
+}
+
+func TestFuzzyExact(t *testing.T) {
+	f := NewFuzzy(false)
+	f.SetExact(true)
+	if !assert.True(t, f.Exact(), "filter should be in exact mode") {
+		return
+	}
+
+	testValues := []struct {
+		input   string
+		query   string
+		matches [][]int
+	}{
+		{"this is a test to test the fuzzy Filter", "test", [][]int{{10, 14}}},
+		{"this is a test to test the fuzzy Filter", "tf", nil},
+		{"THIS IS A TEST TO TEST THE FUZZY FILTER", "fuzzy", [][]int{{27, 32}}},
+		{"this is a test to test the fuzzy filter", "Fuzzy", nil},
+		{"a.b axb", "x", [][]int{{5, 6}}},
+	}
+	for _, v := range testValues {
+		t.Run(fmt.Sprintf(`"%s" against "%s"`, v.input, v.query), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(f.NewContext(context.Background(), v.query), 10*time.Second)
+			defer cancel()
+
+			ch := make(chan interface{}, 1)
+			if !assert.NoError(t, f.Apply(ctx, []line.Line{line.NewRaw(0, v.input, false)}, pipeline.ChanOutput(ch)), `filter.Apply should succeed`) {
+				return
+			}
+			close(ch)
+
+			m, ok := (<-ch).(*line.Matched)
+			if v.matches == nil {
+				assert.False(t, ok, "line should not match")
+				return
+			}
+			if !assert.True(t, ok, "line should match") {
+				return
+			}
+			assert.Equal(t, v.matches, m.Indices(), "result has expected indices")
+		})
+	}
+}
+
+func TestToggleCase(t *testing.T) {
+	matches := func(f Filter, query, input string) bool {
+		ctx, cancel := context.WithTimeout(f.NewContext(context.Background(), query), 10*time.Second)
+		defer cancel()
+
+		ch := make(chan interface{}, 1)
+		if !assert.NoError(t, f.Apply(ctx, []line.Line{line.NewRaw(0, input, false)}, pipeline.ChanOutput(ch)), `filter.Apply should succeed`) {
+			return false
+		}
+		close(ch)
+		_, ok := (<-ch).(*line.Matched)
+		return ok
+	}
+
+	ic := NewIgnoreCase()
+	if !assert.True(t, matches(ic, "foo", "FOO"), "IgnoreCase should ignore case") {
+		return
+	}
+	ic.ToggleCase("foo")
+	assert.True(t, ic.CaseToggled(), "case sensitivity should be switched")
+	assert.False(t, ic.IgnoresCase("foo"), "IgnoreCase should be case sensitive")
+	assert.False(t, matches(ic, "foo", "FOO"), "IgnoreCase should match case")
+	assert.True(t, matches(ic, "foo", "foo"), "IgnoreCase should still match")
+	ic.ToggleCase("foo")
+	assert.False(t, ic.CaseToggled(), "case sensitivity should be switched back")
+	assert.True(t, matches(ic, "foo", "FOO"), "IgnoreCase should ignore case again")
+
+	rx := NewRegexp()
+	assert.False(t, matches(rx, "^fo+$", "FOO"), "Regexp should match case")
+	rx.ToggleCase("^fo+$")
+	assert.True(t, matches(rx, "^fo+$", "FOO"), "Regexp should ignore case")
+
+	sc := NewSmartCase()
+	sc.ToggleCase("Foo")
+	assert.True(t, sc.IgnoresCase("Foo"), "SmartCase should ignore case for upper case queries")
+	assert.True(t, sc.IgnoresCase("foo"), "the switch should apply to other queries")
+	assert.True(t, matches(sc, "Foo", "FOO"), "SmartCase should ignore case")
+
+	var _ CaseToggler = ic
+}
+
+func TestRegexpCache(t *testing.T) {
+	c := newRegexpCache(2)
+	keys := []regexpCacheKey{{pattern: "foo"}, {pattern: "foo", flags: "i"}, {pattern: "foo", quotemeta: true}}
+	for _, key := range keys[:2] {
+		c.put(key, regexp.MustCompile(key.pattern))
+	}
+
+	if !assert.NotNil(t, c.get(keys[0]), "cached regexp should be returned") {
+		return
+	}
+	c.put(keys[2], regexp.MustCompile("foo"))
+
+	assert.Equal(t, 2, c.Len(), "cache should not grow beyond its capacity")
+	assert.NotNil(t, c.get(keys[0]), "recently used regexp should be kept")
+	assert.Nil(t, c.get(keys[1]), "least recently used regexp should be evicted")
+	assert.NotNil(t, c.get(keys[2]))
+
+	rx1, err := regexpFor("a.b", []string{"i"}, true)
+	if !assert.NoError(t, err, "regexpFor should succeed") {
+		return
+	}
+	rx2, _ := regexpFor("a.b", []string{"i"}, true)
+	rx3, _ := regexpFor("a.b", nil, true)
+	assert.True(t, rx1 == rx2, "same term should reuse the compiled regexp")
+	assert.False(t, rx1 == rx3, "terms with different flags should be compiled separately")
+}
+
+// BenchmarkRegexpTyping measures compiling the query after each
+// keystroke, as the user types it
+func BenchmarkRegexpTyping(b *testing.B) {
+	const query = `^\w+ (ERROR|WARN) [a-z]+\.go:\d+ connection (reset|refused) timeout=\d+ms`
+
+	run := func(b *testing.B, cache *regexpCache) {
+		defer func(c *regexpCache) { compiledRegexps = c }(compiledRegexps)
+		compiledRegexps = cache
+
+		for i := 0; i < b.N; i++ {
+			for n := 1; n <= len(query); n++ {
+				// Incomplete terms such as "(ERR" fail to compile,
+				// just like they do while typing
+				queryToRegexps(query[:n], defaultFlags, false)
+			}
+		}
+	}
+
+	b.Run("Cached", func(b *testing.B) { run(b, newRegexpCache(DefaultRegexpCacheSize)) })
+	b.Run("Uncached", func(b *testing.B) { run(b, newRegexpCache(0)) })
+}
@@ -6,6 +6,7 @@ import (
 	"math"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"unicode"
 	"unicode/utf8"
 
@@ -29,7 +30,7 @@ func NewFuzzy(sortLongest bool) *Fuzzy {
 	}
 }
 
-func (ff Fuzzy) BufSize() int {
+func (ff *Fuzzy) BufSize() int {
 	return 0
 }
 
@@ -37,15 +38,40 @@ func (ff *Fuzzy) NewContext(ctx context.Context, query string) context.Context {
 	return newContext(ctx, query)
 }
 
-func (ff Fuzzy) String() string {
+// Concurrent implements the Concurrent interface
+func (ff *Fuzzy) Concurrent() bool {
+	return true
+}
+
+func (ff *Fuzzy) String() string {
 	return "Fuzzy"
 }
 
+// SetExact switches between fuzzy matching, and matching the query
+// as an exact substring of the line. Either way, the query is matched
+// case-insensitively unless it contains an upper case character
+func (ff *Fuzzy) SetExact(b bool) {
+	var v int32
+	if b {
+		v = 1
+	}
+	atomic.StoreInt32(&ff.exact, v)
+}
+
+// Exact returns true if the query is matched as an exact substring
+func (ff *Fuzzy) Exact() bool {
+	return atomic.LoadInt32(&ff.exact) == 1
+}
+
 func (ff *Fuzzy) Apply(ctx context.Context, lines []line.Line, out pipeline.ChanOutput) error {
 	originalQuery := ctx.Value(queryKey).(string)
 	hasUpper := util.ContainsUpper(originalQuery)
 	matched := []fuzzyMatchedItem{}
 
+	if ff.Exact() {
+		return ff.applyExact(originalQuery, hasUpper, lines, out)
+	}
+
 LINE:
 	for _, l := range lines {
 		// Find the first valid rune of the query
@@ -146,6 +172,36 @@ LINE:
 	return nil
 }
 
+// applyExact outputs the lines that contain query as a substring
+func (ff *Fuzzy) applyExact(query string, hasUpper bool, lines []line.Line, out pipeline.ChanOutput) error {
+	var flags []string
+	if !hasUpper {
+		flags = []string{"i"}
+	}
+	rx, err := regexpFor(query, flags, true)
+	if err != nil {
+		return err
+	}
+
+	matched := []fuzzyMatchedItem{}
+	for _, l := range lines {
+		m := rx.FindStringIndex(l.DisplayString())
+		if m == nil {
+			continue
+		}
+		matched = append(matched, newFuzzyMatchedItem(l, [][]int{m}))
+	}
+
+	if ff.sortLongest {
+		sort.SliceStable(matched, less(matched))
+	}
+
+	for i := range matched {
+		out.Send(line.NewMatched(matched[i].line, matched[i].matches))
+	}
+	return nil
+}
+
 func popRune(s string) (string, rune, int) {
 	r, n := utf8.DecodeRuneInString(s)
 	return s[n:], r, n
@@ -1,8 +1,11 @@
 package filter
 
 import (
+	"container/list"
 	"context"
 	"errors"
+	"io"
+	"os/exec"
 	"regexp"
 	"sync"
 	"time"
@@ -22,6 +25,10 @@ var incomingBufferKey = &struct{}{}
 // for BufferThreshold setting on CustomFilters.
 const DefaultCustomFilterBufferThreshold = 100
 
+// DefaultFlushInterval is how often the lines buffered for a filter
+// are passed to it, even if its BufSize has not been reached yet
+const DefaultFlushInterval = 50 * time.Millisecond
+
 type Set struct {
 	current int
 	filters []Filter
@@ -47,30 +54,162 @@ type regexpQuery struct {
 	lastUsed time.Time
 }
 
+// MaxTerms is the number of terms of a query that are matched. The
+// rest are ignored, so that pathological queries, such as pasted text
+// with thousands of words, do not compile a regular expression for
+// each of them
+const MaxTerms = 64
+
+// DefaultRegexpCacheSize is the number of compiled regular expressions
+// that are kept for reuse by the filters
+const DefaultRegexpCacheSize = 256
+
+// regexpCache is a LRU cache of compiled regular expressions. It is
+// shared by all filters, so that the terms of a query that did not
+// change since the previous keystroke are not compiled again
+type regexpCache struct {
+	capacity int
+	entries  map[regexpCacheKey]*list.Element
+	mutex    sync.Mutex
+	order    *list.List // most recently used first
+}
+
+type regexpCacheKey struct {
+	pattern   string
+	flags     string
+	quotemeta bool
+}
+
+type regexpCacheEntry struct {
+	key regexpCacheKey
+	rx  *regexp.Regexp
+}
+
 type Fuzzy struct {
 	sortLongest bool
+	exact       int32 // 1 if the query is matched as a substring. see SetExact
+}
+
+// ExactMatcher is implemented by filters that can switch between
+// their usual behavior, and matching the query as an exact substring
+type ExactMatcher interface {
+	Exact() bool
+	SetExact(bool)
+}
+
+// CaseToggler is implemented by filters whose case sensitivity can be
+// switched without rotating to a different filter
+type CaseToggler interface {
+	// IgnoresCase returns true if query is matched case-insensitively
+	IgnoresCase(query string) bool
+	// CaseToggled returns true if ToggleCase has switched the case
+	// sensitivity of the filter
+	CaseToggled() bool
+	// ToggleCase switches between the usual case sensitivity of the
+	// filter for query, and the opposite one
+	ToggleCase(query string)
 }
 
+// Case sensitivities of Regexp, as switched by ToggleCase
+const (
+	caseDefault int32 = iota
+	caseIgnore
+	caseSensitive
+)
+
 type Regexp struct {
-	factory   *regexpQueryFactory
-	flags     regexpFlags
-	quotemeta bool
-	mutex     sync.Mutex
-	name      string
-	onEnd     func()
-	outCh     pipeline.ChanOutput
+	factory    *regexpQueryFactory
+	flags      regexpFlags
+	quotemeta  bool
+	mutex      sync.Mutex
+	name       string
+	onEnd      func()
+	outCh      pipeline.ChanOutput
+	caseToggle int32 // caseDefault, caseIgnore or caseSensitive. see ToggleCase
+}
+
+// Composite matches each term of the query with a different filter,
+// selected by the prefix of the term
+type Composite struct {
+	filters       map[string]Filter // keyed by prefix
+	defaultFilter Filter
 }
 
 type ExternalCmd struct {
 	args            []string
 	cmd             string
 	enableSep       bool
+	env             func() []string
+	flushInterval   time.Duration
 	idgen           line.IDGenerator
+	incremental     bool
 	outCh           pipeline.ChanOutput
 	name            string
+	stderr          func(string)
 	thresholdBufsiz int
 }
 
+// lineWriter passes each line that is written to it to emit. Lines are
+// stripped of surrounding whitespace, and blank lines are dropped
+type lineWriter struct {
+	buf   []byte
+	emit  func(string)
+	mutex sync.Mutex
+}
+
+type externalSessionKey struct{}
+
+// externalSession holds the command that is kept running for the
+// duration of a query when ExternalCmd is in incremental mode
+type externalSession struct {
+	once  sync.Once
+	err   error
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	done  chan struct{} // closed once all output has been read
+}
+
+// Finisher is implemented by filters that need to be told when all
+// of the lines for a query have been passed to Apply. Finish may
+// send further results to the output
+type Finisher interface {
+	Finish(context.Context, pipeline.ChanOutput) error
+}
+
+// FlushIntervaler is implemented by filters that want the buffered
+// lines to be passed to them at a different interval than
+// DefaultFlushInterval. A non-positive interval means that lines are
+// only passed once BufSize lines have been buffered, or the input ends
+type FlushIntervaler interface {
+	FlushInterval() time.Duration
+}
+
+// Concurrent is implemented by filters whose Apply method may be
+// called concurrently for different chunks of lines of the same query,
+// which is the case when Concurrent returns true. Such filters must
+// match each line independently of the others, and send at most one
+// result for each line that is passed to Apply
+type Concurrent interface {
+	Concurrent() bool
+}
+
+// TermSplitter is implemented by filters that match each of the terms
+// of the query on its own, and only keep the lines that match all of
+// them. Terms returns the terms of query, each of which can be matched
+// as a query of its own. CountTerms returns the number of terms that
+// the filter finds in query, including those past MaxTerms, which it
+// ignores
+type TermSplitter interface {
+	Terms(query string) []string
+	CountTerms(query string) int
+}
+
+// Validator is implemented by filters that can reject a query before
+// it is run, e.g. because it is not a valid regular expression
+type Validator interface {
+	Validate(query string) error
+}
+
 type Filter interface {
 	Apply(context.Context, []line.Line, pipeline.ChanOutput) error
 	BufSize() int
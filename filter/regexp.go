@@ -1,11 +1,12 @@
 package filter
 
 import (
+	"container/list"
 	"context"
 	"fmt"
 	"regexp"
-	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/peco/peco/internal/util"
@@ -22,7 +23,77 @@ func (r regexpFlagFunc) flags(s string) []string {
 	return r(s)
 }
 
+// compiledRegexps is the cache used by regexpFor
+var compiledRegexps = newRegexpCache(DefaultRegexpCacheSize)
+
+func newRegexpCache(capacity int) *regexpCache {
+	return &regexpCache{
+		capacity: capacity,
+		entries:  make(map[regexpCacheKey]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// Len returns the number of regular expressions in the cache
+func (c *regexpCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.order.Len()
+}
+
+// get returns the regular expression cached for key, or nil
+func (c *regexpCache) get(key regexpCacheKey) *regexp.Regexp {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*regexpCacheEntry).rx
+}
+
+// put adds rx to the cache, evicting the least recently used regular
+// expressions if the cache is full
+func (c *regexpCache) put(key regexpCacheKey, rx *regexp.Regexp) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.order.MoveToFront(e)
+		return
+	}
+	if c.capacity <= 0 {
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&regexpCacheEntry{key: key, rx: rx})
+	for c.order.Len() > c.capacity {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.entries, e.Value.(*regexpCacheEntry).key)
+	}
+}
+
+// regexpFor returns the regular expression for the term q. Regular
+// expressions are compiled once, and then reused from compiledRegexps.
+// The compiled regular expressions are safe to be used concurrently
 func regexpFor(q string, flags []string, quotemeta bool) (*regexp.Regexp, error) {
+	key := regexpCacheKey{pattern: q, flags: strings.Join(flags, ""), quotemeta: quotemeta}
+	if rx := compiledRegexps.get(key); rx != nil {
+		return rx, nil
+	}
+
+	rx, err := compileRegexp(q, flags, quotemeta)
+	if err != nil {
+		return nil, err
+	}
+	compiledRegexps.put(key, rx)
+	return rx, nil
+}
+
+func compileRegexp(q string, flags []string, quotemeta bool) (*regexp.Regexp, error) {
 	reTxt := q
 	if quotemeta {
 		reTxt = regexp.QuoteMeta(q)
@@ -39,8 +110,17 @@ func regexpFor(q string, flags []string, quotemeta bool) (*regexp.Regexp, error)
 	return re, nil
 }
 
+// splitQuery returns the terms of query that are matched by the
+// regular expressions, which are separated by single spaces
+func splitQuery(query string) []string {
+	return strings.Split(strings.TrimSpace(query), " ")
+}
+
 func queryToRegexps(query string, flags regexpFlags, quotemeta bool) ([]*regexp.Regexp, error) {
-	queries := strings.Split(strings.TrimSpace(query), " ")
+	queries := splitQuery(query)
+	if len(queries) > MaxTerms {
+		queries = queries[:MaxTerms]
+	}
 	regexps := make([]*regexp.Regexp, 0)
 
 	for _, q := range queries {
@@ -72,7 +152,7 @@ func NewRegexp() *Regexp {
 	}
 }
 
-func (rf Regexp) BufSize() int {
+func (rf *Regexp) BufSize() int {
 	return 0
 }
 
@@ -86,12 +166,14 @@ func (f *regexpQueryFactory) Compile(s string, flags regexpFlags, quotemeta bool
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
 
-	rq, ok := f.compiled[s]
+	// The flags may differ for the same query, e.g. after ToggleCase
+	key := strings.Join(flags.flags(s), "") + "/" + s
+	rq, ok := f.compiled[key]
 	if ok {
 		if time.Since(rq.lastUsed) < f.threshold {
 			return rq.rx, nil
 		}
-		delete(f.compiled, s)
+		delete(f.compiled, key)
 	}
 
 	rxs, err := queryToRegexps(s, flags, quotemeta)
@@ -101,13 +183,20 @@ func (f *regexpQueryFactory) Compile(s string, flags regexpFlags, quotemeta bool
 
 	rq.lastUsed = time.Now()
 	rq.rx = rxs
-	f.compiled[s] = rq
+	f.compiled[key] = rq
 	return rxs, nil
 }
 
+// Validate returns an error if query cannot be compiled into regular
+// expressions
+func (rf *Regexp) Validate(query string) error {
+	_, err := rf.factory.Compile(query, rf.flagsFor(query), rf.quotemeta)
+	return err
+}
+
 func (rf *Regexp) Apply(ctx context.Context, lines []line.Line, out pipeline.ChanOutput) error {
 	query := ctx.Value(queryKey).(string)
-	regexps, err := rf.factory.Compile(query, rf.flags, rf.quotemeta)
+	regexps, err := rf.factory.Compile(query, rf.flagsFor(query), rf.quotemeta)
 	if err != nil {
 		return errors.Wrap(err, "failed to compile queries as regular expression")
 	}
@@ -116,55 +205,103 @@ func (rf *Regexp) Apply(ctx context.Context, lines []line.Line, out pipeline.Cha
 		v := l.DisplayString()
 		allMatched := true
 		matches := [][]int{}
+		terms := []int{}
 	TryRegexps:
-		for _, rx := range regexps {
+		for term, rx := range regexps {
 			match := rx.FindAllStringSubmatchIndex(v, -1)
 			if match == nil {
 				allMatched = false
 				break TryRegexps
 			}
 			matches = append(matches, match...)
+			for range match {
+				terms = append(terms, term)
+			}
 		}
 
 		if !allMatched {
 			continue
 		}
 
-		sort.Sort(byMatchStart(matches))
+		deduped, dedupedTerms := dedupeMatches(matches, terms)
+		out.Send(line.NewMatchedTerms(l, deduped, dedupedTerms))
+	}
+	return nil
+}
 
-		// We need to "dedupe" the results. For example, if we matched the
-		// same region twice, we don't want that to be drawn
+// Terms returns the terms of query, which are separated by spaces
+func (rf *Regexp) Terms(query string) []string {
+	terms := strings.Fields(query)
+	if len(terms) > MaxTerms {
+		terms = terms[:MaxTerms]
+	}
+	return terms
+}
 
-		deduped := make([][]int, 0, len(matches))
+// CountTerms returns the number of terms in query
+func (rf *Regexp) CountTerms(query string) int {
+	return len(splitQuery(query))
+}
 
-		for i, m := range matches {
-			// Always push the first one
-			if i == 0 {
-				deduped = append(deduped, m)
-				continue
-			}
+// Concurrent implements the Concurrent interface
+func (rf *Regexp) Concurrent() bool {
+	return true
+}
 
-			prev := deduped[len(deduped)-1]
-			switch {
-			case matchContains(prev, m):
-				// If the previous match contains this one, then
-				// don't do anything
-				continue
-			case matchOverlaps(prev, m):
-				// If the previous match overlaps with this one,
-				// merge the results and make it a bigger one
-				deduped[len(deduped)-1] = mergeMatches(prev, m)
-			default:
-				deduped = append(deduped, m)
-			}
+func (rf *Regexp) String() string {
+	return rf.name
+}
+
+// flagsFor returns the flags that query is compiled with, which are
+// those of the filter, unless ToggleCase has switched whether case
+// is ignored
+func (rf *Regexp) flagsFor(query string) regexpFlags {
+	flags := rf.flags.flags(query)
+	toggle := atomic.LoadInt32(&rf.caseToggle)
+	if toggle == caseDefault {
+		return regexpFlagList(flags)
+	}
+
+	var l regexpFlagList
+	for _, flag := range flags {
+		if flag != "i" {
+			l = append(l, flag)
 		}
-		out.Send(line.NewMatched(l, deduped))
 	}
-	return nil
+	if toggle == caseIgnore {
+		l = append(l, "i")
+	}
+	return l
 }
 
-func (rf Regexp) String() string {
-	return rf.name
+// IgnoresCase returns true if query is matched case-insensitively
+func (rf *Regexp) IgnoresCase(query string) bool {
+	for _, flag := range rf.flagsFor(query).flags(query) {
+		if flag == "i" {
+			return true
+		}
+	}
+	return false
+}
+
+// CaseToggled returns true if ToggleCase has switched the case
+// sensitivity of the filter
+func (rf *Regexp) CaseToggled() bool {
+	return atomic.LoadInt32(&rf.caseToggle) != caseDefault
+}
+
+// ToggleCase switches between the usual case sensitivity of the
+// filter for query, and the opposite one. Once switched, the filter
+// keeps to it for other queries, until it is switched back
+func (rf *Regexp) ToggleCase(query string) {
+	switch {
+	case rf.CaseToggled():
+		atomic.StoreInt32(&rf.caseToggle, caseDefault)
+	case rf.IgnoresCase(query):
+		atomic.StoreInt32(&rf.caseToggle, caseSensitive)
+	default:
+		atomic.StoreInt32(&rf.caseToggle, caseIgnore)
+	}
 }
 
 func NewIgnoreCase() *Regexp {
@@ -0,0 +1,396 @@
+package peco
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/filter"
+	"github.com/peco/peco/line"
+	"github.com/peco/peco/pipeline"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingFilter matches lines containing the query, but stops after
+// the first match until release is closed
+type blockingFilter struct {
+	release chan struct{}
+}
+
+func (f *blockingFilter) Apply(ctx context.Context, lines []line.Line, out pipeline.ChanOutput) error {
+	query := ctx.Value(blockingFilterQueryKey{}).(string)
+	sent := false
+	for _, l := range lines {
+		if !strings.Contains(l.DisplayString(), query) {
+			continue
+		}
+		out.Send(l)
+		if !sent {
+			sent = true
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-f.release:
+			}
+		}
+	}
+	return nil
+}
+
+type blockingFilterQueryKey struct{}
+
+func (f *blockingFilter) BufSize() int { return 0 }
+func (f *blockingFilter) NewContext(ctx context.Context, query string) context.Context {
+	return context.WithValue(ctx, blockingFilterQueryKey{}, query)
+}
+func (f *blockingFilter) String() string { return "Blocking" }
+
+func TestQueryLatencyBudget(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	p := newPeco()
+	p.Argv = []string{}
+	p.Stdin = bytes.NewBufferString("foo\nbar\nfoobar\n")
+	startPeco(ctx, t, p, 3, 3)
+
+	f := &blockingFilter{release: make(chan struct{})}
+	p.Filters().Add(f)
+	if !assert.NoError(t, p.Filters().SetCurrentByName(f.String()), "SetCurrentByName should succeed") {
+		return
+	}
+
+	waitFor := func(cond func() bool) bool {
+		for ctx.Err() == nil {
+			if cond() {
+				return true
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		return false
+	}
+
+	if !assert.True(t, waitFor(func() bool { return p.source.Size() == 3 }), "source should be read") {
+		return
+	}
+
+	p.screen.SendEvent(termbox.Event{Ch: 'f'})
+
+	// The filter is blocked, so the partial results must be displayed
+	// once the latency budget has been exceeded
+	if !assert.True(t, waitFor(func() bool { return p.PaintLatency() > 0 }), "partial results should be painted") {
+		return
+	}
+	if !assert.Equal(t, 1, p.CurrentLineBuffer().Size(), "partial results should be displayed") {
+		return
+	}
+	if !assert.True(t, p.PaintLatency() >= p.QueryLatencyBudget(), "partial results should not be painted before the budget is exceeded") {
+		return
+	}
+	if !assert.True(t, p.PaintLatency() < time.Second, "partial results should be painted soon after the budget is exceeded") {
+		return
+	}
+
+	close(f.release)
+	if !assert.True(t, waitFor(func() bool { return p.CurrentLineBuffer().Size() == 2 }), "remaining results should be filtered in the background") {
+		return
+	}
+}
+
+// passFilter passes every line through, and is only flushed at the
+// given interval, as its buffer size is never reached in tests
+type passFilter struct {
+	interval time.Duration
+}
+
+func (f passFilter) Apply(ctx context.Context, lines []line.Line, out pipeline.ChanOutput) error {
+	for _, l := range lines {
+		out.Send(l)
+	}
+	return nil
+}
+func (f passFilter) BufSize() int                                             { return 1000 }
+func (f passFilter) FlushInterval() time.Duration                             { return f.interval }
+func (f passFilter) NewContext(ctx context.Context, _ string) context.Context { return ctx }
+func (f passFilter) String() string                                           { return "Pass" }
+
+func TestFlushInterval(t *testing.T) {
+	run := func(t *testing.T, interval time.Duration) (flushed bool) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		in := make(chan interface{})
+		out := pipeline.ChanOutput(make(chan interface{}, 10))
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			acceptAndFilter(ctx, passFilter{interval: interval}, nil, nil, in, out)
+		}()
+
+		in <- line.NewRaw(0, "foo", false)
+		select {
+		case v := <-out:
+			flushed = true
+			assert.Equal(t, "foo", v.(line.Line).DisplayString(), "buffered line should be flushed")
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		in <- pipeline.EndMark{}
+		<-done
+		return flushed
+	}
+
+	t.Run("interval", func(t *testing.T) {
+		assert.True(t, run(t, 10*time.Millisecond), "lines should be flushed before the buffer is full")
+	})
+	t.Run("disabled", func(t *testing.T) {
+		assert.False(t, run(t, -1), "lines should not be flushed before the buffer is full")
+	})
+}
+
+// slowEvenFilter passes lines with even IDs through. It can be applied
+// concurrently, and takes longer for earlier chunks, so that later
+// chunks are done first
+type slowEvenFilter struct {
+	running    int32
+	maxRunning int32
+}
+
+func (f *slowEvenFilter) Apply(ctx context.Context, lines []line.Line, out pipeline.ChanOutput) error {
+	n := atomic.AddInt32(&f.running, 1)
+	defer atomic.AddInt32(&f.running, -1)
+	for {
+		max := atomic.LoadInt32(&f.maxRunning)
+		if n <= max || atomic.CompareAndSwapInt32(&f.maxRunning, max, n) {
+			break
+		}
+	}
+
+	if len(lines) > 0 {
+		time.Sleep(time.Duration(100-lines[0].ID()%100) * time.Microsecond * 50)
+	}
+	for _, l := range lines {
+		if l.ID()%2 == 0 {
+			out.Send(l)
+		}
+	}
+	return nil
+}
+func (f *slowEvenFilter) BufSize() int                                             { return 10 }
+func (f *slowEvenFilter) Concurrent() bool                                         { return true }
+func (f *slowEvenFilter) NewContext(ctx context.Context, _ string) context.Context { return ctx }
+func (f *slowEvenFilter) String() string                                           { return "SlowEven" }
+
+func TestConcurrentFilter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pool := newWorkerPool(4)
+	pool.Run(ctx)
+
+	f := &slowEvenFilter{}
+	// The same pool is used for every query
+	for i := 0; i < 3; i++ {
+		in := make(chan interface{})
+		out := pipeline.ChanOutput(make(chan interface{}))
+		go func() {
+			for id := uint64(0); id < 100; id++ {
+				in <- line.NewRaw(id, "foo", false)
+			}
+			in <- pipeline.EndMark{}
+		}()
+		go acceptAndFilter(ctx, f, pool, nil, in, out)
+
+		var ids []uint64
+		for v := range out {
+			l, ok := v.(line.Line)
+			if !ok {
+				break
+			}
+			ids = append(ids, l.ID())
+		}
+
+		if !assert.Len(t, ids, 50, "every even line should be output") {
+			return
+		}
+		for i, id := range ids {
+			if !assert.Equal(t, uint64(i*2), id, "lines should be output in order") {
+				return
+			}
+		}
+	}
+	assert.True(t, atomic.LoadInt32(&f.maxRunning) > 1, "chunks should be filtered concurrently")
+}
+
+func TestUnchangedResults(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	p := newPeco()
+	p.Argv = []string{}
+	p.Stdin = bytes.NewBufferString("foo\nbar\nbaz\n")
+	startPeco(ctx, t, p, 3, 3)
+
+	b := execQuery(ctx, t, p, "b")
+	if !assert.Equal(t, 2, b.Size(), "query should match two lines") {
+		return
+	}
+	// Draw requests are asynchronous, so wait until the results have
+	// been painted before checking that they are not painted again
+	for p.PaintLatency() == 0 && ctx.Err() == nil {
+		time.Sleep(5 * time.Millisecond)
+	}
+	atomic.StoreInt64(&p.paintLatency, 0)
+	if !assert.True(t, b == execQuery(ctx, t, p, "b "), "buffer should not be replaced when results are the same") {
+		return
+	}
+	if !assert.Equal(t, time.Duration(0), p.PaintLatency(), "results should not be redrawn when they are the same") {
+		return
+	}
+	if !assert.False(t, b == execQuery(ctx, t, p, "ba"), "buffer should be replaced when matches are different") {
+		return
+	}
+
+	b = execQuery(ctx, t, p, "bx")
+	if !assert.Equal(t, 0, b.Size(), "query should match no lines") {
+		return
+	}
+	if !assert.True(t, b == execQuery(ctx, t, p, "bxx"), "buffer should not be replaced when there are still no results") {
+		return
+	}
+}
+
+func TestReleaseResults(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	p := newPeco()
+	p.Argv = []string{}
+	p.Stdin = bytes.NewBufferString("foo\nbar\nbaz\n")
+	p.config.FreeMemoryThreshold = 1
+	startPeco(ctx, t, p, 3, 3)
+
+	b := execQuery(ctx, t, p, "b")
+	if !assert.Equal(t, 2, b.Size(), "query should match two lines") {
+		return
+	}
+	if !assert.Equal(t, 1, execQuery(ctx, t, p, "bar").Size(), "query should match one line") {
+		return
+	}
+	if !assert.Equal(t, 2, execQuery(ctx, t, p, "b").Size(), "query should match two lines again") {
+		return
+	}
+	assert.Equal(t, 0, b.Size(), "results that are no longer displayed should be released")
+
+	b = p.CurrentLineBuffer()
+	if !assert.Equal(t, 3, execQuery(ctx, t, p, "").Size(), "all lines should be displayed") {
+		return
+	}
+	assert.Equal(t, 0, b.Size(), "results should be released when all lines are displayed")
+	assert.Equal(t, 3, p.source.Size(), "the input should be kept")
+}
+
+func TestRestoreCursor(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	state := newPeco()
+	state.Argv = []string{}
+	state.Stdin = bytes.NewBufferString("a1\nb1\na2\nb2\na3\n")
+	go state.Run(ctx)
+	<-state.Ready()
+	for state.source.Size() < 5 {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	query := func(q string) {
+		ch := make(chan struct{})
+		state.Query().Set(q)
+		state.ExecQuery(func() { close(ch) })
+		<-ch
+	}
+	expectLine := func(expected int, msg string) bool {
+		deadline := time.Now().Add(2 * time.Second)
+		for state.Location().LineNumber() != expected && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		return assert.Equal(t, expected, state.Location().LineNumber(), msg)
+	}
+
+	state.Location().SetLineNumber(2)
+	query("a")
+	if !expectLine(1, "cursor should stay on a2") {
+		return
+	}
+	query("")
+	if !expectLine(2, "cursor should stay on a2 once the query is cleared") {
+		return
+	}
+
+	state.Location().SetLineNumber(4)
+	query("b")
+	expectLine(1, "cursor should move to b2, which is the nearest to a3")
+}
+
+func TestInvalidQuery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	state := newPeco()
+	state.Argv = []string{}
+	state.Stdin = bytes.NewBufferString("foo\nbar\nfoobar\n")
+	go state.Run(ctx)
+	<-state.Ready()
+	for state.source.Size() < 3 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !assert.NoError(t, state.Filters().SetCurrentByName("Regexp"), "selecting the Regexp filter should succeed") {
+		return
+	}
+
+	query := func(q string) {
+		ch := make(chan struct{})
+		state.Query().Set(q)
+		state.ExecQuery(func() { close(ch) })
+		<-ch
+	}
+
+	query("foo")
+	if !assert.Equal(t, 2, state.CurrentLineBuffer().Size(), "query should match two lines") {
+		return
+	}
+
+	query("foo(")
+	assert.True(t, state.IsQueryInvalid(), "query should be invalid")
+	assert.Equal(t, 2, state.CurrentLineBuffer().Size(), "results of the previous query should be kept")
+
+	query("foo(bar)")
+	assert.False(t, state.IsQueryInvalid(), "query should be valid again")
+	assert.Equal(t, 1, state.CurrentLineBuffer().Size(), "valid query should be run")
+}
+
+func TestMaxTermsWarning(t *testing.T) {
+	ctx := context.Background()
+
+	p := newPeco()
+	h := &statusRecorderHub{}
+	p.hub = h
+	p.source = NewSource("-", strings.NewReader(""), false, nil, 0, false)
+	p.Filters().Add(filter.NewIgnoreCase())
+	p.Filters().Add(filter.NewFuzzy(false))
+
+	query := strings.Repeat("t ", filter.MaxTerms+1)
+	p.sendQuery(ctx, query, nil)
+	if !assert.Equal(t, []string{"Only the first 64 of 65 terms are matched"}, h.messages, "terms past the limit should be reported") {
+		return
+	}
+
+	h.messages = nil
+	p.Filters().SetCurrentByName("Fuzzy")
+	p.sendQuery(ctx, query, nil)
+	assert.Empty(t, h.messages, "filters that do not split the query should not report terms")
+}
@@ -0,0 +1,267 @@
+package peco
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/peco/peco/line"
+	"github.com/pkg/errors"
+)
+
+// maxFrecencyEntries is the number of lines that are remembered for
+// each frecency database. The lines with the lowest scores are
+// forgotten first
+const maxFrecencyEntries = 1000
+
+// frecencyDir returns the directory where frecency databases are
+// stored
+func frecencyDir(cfg *Config) (string, error) {
+	if dir := cfg.FrecencyDir; dir != "" {
+		return dir, nil
+	}
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return filepath.Join(dir, "peco", "frecency"), nil
+	}
+	home, err := homedirFunc()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get home directory")
+	}
+	return filepath.Join(home, ".local", "share", "peco", "frecency"), nil
+}
+
+// LoadFrecency loads the frecency database stored in path. If the
+// file does not exist, the database is empty
+func LoadFrecency(path string) (*Frecency, error) {
+	f := &Frecency{
+		path:    path,
+		entries: make(map[string]*frecencyEntry),
+		now:     time.Now,
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return f, nil
+		}
+		return nil, errors.Wrapf(err, "failed to read frecency database %s", path)
+	}
+	if err := json.Unmarshal(buf, &f.entries); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode frecency database %s", path)
+	}
+	return f, nil
+}
+
+// Score returns the frecency score of s, which is the number of times
+// it was accepted, weighted by how long ago that last happened. Lines
+// that were never accepted score 0
+func (f *Frecency) Score(s string) float64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.score(f.entries[s])
+}
+
+// score must be called while holding the lock
+func (f *Frecency) score(e *frecencyEntry) float64 {
+	if e == nil {
+		return 0
+	}
+
+	age := f.now().Sub(time.Unix(e.LastUsed, 0))
+	count := float64(e.Count)
+	switch {
+	case age < time.Hour:
+		return count * 4
+	case age < 24*time.Hour:
+		return count * 2
+	case age < 7*24*time.Hour:
+		return count / 2
+	default:
+		return count / 4
+	}
+}
+
+// Add records that the given lines were accepted
+func (f *Frecency) Add(lines ...string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	now := f.now().Unix()
+	for _, s := range lines {
+		e, ok := f.entries[s]
+		if !ok {
+			e = &frecencyEntry{}
+			f.entries[s] = e
+		}
+		e.Count++
+		e.LastUsed = now
+	}
+
+	if len(f.entries) <= maxFrecencyEntries {
+		return
+	}
+
+	keys := make([]string, 0, len(f.entries))
+	for k := range f.entries {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return f.score(f.entries[keys[i]]) > f.score(f.entries[keys[j]])
+	})
+	for _, k := range keys[maxFrecencyEntries:] {
+		delete(f.entries, k)
+	}
+}
+
+// Save writes the database to disk
+func (f *Frecency) Save() error {
+	f.mutex.Lock()
+	buf, err := json.Marshal(f.entries)
+	f.mutex.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "failed to encode frecency database")
+	}
+
+	dir := filepath.Dir(f.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrap(err, "failed to create frecency directory")
+	}
+
+	// Write to a temporary file first, so that the database is not
+	// left half written if something goes wrong
+	tmp, err := ioutil.TempFile(dir, filepath.Base(f.path)+".")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary file")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to write frecency database")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "failed to write frecency database")
+	}
+	return errors.Wrap(os.Rename(tmp.Name(), f.path), "failed to save frecency database")
+}
+
+// recordFrecency records the accepted lines in the frecency database,
+// if --frecency is specified
+func (p *Peco) recordFrecency(lines []line.Line) error {
+	f := p.frecency
+	if f == nil || len(lines) == 0 {
+		return nil
+	}
+
+	list := make([]string, len(lines))
+	for i, l := range lines {
+		list[i] = l.Buffer()
+	}
+	f.Add(list...)
+	return f.Save()
+}
+
+// NewFrecencyBuffer creates a new FrecencyBuffer that ranks the lines
+// in `src` using `f`
+func NewFrecencyBuffer(src Buffer, f *Frecency) *FrecencyBuffer {
+	return &FrecencyBuffer{
+		frecency: f,
+		src:      src,
+	}
+}
+
+// rebuild recalculates the order of the lines if the underlying
+// buffer has changed since the last time we looked at it. As long as
+// no line has a score, lines are added and dropped as they are in the
+// underlying buffer. Must be called with the mutex held
+func (fb *FrecencyBuffer) rebuild() {
+	lines, dropped, added, ok := fb.tracker.update(fb.src)
+	if ok && fb.ranked == 0 {
+		for _, l := range added {
+			if fb.frecency.Score(l.Buffer()) > 0 {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			fb.lines = append(fb.lines[len(dropped):], added...)
+			fb.ver.appended += len(added)
+			return
+		}
+	}
+	if ok && len(dropped) == 0 && len(added) == 0 {
+		return
+	}
+
+	type ranked struct {
+		line  line.Line
+		score float64
+	}
+
+	var top []ranked
+	rest := make([]line.Line, 0, len(lines))
+	for _, l := range lines {
+		if score := fb.frecency.Score(l.Buffer()); score > 0 {
+			top = append(top, ranked{line: l, score: score})
+		} else {
+			rest = append(rest, l)
+		}
+	}
+	sort.SliceStable(top, func(i, j int) bool {
+		return top[i].score > top[j].score
+	})
+
+	ordered := make([]line.Line, 0, len(lines))
+	for _, r := range top {
+		ordered = append(ordered, r.line)
+	}
+	fb.lines = append(ordered, rest...)
+	fb.ranked = len(top)
+	fb.ver = bufferVersion{gen: newBufferGen(), appended: len(fb.lines)}
+}
+
+// Size returns the number of lines in the buffer
+func (fb *FrecencyBuffer) Size() int {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	fb.rebuild()
+	return bufferSize(fb.lines)
+}
+
+// LineAt returns the line at index `n`
+func (fb *FrecencyBuffer) LineAt(n int) (line.Line, error) {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	fb.rebuild()
+	return bufferLineAt(fb.lines, n)
+}
+
+func (fb *FrecencyBuffer) linesInRange(start, end int) []line.Line {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	fb.rebuild()
+	return bufferLinesInRange(fb.lines, start, end)
+}
+
+// versionedLines returns the ranked lines, and their version
+func (fb *FrecencyBuffer) versionedLines() ([]line.Line, bufferVersion) {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	fb.rebuild()
+	n := len(fb.lines)
+	return fb.lines[:n:n], fb.ver
+}
+
+// release drops the ranked lines, and releases the buffer that this
+// FrecencyBuffer decorates
+func (fb *FrecencyBuffer) release() int {
+	fb.mutex.Lock()
+	fb.lines = nil
+	fb.ranked = 0
+	fb.tracker.reset()
+	fb.mutex.Unlock()
+	return releaseBuffer(fb.src)
+}
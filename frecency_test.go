@@ -0,0 +1,92 @@
+package peco
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/peco/peco/line"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrecency(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peco-test-frecency-")
+	if !assert.NoError(t, err, "TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "files")
+	f, err := LoadFrecency(path)
+	if !assert.NoError(t, err, "loading a missing database should succeed") {
+		return
+	}
+
+	now := time.Now()
+	f.now = func() time.Time { return now }
+	f.Add("old", "old", "old")
+	now = now.Add(30 * 24 * time.Hour)
+	f.Add("recent")
+
+	assert.Equal(t, 0.75, f.Score("old"), "old lines should score less")
+	assert.Equal(t, float64(4), f.Score("recent"), "recent lines should score more")
+	assert.Equal(t, float64(0), f.Score("never"), "lines that were never accepted should score 0")
+
+	if !assert.NoError(t, f.Save(), "Save should succeed") {
+		return
+	}
+	loaded, err := LoadFrecency(path)
+	if !assert.NoError(t, err, "LoadFrecency should succeed") {
+		return
+	}
+	loaded.now = f.now
+	assert.Equal(t, 0.75, loaded.Score("old"), "scores should be persisted")
+	assert.Equal(t, float64(4), loaded.Score("recent"), "scores should be persisted")
+
+	src := NewMemoryBuffer()
+	for i, s := range []string{"foo", "old", "bar", "recent"} {
+		src.lines = append(src.lines, line.NewRaw(uint64(i), s, false))
+	}
+	b := NewFrecencyBuffer(src, loaded)
+	var lines []string
+	for i := 0; i < b.Size(); i++ {
+		l, err := b.LineAt(i)
+		if !assert.NoError(t, err, "LineAt should succeed") {
+			return
+		}
+		lines = append(lines, l.DisplayString())
+	}
+	assert.Equal(t, []string{"recent", "old", "foo", "bar"}, lines, "lines should be ranked by their score")
+}
+
+func TestFrecencyBufferFollowsSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peco-test-frecency-")
+	if !assert.NoError(t, err, "TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := LoadFrecency(filepath.Join(dir, "frecency.json"))
+	if !assert.NoError(t, err, "LoadFrecency should succeed") {
+		return
+	}
+	f.Add("recent")
+
+	src := NewSource("-", strings.NewReader(""), false, nil, 2, false)
+	b := NewFrecencyBuffer(src, f)
+	src.Append(line.NewRaw(1, "foo", false))
+	src.Append(line.NewRaw(2, "bar", false))
+	if !assert.Equal(t, []string{"foo", "bar"}, bufferStrings(b), "lines without a score should keep their order") {
+		return
+	}
+
+	src.Append(line.NewRaw(3, "baz", false))
+	if !assert.Equal(t, []string{"bar", "baz"}, bufferStrings(b), "lines should follow the source once it is full") {
+		return
+	}
+	src.Append(line.NewRaw(4, "recent", false))
+	assert.Equal(t, []string{"recent", "baz"}, bufferStrings(b), "lines with a score should come first")
+}
@@ -11,4 +11,6 @@ require (
 	github.com/pkg/errors v0.9.1
 	github.com/rivo/uniseg v0.4.4 // indirect
 	github.com/stretchr/testify v1.8.4
+	go.uber.org/goleak v1.1.12
+	golang.org/x/text v0.13.0
 )
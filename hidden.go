@@ -0,0 +1,213 @@
+package peco
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/btree"
+	"github.com/lestrrat-go/pdebug"
+	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/internal/i18n"
+	"github.com/peco/peco/line"
+)
+
+// NewHiddenLines creates a new empty HiddenLines
+func NewHiddenLines() *HiddenLines {
+	return &HiddenLines{ids: make(map[uint64]struct{})}
+}
+
+// Add hides the given line. Group headers cannot be hidden
+func (h *HiddenLines) Add(l line.Line) {
+	if isGroupHeader(l) {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if _, ok := h.ids[l.ID()]; !ok {
+		h.ids[l.ID()] = struct{}{}
+		h.gen++
+	}
+}
+
+// Has returns true if the line with the given ID is hidden
+func (h *HiddenLines) Has(id uint64) bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	_, ok := h.ids[id]
+	return ok
+}
+
+// Len returns the number of hidden lines
+func (h *HiddenLines) Len() int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return len(h.ids)
+}
+
+// generation returns a number that changes each time a line is hidden
+func (h *HiddenLines) generation() uint64 {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.gen
+}
+
+// NewHiddenBuffer creates a new HiddenBuffer that leaves out the lines
+// in `src` that are in `hidden`, including those hidden later on
+func NewHiddenBuffer(src Buffer, hidden *HiddenLines) *HiddenBuffer {
+	return &HiddenBuffer{
+		hidden: hidden,
+		src:    src,
+	}
+}
+
+// rebuild updates the visible lines if the underlying buffer, or the
+// hidden lines, have changed since the last time we looked at them.
+// Lines added to the underlying buffer, or dropped from it, are
+// filtered on their own, but all of the lines are filtered again once
+// another line is hidden. Until a line is hidden, the lines of the
+// underlying buffer are used as is, and this returns false. Must be
+// called with the mutex held
+func (hb *HiddenBuffer) rebuild() bool {
+	gen := hb.hidden.generation()
+	if gen == 0 {
+		return false
+	}
+
+	lines, dropped, added, ok := hb.tracker.update(hb.src)
+	if ok && gen == hb.gen {
+		var n int
+		for _, l := range dropped {
+			if !hb.hidden.Has(l.ID()) {
+				n++
+			}
+		}
+		hb.lines = hb.lines[n:]
+		for _, l := range added {
+			if !hb.hidden.Has(l.ID()) {
+				hb.lines = append(hb.lines, l)
+				hb.ver.appended++
+			}
+		}
+		return true
+	}
+
+	visible := make([]line.Line, 0, len(lines))
+	for _, l := range lines {
+		if !hb.hidden.Has(l.ID()) {
+			visible = append(visible, l)
+		}
+	}
+
+	hb.lines = visible
+	hb.gen = gen
+	hb.ver = bufferVersion{gen: newBufferGen(), appended: len(visible)}
+	return true
+}
+
+// Size returns the number of lines in the buffer
+func (hb *HiddenBuffer) Size() int {
+	hb.mutex.Lock()
+	defer hb.mutex.Unlock()
+	if !hb.rebuild() {
+		return hb.src.Size()
+	}
+	return bufferSize(hb.lines)
+}
+
+// LineAt returns the line at index `n`
+func (hb *HiddenBuffer) LineAt(n int) (line.Line, error) {
+	hb.mutex.Lock()
+	defer hb.mutex.Unlock()
+	if !hb.rebuild() {
+		return hb.src.LineAt(n)
+	}
+	return bufferLineAt(hb.lines, n)
+}
+
+func (hb *HiddenBuffer) linesInRange(start, end int) []line.Line {
+	hb.mutex.Lock()
+	defer hb.mutex.Unlock()
+	if !hb.rebuild() {
+		return hb.src.linesInRange(start, end)
+	}
+	return bufferLinesInRange(hb.lines, start, end)
+}
+
+// versionedLines returns the visible lines, and their version
+func (hb *HiddenBuffer) versionedLines() ([]line.Line, bufferVersion) {
+	hb.mutex.Lock()
+	defer hb.mutex.Unlock()
+	if !hb.rebuild() {
+		return versionedLines(hb.src)
+	}
+	n := len(hb.lines)
+	return hb.lines[:n:n], hb.ver
+}
+
+// release drops the visible lines, and releases the buffer that this
+// HiddenBuffer decorates
+func (hb *HiddenBuffer) release() int {
+	hb.mutex.Lock()
+	hb.lines = nil
+	hb.gen = 0
+	hb.tracker.reset()
+	hb.mutex.Unlock()
+	return releaseBuffer(hb.src)
+}
+
+// HiddenLines returns the lines that have been deleted with
+// peco.DeleteLine or peco.DeleteSelected
+func (p *Peco) HiddenLines() *HiddenLines {
+	return p.hidden
+}
+
+// hideLines hides the lines in sel for the rest of the session, and
+// removes them from the selection
+func hideLines(ctx context.Context, state *Peco, sel *Selection) {
+	sel.Ascend(func(it btree.Item) bool {
+		l := it.(line.Line)
+		state.HiddenLines().Add(l)
+		state.Selection().Remove(l)
+		return true
+	})
+
+	state.SendStatusAndClear(ctx, StatusInfo, i18n.Sprintf("Deleted %d lines", sel.Len()), 2*time.Second)
+	state.Hub().SendDraw(ctx, &DrawOptions{DisableCache: true})
+}
+
+// doDeleteLine hides the line under the cursor from the list for the
+// rest of the session. The input is left untouched
+func doDeleteLine(ctx context.Context, state *Peco, e termbox.Event) {
+	if pdebug.Enabled {
+		g := pdebug.Marker("doDeleteLine")
+		defer g.End()
+	}
+
+	l, err := state.CurrentLineBuffer().LineAt(state.Location().LineNumber())
+	if err != nil || isGroupHeader(l) {
+		return
+	}
+
+	sel := NewSelection()
+	sel.Add(l)
+	hideLines(ctx, state, sel)
+}
+
+// doDeleteSelected hides the selected lines from the list for the
+// rest of the session. The input is left untouched
+func doDeleteSelected(ctx context.Context, state *Peco, e termbox.Event) {
+	if pdebug.Enabled {
+		g := pdebug.Marker("doDeleteSelected")
+		defer g.End()
+	}
+
+	if state.Selection().Len() == 0 {
+		state.SendStatusAndClear(ctx, StatusWarn, i18n.T("No lines selected"), 500*time.Millisecond)
+		return
+	}
+
+	sel := NewSelection()
+	state.Selection().Copy(sel)
+	hideLines(ctx, state, sel)
+}
@@ -0,0 +1,93 @@
+package peco
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/line"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeleteLine(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	state := newPeco()
+	state.Argv = nil
+	state.Stdin = bytes.NewBufferString("foo\nbar\nbaz\n")
+	go state.Run(ctx)
+	<-state.Ready()
+	<-state.source.SetupDone()
+
+	displayed := func() []string {
+		var lines []string
+		b := state.CurrentLineBuffer()
+		for i := 0; i < b.Size(); i++ {
+			l, err := b.LineAt(i)
+			if err != nil {
+				break
+			}
+			lines = append(lines, l.DisplayString())
+		}
+		return lines
+	}
+
+	state.Location().SetLineNumber(1)
+	doDeleteLine(ctx, state, termbox.Event{})
+	if !assert.Equal(t, []string{"foo", "baz"}, displayed(), "the line under the cursor should be hidden") {
+		return
+	}
+	if !assert.Equal(t, 3, state.source.Size(), "the input should be left untouched") {
+		return
+	}
+
+	l, _ := state.CurrentLineBuffer().LineAt(1)
+	state.Selection().Add(l)
+	doDeleteSelected(ctx, state, termbox.Event{})
+	if !assert.Equal(t, []string{"foo"}, displayed(), "the selected lines should be hidden") {
+		return
+	}
+	if !assert.Equal(t, 0, state.Selection().Len(), "hidden lines should be removed from the selection") {
+		return
+	}
+
+	ch := make(chan struct{})
+	state.Query().Set("ba")
+	state.ExecQuery(func() { close(ch) })
+	<-ch
+	if !assert.Empty(t, displayed(), "hidden lines should not be matched by queries") {
+		return
+	}
+}
+
+func TestHiddenBufferFollowsSource(t *testing.T) {
+	src := NewSource("-", strings.NewReader(""), false, nil, 3, false)
+	hidden := NewHiddenLines()
+	b := NewHiddenBuffer(src, hidden)
+	for i, s := range []string{"foo", "bar", "baz"} {
+		src.Append(line.NewRaw(uint64(i), s, false))
+	}
+
+	l, _ := src.LineAt(1)
+	hidden.Add(l)
+	if !assert.Equal(t, []string{"foo", "baz"}, bufferStrings(b), "hidden lines should be left out") {
+		return
+	}
+
+	src.Append(line.NewRaw(3, "qux", false))
+	if !assert.Equal(t, []string{"baz", "qux"}, bufferStrings(b), "new lines should be added as old ones are dropped") {
+		return
+	}
+	src.Append(line.NewRaw(4, "quux", false))
+	src.Append(line.NewRaw(5, "corge", false))
+	if !assert.Equal(t, []string{"qux", "quux", "corge"}, bufferStrings(b), "lines should follow the source once it is full") {
+		return
+	}
+
+	l, _ = src.LineAt(0)
+	hidden.Add(l)
+	assert.Equal(t, []string{"quux", "corge"}, bufferStrings(b), "lines hidden later should be left out")
+}
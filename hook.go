@@ -0,0 +1,93 @@
+package peco
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/peco/peco/internal/util"
+	"github.com/peco/peco/line"
+	"github.com/pkg/errors"
+)
+
+// Names of the hooks, exposed to their commands as PECO_HOOK
+const (
+	hookStart  = "start"
+	hookAccept = "accept"
+	hookCancel = "cancel"
+)
+
+// errUserCanceled is the cause of the error that peco exits with when
+// the user cancels it
+var errUserCanceled = errors.New("user canceled")
+
+// runHook runs command as the named hook, and waits for it to finish.
+// Hooks are meant for notifications and logging, so their output is
+// discarded. extraEnv is added to the environment of the command
+func (p *Peco) runHook(name, command string, stdin []byte, extraEnv ...string) error {
+	if command == "" {
+		return nil
+	}
+
+	cmd := util.Shell(command)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Env = append(append(p.commandEnv(), `PECO_HOOK=`+name), extraEnv...)
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "failed to run %s hook", name)
+	}
+	return nil
+}
+
+// runStartHook runs the OnStart hook in the background. Failures are
+// displayed in the status bar
+func (p *Peco) runStartHook(ctx context.Context) {
+	command := p.config.Hooks.OnStart
+	if command == "" {
+		return
+	}
+
+	go func() {
+		if err := p.runHook(hookStart, command, nil); err != nil {
+			p.SendStatusAndClear(ctx, StatusError, err.Error(), 2*time.Second)
+		}
+	}()
+}
+
+// runAcceptHook runs the OnAccept hook with the accepted lines, which
+// are sent to its stdin, and stored in PECO_SELECTION. Their IDs are
+// listed as for --exec
+func (p *Peco) runAcceptHook(accepted []line.Line) error {
+	command := p.config.Hooks.OnAccept
+	if command == "" {
+		return nil
+	}
+
+	var stdin bytes.Buffer
+	outputs := make([]string, len(accepted))
+	for i, l := range accepted {
+		stdin.WriteString(l.Buffer())
+		stdin.WriteByte(p.outputSeparator())
+		outputs[i] = l.Output()
+	}
+	idsEnv, removeIDs, err := matchedIDsEnv(accepted)
+	if err != nil {
+		return errors.Wrapf(err, "failed to run %s hook", hookAccept)
+	}
+	defer removeIDs()
+
+	return p.runHook(hookAccept, command, stdin.Bytes(), append([]string{
+		`PECO_MATCHED_LINE_COUNT=` + strconv.Itoa(len(accepted)),
+		`PECO_SELECTION=` + strings.Join(outputs, "\n"),
+	}, idsEnv...)...)
+}
+
+// runCancelHook runs the OnCancel hook, if peco exited because the
+// user canceled it
+func (p *Peco) runCancelHook() error {
+	if errors.Cause(p.Err()) != errUserCanceled {
+		return nil
+	}
+	return p.runHook(hookCancel, p.config.Hooks.OnCancel, nil)
+}
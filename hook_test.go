@@ -0,0 +1,59 @@
+package peco
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/peco/peco/filter"
+	"github.com/peco/peco/line"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires /bin/sh")
+	}
+
+	dir, err := ioutil.TempDir("", "peco-test-")
+	if !assert.NoError(t, err, "creating temporary directory should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+
+	// The hooks are run without starting peco, which would read the
+	// config, along with Hooks, on its own goroutine
+	state := newPeco()
+	state.Filters().Add(filter.NewIgnoreCase())
+	state.currentLineBuffer = NewMemoryBuffer()
+
+	hook := `printf '%s %s %s %s|' "$PECO_HOOK" "$PECO_MATCHED_LINE_COUNT" "$PECO_MATCHED_IDS" "$PECO_SELECTION" >> ` + out + `; cat >> ` + out
+	state.config.Hooks = HooksConfig{OnAccept: hook, OnCancel: hook}
+
+	accepted := []line.Line{line.NewRaw(1, "foo", false), line.NewRaw(2, "bar", false)}
+	if !assert.NoError(t, state.runAcceptHook(accepted), "runAcceptHook should succeed") {
+		return
+	}
+
+	state.err = makeIgnorable(errUserCanceled)
+	if !assert.NoError(t, state.runCancelHook(), "runCancelHook should succeed") {
+		return
+	}
+
+	state.err = makeIgnorable(errCollectResults{})
+	if !assert.NoError(t, state.runCancelHook(), "runCancelHook should succeed") {
+		return
+	}
+
+	buf, err := ioutil.ReadFile(out)
+	if !assert.NoError(t, err, "hooks should have been run") {
+		return
+	}
+	assert.Equal(t, "accept 2 1 2 foo\nbar|foo\nbar\ncancel   |", string(buf), "hooks should receive the selection, and only run when appropriate")
+
+	state.config.Hooks.OnAccept = "exit 1"
+	assert.Error(t, state.runAcceptHook(accepted), "failing hooks should be reported")
+}
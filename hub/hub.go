@@ -3,6 +3,7 @@ package hub
 import (
 	"context"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	pdebug "github.com/lestrrat-go/pdebug"
@@ -29,21 +30,186 @@ func (p payload) Data() interface{} {
 // asynchronous mode (default), it's a no op. Otherwise it
 // closes the reply channel to finish up the synchronous communication
 func (p payload) Done() {
+	if p.release != nil {
+		p.release()
+	}
 	if p.done == nil {
 		return
 	}
 	p.done <- struct{}{}
 }
 
-// NewHub creates a new Hub struct
+// New creates a new Hub struct. bufsiz is the number of messages
+// each lane can hold before senders start blocking
 func New(bufsiz int) *Hub {
-	return &Hub{
-		isSync:      false,
-		queryCh:     make(chan Payload, bufsiz),
-		drawCh:      make(chan Payload, bufsiz),
-		statusMsgCh: make(chan Payload, bufsiz),
-		pagingCh:    make(chan Payload, bufsiz),
+	h := &Hub{
+		isSync: false,
+		bufsiz: bufsiz,
+		closed: make(chan struct{}),
+	}
+	h.qcond = sync.NewCond(&h.qmutex)
+
+	// Queries only matter in their latest form, as do status messages.
+	// Identical draw requests that are still waiting are redundant.
+	// Paging requests must be processed one by one
+	h.lanes[QueryLane] = &lane{id: QueryLane, ch: make(chan Payload), coalesce: coalesceLatest}
+	h.lanes[PagingLane] = &lane{id: PagingLane, ch: make(chan Payload), coalesce: coalesceNone}
+	h.lanes[DrawLane] = &lane{id: DrawLane, ch: make(chan Payload), coalesce: coalesceSame}
+	h.lanes[StatusLane] = &lane{id: StatusLane, ch: make(chan Payload), coalesce: coalesceLatest}
+
+	// Queries are read by the filter, and everything else by the view.
+	// Keystroke driven paging takes precedence over draws, which in
+	// turn take precedence over status messages
+	h.groups = []*laneGroup{
+		{lanes: []*lane{h.lanes[QueryLane]}},
+		{lanes: []*lane{h.lanes[PagingLane], h.lanes[DrawLane], h.lanes[StatusLane]}},
+	}
+	return h
+}
+
+// SetObserver registers an Observer that is notified of messages
+// going through the hub. Specifying nil removes the observer
+func (h *Hub) SetObserver(o Observer) {
+	h.qmutex.Lock()
+	defer h.qmutex.Unlock()
+	h.observer = o
+}
+
+func (h *Hub) groupFor(l *lane) *laneGroup {
+	for _, g := range h.groups {
+		for _, x := range g.lanes {
+			if x == l {
+				return g
+			}
+		}
+	}
+	return nil
+}
+
+// coalescable returns true if data can be compared against other
+// payloads' data to find duplicates
+func coalescable(data interface{}) bool {
+	switch data.(type) {
+	case nil, string, bool:
+		return true
+	}
+	return false
+}
+
+// enqueue adds r to the lane, merging it with a waiting message if
+// the lane allows it. Payloads that are part of a batch are never
+// merged, as their senders are waiting for them to be processed.
+// If the lane is full, enqueue blocks until there's room
+func (h *Hub) enqueue(l *lane, r *payload) {
+	h.qmutex.Lock()
+	defer h.qmutex.Unlock()
+
+	if !r.batch {
+		switch l.coalesce {
+		case coalesceSame:
+			if coalescable(r.data) {
+				for _, x := range l.queue {
+					if !x.batch && coalescable(x.data) && x.data == r.data {
+						if h.observer != nil {
+							h.observer.Coalesce(l.id)
+						}
+						return
+					}
+				}
+			}
+		case coalesceLatest:
+			if n := len(l.queue); n > 0 && !l.queue[n-1].batch {
+				r.enqueued = l.queue[n-1].enqueued
+				r.release = l.queue[n-1].release
+				l.queue[n-1] = r
+				if h.observer != nil {
+					h.observer.Coalesce(l.id)
+				}
+				return
+			}
+		}
+	}
+
+	for h.bufsiz > 0 && len(l.queue) >= h.bufsiz {
+		h.qcond.Wait()
+	}
+
+	r.enqueued = time.Now()
+	r.release = h.release
+	atomic.AddInt64(&h.inflight, 1)
+	l.queue = append(l.queue, r)
+	if h.observer != nil {
+		h.observer.Enqueue(l.id, len(l.queue))
+	}
+
+	// The dispatcher only runs while there are messages to deliver
+	if g := h.groupFor(l); !g.running {
+		g.running = true
+		go h.dispatch(g)
+	}
+}
+
+func (h *Hub) release() {
+	atomic.AddInt64(&h.inflight, -1)
+}
+
+// Idle returns true if there are no messages waiting to be delivered,
+// and all messages that have been delivered have been marked as done
+func (h *Hub) Idle() bool {
+	return atomic.LoadInt64(&h.inflight) == 0
+}
+
+// dequeue pops the next message to be delivered from the group,
+// in order of priority. It returns nil if there are no messages,
+// in which case the group is marked as not running.
+func (h *Hub) dequeue(g *laneGroup) (*lane, *payload) {
+	h.qmutex.Lock()
+	defer h.qmutex.Unlock()
+
+	for _, l := range g.lanes {
+		if len(l.queue) == 0 {
+			continue
+		}
+		r := l.queue[0]
+		l.queue[0] = nil
+		l.queue = l.queue[1:]
+		h.qcond.Broadcast()
+		return l, r
 	}
+	g.running = false
+	return nil, nil
+}
+
+func (h *Hub) dispatch(g *laneGroup) {
+	for {
+		l, r := h.dequeue(g)
+		if r == nil {
+			return
+		}
+
+		select {
+		case l.ch <- r:
+		case <-h.closed:
+			// Nobody receives messages anymore. Mark them as done,
+			// as their senders may be waiting for that
+			r.Done()
+			continue
+		}
+
+		h.qmutex.Lock()
+		o := h.observer
+		h.qmutex.Unlock()
+		if o != nil {
+			o.Dispatch(l.id, time.Since(r.enqueued))
+		}
+	}
+}
+
+// Close stops delivering messages, for when their receivers are gone.
+// Messages that are still waiting to be delivered, or that are sent
+// afterwards, are dropped and marked as done
+func (h *Hub) Close() {
+	h.closing.Do(func() { close(h.closed) })
 }
 
 type operationNameKey struct{}
@@ -95,7 +261,7 @@ func isBatchCtx(ctx context.Context) bool {
 }
 
 // low-level utility
-func send(ctx context.Context, ch chan Payload, r *payload) {
+func (h *Hub) send(ctx context.Context, l *lane, r *payload) {
 	isBatchMode := isBatchCtx(ctx)
 	if pdebug.Enabled {
 		g := pdebug.Marker("hub.send %#v (name=%s, isBatchMode=%t)", r, ctx.Value(operationNameKey{}), isBatchMode)
@@ -110,39 +276,39 @@ func send(ctx context.Context, ch chan Payload, r *payload) {
 		defer r.waitDone()
 	}
 
-	ch <- r
+	h.enqueue(l, r)
 }
 
 // QueryCh returns the underlying channel for queries
 func (h *Hub) QueryCh() chan Payload {
-	return h.queryCh
+	return h.lanes[QueryLane].ch
 }
 
 // SendQuery sends the query string to be processed by the Filter
 func (h *Hub) SendQuery(ctx context.Context, q string) {
-	send(context.WithValue(ctx, operationNameKey{}, "send query"), h.QueryCh(), NewPayload(q, isBatchCtx(ctx)))
+	h.send(context.WithValue(ctx, operationNameKey{}, "send query"), h.lanes[QueryLane], NewPayload(q, isBatchCtx(ctx)))
 }
 
 // DrawCh returns the channel to redraw the terminal display
 func (h *Hub) DrawCh() chan Payload {
-	return h.drawCh
+	return h.lanes[DrawLane].ch
 }
 
 // SendDrawPrompt sends a request to redraw the prompt only
 func (h *Hub) SendDrawPrompt(ctx context.Context) {
-	send(ctx, h.DrawCh(), NewPayload("prompt", isBatchCtx(ctx)))
+	h.send(ctx, h.lanes[DrawLane], NewPayload("prompt", isBatchCtx(ctx)))
 }
 
 // SendDraw sends a request to redraw the terminal display
 func (h *Hub) SendDraw(ctx context.Context, options interface{}) {
 	pdebug.Printf("START Hub.SendDraw %v", options)
 	defer pdebug.Printf("END Hub.SendDraw %v", options)
-	send(ctx, h.DrawCh(), NewPayload(options, isBatchCtx(ctx)))
+	h.send(ctx, h.lanes[DrawLane], NewPayload(options, isBatchCtx(ctx)))
 }
 
 // StatusMsgCh returns the channel to update the status message
 func (h *Hub) StatusMsgCh() chan Payload {
-	return h.statusMsgCh
+	return h.lanes[StatusLane].ch
 }
 
 // SendStatusMsg sends a string to be displayed in the status message
@@ -179,19 +345,19 @@ func newStatusMsgReq(s string, d time.Duration) *statusMsgReq {
 // as well as a delay until the message should be cleared
 func (h *Hub) SendStatusMsgAndClear(ctx context.Context, q string, clearDelay time.Duration) {
 	msg := newStatusMsgReq(q, clearDelay)
-	send(ctx, h.StatusMsgCh(), NewPayload(msg, isBatchCtx(ctx)))
+	h.send(ctx, h.lanes[StatusLane], NewPayload(msg, isBatchCtx(ctx)))
 }
 
 func (h *Hub) SendPurgeDisplayCache(ctx context.Context) {
-	send(ctx, h.DrawCh(), NewPayload("purgeCache", isBatchCtx(ctx)))
+	h.send(ctx, h.lanes[DrawLane], NewPayload("purgeCache", isBatchCtx(ctx)))
 }
 
 // PagingCh returns the channel to page through the results
 func (h *Hub) PagingCh() chan Payload {
-	return h.pagingCh
+	return h.lanes[PagingLane].ch
 }
 
 // SendPaging sends a request to move the cursor around
 func (h *Hub) SendPaging(ctx context.Context, x interface{}) {
-	send(ctx, h.PagingCh(), NewPayload(x, isBatchCtx(ctx)))
+	h.send(ctx, h.lanes[PagingLane], NewPayload(x, isBatchCtx(ctx)))
 }
@@ -2,6 +2,7 @@ package hub_test
 
 import (
 	"context"
+	"sync"
 	"testing"
 	"time"
 
@@ -86,3 +87,93 @@ func TestHub(t *testing.T) {
 		}
 	}
 }
+
+type countingObserver struct {
+	mutex     sync.Mutex
+	coalesced map[hub.Lane]int
+}
+
+func (o *countingObserver) Enqueue(hub.Lane, int)            {}
+func (o *countingObserver) Dispatch(hub.Lane, time.Duration) {}
+func (o *countingObserver) Coalesce(l hub.Lane) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.coalesced[l]++
+}
+
+func TestHubPriority(t *testing.T) {
+	ctx := context.Background()
+
+	h := hub.New(5)
+	o := &countingObserver{coalesced: make(map[hub.Lane]int)}
+	h.SetObserver(o)
+
+	h.SendPaging(ctx, 1)
+	h.SendDraw(ctx, nil)
+	h.SendStatusMsg(ctx, "first")
+	h.SendDraw(ctx, nil)
+	h.SendStatusMsg(ctx, "second")
+	h.SendDraw(ctx, nil)
+	h.SendPaging(ctx, 2)
+
+	var got []interface{}
+	timeout := time.After(time.Second)
+	for len(got) < 4 {
+		select {
+		case <-timeout:
+			t.Fatalf("timed out waiting for messages, got %v", got)
+		case r := <-h.PagingCh():
+			got = append(got, r.Data())
+		case r := <-h.DrawCh():
+			got = append(got, r.Data())
+		case r := <-h.StatusMsgCh():
+			got = append(got, r.Data().(hub.StatusMsg).Message())
+		}
+	}
+
+	expected := []interface{}{1, 2, nil, "second"}
+	for i, v := range expected {
+		if got[i] != v {
+			t.Errorf("expected message %d to be %v, got %v", i, v, got[i])
+		}
+	}
+
+	select {
+	case r := <-h.DrawCh():
+		t.Errorf("expected draws to be coalesced, got extra draw %v", r.Data())
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.coalesced[hub.DrawLane] != 2 {
+		t.Errorf("expected 2 coalesced draws, got %d", o.coalesced[hub.DrawLane])
+	}
+	if o.coalesced[hub.StatusLane] != 1 {
+		t.Errorf("expected 1 coalesced status message, got %d", o.coalesced[hub.StatusLane])
+	}
+}
+
+func TestHubClose(t *testing.T) {
+	h := hub.New(5)
+	h.Close()
+
+	// Nobody receives the message, but the sender must not be left
+	// waiting for it to be processed
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.Batch(context.Background(), func(ctx context.Context) {
+			h.SendDraw(ctx, nil)
+		}, false)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the message to be dropped")
+	}
+	if !h.Idle() {
+		t.Errorf("expected the hub to be idle once closed")
+	}
+}
@@ -1,17 +1,83 @@
 package hub
 
-import "sync"
+import (
+	"sync"
+	"time"
+)
 
 // Hub acts as the messaging hub between components -- that is,
 // it controls how the communication that goes through channels
 // are handled.
+//
+// Messages are first placed in per-lane queues, and are then handed
+// over to the receiving end by a dispatcher goroutine. Lanes that are
+// read by the same receiver share a dispatcher, which always delivers
+// messages from the lane with the highest priority first.
 type Hub struct {
-	isSync      bool
-	mutex       sync.Mutex
-	queryCh     chan Payload
-	drawCh      chan Payload
-	statusMsgCh chan Payload
-	pagingCh    chan Payload
+	isSync   bool
+	mutex    sync.Mutex
+	qmutex   sync.Mutex
+	qcond    *sync.Cond
+	bufsiz   int
+	lanes    [laneMax]*lane
+	groups   []*laneGroup
+	observer Observer
+	inflight int64 // number of messages that have been queued, but not marked as done
+	closed   chan struct{}
+	closing  sync.Once
+}
+
+// Lane identifies one of the message queues in the Hub
+type Lane int
+
+// List of lanes. Within the same receiver, lanes with a smaller
+// value take precedence over those with a larger value
+const (
+	QueryLane Lane = iota
+	PagingLane
+	DrawLane
+	StatusLane
+	laneMax
+)
+
+// Observer can be registered to a Hub to receive notifications
+// about messages going through it. Methods are called synchronously,
+// so implementations should return quickly
+type Observer interface {
+	// Enqueue is called when a message is added to a lane. depth is
+	// the number of messages waiting in the lane, including this one
+	Enqueue(l Lane, depth int)
+
+	// Coalesce is called when a message is merged into, or replaces
+	// a message that is already waiting in a lane
+	Coalesce(l Lane)
+
+	// Dispatch is called when a message has been handed over to the
+	// receiver. wait is the time the message spent in the lane
+	Dispatch(l Lane, wait time.Duration)
+}
+
+type coalescePolicy int
+
+const (
+	// coalesceNone queues every message
+	coalesceNone coalescePolicy = iota
+	// coalesceSame drops a message if an identical one is already waiting
+	coalesceSame
+	// coalesceLatest replaces the last waiting message with the new one
+	coalesceLatest
+)
+
+type lane struct {
+	id       Lane
+	ch       chan Payload
+	queue    []*payload
+	coalesce coalescePolicy
+}
+
+type laneGroup struct {
+	lanes   []*lane // in order of priority
+	running bool
 }
 
 // Payload is a wrapper around the actual request value that needs
@@ -33,7 +99,9 @@ type Payload interface {
 }
 
 type payload struct {
-	batch bool
-	data interface{}
-	done chan struct{}
+	batch    bool
+	data     interface{}
+	done     chan struct{}
+	enqueued time.Time
+	release  func() // called when the payload is done
 }
@@ -1,6 +1,7 @@
 package peco
 
 import (
+	"sync/atomic"
 	"time"
 
 	"context"
@@ -25,7 +26,13 @@ func (i *Input) Loop(ctx context.Context, cancel func()) error {
 		case <-ctx.Done():
 			return nil
 		case ev := <-i.evsrc:
-			if err := i.handleInputEvent(ctx, ev); err != nil {
+			atomic.StoreInt64(&i.state.lastInputAt, time.Now().UnixNano())
+			if r := i.state.recorder; r != nil {
+				r.Record(ev)
+			}
+			err := i.handleInputEvent(ctx, ev)
+			atomic.AddUint64(&i.state.eventsHandled, 1)
+			if err != nil {
 				return nil
 			}
 		}
@@ -57,7 +64,9 @@ func (i *Input) handleInputEvent(ctx context.Context, ev termbox.Event) error {
 		m.Lock()
 		if ev.Ch == 0 && ev.Key == 27 && i.mod == nil {
 			tmp := ev
+			atomic.AddInt32(&i.state.pendingInput, 1)
 			i.mod = time.AfterFunc(50*time.Millisecond, func() {
+				defer atomic.AddInt32(&i.state.pendingInput, -1)
 				m.Lock()
 				i.mod = nil
 				m.Unlock()
@@ -72,7 +81,9 @@ func (i *Input) handleInputEvent(ctx context.Context, ev termbox.Event) error {
 		// timer, stop it because this is probably Alt+ this new key
 		m.Lock()
 		if i.mod != nil {
-			i.mod.Stop()
+			if i.mod.Stop() {
+				atomic.AddInt32(&i.state.pendingInput, -1)
+			}
 			i.mod = nil
 			ev.Mod |= termbox.ModAlt
 		}
@@ -1,7 +1,11 @@
 package peco
 
 import (
+	"bufio"
+	"encoding/json"
 	"io"
+	"os"
+	"regexp"
 	"sync"
 	"time"
 
@@ -21,16 +25,136 @@ const (
 	errorKey   = "error"
 )
 
+// Values of --selection-order
 const (
-	ToLineAbove       PagingRequestType = iota // ToLineAbove moves the selection to the line above
-	ToScrollPageDown                           // ToScrollPageDown moves the selection to the next page
-	ToLineBelow                                // ToLineBelow moves the selection to the line below
-	ToScrollPageUp                             // ToScrollPageUp moves the selection to the previous page
-	ToScrollLeft                               // ToScrollLeft scrolls screen to the left
-	ToScrollRight                              // ToScrollRight scrolls screen to the right
-	ToLineInPage                               // ToLineInPage jumps to a particular line on the page
-	ToScrollFirstItem                          // ToScrollFirstItem
-	ToScrollLastItem                           // ToScrollLastItem
+	selectionOrderInput  = "input"
+	selectionOrderPicked = "picked"
+)
+
+// Values of --output-mode
+const (
+	outputTruncate = "truncate"
+	outputAppend   = "append"
+)
+
+const (
+	enterLayerPrefix  = "peco.EnterLayer."
+	toggleLayerPrefix = "peco.ToggleLayer."
+
+	saveSelectionPrefix  = "peco.SaveSelectionAs."
+	loadSelectionPrefix  = "peco.LoadSelection."
+	mergeSelectionPrefix = "peco.MergeSelection."
+
+	setBookmarkPrefix = "peco.SetBookmark."
+
+	selectFilterPrefix = "peco.SelectFilter."
+
+	nextTermMatchPrefix     = "peco.NextTermMatch."
+	previousTermMatchPrefix = "peco.PreviousTermMatch."
+)
+
+// DefaultQueryLatencyBudget is how long the results of the previous
+// query are kept on screen while a new query is running, unless
+// QueryLatencyBudget is specified in the config file
+const DefaultQueryLatencyBudget = 100 * time.Millisecond
+
+// DefaultQueryExecDelay is how long peco waits for more keystrokes
+// before running a query on a large input, until it knows how long
+// queries take. MaxQueryExecDelay is the longest that it waits. Both
+// only apply unless QueryExecutionDelay is specified in the config file
+const (
+	DefaultQueryExecDelay = 50 * time.Millisecond
+	MaxQueryExecDelay     = 250 * time.Millisecond
+)
+
+// maxSnapshots is the number of snapshots taken by peco.TakeSnapshot
+// that are kept. Older ones are dropped
+const maxSnapshots = 16
+
+// defaultPopupSize is the width and the height of the popup that peco
+// runs in with --popup, unless specified in the config file
+const defaultPopupSize = "80%"
+
+// leakCheckGrace is how long --debug-leak-check gives goroutines that
+// are on their way out to finish, before reporting them as leaked
+const leakCheckGrace = 500 * time.Millisecond
+
+// Escape sequences that save the title of the terminal on its title
+// stack, and restore it from there. They are supported by xterm and
+// most terminals that emulate it, and ignored by others
+const (
+	pushTitleSequence = "\x1b[22;0t"
+	popTitleSequence  = "\x1b[23;0t"
+)
+
+// Terminals that --popup opens a popup in
+const (
+	popupTmux  = "tmux"
+	popupKitty = "kitty"
+)
+
+// maxMatchedIDsEnv is the number of lines sent to a command up to which
+// their IDs are listed in PECO_MATCHED_IDS. Beyond it, the environment
+// could grow too large for the command to be executed, and the IDs are
+// only listed in PECO_MATCHED_IDS_FILE
+const maxMatchedIDsEnv = 10000
+
+// DefaultInputSettleInterval is how long lines are collected after
+// new input has been read, before the screen is redrawn, unless
+// InputSettleInterval is specified in the config file
+const DefaultInputSettleInterval = 100 * time.Millisecond
+
+const (
+	renderText = "text"
+	renderANSI = "ansi"
+)
+
+const (
+	keymapDumpText = "text"
+	keymapDumpJSON = "json"
+)
+
+// Colors that the terminal supports, for --colors and Colors in the
+// config file
+const (
+	colorsAuto  = "auto"
+	colors256   = "256"
+	colorsBasic = "basic"
+	colorsNone  = "none"
+)
+
+// Values of --tmux
+const (
+	tmuxBuffer = "buffer"
+	tmuxWindow = "window"
+	tmuxPane   = "pane"
+)
+
+// Formats of --print-indices
+const (
+	indicesTSV  = "tsv"
+	indicesJSON = "json"
+)
+
+const (
+	ToLineAbove          PagingRequestType = iota // ToLineAbove moves the selection to the line above
+	ToScrollPageDown                              // ToScrollPageDown moves the selection to the next page
+	ToLineBelow                                   // ToLineBelow moves the selection to the line below
+	ToScrollPageUp                                // ToScrollPageUp moves the selection to the previous page
+	ToScrollLeft                                  // ToScrollLeft scrolls screen to the left
+	ToScrollRight                                 // ToScrollRight scrolls screen to the right
+	ToLineInPage                                  // ToLineInPage jumps to a particular line on the page
+	ToScrollFirstItem                             // ToScrollFirstItem
+	ToScrollLastItem                              // ToScrollLastItem
+	ToScrollHalfPageDown                          // ToScrollHalfPageDown moves the selection half a page down
+	ToScrollHalfPageUp                            // ToScrollHalfPageUp moves the selection half a page up
+)
+
+// These are the values of SortCollation in the config file, which
+// decide how peco.ToggleSort orders the lines
+const (
+	SortCollationCodepoint = "codepoint" // by Unicode code point, the default
+	SortCollationLocale    = "locale"    // by the rules of the locale, from LC_ALL, LC_COLLATE or LANG
 )
 
 const (
@@ -53,7 +177,8 @@ const (
 )
 
 type idgen struct {
-	ch chan uint64
+	ch   chan uint64
+	done chan struct{} // closed once Run returns
 }
 
 // Peco is the global object containing everything required to run peco.
@@ -72,32 +197,87 @@ type Peco struct {
 	config                  Config
 	currentLineBuffer       Buffer
 	enableSep               bool // Enable parsing on separators
-	execOnFinish            string
+	execOnFinish            CommandConfig
 	filters                 filter.Set
+	filterStderr            *statusThrottle
+	groupBy                 *regexp.Regexp // populated if --group-by is specified
+	matchColumn             int            // populated if --match-column is specified
+	columnDelimiter         string         // populated if --column-delimiter is specified
 	idgen                   *idgen
 	initialFilter           string
-	initialQuery            string   // populated if --query is specified
-	inputseq                Inputseq // current key sequence (just the names)
+	initialMatch            *regexp.Regexp // populated if --initial-match is specified
+	initialQuery            string         // populated if --query is specified
+	inputseq                Inputseq       // current key sequence (just the names)
 	keymap                  Keymap
 	layoutType              string
 	location                Location
 	maxScanBufferSize       int
+	maxSelect               int // populated if --max-select or --select-exact is specified
+	minSelect               int // populated if --min-select or --select-exact is specified
 	mutex                   sync.Mutex
 	onCancel                string
+	print0                  bool // True if --print0 is enabled
+	read0                   bool // True if --read0 is enabled
+	quiet                   bool // True if --quiet is enabled
+	spillToDisk             bool // True if --spill-to-disk is enabled
 	printQuery              bool
+	printIndices            string // populated if --print-indices is specified
 	prompt                  string
 	query                   Query
-	queryExecDelay          time.Duration
+	queryExecDelay          time.Duration // see QueryExecutionDelay in Config. adaptive if zero
 	queryExecMutex          sync.Mutex
 	queryExecTimer          *time.Timer
+	queryLatencyBudget      time.Duration // see QueryLatencyBudget in Config
+	idleTimeout             time.Duration // see --timeout. 0 if peco never times out
+	queryStartedMutex       sync.Mutex
+	queryStartedAt          time.Time // when the query currently being run was typed
+	paintLatency            int64     // nanoseconds between the last query and its first paint
+	queryDuration           int64     // nanoseconds taken by the last query that ran to completion
 	readyCh                 chan struct{}
 	resultCh                chan line.Line
+	rprompt                 string
+	runningQueries          int32  // number of queries currently being processed
+	queryInvalid            int32  // 1 if the current query was rejected by the filter
+	following               int32  // 1 while the view follows new lines, see peco.ToggleFollow
+	eventsHandled           uint64 // number of input events that have been handled
+	lastInputAt             int64  // unix nanoseconds of the last input event, see --timeout
+	pendingInput            int32  // number of input events whose handling has been deferred
 	screen                  Screen
 	selection               *Selection
+	selectionOrder          string // see --selection-order
+	uniqueOutput            bool   // true if --unique-output is enabled
+	printNewOnly            bool   // true if --print-new-only is enabled
+	selectionFile           string // see --selection-file
 	selectionPrefix         string
+	selectionBar            bool       // True if --selection-bar is enabled
+	stripCommonPrefix       bool       // True if --strip-common-prefix is enabled
+	maxLineWidth            int        // see --max-line-width. 0 if lines are not truncated
+	maxQueryLength          int        // see --max-query-length. 0 if the query is not limited
+	sessionID               string     // exposed to commands as PECO_SESSION
+	lineStyler              LineStyler // populated if --dim-older-than is specified
+	lineRenderer            LineRenderer
 	selectionRangeStart     RangeStart
-	selectOneAndExit        bool // True if --select-1 is enabled
+	selectOneAndExit        bool            // True if --select-1 is enabled
+	exitZero                bool            // True if --exit-0 is enabled
+	renderOnce              string          // populated if --render-once is specified
+	noTTY                   bool            // True if --no-tty is enabled
+	summary                 bool            // True if --summary is enabled
+	inputs                  []string        // populated if --input is specified
+	sourceCmd               string          // see --source-cmd
+	keys                    []termbox.Event // populated if --keys is specified
+	record                  string          // see --record
+	recorder                *SessionRecorder
+	replay                  *Session // populated if --replay is specified
+	replayConfig            string   // temporary config file written by --replay
+	trace                   string   // see --trace
+	tracer                  pipeline.Tracer
 	singleKeyJumpMode       bool
+	countPrefixMode         bool // true while the user is typing a count prefix
+	countPrefix             int
+	searchMode              bool           // true while the user is typing a pattern for SearchInResults
+	keymapLayer             string         // name of the active keymap layer, if any
+	searchQuery             Query          // pattern being typed for SearchInResults
+	searchPattern           *regexp.Regexp // secondary highlight within the results. nil if none
 	singleKeyJumpPrefixes   []rune
 	singleKeyJumpPrefixMap  map[rune]uint
 	singleKeyJumpShowPrefix bool
@@ -107,8 +287,88 @@ type Peco struct {
 	fuzzyLongestSort        bool
 
 	// Source is where we buffer input. It gets reused when a new query is
-	// executed.
-	source *Source
+	// executed. peco.ReloadInput replaces it while other goroutines
+	// read it, so it is guarded by sourceMutex, and read through
+	// inputSource. cancelSource stops reading the input, and its
+	// command if any
+	sourceMutex  sync.Mutex
+	source       *Source
+	cancelSource func()
+
+	// selectionSets holds the selections saved by SaveSelectionSet
+	selectionSetsMutex sync.Mutex
+	selectionSets      map[string]*Selection
+
+	// bookmarks holds the IDs of the lines bookmarked with
+	// peco.SetBookmark.<name>, keyed by name
+	bookmarksMutex sync.Mutex
+	bookmarks      map[string]uint64
+
+	// selectionFileLines holds the lines listed in --selection-file
+	selectionFileLines map[string]struct{}
+
+	// output is the file that accepted lines are also written to, see
+	// --output. outputWritten is true once something has been written
+	// to it, so that it is only truncated by the first write
+	outputMutex   sync.Mutex
+	output        string
+	outputMode    string
+	outputWritten bool
+
+	// frecency ranks the lines accepted in previous sessions first,
+	// if --frecency is specified
+	frecency *Frecency
+
+	// jumpList holds the positions that the cursor jumped from, for
+	// JumpBack and JumpForward
+	jumpList JumpList
+
+	// snapshots holds the snapshots taken by peco.TakeSnapshot, oldest
+	// first. snapshot is the one being browsed, or nil if the input is
+	// displayed
+	snapshotsMutex sync.Mutex
+	snapshots      []*Snapshot
+	snapshot       *Snapshot
+	snapshotSeq    int
+
+	// hidden holds the lines deleted by peco.DeleteLine and
+	// peco.DeleteSelected
+	hidden *HiddenLines
+
+	// sorter decides whether the lines are sorted, see peco.ToggleSort
+	sorter *LineSorter
+
+	// annotations holds the notes attached to lines by peco.Annotate,
+	// by line ID. savedAnnotations holds those of --annotations, by
+	// the text of the lines, as IDs change from one session to the
+	// next. annotationTarget is the line that a note is being typed
+	// for, or nil
+	annotationsMutex sync.Mutex
+	annotations      map[uint64]string
+	savedAnnotations map[string]string
+	annotationsFile  string // see --annotations
+	annotateOutput   bool   // true if --annotate-output is enabled
+	annotationTarget line.Line
+	annotationQuery  Query
+
+	titleSet bool // true once the title of the terminal has been set
+
+	// shownResults is the buffer that holds the results of the latest
+	// query while they are displayed. It is released once other lines
+	// replace them. freeingMemory is 1 while memory is being returned
+	// to the OS
+	shownResultsMutex sync.Mutex
+	shownResults      Buffer
+	freeingMemory     int32
+
+	// goroutines tracks the goroutines started by Run, which are all
+	// waited for before it returns. leakCheck is true if
+	// --debug-leak-check is enabled
+	goroutines sync.WaitGroup
+	leakCheck  bool
+
+	copyToTmux bool   // true if --tmux includes "buffer"
+	tmuxOpen   string // "window" or "pane" if --tmux includes either
 
 	// cancelFunc is called for Exit()
 	cancelFunc func()
@@ -123,6 +383,14 @@ type MatchIndexer interface {
 	Indices() [][]int
 }
 
+// MatchTermIndexer is implemented by lines that know which query term
+// produced each of their matches
+type MatchTermIndexer interface {
+	// Term returns the ordinal of the query term that produced the
+	// n-th match returned by Indices()
+	Term(int) int
+}
+
 type Keyseq interface {
 	Add(keyseq.KeyList, interface{})
 	AcceptKey(keyseq.Key) (interface{}, error)
@@ -135,18 +403,66 @@ type Keyseq interface {
 // PagingRequest can be sent to move the selection cursor
 type PagingRequestType int
 
+// toCursorAnchor is the type of the requests that keep the cursor on
+// the same line when the results change. They are handled by the view,
+// and never reach the layout
+const toCursorAnchor PagingRequestType = -1
+
 type PagingRequest interface {
 	Type() PagingRequestType
 }
 
 type JumpToLineRequest int
 
+// StatusLevel describes how important a status message is. Messages
+// below the level configured for the Peco object are not displayed.
+// Echoes of what the user is typing (key sequences, count prefixes,
+// search patterns) are not subject to this, as they are part of the
+// input itself
+type StatusLevel int
+
+const (
+	StatusInfo  StatusLevel = iota // StatusInfo is for progress and informational messages
+	StatusWarn                     // StatusWarn is for requests that could not be fulfilled
+	StatusError                    // StatusError is for errors
+)
+
+// CountedPagingRequest repeats the paging request Request Count times,
+// e.g. when a count prefix was entered before SelectDown
+type CountedPagingRequest struct {
+	Request PagingRequestType
+	Count   int
+}
+
+// JumpList records the lines that the cursor was on before it jumped
+// elsewhere, so that the user can go back and forth between them.
+// Lines are stored by their IDs, so that they can be found again after
+// the query changes, as long as they are still in the results
+type JumpList struct {
+	mutex   sync.Mutex
+	entries []uint64
+	current int // index of the entry the cursor is on. len(entries) if none
+}
+
 // Selection stores the line ids that were selected by the user.
 // The contents of the Selection is always sorted from smallest to
 // largest line ID
 type Selection struct {
-	mutex sync.Mutex
-	tree  *btree.BTree
+	limit  int // max number of lines that can be selected. 0 means unlimited
+	mutex  sync.Mutex
+	picked map[uint64]uint64 // order in which lines were selected, by line ID
+	seq    uint64
+	tree   *btree.BTree
+}
+
+// SelectionIterator moves through the lines of a Selection in order
+// of their IDs, starting from a given ID. Each step only looks at the
+// lines next to the current position, so the whole selection does not
+// need to be visited. Lines that are added to or removed from the
+// selection while iterating are taken into account
+type SelectionIterator struct {
+	selection *Selection
+	id        uint64
 }
 
 // Screen hides termbox from the consuming code so that
@@ -167,15 +483,68 @@ type Screen interface {
 
 // Termbox just hands out the processing to the termbox library
 type Termbox struct {
-	mutex     sync.Mutex
-	resumeCh  chan chan struct{}
-	suspendCh chan struct{}
+	mutex       sync.Mutex
+	initialized bool
+	colors      string
+	resumeCh    chan chan struct{}
+	suspendCh   chan struct{}
+}
+
+// Cell is a single character cell on a MemoryScreen
+type Cell struct {
+	Ch rune
+	Fg termbox.Attribute
+	Bg termbox.Attribute
+
+	// wide is true if this cell is covered by the wide character
+	// in the cell to its left
+	wide bool
+}
+
+// MemoryScreen is a Screen that draws into an in-memory grid of
+// cells instead of a terminal. The contents can be exported as plain
+// text or with ANSI escape sequences, which is used by --render-once
+// and by tests
+type MemoryScreen struct {
+	mutex   sync.Mutex
+	width   int
+	height  int
+	cells   []Cell
+	cursorX int
+	cursorY int
+	flushes int
+	events  chan termbox.Event
+	titles  []string // titles set by SetTitle, the current one last
+}
+
+// titledScreen is implemented by screens that can change the title of
+// the terminal, for TerminalTitle
+type titledScreen interface {
+	// SetTitle saves the current title, and replaces it with title
+	SetTitle(title string) error
+	// RestoreTitle restores the title saved by SetTitle
+	RestoreTitle() error
+}
+
+// DiffScreen wraps another Screen, and keeps track of the cells that
+// have been flushed to it, so that only the cells that have changed
+// since the previous frame are drawn. This reduces flicker on
+// terminals that are slow to redraw, such as the Windows console
+type DiffScreen struct {
+	Screen
+	mutex  sync.Mutex
+	width  int
+	height int
+	back   []Cell // cells of the frame being drawn
+	front  []Cell // cells flushed to Screen. nil if unknown
 }
 
 // View handles the drawing/updating the screen
 type View struct {
-	layout Layout
-	state  *Peco
+	layout      Layout
+	state       *Peco
+	cursorMoves uint64       // number of times the user has moved the cursor
+	sticky      cursorAnchor // see restoreCursorRequest.sticky
 }
 
 // PageCrop filters out a new LineBuffer based on entries
@@ -225,14 +594,98 @@ type StatusBar struct {
 	timerMutex sync.Mutex
 }
 
+// statusThrottle limits how often messages are passed to send.
+// Messages that arrive less than interval after the previous one are
+// held back, and only the latest of them is sent once the interval
+// has passed
+type statusThrottle struct {
+	interval time.Duration
+	last     time.Time
+	mutex    sync.Mutex
+	pending  string
+	send     func(string)
+	timer    *time.Timer
+}
+
 // ListArea represents the area where the actual line buffer is
 // displayed in the screen
 type ListArea struct {
 	*AnchorSettings
 	sortTopDown  bool
-	displayCache []line.Line
+	displayCache []displayCacheEntry
 	dirty        bool
 	styles       *StyleSet
+	lineStyler   LineStyler
+	lineRenderer LineRenderer
+
+	// onCursor is true while the line under the cursor is being
+	// drawn, so that matches are drawn in the MatchedSelected style
+	onCursor bool
+
+	// inSelectionBar is true while the line under the cursor is
+	// being drawn with --selection-bar
+	inSelectionBar bool
+
+	// styleGen is incremented whenever styleKey changes, so that rows
+	// drawn with an older style are not taken from displayCache
+	styleGen uint64
+	styleKey listStyleKey
+}
+
+// displayCacheEntry records what was drawn on a row of a ListArea.
+// The row is only redrawn once any of it changes
+type displayCacheEntry struct {
+	line     line.Line // nil if nothing is cached for the row
+	id       uint64
+	column   int    // horizontal scroll position
+	styleGen uint64 // see ListArea.styleGen
+	fg       termbox.Attribute
+	bg       termbox.Attribute
+	prefix   string
+}
+
+// listStyleKey holds the state that changes how every line in a
+// ListArea is drawn. A new style generation starts whenever it changes
+type listStyleKey struct {
+	searchPattern *regexp.Regexp
+	jumpPrefixes  bool
+	selectionBar  bool
+	commonPrefix  string // hidden by --strip-common-prefix
+}
+
+// LineStyler is used by ListArea to change the style that a line is
+// drawn with. StyleLine receives the foreground and background
+// attributes that would otherwise be used, and returns the ones to use
+type LineStyler interface {
+	StyleLine(line.Line, termbox.Attribute, termbox.Attribute) (termbox.Attribute, termbox.Attribute)
+}
+
+// LineRenderer is used by ListArea to change the text that is
+// displayed for each line, e.g. to shorten paths or to prepend icons.
+// RenderLine receives the display string of the line and the portions
+// of it that matched the query, and returns the string to display and
+// the positions of the same matches within it, in the same order.
+// Matches that are not displayed anymore may be returned as empty ranges
+type LineRenderer interface {
+	RenderLine(l line.Line, s string, matches [][]int) (string, [][]int)
+}
+
+// DefaultLineRenderer is the LineRenderer used when none is
+// configured. It displays lines as they are
+type DefaultLineRenderer struct{}
+
+// ShortenPathLineRenderer is a LineRenderer that replaces the user's
+// home directory with "~" in paths found in lines
+type ShortenPathLineRenderer struct {
+	home string
+}
+
+// StripPrefixLineRenderer is a LineRenderer that replaces a prefix
+// shared by all lines, such as a long base directory, with a marker.
+// The rest is rendered by another LineRenderer
+type StripPrefixLineRenderer struct {
+	prefix func() string
+	next   LineRenderer
 }
 
 // BasicLayout is... the basic layout :) At this point this is the
@@ -248,13 +701,54 @@ type BasicLayout struct {
 // Keymap holds all the key sequence to action map
 type Keymap struct {
 	Config map[string]string
-	Action map[string][]string // custom actions
+	Action map[string][]string      // custom actions
+	Exec   map[string]CommandConfig // custom actions that execute a command
+	Layers map[string]KeymapLayerConfig
 	seq    Keyseq
+	layers map[string]*keymapLayer
+}
+
+// keymapBinding describes a key binding, as printed by --dump-keymap
+type keymapBinding struct {
+	Layer  string `json:"Layer,omitempty"`
+	Key    string `json:"Key"`
+	Action string `json:"Action"`
+	// Sequence holds the actions that are executed, if Action
+	// is a custom action defined in the config file
+	Sequence []string `json:"Sequence,omitempty"`
+	// Custom is true if this binding comes from the config file
+	Custom bool `json:"Custom"`
+}
+
+// keymapLayer holds the compiled key bindings of a layer
+type keymapLayer struct {
+	seq    Keyseq
+	strict bool
+}
+
+// KeymapLayerConfig describes a set of key bindings that can be
+// switched on and off with the peco.EnterLayer.<name>,
+// peco.ToggleLayer.<name> and peco.LeaveLayer actions. While a layer
+// is active, keys are looked up in the layer before the default keymap
+type KeymapLayerConfig struct {
+	Keymap map[string]string `json:"Keymap"`
+
+	// If Strict is true, characters that are not bound in the layer
+	// are ignored, instead of being inserted into the query. Other
+	// keys are still looked up in the default keymap
+	Strict bool `json:"Strict"`
 }
 
 // Filter is responsible for the actual "grep" part of peco
 type Filter struct {
 	state *Peco
+	pool  *workerPool
+
+	// The results of the last query that has been displayed, used to
+	// skip redrawing when a query produces the same results
+	mutex           sync.Mutex
+	last            Buffer
+	lastFingerprint uint64
 }
 
 // Action describes an action that can be executed upon receiving user
@@ -279,10 +773,139 @@ type FilteredBuffer struct {
 	selection []int // maps from our index to src's index
 }
 
+// GroupedBuffer decorates another Buffer, and rearranges its
+// contents so that lines sharing the same group key (as extracted
+// by a regular expression) are placed together, each group
+// preceded by a non-selectable header line
+type GroupedBuffer struct {
+	mutex   sync.Mutex
+	rx      *regexp.Regexp
+	src     Buffer
+	tracker bufferTracker
+	ver     bufferVersion
+	lines   []line.Line
+}
+
+// PinnedBuffer decorates another Buffer, and rearranges its contents
+// so that the lines that were selected when it was created come
+// first, followed by the rest. The relative order of lines is kept
+type PinnedBuffer struct {
+	mutex   sync.Mutex
+	pinned  *Selection
+	src     Buffer
+	tracker bufferTracker
+	ver     bufferVersion
+	lines   []line.Line
+}
+
+// HiddenLines is the set of lines that have been deleted with
+// peco.DeleteLine or peco.DeleteSelected. They are kept in the input,
+// but are not displayed for the rest of the session
+type HiddenLines struct {
+	mutex sync.RWMutex
+	ids   map[uint64]struct{}
+	gen   uint64 // incremented each time a line is hidden
+}
+
+// LineSorter tells the SortedBuffers whether lines are sorted, as
+// toggled by peco.ToggleSort, and how they are compared
+type LineSorter struct {
+	mutex     sync.RWMutex
+	collation string
+	enabled   bool
+	gen       uint64 // incremented each time sorting is toggled
+}
+
+// SortedBuffer decorates another Buffer, and sorts its lines by
+// their text while sorting is enabled. Lines with the same text keep
+// their relative order
+type SortedBuffer struct {
+	mutex    sync.Mutex
+	sorter   *LineSorter
+	collator collator
+	src      Buffer
+	tracker  bufferTracker
+	gen      uint64 // generation of sorter that lines was sorted with
+	ver      bufferVersion
+	lines    []line.Line
+	keys     []string // sort keys of lines
+}
+
+// HiddenBuffer decorates another Buffer, and leaves out the lines
+// that have been hidden. The order of the rest is kept
+type HiddenBuffer struct {
+	mutex   sync.Mutex
+	hidden  *HiddenLines
+	src     Buffer
+	tracker bufferTracker
+	gen     uint64 // generation of hidden that lines was filtered with
+	ver     bufferVersion
+	lines   []line.Line
+}
+
+// FrecencyBuffer decorates another Buffer, and rearranges its
+// contents so that the lines that were accepted in previous sessions
+// come first, ranked by their frecency score, followed by the rest.
+// The relative order of lines with the same score is kept
+type FrecencyBuffer struct {
+	mutex    sync.Mutex
+	frecency *Frecency
+	src      Buffer
+	tracker  bufferTracker
+	ranked   int // number of lines that come first, as they have a score
+	ver      bufferVersion
+	lines    []line.Line
+}
+
+// Frecency is a persisted record of the lines that were accepted
+// for a given input source, used to rank frequently and recently
+// accepted lines first (see --frecency)
+type Frecency struct {
+	mutex   sync.Mutex
+	path    string
+	entries map[string]*frecencyEntry
+	now     func() time.Time
+}
+
+type frecencyEntry struct {
+	Count    int   `json:"count"`
+	LastUsed int64 `json:"last_used"` // unix time
+}
+
+// groupHeader is the line that GroupedBuffer inserts at the
+// beginning of each group. It is displayed, but can never be
+// selected
+type groupHeader struct {
+	id    uint64
+	key   string
+	dirty bool
+}
+
+// ActionConfig is a custom action in the config file. It is either a
+// list of the names of the actions to execute in turn, or an object
+// whose "exec" key is a command to execute
+type ActionConfig struct {
+	Actions []string
+	Exec    CommandConfig
+}
+
+// CommandConfig is a command executed by peco. In the config file, it
+// is either a string, which is run by the shell, or a list of the
+// program and its arguments, which is executed directly
+type CommandConfig struct {
+	Line string
+	Argv []string
+}
+
 // Config holds all the data that can be configured in the
 // external configuration file
 type Config struct {
-	Action map[string][]string `json:"Action"`
+	// Include lists other config files that are read before this
+	// one. Relative paths are resolved against the directory of the
+	// including file
+	Include []string `json:"Include"`
+
+	Action map[string]ActionConfig `json:"Action"`
 	// Keymap used to be directly responsible for dispatching
 	// events against user input, but since then this has changed
 	// into something that just records the user's config input
@@ -292,15 +915,56 @@ type Config struct {
 	InitialFilter       string            `json:"InitialFilter"`
 	Style               StyleSet          `json:"Style"`
 	Prompt              string            `json:"Prompt"`
+	RPrompt             string            `json:"RPrompt"`
 	Layout              string            `json:"Layout"`
 	Use256Color         bool              `json:"Use256Color"`
 	OnCancel            string            `json:"OnCancel"`
 	CustomMatcher       map[string][]string
 	CustomFilter        map[string]CustomFilterConfig
-	QueryExecutionDelay int
+	QueryTransform      QueryTransformConfig `json:"QueryTransform"`
+	QueryExecutionDelay int                  // milliseconds. adaptive if zero, no delay if negative
 	StickySelection     bool
 	MaxScanBufferSize   int
 	FuzzyLongestSort    bool
+	SuppressStatusMsg   bool // Same as --quiet
+
+	// Exec is the command executed with the selected lines instead of
+	// finishing, like --exec, which takes precedence. As a list of the
+	// program and its arguments, it is executed without a shell
+	Exec CommandConfig `json:"Exec"`
+
+	// QueryLatencyBudget is the number of milliseconds that the results
+	// of the previous query are kept on screen while a new query is
+	// running. If the new query takes longer, its partial results are
+	// displayed while the rest is filtered in the background. A
+	// negative value displays partial results right away
+	QueryLatencyBudget int `json:"QueryLatencyBudget"`
+
+	// InputSettleInterval is the number of milliseconds that lines
+	// are collected after new input has been read, before the screen
+	// is redrawn. Nothing is redrawn while no input arrives
+	InputSettleInterval int `json:"InputSettleInterval"`
+
+	// FreeMemoryThreshold is the number of lines that the results of a
+	// query must have held, for the memory to be returned to the OS
+	// once other results replace them. 0 leaves it to the runtime
+	FreeMemoryThreshold int `json:"FreeMemoryThreshold"`
+
+	// TermMatchCounts counts the lines matched by each term of a query
+	// that matched nothing, and tells which terms are to blame
+	TermMatchCounts bool `json:"TermMatchCounts"`
+
+	// TerminalTitle sets the title of the terminal to the name of the
+	// input while peco runs, and restores the previous title on exit
+	TerminalTitle bool `json:"TerminalTitle"`
+
+	// Layers are additional sets of key bindings that can be
+	// switched on and off, for modal workflows
+	Layers map[string]KeymapLayerConfig `json:"Layers"`
+
+	// Timestamp configures how leading timestamps are detected
+	// when dimming old lines (see --dim-older-than)
+	Timestamp TimestampConfig `json:"Timestamp"`
 
 	// If this is true, then the prefix for single key jump mode
 	// is displayed by default.
@@ -308,6 +972,106 @@ type Config struct {
 
 	// Use this prefix to denote currently selected line
 	SelectionPrefix string `json:"SelectionPrefix"`
+
+	// SelectionBar draws the line under the cursor in reverse video
+	// across the full width of the screen. Same as --selection-bar
+	SelectionBar bool `json:"SelectionBar"`
+
+	// MaxLineWidth truncates displayed lines at this many columns.
+	// Same as --max-line-width
+	MaxLineWidth int `json:"MaxLineWidth"`
+
+	// MaxQueryLength limits the query to this many characters.
+	// Same as --max-query-length
+	MaxQueryLength int `json:"MaxQueryLength"`
+
+	// Colors are the colors that the terminal supports: "auto",
+	// "256", "basic" or "none". Same as --colors
+	Colors string `json:"Colors"`
+
+	// Filters are the names of the filters that peco.RotateFilter
+	// cycles through, in that order. Built-in filters that are not
+	// listed are not available. Custom filters that are not listed
+	// come after the listed ones. All filters are used if empty
+	Filters []string `json:"Filters"`
+
+	// StripCommonPrefix hides the prefix shared by all lines when
+	// displaying them. Same as --strip-common-prefix
+	StripCommonPrefix bool `json:"StripCommonPrefix"`
+
+	// LineRenderer is the name of the renderer used to change how
+	// lines are displayed. "Default" or "ShortenPath"
+	LineRenderer string `json:"LineRenderer"`
+
+	// Theme is the name of a built-in theme, or the path to a theme
+	// file, used as the base for Style
+	Theme string `json:"Theme"`
+
+	// Env holds extra environment variables for the commands executed
+	// by peco, which are --exec, custom filters and hooks
+	Env map[string]string `json:"Env"`
+
+	// Hooks are commands that are run at points in the lifecycle of
+	// peco, such as when the user accepts the selection
+	Hooks HooksConfig `json:"Hooks"`
+
+	// Popup is the size of the popup that peco runs in with --popup
+	Popup PopupConfig `json:"Popup"`
+
+	// SelectionSetDir is the directory where selection sets saved with
+	// peco.SaveSelectionAs.<name> are written to, so that they can be
+	// loaded by later invocations of peco. If empty, selection sets
+	// only last for the current session
+	SelectionSetDir string `json:"SelectionSetDir"`
+
+	// FrecencyDir is the directory where the databases used by
+	// --frecency are stored. Defaults to $XDG_DATA_HOME/peco/frecency,
+	// or ~/.local/share/peco/frecency
+	FrecencyDir string `json:"FrecencyDir"`
+
+	// Language is the language of the messages that peco displays,
+	// e.g. "ja". PECO_LANG takes precedence over this setting
+	Language string `json:"Language"`
+
+	// ProjectConfig enables reading .peco/config.json from the current
+	// directory on top of this config. Same as --project-config
+	ProjectConfig bool `json:"ProjectConfig"`
+
+	// SortCollation is how peco.ToggleSort compares lines: "codepoint"
+	// (the default) or "locale"
+	SortCollation string `json:"SortCollation"`
+
+	// deprecated lists the deprecated keys found by ReadFilename. They
+	// are reported by ApplyConfig, once Language has been applied
+	deprecated []deprecatedKey
+}
+
+// deprecatedKey is a deprecated config key, along with the key that
+// replaces it
+type deprecatedKey struct {
+	name        string
+	replacement string
+}
+
+// TimestampConfig is used to specify how timestamps at the beginning
+// of lines are detected, and how old a line must be before it is dimmed
+type TimestampConfig struct {
+	// DimOlderThan is the number of minutes after which a line is
+	// dimmed. Zero disables dimming. Same as --dim-older-than
+	DimOlderThan int `json:"DimOlderThan"`
+
+	// Patterns are the timestamp formats to look for. If empty,
+	// DefaultTimestampPatterns are used
+	Patterns []TimestampPattern `json:"Patterns"`
+}
+
+// TimestampPattern describes a timestamp format. Pattern is a regular
+// expression that matches the timestamp at the beginning of a line,
+// and Layout is the format, as understood by time.Parse, used to parse
+// the matched text (or its first capture group, if any)
+type TimestampPattern struct {
+	Pattern string `json:"Pattern"`
+	Layout  string `json:"Layout"`
 }
 
 type SingleKeyJumpConfig struct {
@@ -331,6 +1095,64 @@ type CustomFilterConfig struct {
 	// more often, but you pay the penalty of invoking that command
 	// more times.
 	BufferThreshold int
+
+	// FlushInterval is the number of milliseconds after which the
+	// external command is invoked with the lines buffered so far,
+	// even if BufferThreshold lines have not been buffered yet. If
+	// unspecified, the command is invoked every 50 milliseconds. A
+	// negative value means that the command is only invoked once
+	// BufferThreshold lines have been buffered, or the input ends
+	FlushInterval int
+
+	// If Incremental is true, the external command is started once
+	// per query, and lines are written to it as they are read, instead
+	// of starting the command for every BufferThreshold lines. This is
+	// useful for infinite sources, but the command must write out its
+	// results without waiting for the end of its input
+	Incremental bool
+}
+
+// HooksConfig is used to specify the commands that are run at points
+// in the lifecycle of peco. Each command is executed via the shell,
+// with the same environment variables as --exec, plus PECO_HOOK set
+// to the name of the hook. Empty commands are not run
+type HooksConfig struct {
+	// OnStart is run in the background once the first line of input
+	// has been read
+	OnStart string `json:"OnStart"`
+
+	// OnAccept is run when the user accepts the selection, before the
+	// selected lines are printed or sent to --exec. It receives the
+	// selected lines from stdin, and in PECO_SELECTION
+	OnAccept string `json:"OnAccept"`
+
+	// OnCancel is run when the user cancels peco, after the screen
+	// has been closed
+	OnCancel string `json:"OnCancel"`
+}
+
+// PopupConfig is used to specify the size of the popup that peco runs
+// in with --popup, either in cells, or as a percentage of the terminal
+// such as "80%". Empty values default to defaultPopupSize
+type PopupConfig struct {
+	Width  string `json:"Width"`
+	Height string `json:"Height"`
+}
+
+// QueryTransformConfig is used to specify how the query is
+// rewritten before it is handed to the filter. The query displayed
+// in the prompt is left untouched
+type QueryTransformConfig struct {
+	// Cmd is the name of the command to invoke. Any argument in
+	// Args that is "$QUERY" is replaced with the query, and the
+	// output of the command is used as the new query. The query is
+	// left as is if the command takes more than a second
+	Cmd  string
+	Args []string
+
+	// Template is applied after Cmd. Every occurrence of "$QUERY"
+	// in Template is replaced with the query
+	Template string
 }
 
 // StyleSet holds styles for various sections
@@ -340,6 +1162,22 @@ type StyleSet struct {
 	Selected       Style `json:"Selected"`
 	Query          Style `json:"Query"`
 	Matched        Style `json:"Matched"`
+	SearchMatched  Style `json:"SearchMatched"`
+	Escaped        Style `json:"Escaped"`
+	QueryError     Style `json:"QueryError"`
+	Truncated      Style `json:"Truncated"`
+	Annotation     Style `json:"Annotation"`
+
+	// MatchedPalette, if non-empty, is used instead of Matched to
+	// highlight matches. Each term in the query gets its own style,
+	// cycling through the palette
+	MatchedPalette []Style `json:"MatchedPalette"`
+
+	// MatchedSelected, if specified, is used instead of Matched (or
+	// MatchedPalette) to highlight matches on the line under the
+	// cursor, as the Matched colors may be hard to read against the
+	// background of Selected
+	MatchedSelected *Style `json:"MatchedSelected"`
 }
 
 // Style describes termbox styles
@@ -353,7 +1191,38 @@ type Caret struct {
 	pos   int
 }
 
+// cursorAnchor remembers the line under the cursor before a query is
+// run, so that the cursor can be kept on it once the results are in.
+// It is only accessed by the view goroutine, which moves the cursor
+type cursorAnchor struct {
+	id    uint64
+	moves uint64 // View.cursorMoves when the anchor was taken
+	valid bool   // false if there was no line under the cursor
+}
+
+// anchorCursorRequest asks the view to fill anchor with the line
+// under the cursor in buffer
+type anchorCursorRequest struct {
+	anchor *cursorAnchor
+	buffer Buffer
+}
+
+// restoreCursorRequest asks the view to move the cursor to the line
+// in buffer that anchor was taken on, unless the user has moved the
+// cursor since
+type restoreCursorRequest struct {
+	anchor *cursorAnchor
+	buffer Buffer
+	// sticky makes later requests restore the cursor to the line of
+	// anchor, instead of their own, until the user moves the cursor.
+	// The results of a query that started earlier then keep it there
+	sticky bool
+}
+
+// Location is where the cursor is, and which part of the results is
+// displayed. It is safe for concurrent use
 type Location struct {
+	mutex   sync.Mutex
 	col     int
 	lineno  int
 	maxPage int
@@ -373,20 +1242,75 @@ type FilterQuery Query
 
 // Source implements pipeline.Source, and is the buffer for the input
 type Source struct {
+	// Accessed atomically, so it comes first to be 64-bit aligned
+	linesRead int64
+
 	pipeline.ChanOutput
 
-	capacity   int
-	enableSep  bool
-	idgen      line.IDGenerator
+	capacity  int
+	dropped   int // number of lines dropped to stay within capacity
+	enableSep bool
+	gen       uint64 // see bufferVersion
+	grown     chan struct{}
+	read0     bool // records are terminated by NUL instead of newline
+	idgen     line.IDGenerator
+	inputs    []*sourceInput
+	origins   []originRun // only recorded if there are multiple inputs
+	lines     []line.Line
+	name      string
+	mutex     sync.RWMutex
+	progress  *progressReader // counts the bytes read from all of the inputs, once Setup starts
+	ready     chan struct{}
+	setupDone chan struct{}
+	setupOnce sync.Once
+	size      int64      // total size of the inputs, or -1 if unknown
+	spill     *spillFile // populated if --spill-to-disk is specified
+
+	// commonPrefix is shared by the displayed strings of all of the
+	// lines, if trackPrefix is true. see --strip-common-prefix
+	commonPrefix string
+	prefixLines  int
+	trackPrefix  bool
+}
+
+// sourceInput is one of the streams that a Source reads lines from
+type sourceInput struct {
+	name       string
 	in         io.Reader
-	inClosed   bool
+	open       func() (io.Reader, error) // opens in when reading starts, if in is nil
 	isInfinite bool
-	lines      []line.Line
-	name       string
-	mutex      sync.RWMutex
-	ready      chan struct{}
-	setupDone  chan struct{}
-	setupOnce  sync.Once
+	closed     bool // protected by the Source's mutex
+}
+
+// sourceLine is a line read from the input-th input of a Source
+type sourceLine struct {
+	input int
+	text  string
+}
+
+// originRun records that the lines starting with the ID from, up to
+// the next run, were read from the input-th input of a Source
+type originRun struct {
+	from  uint64
+	input int
+}
+
+// progressReader counts the number of bytes read through it, so
+// that the progress of reading the input can be displayed
+type progressReader struct {
+	io.Reader
+	read  int64           // accessed atomically
+	total *progressReader // if not nil, also counts the bytes read
+}
+
+// spillFile stores lines that overflowed the Source's capacity on
+// disk, so that they can still be matched against queries
+type spillFile struct {
+	mutex sync.Mutex
+	file  *os.File
+	w     *bufio.Writer
+	size  int64
+	count int
 }
 
 type State interface {
@@ -402,27 +1326,118 @@ type State interface {
 }
 
 type CLIOptions struct {
-	OptHelp            bool   `short:"h" long:"help" description:"show this help message and exit"`
-	OptQuery           string `long:"query" description:"initial value for query"`
-	OptRcfile          string `long:"rcfile" description:"path to the settings file"`
-	OptVersion         bool   `long:"version" description:"print the version and exit"`
-	OptBufferSize      int    `long:"buffer-size" short:"b" description:"number of lines to keep in search buffer"`
-	OptEnableNullSep   bool   `long:"null" description:"expect NUL (\\0) as separator for target/output"`
-	OptInitialIndex    int    `long:"initial-index" description:"position of the initial index of the selection (0 base)"`
-	OptInitialMatcher  string `long:"initial-matcher" description:"specify the default matcher (deprecated)"`
-	OptInitialFilter   string `long:"initial-filter" description:"specify the default filter"`
-	OptPrompt          string `long:"prompt" description:"specify the prompt string"`
-	OptLayout          string `long:"layout" description:"layout to be used. 'top-down' or 'bottom-up'. default is 'top-down'"`
-	OptSelect1         bool   `long:"select-1" description:"select first item and immediately exit if the input contains only 1 item"`
-	OptOnCancel        string `long:"on-cancel" description:"specify action on user cancel. 'success' or 'error'.\ndefault is 'success'. This may change in future versions"`
-	OptSelectionPrefix string `long:"selection-prefix" description:"use a prefix instead of changing line color to indicate currently selected lines.\ndefault is to use colors. This option is experimental"`
-	OptExec            string `long:"exec" description:"execute command instead of finishing/terminating peco.\nPlease note that this command will receive selected line(s) from stdin,\nand will be executed via '/bin/sh -c' or 'cmd /c'"`
-	OptPrintQuery      bool   `long:"print-query" description:"print out the current query as first line of output"`
+	OptHelp            bool     `short:"h" long:"help" description:"show this help message and exit"`
+	OptQuery           string   `long:"query" description:"initial value for query"`
+	OptRcfile          string   `long:"rcfile" description:"path to the settings file"`
+	OptVersion         bool     `long:"version" description:"print the version and exit"`
+	OptBufferSize      int      `long:"buffer-size" short:"b" description:"number of lines to keep in search buffer"`
+	OptSpillToDisk     bool     `long:"spill-to-disk" description:"when the buffer size is exceeded, store old lines in a temporary file instead of dropping them"`
+	OptEnableNullSep   bool     `long:"null" description:"expect NUL (\\0) as separator for target/output"`
+	OptInitialIndex    int      `long:"initial-index" description:"position of the initial index of the selection (0 base)"`
+	OptInitialMatch    string   `long:"initial-match" description:"position the initial index of the selection on the first line matching this regular expression"`
+	OptInitialMatcher  string   `long:"initial-matcher" description:"specify the default matcher (deprecated)"`
+	OptInitialFilter   string   `long:"initial-filter" description:"specify the default filter"`
+	OptPrompt          string   `long:"prompt" description:"specify the prompt string"`
+	OptLayout          string   `long:"layout" description:"layout to be used. 'top-down' or 'bottom-up'. default is 'top-down'"`
+	OptSelect1         bool     `long:"select-1" description:"select first item and immediately exit if the input contains only 1 item"`
+	OptExit0           bool     `long:"exit-0" description:"exit immediately with a non-zero status if the initial query matches no lines"`
+	OptOnCancel        string   `long:"on-cancel" description:"specify action on user cancel. 'success' or 'error'.\ndefault is 'success'. This may change in future versions"`
+	OptSelectionPrefix string   `long:"selection-prefix" description:"use a prefix instead of changing line color to indicate currently selected lines.\ndefault is to use colors. This option is experimental"`
+	OptSelectionBar    bool     `long:"selection-bar" description:"draw the line under the cursor in reverse video across the full width of the screen"`
+	OptStripPrefix     bool     `long:"strip-common-prefix" description:"hide the prefix shared by all lines, such as a base directory, when displaying them"`
+	OptMaxLineWidth    int      `long:"max-line-width" description:"truncate displayed lines at this many columns.\nthe whole lines are still matched and printed"`
+	OptMaxQueryLength  int      `long:"max-query-length" description:"do not allow the query to be longer than this many characters,\nand display its length in the prompt"`
+	OptExec            string   `long:"exec" description:"execute command instead of finishing/terminating peco.\nPlease note that this command will receive selected line(s) from stdin,\nand will be executed via '/bin/sh -c' or 'cmd /c'"`
+	OptPrintQuery      bool     `long:"print-query" description:"print out the current query as first line of output"`
+	OptQuiet           bool     `long:"quiet" description:"do not display informational messages in the status bar"`
+	OptPrint0          bool     `long:"print0" description:"separate lines in the output with NUL (\\0) instead of newline"`
+	OptRead0           bool     `long:"read0" description:"read NUL (\\0) terminated records from the input instead of lines. use with --print0 for records that contain newlines"`
+	OptMinSelect       int      `long:"min-select" description:"do not allow finishing until at least this many lines are selected"`
+	OptMaxSelect       int      `long:"max-select" description:"do not allow selecting more than this many lines"`
+	OptSelectExact     int      `long:"select-exact" description:"require exactly this many lines to be selected. same as --min-select N --max-select N"`
+	OptRenderOnce      string   `long:"render-once" optional:"yes" optional-value:"text" description:"print a single frame of what peco would display, and exit.\n'text' or 'ansi' (to include colors). default is 'text'"`
+	OptDumpKeymap      string   `long:"dump-keymap" optional:"yes" optional-value:"text" description:"print the effective key bindings after reading the config file, and exit.\n'text' or 'json'. default is 'text'"`
+	OptMatchColumn     int      `long:"match-column" description:"only match the query against this column (1-based) of each line, while still displaying whole lines"`
+	OptColumnDelimiter string   `long:"column-delimiter" description:"string that separates columns for --match-column. default is runs of whitespace"`
+	OptGroupBy         string   `long:"group-by" description:"group lines under headers using the first capture group of the given regular expression"`
+	OptDimOlderThan    int      `long:"dim-older-than" description:"dim lines whose leading timestamp is older than this many minutes"`
+	OptNoTTY           bool     `long:"no-tty" description:"do not use the terminal. print the lines matching --query, and exit"`
+	OptProjectConfig   bool     `long:"project-config" description:"also read .peco/config.json in the current directory, if it exists"`
+	OptSummary         bool     `long:"summary" description:"on exit, print a summary of the session to stderr"`
+	OptUniqueOutput    bool     `long:"unique-output" description:"print each distinct selected line only once"`
+	OptSelectionOrder  string   `long:"selection-order" description:"order in which the selected lines are printed.\n'input' (the order of the input) or 'picked' (the order they were selected in). default is 'input'"`
+	OptFrecency        string   `long:"frecency" description:"rank lines that were accepted before with the same name first, by how often and how recently they were accepted"`
+	OptSourceCmd       string   `long:"source-cmd" description:"read lines from the output of this shell command, which is run by peco.\nit is killed when peco exits, and run again by peco.ReloadInput"`
+	OptKeys            string   `long:"keys" description:"type these keys once the input is ready, such as 'foo<C-n><Enter>'.\nkeys are named as in the keymap, enclosed in angle brackets. '<lt>' is '<'"`
+	OptInput           []string `long:"input" description:"read lines from this input, in addition to the other --input options.\n'fd:N' for a file descriptor, 'fifo:PATH' for a named pipe, '-' for stdin, or a file name"`
+	OptRecord          string   `long:"record" description:"record the input, key strokes and their timings to this file, so that the session can be reproduced with --replay"`
+	OptRecordHash      bool     `long:"record-hash" description:"with --record, store hashes of the input lines instead of the lines themselves"`
+	OptReplay          string   `long:"replay" description:"replay a session recorded with --record without a terminal, and print the final screen"`
+	OptPrintIndices    string   `long:"print-indices" optional:"yes" optional-value:"tsv" description:"print the ranges of each line that matched the query along with it.\n'tsv' or 'json'. default is 'tsv'"`
+	OptSelectionFile   string   `long:"selection-file" description:"file listing the lines selected in a previous session, for peco.DiffSelectionWithFile and --print-new-only"`
+	OptPrintNewOnly    bool     `long:"print-new-only" description:"only print the selected lines that are not listed in --selection-file"`
+	OptColors          string   `long:"colors" description:"colors that the terminal supports. 'auto', '256', 'basic' or 'none'.\ndefault is 'auto', which guesses them from $TERM"`
+	OptTrace           string   `long:"trace" description:"write the timings of the filtering pipeline to this file, one JSON object per line"`
+	OptDebugLeakCheck  bool     `long:"debug-leak-check" description:"on exit, report the goroutines that are still running to stderr"`
+	OptOutput          string   `long:"output" description:"also write the accepted lines to this file, and to the file that peco.AppendSelectionToFile appends to"`
+	OptOutputMode      string   `long:"output-mode" description:"how --output is written to.\n'truncate' (replace the contents of the file) or 'append'. default is 'truncate'"`
+	OptAnnotations     string   `long:"annotations" description:"read the notes attached to lines by peco.Annotate from this file, and save them to it"`
+	OptAnnotateOutput  bool     `long:"annotate-output" description:"print the note attached to each line after it, separated by a tab"`
+	OptPopup           bool     `long:"popup" description:"run in a popup centered over the current pane, when running inside tmux or kitty"`
+	OptTmux            string   `long:"tmux" description:"hand the results over to tmux, when running inside tmux. a comma separated list of\n'buffer' (copy the results into a paste buffer), and 'window' or 'pane' (run --exec in a new window or pane)"`
+	OptTimeout         string   `long:"timeout" description:"cancel peco if there is no input for this long, e.g. '30s'.\nthe exit status follows --on-cancel"`
 }
 
 type CLI struct {
 }
 
+// Session is a recording of a peco session, written by --record and
+// reproduced by --replay
+type Session struct {
+	Version int
+	Args    []string // command line arguments, without the program name
+	Config  string   `json:",omitempty"` // contents of the config file
+	Width   int
+	Height  int
+	Hashed  bool // true if Lines holds hashes of the lines that were read
+	Lines   []string
+	Events  []SessionEvent
+}
+
+// SessionEvent is an input event in a Session
+type SessionEvent struct {
+	Delay  int64 // milliseconds since the previous event
+	Type   termbox.EventType
+	Key    termbox.Key      `json:",omitempty"`
+	Ch     string           `json:",omitempty"`
+	Mod    termbox.Modifier `json:",omitempty"`
+	Width  int              `json:",omitempty"`
+	Height int              `json:",omitempty"`
+}
+
+// SessionRecorder collects the input events of a session for --record
+type SessionRecorder struct {
+	mutex   sync.Mutex
+	session Session
+	last    time.Time
+}
+
+// Snapshot holds the lines of the input as they were at some point,
+// so that they can be browsed while the input keeps being read. See
+// peco.TakeSnapshot
+type Snapshot struct {
+	id    int
+	taken time.Time
+	lines []line.Line
+}
+
+// jsonTracer is the pipeline.Tracer used for --trace. It writes
+// each event as a line of JSON
+type jsonTracer struct {
+	mutex sync.Mutex
+	enc   *json.Encoder
+}
+
 type RangeStart struct {
 	val   int
 	valid bool
@@ -436,11 +1451,47 @@ type Buffer interface {
 	Size() int
 }
 
+// bufferReleaser is implemented by buffers that can drop the lines
+// that they hold once they are no longer displayed, so that the lines
+// can be garbage collected even while the buffer is still referenced
+type bufferReleaser interface {
+	// release drops the lines, and returns how many were dropped
+	release() int
+}
+
+// bufferVersion identifies the lines of a buffer at some point. While
+// gen stays the same, lines are only added at the end of the buffer,
+// and dropped from its beginning, so that the buffer holds the last of
+// the lines that were appended to it since gen changed
+type bufferVersion struct {
+	gen      uint64
+	appended int
+}
+
+// versionedBuffer is implemented by buffers that tell how their lines
+// have changed, so that the buffers that decorate them do not need to
+// go through all of the lines each time they change
+type versionedBuffer interface {
+	// versionedLines returns the lines of the buffer, and their version
+	versionedLines() ([]line.Line, bufferVersion)
+}
+
+// bufferTracker follows the changes to the lines of the buffer that a
+// decorating buffer is derived from. The zero value has not seen any
+// lines yet
+type bufferTracker struct {
+	lines []line.Line
+	ver   bufferVersion
+	valid bool
+}
+
 // MemoryBuffer is an implementation of Buffer
 type MemoryBuffer struct {
 	done         chan struct{}
+	gen          uint64 // see bufferVersion
 	lines        []line.Line
 	mutex        sync.RWMutex
+	released     bool // see release
 	PeriodicFunc func()
 }
 
@@ -476,4 +1527,15 @@ type MessageHub interface {
 type filterProcessor struct {
 	filter filter.Filter
 	query  string
+	pool   *workerPool
+	hidden *HiddenLines // lines that are skipped. may be nil
+}
+
+// workerPool is a set of goroutines that is shared by all queries,
+// and that filters chunks of lines for filters that can be applied
+// concurrently
+type workerPool struct {
+	jobs chan func()
+	size int
+	wg   sync.WaitGroup
 }
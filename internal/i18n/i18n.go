@@ -0,0 +1,104 @@
+// Package i18n translates the messages that peco displays to the user.
+//
+// Messages are looked up by their English text, so that untranslated
+// messages, and messages in languages without a catalog, are
+// displayed in English
+package i18n
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// DefaultLanguage is the language used when none is specified
+const DefaultLanguage = "en"
+
+// EnvLanguage is the environment variable that selects the language.
+// It takes precedence over the language specified in the config file
+const EnvLanguage = "PECO_LANG"
+
+// catalogs maps languages to their translations. English needs no
+// catalog, as messages are written in English
+var catalogs = map[string]map[string]string{
+	"en": {},
+	"ja": ja,
+}
+
+var (
+	mutex    sync.RWMutex
+	language = DefaultLanguage
+	catalog  = catalogs[DefaultLanguage]
+)
+
+func init() {
+	if v := os.Getenv(EnvLanguage); v != "" {
+		SetLanguage(v)
+	}
+}
+
+// normalize converts locale names such as "ja_JP.UTF-8" to the
+// language code ("ja")
+func normalize(lang string) string {
+	lang = strings.ToLower(lang)
+	if i := strings.IndexAny(lang, "_-.@"); i >= 0 {
+		lang = lang[:i]
+	}
+	return lang
+}
+
+// SetLanguage selects the language that messages are translated to.
+// It returns false, leaving the current language unchanged, if there
+// is no catalog for lang
+func SetLanguage(lang string) bool {
+	lang = normalize(lang)
+	c, ok := catalogs[lang]
+	if !ok {
+		return false
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	language = lang
+	catalog = c
+	return true
+}
+
+// Language returns the language that messages are translated to
+func Language() string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return language
+}
+
+// Detect returns the language to use: the value of PECO_LANG if it
+// is set, otherwise configured if it is not empty, otherwise
+// DefaultLanguage
+func Detect(configured string) string {
+	if v := os.Getenv(EnvLanguage); v != "" {
+		return v
+	}
+	if configured != "" {
+		return configured
+	}
+	return DefaultLanguage
+}
+
+// T returns the translation of msg in the current language, or msg
+// itself if there is none
+func T(msg string) string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	if v, ok := catalog[msg]; ok {
+		return v
+	}
+	return msg
+}
+
+// Sprintf translates format with T, and formats it with args.
+// Translations may reorder the arguments with explicit argument
+// indexes such as %[2]s
+func Sprintf(format string, args ...interface{}) string {
+	return fmt.Sprintf(T(format), args...)
+}
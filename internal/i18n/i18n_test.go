@@ -0,0 +1,46 @@
+package i18n
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTranslate(t *testing.T) {
+	defer SetLanguage(Language())
+
+	if !assert.True(t, SetLanguage("ja_JP.UTF-8"), "locale names should be accepted") {
+		return
+	}
+	assert.Equal(t, "ja", Language())
+	assert.Equal(t, "入力を待っています...", T("Waiting for input..."))
+	assert.Equal(t, "50 行", Sprintf("%d lines", 50))
+	assert.Equal(t, "All your filters are belongs to us", T("All your filters are belongs to us"), "untranslated messages should be displayed as is")
+
+	assert.False(t, SetLanguage("xx"), "languages without a catalog should be rejected")
+	assert.Equal(t, "ja", Language(), "language should not change")
+
+	assert.True(t, SetLanguage("en"))
+	assert.Equal(t, "Waiting for input...", T("Waiting for input..."))
+}
+
+func TestCatalogFormats(t *testing.T) {
+	// Translations must consume the same number of arguments as the
+	// original message
+	for msg, tr := range ja {
+		assert.Equal(t, strings.Count(msg, "%")-2*strings.Count(msg, "%%"), strings.Count(tr, "%")-2*strings.Count(tr, "%%"), "verbs in %q", msg)
+	}
+}
+
+func TestDetect(t *testing.T) {
+	defer os.Setenv(EnvLanguage, os.Getenv(EnvLanguage))
+
+	os.Unsetenv(EnvLanguage)
+	assert.Equal(t, DefaultLanguage, Detect(""))
+	assert.Equal(t, "ja", Detect("ja"))
+
+	os.Setenv(EnvLanguage, "en")
+	assert.Equal(t, "en", Detect("ja"), "PECO_LANG should take precedence over the config")
+}
@@ -0,0 +1,93 @@
+package i18n
+
+var ja = map[string]string{
+	// Input and filtering
+	"Waiting for input...":                    "入力を待っています...",
+	"%d lines":                                "%d 行",
+	"Running query...":                        "クエリを実行しています...",
+	"Invalid query: %s":                       "無効なクエリです: %s",
+	"Executing %s":                            "%s を実行しています",
+	"%s is deprecated. Use %s":                "%s は非推奨です。%s を使ってください",
+	"Cannot select more than %d lines":        "%d 行より多くは選択できません",
+	"ToggleExactMatch is not supported by %s": "%s では ToggleExactMatch を使えません",
+	"No such filter: %s":                      "フィルタ %s はありません",
+	"Filter: %s":                              "フィルタ: %s",
+
+	// Follow mode
+	"Follow mode on":  "追従モードを有効にしました",
+	"Follow mode off": "追従モードを無効にしました",
+
+	// Snapshots
+	"Took snapshot %d (%d lines)": "スナップショット %d を作成しました (%d 行)",
+	"Snapshot %d (%s)":            "スナップショット %d (%s)",
+	"No older snapshot":           "これより前のスナップショットはありません",
+	"No newer snapshot":           "これより後のスナップショットはありません",
+	"Back to live input":          "ライブ入力に戻りました",
+
+	// Deleted lines
+	"Deleted %d lines": "%d 行を削除しました",
+
+	// Annotations
+	"Note: %s": "メモ: %s",
+
+	// Counts and layers
+	"Count: ":    "回数: ",
+	"Count: %d":  "回数: %d",
+	"Left layer": "レイヤーを抜けました",
+	"Layer: %s":  "レイヤー: %s",
+
+	// Selection
+	"Unpinned selected lines":    "選択行の固定を解除しました",
+	"No lines selected":          "行が選択されていません",
+	"No Selection":               "選択がありません",
+	"Next Selection":             "次の選択",
+	"Next Selection (first)":     "次の選択 (先頭)",
+	"Previous Selection":         "前の選択",
+	"Previous Selection (first)": "前の選択 (先頭)",
+	"Saved %d lines as '%s'":     "%[1]d 行を '%[2]s' として保存しました",
+	"Loaded '%s' (%d lines)":     "'%s' を読み込みました (%d 行)",
+	"Merged '%s' (%d lines)":     "'%s' を統合しました (%d 行)",
+
+	// Selection file
+	"No selection file specified":         "選択ファイルが指定されていません",
+	"%d added, %d removed compared to %s": "%[3]s と比べて %[1]d 行追加、%[2]d 行削除されています",
+
+	// Output file
+	"No output file specified": "出力ファイルが指定されていません",
+	"Appended %d lines to %s":  "%[2]s に %[1]d 行を追記しました",
+
+	// Query limits
+	"The query is limited to %d characters":     "クエリは %d 文字までです",
+	"Only the first %d of %d terms are matched": "%[2]d 語のうち最初の %[1]d 語だけを照合します",
+
+	// Search
+	"Search: %s":           "検索: %s",
+	"No search pattern":    "検索パターンがありません",
+	"No match for %s":      "%s に一致する行がありません",
+	"No match for term %d": "%d 番目の語に一致する行がありません",
+
+	// Jump list and bookmarks
+	"No older position":                   "これより前の位置はありません",
+	"No newer position":                   "これより後の位置はありません",
+	"Bookmark '%s' set":                   "ブックマーク '%s' を設定しました",
+	"Set bookmarks '%s' and '%s' first":   "先にブックマーク '%s' と '%s' を設定してください",
+	"Selected %d lines between bookmarks": "ブックマーク間の %d 行を選択しました",
+
+	// tmux
+	"Not running inside tmux":            "tmux の中で実行されていません",
+	"Copied %d lines to the tmux buffer": "%d 行を tmux のバッファにコピーしました",
+
+	// Case sensitivity
+	"ToggleCaseSensitivity is not supported by %s": "%s では ToggleCaseSensitivity を使えません",
+
+	// Source command
+	"The input can only be reloaded with --source-cmd": "入力を再読み込みできるのは --source-cmd を使った場合だけです",
+
+	// Match counts per term
+	"0 matches: term '%s' matched 0 lines":      "0 件: 語 '%s' に一致する行は 0 行です",
+	"0 matches: no line matches all terms (%s)": "0 件: すべての語に一致する行はありません (%s)",
+
+	// Sorting
+	"Sorted lines":         "行を並べ替えました",
+	"Lines in input order": "行を入力の順に戻しました",
+}
@@ -121,6 +121,61 @@ func ToKeyList(ksk string) (KeyList, error) {
 	return list, nil
 }
 
+// ParseKeys parses a sequence of keys to be typed, such as
+// "foo<C-n><Enter>". Characters stand for themselves, while the keys
+// that ToKey knows by name, such as Enter, C-n or M-x, are enclosed in
+// angle brackets. "<lt>" stands for '<'
+func ParseKeys(s string) (KeyList, error) {
+	list := KeyList{}
+	for len(s) > 0 {
+		if s[0] != '<' {
+			ch, n := utf8.DecodeRuneInString(s)
+			if ch == ' ' {
+				// termbox reports the space bar as a key
+				list = append(list, Key{ModNone, termbox.KeySpace, 0})
+			} else {
+				list = append(list, Key{ModNone, 0, ch})
+			}
+			s = s[n:]
+			continue
+		}
+
+		end := strings.IndexByte(s, '>')
+		if end < 0 {
+			return nil, errors.Errorf("missing '>' after '%s'", s)
+		}
+		k, err := namedKey(s[1:end])
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, k)
+		s = s[end+1:]
+	}
+	return list, nil
+}
+
+// namedKey returns the key called name in ParseKeys. Unlike ToKey, it
+// rejects names that it does not know
+func namedKey(name string) (Key, error) {
+	modifier := ModNone
+	key := name
+	if strings.HasPrefix(key, "M-") && len(key) > 2 {
+		modifier = ModAlt
+		key = key[2:]
+	}
+
+	if k, ok := stringToKey[key]; ok {
+		return Key{modifier, k, 0}, nil
+	}
+	if key == "lt" {
+		return Key{modifier, 0, '<'}, nil
+	}
+	if ch, n := utf8.DecodeRuneInString(key); n == len(key) && ch != utf8.RuneError {
+		return Key{modifier, 0, ch}, nil
+	}
+	return Key{}, errors.Errorf("no such key <%s>", name)
+}
+
 // EventToString returns human readable name for a given termbox.Event
 func EventToString(ev termbox.Event) (string, error) {
 	s := ""
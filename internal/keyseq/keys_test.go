@@ -154,3 +154,34 @@ func TestKeymapStrToKeyValueCh(t *testing.T) {
 	}
 
 }
+
+func TestParseKeys(t *testing.T) {
+	list, err := ParseKeys("a b<C-n><lt><M-x><Enter>")
+	if err != nil {
+		t.Fatalf("ParseKeys should succeed: %s", err)
+	}
+
+	expected := KeyList{
+		{ModNone, 0, 'a'},
+		{ModNone, termbox.KeySpace, 0},
+		{ModNone, 0, 'b'},
+		{ModNone, termbox.KeyCtrlN, 0},
+		{ModNone, 0, '<'},
+		{ModAlt, 0, 'x'},
+		{ModNone, termbox.KeyEnter, 0},
+	}
+	if len(list) != len(expected) {
+		t.Fatalf("expected %d keys, got %d", len(expected), len(list))
+	}
+	for i, k := range expected {
+		if list[i] != k {
+			t.Errorf("expected key %d to be %#v, got %#v", i, k, list[i])
+		}
+	}
+
+	for _, s := range []string{"<Enter", "<Foo>", "<>"} {
+		if _, err := ParseKeys(s); err == nil {
+			t.Errorf("ParseKeys(%q) should fail", s)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// Package tmux runs the tmux commands that peco uses to hand its
+// results over to tmux
+package tmux
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Program is the tmux executable
+var Program = "tmux"
+
+// Inside returns true if peco is running inside tmux, judging by the
+// environment that getenv reads
+func Inside(getenv func(string) string) bool {
+	return getenv("TMUX") != ""
+}
+
+// SetBuffer places text into a new tmux paste buffer, which becomes
+// the one that tmux pastes
+func SetBuffer(text string) error {
+	cmd := exec.Command(Program, "load-buffer", "-")
+	cmd.Stdin = strings.NewReader(text)
+	return run(cmd)
+}
+
+// NewWindow opens a new tmux window that runs the shell command line.
+// env lists variables in the form NAME=value that are added to the
+// environment of the command, which requires tmux 3.0 or later
+func NewWindow(command string, env []string) error {
+	return run(exec.Command(Program, withEnv([]string{"new-window"}, env, command)...))
+}
+
+// SplitWindow splits the current tmux pane, and runs the shell command
+// line in the new pane. env is the same as for NewWindow
+func SplitWindow(command string, env []string) error {
+	return run(exec.Command(Program, withEnv([]string{"split-window"}, env, command)...))
+}
+
+// withEnv appends an -e option to args for each variable in env,
+// followed by command
+func withEnv(args, env []string, command string) []string {
+	for _, v := range env {
+		args = append(args, "-e", v)
+	}
+	return append(args, command)
+}
+
+// DisplayPopup runs the shell command line in a popup centered over
+// the current pane, in the directory dir. width and height are in
+// cells, or a percentage of the pane such as "80%". tmux 3.2 or later
+// is required
+func DisplayPopup(dir, width, height, command string) error {
+	return run(exec.Command(Program, "display-popup", "-E", "-d", dir, "-w", width, "-h", height, command))
+}
+
+// run runs cmd, and reports what tmux printed on failure
+func run(cmd *exec.Cmd) error {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return errors.Wrapf(err, "tmux %s failed: %s", cmd.Args[1], msg)
+		}
+		return errors.Wrapf(err, "tmux %s failed", cmd.Args[1])
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package tmux
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeTmux replaces Program with a script that records its arguments
+// and stdin in dir. The returned function restores Program
+func fakeTmux(t *testing.T, dir string) func() {
+	script := filepath.Join(dir, "tmux")
+	body := "#!/bin/sh\necho \"$@\" > " + filepath.Join(dir, "args") + "\ncat > " + filepath.Join(dir, "stdin") + "\n"
+	if err := ioutil.WriteFile(script, []byte(body), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	old := Program
+	Program = script
+	return func() { Program = old }
+}
+
+func TestTmux(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires /bin/sh")
+	}
+
+	dir, err := ioutil.TempDir("", "peco-tmux-")
+	if !assert.NoError(t, err, "ioutil.TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+	defer fakeTmux(t, dir)()
+
+	read := func(name string) string {
+		buf, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return ""
+		}
+		return string(buf)
+	}
+
+	assert.True(t, Inside(func(string) string { return "/tmp/tmux-1000/default,1,0" }), "TMUX is set")
+	assert.False(t, Inside(func(string) string { return "" }), "TMUX is not set")
+
+	if !assert.NoError(t, SetBuffer("foo\nbar\n"), "SetBuffer should succeed") {
+		return
+	}
+	assert.Equal(t, "load-buffer -\n", read("args"), "the buffer is loaded from stdin")
+	assert.Equal(t, "foo\nbar\n", read("stdin"), "the text is written to tmux")
+
+	if !assert.NoError(t, NewWindow("vim foo", nil), "NewWindow should succeed") {
+		return
+	}
+	assert.Equal(t, "new-window vim foo\n", read("args"))
+
+	if !assert.NoError(t, NewWindow("vim foo", []string{"FOO=1", "BAR=2"}), "NewWindow should succeed") {
+		return
+	}
+	assert.Equal(t, "new-window -e FOO=1 -e BAR=2 vim foo\n", read("args"))
+
+	if !assert.NoError(t, SplitWindow("vim foo", nil), "SplitWindow should succeed") {
+		return
+	}
+	assert.Equal(t, "split-window vim foo\n", read("args"))
+
+	if !assert.NoError(t, DisplayPopup("/tmp", "80%", "20", "peco"), "DisplayPopup should succeed") {
+		return
+	}
+	assert.Equal(t, "display-popup -E -d /tmp -w 80% -h 20 peco\n", read("args"))
+
+	Program = filepath.Join(dir, "missing")
+	assert.Error(t, SetBuffer("foo"), "failures are reported")
+}
@@ -0,0 +1,88 @@
+package util
+
+import "unicode"
+
+const zeroWidthJoiner = '\u200d'
+
+// isGraphemeExtend returns true if r never starts a grapheme cluster
+// on its own, but is instead attached to the preceding rune. This is
+// a simplified version of the Grapheme_Cluster_Break=Extend property
+// from UAX #29, which covers combining marks, variation selectors,
+// emoji modifiers and tags
+func isGraphemeExtend(r rune) bool {
+	switch {
+	case r == zeroWidthJoiner:
+		return true
+	case r >= 0xFE00 && r <= 0xFE0F: // variation selectors
+		return true
+	case r >= 0xE0100 && r <= 0xE01EF: // variation selectors supplement
+		return true
+	case r >= 0x1F3FB && r <= 0x1F3FF: // emoji skin tone modifiers
+		return true
+	case r >= 0xE0020 && r <= 0xE007F: // tags
+		return true
+	}
+	return unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc)
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+// NextGraphemeBoundary returns the index of the rune that follows the
+// grapheme cluster (user-perceived character) starting at rs[pos]
+func NextGraphemeBoundary(rs []rune, pos int) int {
+	if pos < 0 {
+		return 0
+	}
+	if pos >= len(rs) {
+		return len(rs)
+	}
+
+	i := pos + 1
+	switch {
+	case rs[pos] == '\r':
+		if i < len(rs) && rs[i] == '\n' {
+			i++
+		}
+		return i
+	case isRegionalIndicator(rs[pos]):
+		// flags are made up of pairs of regional indicators
+		if i < len(rs) && isRegionalIndicator(rs[i]) {
+			i++
+		}
+	}
+
+	for i < len(rs) {
+		switch {
+		case isGraphemeExtend(rs[i]):
+			i++
+		case rs[i-1] == zeroWidthJoiner:
+			// ZWJ sequences, e.g. family emoji, form a single cluster
+			i++
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// PrevGraphemeBoundary returns the index of the first rune of the
+// grapheme cluster that precedes rs[pos]
+func PrevGraphemeBoundary(rs []rune, pos int) int {
+	if pos > len(rs) {
+		pos = len(rs)
+	}
+
+	// Boundaries can only be reliably found from the start of the
+	// text (think of regional indicator pairs), but queries are short
+	var b int
+	for b < pos {
+		next := NextGraphemeBoundary(rs, b)
+		if next >= pos {
+			return b
+		}
+		b = next
+	}
+	return 0
+}
@@ -2,17 +2,42 @@
 
 package util
 
-import "os/exec"
+import (
+	"os/exec"
+	"strings"
+	"syscall"
+)
 
+// Shell creates a command that runs cmd, joined by spaces, with
+// cmd.exe. The command line is passed to cmd.exe as it is, as the
+// arguments of cmd.exe are not parsed the way that exec.Command quotes
+// them: "/s /c" with the whole line in quotes makes cmd.exe remove the
+// outer quotes only, and run the rest verbatim
 func Shell(cmd ...string) *exec.Cmd {
 	const shellpath = `cmd`
-	const shellopt  = `/c`
 
-	args := make([]string, len(cmd) + 1)
-	args[0] = shellopt
-	for i := 0; i < len(cmd); i++ {
-		args[i+1] = cmd[i]
+	c := exec.Command(shellpath)
+	c.SysProcAttr = &syscall.SysProcAttr{
+		CmdLine: shellpath + ` /s /c "` + strings.Join(cmd, " ") + `"`,
 	}
-	
-	return exec.Command(shellpath, args...)
+	return c
+}
+
+// cmdMetaChars are the characters that cmd.exe interprets
+const cmdMetaChars = `()%!^"<>&|`
+
+// ShellQuote quotes s so that the shell used by Shell treats it as a
+// single word. s is first quoted for the command line parser of the
+// program, then every character that cmd.exe would interpret is
+// escaped with "^", so that cmd.exe passes it on as it is, whether it
+// is within quotes or not
+func ShellQuote(s string) string {
+	var buf strings.Builder
+	for _, c := range syscall.EscapeArg(s) {
+		if strings.ContainsRune(cmdMetaChars, c) {
+			buf.WriteByte('^')
+		}
+		buf.WriteRune(c)
+	}
+	return buf.String()
 }
@@ -0,0 +1,121 @@
+package peco
+
+import (
+	"context"
+
+	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/internal/i18n"
+)
+
+// maxJumpListSize is the number of positions that are remembered
+const maxJumpListSize = 100
+
+// Push records id as the line that the cursor is jumping from. Any
+// positions that were gone back from are forgotten
+func (jl *JumpList) Push(id uint64) {
+	jl.mutex.Lock()
+	defer jl.mutex.Unlock()
+
+	jl.entries = jl.entries[:jl.current]
+	if n := len(jl.entries); n > 0 && jl.entries[n-1] == id {
+		jl.current = n
+		return
+	}
+	jl.entries = append(jl.entries, id)
+	if len(jl.entries) > maxJumpListSize {
+		jl.entries = jl.entries[len(jl.entries)-maxJumpListSize:]
+	}
+	jl.current = len(jl.entries)
+}
+
+// Back returns the position before the current one. cur is the line
+// that the cursor is on, which is recorded on the first step back so
+// that Forward can return to it
+func (jl *JumpList) Back(cur uint64) (uint64, bool) {
+	jl.mutex.Lock()
+	defer jl.mutex.Unlock()
+
+	if jl.current == len(jl.entries) {
+		if n := len(jl.entries); n == 0 || jl.entries[n-1] != cur {
+			jl.entries = append(jl.entries, cur)
+		}
+		jl.current = len(jl.entries) - 1
+	}
+
+	if jl.current <= 0 {
+		return 0, false
+	}
+	jl.current--
+	return jl.entries[jl.current], true
+}
+
+// Forward returns the position after the current one, which is only
+// available after going Back
+func (jl *JumpList) Forward() (uint64, bool) {
+	jl.mutex.Lock()
+	defer jl.mutex.Unlock()
+
+	if jl.current >= len(jl.entries)-1 {
+		return 0, false
+	}
+	jl.current++
+	return jl.entries[jl.current], true
+}
+
+// currentLineID returns the ID of the line under the cursor
+func currentLineID(state *Peco) (uint64, bool) {
+	l, err := state.CurrentLineBuffer().LineAt(state.Location().LineNumber())
+	if err != nil {
+		return 0, false
+	}
+	return l.ID(), true
+}
+
+// recordJump records the line under the cursor in the jump list. It
+// is called by actions that move the cursor far away
+func recordJump(state *Peco) {
+	if id, ok := currentLineID(state); ok {
+		state.jumpList.Push(id)
+	}
+}
+
+// lineIndexByID returns the position of the line with the given ID
+// in b, or -1 if it is not there
+func lineIndexByID(b Buffer, id uint64) int {
+	for i := 0; i < b.Size(); i++ {
+		if l, err := b.LineAt(i); err == nil && l.ID() == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func doJumpBack(ctx context.Context, state *Peco, _ termbox.Event) {
+	cur, ok := currentLineID(state)
+	if !ok {
+		return
+	}
+	jumpInList(ctx, state, func() (uint64, bool) { return state.jumpList.Back(cur) }, i18n.T("No older position"))
+}
+
+func doJumpForward(ctx context.Context, state *Peco, _ termbox.Event) {
+	jumpInList(ctx, state, state.jumpList.Forward, i18n.T("No newer position"))
+}
+
+// jumpInList moves the cursor to the position returned by next.
+// Positions whose lines are not in the current results are skipped
+func jumpInList(ctx context.Context, state *Peco, next func() (uint64, bool), notFound string) {
+	b := state.CurrentLineBuffer()
+	for {
+		id, ok := next()
+		if !ok {
+			state.SendStatus(ctx, StatusWarn, notFound)
+			return
+		}
+		if n := lineIndexByID(b, id); n >= 0 {
+			state.Hub().SendPaging(ctx, ToScrollFirstItem)
+			state.Hub().SendPaging(ctx, JumpToLineRequest(n))
+			return
+		}
+	}
+}
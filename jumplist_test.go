@@ -0,0 +1,105 @@
+package peco
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nsf/termbox-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJumpList(t *testing.T) {
+	var jl JumpList
+	_, ok := jl.Back(1)
+	assert.False(t, ok, "there should be nothing to go back to")
+
+	jl.Push(1)
+	jl.Push(2)
+
+	id, ok := jl.Back(3)
+	if assert.True(t, ok, "Back should succeed") {
+		assert.Equal(t, uint64(2), id, "Back should return the last position")
+	}
+	id, ok = jl.Back(2)
+	if assert.True(t, ok, "Back should succeed") {
+		assert.Equal(t, uint64(1), id, "Back should return the first position")
+	}
+	_, ok = jl.Back(1)
+	assert.False(t, ok, "there should be nothing older than the first position")
+
+	id, ok = jl.Forward()
+	if assert.True(t, ok, "Forward should succeed") {
+		assert.Equal(t, uint64(2), id, "Forward should return the second position")
+	}
+	id, ok = jl.Forward()
+	if assert.True(t, ok, "Forward should succeed") {
+		assert.Equal(t, uint64(3), id, "Forward should return to where Back was first called")
+	}
+	_, ok = jl.Forward()
+	assert.False(t, ok, "there should be nothing newer than the last position")
+
+	// Jumping from an older position forgets the newer ones
+	jl.Back(3)
+	jl.Push(4)
+	_, ok = jl.Forward()
+	assert.False(t, ok, "newer positions should be forgotten")
+	id, ok = jl.Back(5)
+	if assert.True(t, ok, "Back should succeed") {
+		assert.Equal(t, uint64(4), id, "Back should return the new position")
+	}
+}
+
+func TestJumpBackAndForward(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	state := newPeco()
+	state.Argv = []string{}
+	state.Stdin = bytes.NewBufferString(strings.Repeat("foo\nbar\n", 5))
+	go state.Run(ctx)
+	<-state.Ready()
+	for state.source.Size() < 10 {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	expectLine := func(expected int, msg string) bool {
+		deadline := time.Now().Add(2 * time.Second)
+		for state.Location().LineNumber() != expected && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		return assert.Equal(t, expected, state.Location().LineNumber(), msg)
+	}
+
+	state.Hub().SendPaging(ctx, ToLineBelow)
+	if !expectLine(1, "cursor should move down") {
+		return
+	}
+	nameToActions["peco.ScrollLastItem"].Execute(ctx, state, termbox.Event{})
+	if !expectLine(9, "cursor should move to the last line") {
+		return
+	}
+	nameToActions["peco.JumpBack"].Execute(ctx, state, termbox.Event{})
+	if !expectLine(1, "cursor should jump back") {
+		return
+	}
+	nameToActions["peco.JumpForward"].Execute(ctx, state, termbox.Event{})
+	if !expectLine(9, "cursor should jump forward") {
+		return
+	}
+
+	// The position of the line changes after filtering, but the
+	// jump list still finds it
+	ch := make(chan struct{})
+	state.Query().Set("bar")
+	state.ExecQuery(func() { close(ch) })
+	<-ch
+	// Wait for the cursor to be moved into the filtered results
+	if !expectLine(4, "cursor should be on the last line of the results") {
+		return
+	}
+	nameToActions["peco.JumpBack"].Execute(ctx, state, termbox.Event{})
+	expectLine(0, "cursor should jump back to the line in the filtered results")
+}
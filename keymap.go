@@ -2,9 +2,14 @@ package peco
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"sort"
 	"strings"
+	"text/tabwriter"
 	"time"
+
 	"github.com/lestrrat-go/pdebug"
 	"github.com/nsf/termbox-go"
 	"github.com/peco/peco/internal/keyseq"
@@ -17,6 +22,7 @@ func NewKeymap(config map[string]string, actions map[string][]string) Keymap {
 		Config: config,
 		Action: actions,
 		seq:    keyseq.New(),
+		layers: make(map[string]*keymapLayer),
 	}
 }
 
@@ -32,7 +38,7 @@ func (km Keymap) ExecuteAction(ctx context.Context, state *Peco, ev termbox.Even
 		defer g.End()
 	}
 
-	a := km.LookupAction(ev)
+	a := km.LookupLayerAction(state.KeymapLayer(), ev)
 	if a == nil {
 		return errors.New("action not found")
 	}
@@ -42,20 +48,50 @@ func (km Keymap) ExecuteAction(ctx context.Context, state *Peco, ev termbox.Even
 	return nil
 }
 
-// LookupAction returns the appropriate action for the given termbox event
-func (km Keymap) LookupAction(ev termbox.Event) Action {
+func eventToKey(ev termbox.Event) keyseq.Key {
 	modifier := keyseq.ModNone
 	if (ev.Mod & termbox.ModAlt) != 0 {
 		modifier = keyseq.ModAlt
 	}
 
-	key := keyseq.Key{
+	return keyseq.Key{
 		Modifier: modifier,
 		Key:      ev.Key,
 		Ch:       ev.Ch,
 	}
-	action, err := km.seq.AcceptKey(key)
+}
+
+// LookupLayerAction returns the appropriate action for the given
+// termbox event, consulting the named keymap layer before the
+// default key bindings. If name is empty, or there is no such layer,
+// this is the same as LookupAction
+func (km Keymap) LookupLayerAction(name string, ev termbox.Event) Action {
+	layer, ok := km.layers[name]
+	if !ok {
+		return km.LookupAction(ev)
+	}
+
+	action, err := layer.seq.AcceptKey(eventToKey(ev))
+	if err == keyseq.ErrNoMatch {
+		// In strict layers, typing does not change the query
+		if layer.strict && ev.Mod&termbox.ModAlt == 0 && (ev.Ch != 0 || ev.Key == termbox.KeySpace) {
+			if pdebug.Enabled {
+				pdebug.Printf("Keymap.Handler: Ignoring character not bound in strict layer %s", name)
+			}
+			return wrapClearSequence(ActionFunc(doNothing))
+		}
+		return km.LookupAction(ev)
+	}
+	return km.actionFor(action, err)
+}
+
+// LookupAction returns the appropriate action for the given termbox event
+func (km Keymap) LookupAction(ev termbox.Event) Action {
+	action, err := km.seq.AcceptKey(eventToKey(ev))
+	return km.actionFor(action, err)
+}
 
+func (km Keymap) actionFor(action interface{}, err error) Action {
 	switch err {
 	case nil:
 		// Found an action!
@@ -96,7 +132,7 @@ func wrapClearSequence(a Action) Action {
 
 		if seq.Len() > 0 {
 			msg := strings.Join(seq.KeyNames(), " ")
-			state.Hub().SendStatusMsgAndClear(ctx, msg, 500*time.Millisecond)
+			state.SendStatusAndClear(ctx, StatusInfo, msg, 500*time.Millisecond)
 			seq.Reset()
 		}
 
@@ -117,6 +153,31 @@ func (km Keymap) resolveActionName(name string, depth int) (Action, error) {
 		return v, nil
 	}
 
+	// Can it be resolved as an action that switches layers?
+	if v, ok, err := km.resolveLayerAction(name); ok {
+		return v, err
+	}
+
+	// Can it be resolved as an action on named selection sets?
+	if v, ok, err := resolveSelectionSetAction(name); ok {
+		return v, err
+	}
+
+	// Can it be resolved as an action that sets a bookmark?
+	if v, ok, err := resolveBookmarkAction(name); ok {
+		return v, err
+	}
+
+	// Can it be resolved as an action that jumps to a term's matches?
+	if v, ok, err := resolveTermMatchAction(name); ok {
+		return v, err
+	}
+
+	// Can it be resolved as an action that switches filters?
+	if v, ok, err := resolveSelectFilterAction(name); ok {
+		return v, err
+	}
+
 	// Can it be resolved via combined actions?
 	l, ok := km.Action[name]
 	if ok {
@@ -133,9 +194,101 @@ func (km Keymap) resolveActionName(name string, depth int) (Action, error) {
 		return v, nil
 	}
 
+	// Can it be resolved as an action that executes a command?
+	if command, ok := km.Exec[name]; ok {
+		v = makeExecAction(command)
+		nameToActions[name] = v
+		return v, nil
+	}
+
 	return nil, errors.Errorf("could not resolve %s: no such action", name)
 }
 
+// resolveLayerAction resolves peco.EnterLayer.<name> and
+// peco.ToggleLayer.<name>. The second return value is false if the
+// action name is not one of these
+func (km Keymap) resolveLayerAction(name string) (Action, bool, error) {
+	var toggle bool
+	var layer string
+	switch {
+	case strings.HasPrefix(name, enterLayerPrefix):
+		layer = strings.TrimPrefix(name, enterLayerPrefix)
+	case strings.HasPrefix(name, toggleLayerPrefix):
+		layer = strings.TrimPrefix(name, toggleLayerPrefix)
+		toggle = true
+	default:
+		return nil, false, nil
+	}
+
+	if _, ok := km.Layers[layer]; !ok {
+		return nil, true, errors.Errorf("could not resolve %s: no such layer", name)
+	}
+
+	return ActionFunc(func(ctx context.Context, state *Peco, _ termbox.Event) {
+		if toggle && state.KeymapLayer() == layer {
+			setKeymapLayer(ctx, state, "")
+			return
+		}
+		setKeymapLayer(ctx, state, layer)
+	}), true, nil
+}
+
+// compileBindings resolves the actions in kb, and adds them to k
+func compileBindings(k Keyseq, kb map[string]Action) error {
+	// there's no need to do this, but we sort keys here just to make
+	// debugging easier
+	keys := make([]string, 0, len(kb))
+	for s := range kb {
+		keys = append(keys, s)
+	}
+	sort.Strings(keys)
+
+	for _, s := range keys {
+		a := kb[s]
+		list, err := keyseq.ToKeyList(s)
+		if err != nil {
+			return errors.Wrapf(err, "urnknown key %s: %s", s, err)
+		}
+
+		k.Add(list, a)
+	}
+
+	return errors.Wrap(k.Compile(), "failed to compile key binding patterns")
+}
+
+// applyLayers compiles the key bindings of each layer. Unlike the
+// default key bindings, layers start out empty
+func (km *Keymap) applyLayers() error {
+	for name := range km.layers {
+		delete(km.layers, name)
+	}
+
+	for name, cfg := range km.Layers {
+		kb := map[string]Action{}
+		for s, as := range cfg.Keymap {
+			if as == "-" {
+				// Explicitly do nothing, instead of falling through
+				// to the default key bindings
+				kb[s] = ActionFunc(doNothing)
+				continue
+			}
+
+			v, err := km.resolveActionName(as, 0)
+			if err != nil {
+				return errors.Wrapf(err, "failed to resolve action name %s in layer %s", as, name)
+			}
+			kb[s] = v
+		}
+
+		k := keyseq.New()
+		if err := compileBindings(k, kb); err != nil {
+			return errors.Wrapf(err, "failed to compile layer %s", name)
+		}
+		km.layers[name] = &keymapLayer{seq: k, strict: cfg.Strict}
+	}
+	return nil
+}
+
 // ApplyKeybinding applies all of the custom key bindings on top of
 // the default key bindings
 func (km *Keymap) ApplyKeybinding() error {
@@ -163,28 +316,132 @@ func (km *Keymap) ApplyKeybinding() error {
 	}
 
 	// now compile using kb
-	// there's no need to do this, but we sort keys here just to make
-	// debugging easier
-	keys := make([]string, 0, len(kb))
-	for s := range kb {
-		keys = append(keys, s)
+	if err := compileBindings(k, kb); err != nil {
+		return err
 	}
-	sort.Strings(keys)
 
-	for _, s := range keys {
-		a := kb[s]
-		list, err := keyseq.ToKeyList(s)
-		if err != nil {
-			return errors.Wrapf(err, "urnknown key %s: %s", s, err)
-		}
+	return errors.Wrap(km.applyLayers(), "failed to apply keymap layers")
+}
 
-		k.Add(list, a)
+// InMiddleOfChain returns true if a key sequence has been partially
+// entered, either in the default key bindings or in any of the layers
+func (km Keymap) InMiddleOfChain() bool {
+	if km.seq.InMiddleOfChain() {
+		return true
+	}
+	for _, layer := range km.layers {
+		if layer.seq.InMiddleOfChain() {
+			return true
+		}
 	}
+	return false
+}
 
-	return errors.Wrap(k.Compile(), "failed to compile key binding patterns")
+// CancelChain discards any partially entered key sequence
+func (km Keymap) CancelChain() {
+	km.seq.CancelChain()
+	for _, layer := range km.layers {
+		layer.seq.CancelChain()
+	}
 }
 
 // TODO: this needs to be fixed.
 func (km Keymap) hasModifierMaps() bool {
 	return false
 }
+
+// bindings returns the effective key bindings, sorted by layer and key
+func (km Keymap) bindings() []keymapBinding {
+	var list []keymapBinding
+
+	base := map[string]keymapBinding{}
+	for s, name := range defaultKeyBindingNames {
+		if s == "\x00" {
+			// C-Space is registered as the NUL character, which is
+			// not something users can write in their config files
+			s = "C-Space"
+		}
+		base[s] = keymapBinding{Key: s, Action: name}
+	}
+	for s, name := range km.Config {
+		if name == "-" {
+			delete(base, s)
+			continue
+		}
+		base[s] = km.binding("", s, name)
+	}
+	for _, b := range base {
+		list = append(list, b)
+	}
+
+	for layer, cfg := range km.Layers {
+		for s, name := range cfg.Keymap {
+			list = append(list, km.binding(layer, s, name))
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Layer != list[j].Layer {
+			return list[i].Layer < list[j].Layer
+		}
+		return list[i].Key < list[j].Key
+	})
+	return list
+}
+
+// binding creates a keymapBinding for a key binding in the config file
+func (km Keymap) binding(layer, key, name string) keymapBinding {
+	b := keymapBinding{Layer: layer, Key: key, Action: name, Custom: true}
+	if _, ok := km.Action[name]; ok {
+		b.Sequence = km.expandAction(name, 0)
+	}
+	if command, ok := km.Exec[name]; ok {
+		b.Sequence = []string{"exec " + command.String()}
+	}
+	return b
+}
+
+// expandAction returns the names of the actions that are executed
+// by the custom action name
+func (km Keymap) expandAction(name string, depth int) []string {
+	l, ok := km.Action[name]
+	if !ok || depth >= maxResolveActionDepth {
+		return []string{name}
+	}
+
+	var list []string
+	for _, child := range l {
+		list = append(list, km.expandAction(child, depth+1)...)
+	}
+	return list
+}
+
+// dump writes the effective key bindings to w, for --dump-keymap
+func (km Keymap) dump(w io.Writer, format string) error {
+	list := km.bindings()
+	if format == keymapDumpJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return errors.Wrap(enc.Encode(list), "failed to encode keymap")
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, b := range list {
+		key := b.Key
+		if b.Layer != "" {
+			key = "[" + b.Layer + "] " + key
+		}
+
+		action := b.Action
+		if len(b.Sequence) > 0 {
+			action += " = " + strings.Join(b.Sequence, ", ")
+		}
+
+		source := "default"
+		if b.Custom {
+			source = "config"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t(%s)\n", key, action, source)
+	}
+	return errors.Wrap(tw.Flush(), "failed to write keymap")
+}
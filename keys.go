@@ -0,0 +1,103 @@
+package peco
+
+import (
+	"context"
+	"time"
+
+	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/internal/keyseq"
+	"github.com/pkg/errors"
+)
+
+// parseKeys parses the key sequence given to --keys into the events
+// that the screen would report if they were typed
+func parseKeys(s string) ([]termbox.Event, error) {
+	list, err := keyseq.ParseKeys(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid --keys")
+	}
+
+	events := make([]termbox.Event, 0, len(list))
+	for _, k := range list {
+		ev := termbox.Event{Type: termbox.EventKey, Key: k.Key, Ch: k.Ch}
+		if k.Modifier == keyseq.ModAlt {
+			ev.Mod = termbox.ModAlt
+		}
+		events = append(events, ev)
+	}
+	return events, nil
+}
+
+// injectKeys implements --keys. It returns a channel that receives the
+// keys given to --keys once ready is closed, followed by the events
+// received from src. Each key is sent once peco has finished handling
+// the previous one, so that, for example, Enter picks a line from the
+// results of the query that was typed before it
+func (p *Peco) injectKeys(ctx context.Context, src chan termbox.Event, ready <-chan struct{}) chan termbox.Event {
+	events := make(chan termbox.Event)
+	p.spawn(func() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ready:
+		}
+
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for i, ev := range p.keys {
+			// Nothing else is sent until the keys have been typed,
+			// so EventsHandled only counts the keys
+			for p.EventsHandled() < uint64(i) || p.hasPendingWork() {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case events <- ev:
+			}
+		}
+		ticker.Stop()
+
+		for {
+			var ev termbox.Event
+			var ok bool
+			select {
+			case <-ctx.Done():
+				return
+			case ev, ok = <-src:
+				if !ok {
+					// events is not closed, as the input loop
+					// expects the screen to keep it open
+					return
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case events <- ev:
+			}
+		}
+	})
+	return events
+}
+
+// waitForKeys waits until the keys given to --keys have been handled,
+// and peco has finished the work that they caused
+func (p *Peco) waitForKeys(ctx context.Context) bool {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for p.EventsHandled() < uint64(len(p.keys)) || !p.IsIdle() {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
@@ -0,0 +1,64 @@
+package peco
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/internal/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseKeys(t *testing.T) {
+	events, err := parseKeys("a<M-x><Enter>")
+	if !assert.NoError(t, err, "parseKeys should succeed") {
+		return
+	}
+	assert.Equal(t, []termbox.Event{
+		{Type: termbox.EventKey, Ch: 'a'},
+		{Type: termbox.EventKey, Ch: 'x', Mod: termbox.ModAlt},
+		{Type: termbox.EventKey, Key: termbox.KeyEnter},
+	}, events, "keys should be converted to events")
+
+	_, err = parseKeys("<NoSuchKey>")
+	assert.Error(t, err, "unknown keys should be rejected")
+}
+
+func TestKeys(t *testing.T) {
+	run := func(t *testing.T, args ...string) (string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		p := newPeco()
+		p.Argv = args
+		p.Stdin = bytes.NewBufferString("apple\nbanana\ncherry\nmango\n")
+		var out bytes.Buffer
+		p.Stdout = &out
+
+		err := p.Run(ctx)
+		if !assert.NoError(t, ctx.Err(), "timeout reached") {
+			return "", err
+		}
+		if util.IsCollectResultsError(err) {
+			p.PrintResults()
+		}
+		return out.String(), err
+	}
+
+	t.Run("finish", func(t *testing.T) {
+		out, err := run(t, "--keys", "an<C-n><Enter>")
+		if !assert.True(t, util.IsCollectResultsError(err), "isCollectResultsError") {
+			return
+		}
+		assert.Equal(t, "mango\n", out, "the line under the cursor should be printed")
+	})
+	t.Run("no-tty", func(t *testing.T) {
+		out, err := run(t, "--no-tty", "--query", "a", "--keys", "n")
+		if !assert.True(t, util.IsCollectResultsError(err), "isCollectResultsError") {
+			return
+		}
+		assert.Equal(t, "banana\nmango\n", out, "the keys should be appended to the initial query")
+	})
+}
@@ -1,7 +1,6 @@
 package peco
 
 import (
-	"fmt"
 	"strconv"
 	"strings"
 	"time"
@@ -10,6 +9,7 @@ import (
 	"github.com/lestrrat-go/pdebug"
 	"github.com/mattn/go-runewidth"
 	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/filter"
 	"github.com/peco/peco/line"
 	"github.com/pkg/errors"
 )
@@ -109,8 +109,14 @@ func (u UserPrompt) Draw(state *Peco) {
 		c.SetPos(ql)
 	}
 
-	fg := u.styles.Query.fg
-	bg := u.styles.Query.bg
+	// Invalid queries are displayed in the QueryError style, until
+	// they are fixed
+	style := u.styles.Query
+	if state.IsQueryInvalid() {
+		style = u.styles.QueryError
+	}
+	fg := style.fg
+	bg := style.bg
 
 	// Used to notify termbox where our cursor is
 	var posX int
@@ -165,8 +171,8 @@ func (u UserPrompt) Draw(state *Peco) {
 		prev := int(0)
 		var i int
 		for r := range q.Runes() {
-			fg := u.styles.Query.fg
-			bg := u.styles.Query.bg
+			fg := style.fg
+			bg := style.bg
 			if i == c.Pos() {
 				fg |= termbox.AttrReverse
 				bg |= termbox.AttrReverse
@@ -175,8 +181,6 @@ func (u UserPrompt) Draw(state *Peco) {
 			prev += int(runewidth.RuneWidth(r))
 			i++
 		}
-		fg := u.styles.Query.fg
-		bg := u.styles.Query.bg
 		u.screen.Print(PrintArgs{
 			X:    u.promptLen + prev + 1,
 			Y:    location,
@@ -190,19 +194,106 @@ func (u UserPrompt) Draw(state *Peco) {
 
 	width, _ := u.screen.Size()
 
-	loc := state.Location()
-	pmsg := fmt.Sprintf("%s [%d (%d/%d)]", state.Filters().Current().String(), loc.Total(), loc.Page(), loc.MaxPage())
-	u.screen.Print(PrintArgs{
-		X:   int(width - runewidth.StringWidth(pmsg)),
-		Y:   location,
-		Fg:  u.styles.Basic.fg,
-		Bg:  u.styles.Basic.bg,
-		Msg: pmsg,
-	})
+	if pmsg := rightPrompt(state); len(pmsg) > 0 {
+		u.screen.Print(PrintArgs{
+			X:   int(width - runewidth.StringWidth(pmsg)),
+			Y:   location,
+			Fg:  u.styles.Basic.fg,
+			Bg:  u.styles.Basic.bg,
+			Msg: pmsg,
+		})
+	}
 
 	u.screen.Flush()
 }
 
+var spinnerFrames = []string{"|", "/", "-", "\\"}
+
+// spinnerInterval is how long each frame of the spinner is displayed
+const spinnerInterval = 100 * time.Millisecond
+
+// spinner returns the current frame of the spinner if running is
+// true, or a blank string of the same width otherwise
+func spinner(running bool) string {
+	if !running {
+		return " "
+	}
+	n := time.Now().UnixNano() / int64(spinnerInterval)
+	return spinnerFrames[n%int64(len(spinnerFrames))]
+}
+
+// rightPrompt returns what is displayed on the right-hand side of the
+// query line. While the input is still being read, a spinner and the
+// progress come first. With --max-query-length, the length of the
+// query is displayed before the prompt
+func rightPrompt(state *Peco) string {
+	pmsg := expandRPrompt(state.RPrompt(), state)
+	if c := queryCounter(state); c != "" {
+		if pmsg == "" {
+			pmsg = c
+		} else {
+			pmsg = c + " " + pmsg
+		}
+	}
+	if s := state.Snapshot(); s != nil {
+		if pmsg == "" {
+			pmsg = s.label()
+		} else {
+			pmsg = s.label() + " " + pmsg
+		}
+	}
+	src := state.inputSource()
+	if src == nil {
+		return pmsg
+	}
+	progress := src.Progress()
+	if progress == "" {
+		return pmsg
+	}
+	if pmsg == "" {
+		return spinner(true) + " " + progress
+	}
+	return spinner(true) + " " + progress + " " + pmsg
+}
+
+// filterLabel returns the name of f, as displayed in the prompt while
+// query is being matched. Switched case sensitivity is indicated by
+// [i] (ignore case) or [s] (case sensitive)
+func filterLabel(f filter.Filter, query string) string {
+	label := f.String()
+	if em, ok := f.(filter.ExactMatcher); ok && em.Exact() {
+		label += "(exact)"
+	}
+	if ct, ok := f.(filter.CaseToggler); ok && ct.CaseToggled() {
+		if ct.IgnoresCase(query) {
+			label += "[i]"
+		} else {
+			label += "[s]"
+		}
+	}
+	return label
+}
+
+// expandRPrompt replaces the placeholders in the RPrompt template
+// with their current values
+func expandRPrompt(tmpl string, state *Peco) string {
+	if len(tmpl) <= 0 {
+		return ""
+	}
+
+	loc := state.Location()
+	r := strings.NewReplacer(
+		"{filter}", filterLabel(state.Filters().Current(), state.Query().String()),
+		"{total}", strconv.Itoa(loc.Total()),
+		"{page}", strconv.Itoa(loc.Page()),
+		"{maxpage}", strconv.Itoa(loc.MaxPage()),
+		"{selected}", strconv.Itoa(state.Selection().Len()),
+		"{spinner}", spinner(state.IsQueryRunning()),
+		"{layer}", state.KeymapLayer(),
+	)
+	return r.Replace(tmpl)
+}
+
 // NewStatusBar creates a new StatusBar struct
 func NewStatusBar(screen Screen, anchor VerticalAnchor, anchorOffset int, styles *StyleSet) *StatusBar {
 	return &StatusBar{
@@ -291,15 +382,112 @@ func (s *StatusBar) PrintStatus(msg string, clearDelay time.Duration) {
 func NewListArea(screen Screen, anchor VerticalAnchor, anchorOffset int, sortTopDown bool, styles *StyleSet) *ListArea {
 	return &ListArea{
 		AnchorSettings: NewAnchorSettings(screen, anchor, anchorOffset),
-		displayCache:   []line.Line{},
+		displayCache:   []displayCacheEntry{},
 		dirty:          false,
 		sortTopDown:    sortTopDown,
 		styles:         styles,
 	}
 }
 
+// SetLineRenderer sets the LineRenderer used to change the text
+// displayed for each line. If nil, lines are displayed as they are
+func (l *ListArea) SetLineRenderer(r LineRenderer) {
+	l.lineRenderer = r
+}
+
+// SetLineStyler sets the LineStyler used to adjust the style of
+// each line that is drawn. Pass nil to remove it
+func (l *ListArea) SetLineStyler(s LineStyler) {
+	l.lineStyler = s
+}
+
 func (l *ListArea) purgeDisplayCache() {
-	l.displayCache = []line.Line{}
+	l.displayCache = []displayCacheEntry{}
+}
+
+// updateStyleGeneration starts a new style generation if anything
+// that changes how every line is drawn has changed since the last
+// call. It returns true if a new generation was started
+func (l *ListArea) updateStyleGeneration(state *Peco) bool {
+	key := listStyleKey{
+		searchPattern: state.SearchPattern(),
+		jumpPrefixes:  state.SingleKeyJumpMode() || state.SingleKeyJumpShowPrefix(),
+		selectionBar:  state.selectionBar,
+	}
+	if state.stripCommonPrefix {
+		key.commonPrefix = state.commonPrefix()
+	}
+	if key == l.styleKey {
+		return false
+	}
+	l.styleKey = key
+	l.styleGen++
+	return true
+}
+
+// partialRows returns the set of line numbers to redraw, if only some
+// of the rows need to be redrawn according to options. Otherwise it
+// returns nil
+func (l *ListArea) partialRows(options *DrawOptions, perPage, bufsiz, column int) map[int]struct{} {
+	if options == nil || len(options.Lines) == 0 || options.RunningQuery || options.DisableCache || l.IsDirty() {
+		return nil
+	}
+
+	// The rows that are not redrawn must still be valid, so the page
+	// must have been filled the last time, still be filled, and not
+	// have been scrolled horizontally
+	if len(l.displayCache) != perPage || bufsiz < perPage || l.displayCache[0].column != column {
+		return nil
+	}
+
+	rows := make(map[int]struct{}, len(options.Lines))
+	for _, n := range options.Lines {
+		rows[n] = struct{}{}
+	}
+	return rows
+}
+
+// isDrawn returns true if the row described by e can be left as it is,
+// because it is identical to what was drawn there before
+func (e displayCacheEntry) isDrawn(drawn displayCacheEntry) bool {
+	if drawn.line == nil {
+		return false
+	}
+	if e.id != drawn.id || e.column != drawn.column || e.styleGen != drawn.styleGen || e.fg != drawn.fg || e.bg != drawn.bg || e.prefix != drawn.prefix {
+		return false
+	}
+	// Group headers are not lines of the input, and do not tell
+	// groups apart by their IDs, but by their keys
+	if isGroupHeader(e.line) || isGroupHeader(drawn.line) {
+		return isGroupHeader(e.line) && isGroupHeader(drawn.line) && e.line.DisplayString() == drawn.line.DisplayString()
+	}
+	// A new query creates new lines for the same input, which only
+	// need to be redrawn if they are highlighted differently
+	return e.line == drawn.line || sameMatches(e.line, drawn.line)
+}
+
+// sameMatches returns true if a and b have the same matches
+// highlighted in them
+func sameMatches(a, b line.Line) bool {
+	ai, aok := a.(MatchIndexer)
+	bi, bok := b.(MatchIndexer)
+	if aok != bok {
+		return false
+	}
+	if !aok {
+		return true
+	}
+
+	am, bm := ai.Indices(), bi.Indices()
+	if len(am) != len(bm) {
+		return false
+	}
+	for i := range am {
+		if len(am[i]) < 2 || len(bm[i]) < 2 || am[i][0] != bm[i][0] || am[i][1] != bm[i][1] || matchTerm(a, i) != matchTerm(b, i) {
+			return false
+		}
+	}
+	return true
 }
 
 func (l *ListArea) IsDirty() bool {
@@ -317,9 +505,41 @@ func selectionContains(state *Peco, n int) bool {
 	return false
 }
 
+// print prints args on the screen, rendering non-printable bytes
+// using the Escaped style
+func (l *ListArea) print(args PrintArgs) int {
+	args.Escape = &l.styles.Escaped
+	if l.inSelectionBar {
+		// The row has already been filled, and must not be
+		// overwritten by the style of the last segment
+		args.Fg |= termbox.AttrReverse
+		args.Fill = false
+	}
+	return l.screen.Print(args)
+}
+
+// matchTerm returns the ordinal of the query term that produced
+// the n-th match of the given line
+func matchTerm(target line.Line, n int) int {
+	if ti, ok := target.(MatchTermIndexer); ok {
+		return ti.Term(n)
+	}
+	return 0
+}
+
 type DrawOptions struct {
 	RunningQuery bool
 	DisableCache bool
+
+	// Lines are the line numbers of the only rows that need to be
+	// redrawn, e.g. after moving the cursor. The whole list is
+	// redrawn if it may have changed in any other way
+	Lines []int
+
+	// queryStartedAt is set on the first draw request for the results
+	// of a query, so that the latency until they are painted can be
+	// recorded
+	queryStartedAt time.Time
 }
 
 // Draw displays the ListArea on the screen
@@ -381,10 +601,15 @@ func (l *ListArea) Draw(state *Peco, parent Layout, perPage int, options *DrawOp
 		loc.SetColumn(max)
 	}
 
+	only := l.partialRows(options, perPage, bufsiz, loc.Column())
+	if l.updateStyleGeneration(state) {
+		only = nil
+	}
+
 	// previously drawn lines are cached. first, truncate the cache
 	// to current size of the drawable area
 	if ldc := int(len(l.displayCache)); ldc != perPage {
-		newCache := make([]line.Line, perPage)
+		newCache := make([]displayCacheEntry, perPage)
 		copy(newCache, l.displayCache)
 		l.displayCache = newCache
 	} else if perPage > bufsiz {
@@ -407,7 +632,7 @@ func (l *ListArea) Draw(state *Peco, parent Layout, perPage int, options *DrawOp
 			y = start - n
 		}
 
-		l.screen.Print(PrintArgs{
+		l.print(PrintArgs{
 			Y:    y,
 			Fg:   l.styles.Basic.fg,
 			Bg:   l.styles.Basic.bg,
@@ -416,7 +641,6 @@ func (l *ListArea) Draw(state *Peco, parent Layout, perPage int, options *DrawOp
 	}
 
 	var cached, written int
-	var fgAttr, bgAttr termbox.Attribute
 	var selectionPrefix = state.selectionPrefix
 	var prefix = ""
 
@@ -430,6 +654,13 @@ func (l *ListArea) Draw(state *Peco, parent Layout, perPage int, options *DrawOp
 	}
 
 	for n := 0; n < perPage; n++ {
+		if only != nil {
+			if _, ok := only[n+loc.Offset()]; !ok {
+				continue
+			}
+		}
+
+		var fgAttr, bgAttr termbox.Attribute
 		if len(selectionPrefix) > 0 {
 			switch {
 			case n+loc.Offset() == loc.LineNumber():
@@ -468,22 +699,80 @@ func (l *ListArea) Draw(state *Peco, parent Layout, perPage int, options *DrawOp
 			break
 		}
 
-		if (options != nil && options.DisableCache) || l.IsDirty() || target.IsDirty() {
+		// The style given by a LineStyler may change without the
+		// line itself changing (e.g. as time passes), so it is part
+		// of the cache entry
+		if s := l.lineStyler; s != nil {
+			fgAttr, bgAttr = s.StyleLine(target, fgAttr, bgAttr)
+		}
+
+		entry := displayCacheEntry{
+			line:     target,
+			id:       target.ID(),
+			column:   loc.Column(),
+			styleGen: l.styleGen,
+			fg:       fgAttr,
+			bg:       bgAttr,
+			prefix:   prefix,
+		}
+		if (options != nil && options.DisableCache) || only != nil || l.IsDirty() || target.IsDirty() {
 			target.SetDirty(false)
-		} else if l.displayCache[n] == target {
+		} else if entry.isDrawn(l.displayCache[n]) {
 			cached++
 			continue
 		}
 
 		written++
-		l.displayCache[n] = target
+		l.displayCache[n] = entry
+
+		// Without a selection prefix, the line under the cursor is
+		// drawn in the Selected style, and so are its matches
+		l.onCursor = len(selectionPrefix) == 0 && n+loc.Offset() == loc.LineNumber()
+
+		// With --selection-bar, the whole row under the cursor is
+		// filled before the line is drawn on top of it, so that the
+		// bar extends across the full width, even if the line is
+		// shorter than the screen, or scrolled out of view
+		l.inSelectionBar = false
+		if state.selectionBar && n+loc.Offset() == loc.LineNumber() {
+			l.screen.Print(PrintArgs{
+				Y:    y,
+				Fg:   fgAttr | termbox.AttrReverse,
+				Bg:   bgAttr,
+				Fill: true,
+			})
+			l.inSelectionBar = true
+		}
 
 		x := -1 * loc.Column()
 		xOffset := loc.Column()
+
+		// The note is looked up before the line is rendered, as it
+		// may be attached to the text of the original line
+		var note string
+		if !isGroupHeader(target) {
+			note = state.Annotation(target)
+		}
+		if r := l.lineRenderer; r != nil && !isGroupHeader(target) {
+			target = renderLine(r, target)
+		}
 		line := target.DisplayString()
 
+		if isGroupHeader(target) {
+			l.print(PrintArgs{
+				X:       x,
+				Y:       y,
+				XOffset: xOffset,
+				Fg:      l.styles.Basic.fg | termbox.AttrBold,
+				Bg:      l.styles.Basic.bg,
+				Msg:     line,
+				Fill:    true,
+			})
+			continue
+		}
+
 		if len := len(prefix); len > 0 {
-			l.screen.Print(PrintArgs{
+			l.print(PrintArgs{
 				X:       x,
 				Y:       y,
 				XOffset: xOffset,
@@ -496,7 +785,7 @@ func (l *ListArea) Draw(state *Peco, parent Layout, perPage int, options *DrawOp
 		if state.SingleKeyJumpMode() || state.SingleKeyJumpShowPrefix() {
 			prefixes := state.SingleKeyJumpPrefixes()
 			if n < int(len(prefixes)) {
-				l.screen.Print(PrintArgs{
+				l.print(PrintArgs{
 					X:       x,
 					Y:       y,
 					XOffset: xOffset,
@@ -504,7 +793,7 @@ func (l *ListArea) Draw(state *Peco, parent Layout, perPage int, options *DrawOp
 					Bg:      bgAttr,
 					Msg:     string(prefixes[n]),
 				})
-				l.screen.Print(PrintArgs{
+				l.print(PrintArgs{
 					X:       x + 1,
 					Y:       y,
 					XOffset: xOffset,
@@ -513,7 +802,7 @@ func (l *ListArea) Draw(state *Peco, parent Layout, perPage int, options *DrawOp
 					Msg:     " ",
 				})
 			} else {
-				l.screen.Print(PrintArgs{
+				l.print(PrintArgs{
 					X:       x,
 					Y:       y,
 					XOffset: xOffset,
@@ -526,79 +815,188 @@ func (l *ListArea) Draw(state *Peco, parent Layout, perPage int, options *DrawOp
 			x += 2
 		}
 
-		ix, ok := target.(MatchIndexer)
-		if !ok {
-			l.screen.Print(PrintArgs{
-				X:       x,
+		// With --max-line-width, long lines are cut short, and end
+		// with a marker in the Truncated style
+		markerX := -1
+		if max := state.maxLineWidth; max > 0 {
+			var width int
+			var truncated bool
+			if target, width, truncated = truncateLine(target, max, x+xOffset); truncated {
+				line = target.DisplayString()
+				markerX = x + width
+			}
+		}
+
+		l.drawLine(state, target, line, x, y, xOffset, fgAttr, bgAttr)
+		if markerX >= 0 {
+			l.print(PrintArgs{
+				X:       markerX,
 				Y:       y,
 				XOffset: xOffset,
-				Fg:      fgAttr,
-				Bg:      bgAttr,
-				Msg:     line,
-				Fill:    true,
+				Fg:      l.styles.Truncated.fg,
+				Bg:      mergeAttribute(bgAttr, l.styles.Truncated.bg),
+				Msg:     truncationMarker,
 			})
-			continue
 		}
 
-		matches := ix.Indices()
-		prev := x
-		index := 0
+		// Notes are drawn at the right edge of the row, regardless of
+		// horizontal scrolling, on top of the end of long lines
+		if note != "" {
+			msg := " " + note
+			width, _ := l.screen.Size()
+			l.screen.Print(PrintArgs{
+				X:   width - runewidth.StringWidth(msg),
+				Y:   y,
+				Fg:  l.styles.Annotation.fg,
+				Bg:  mergeAttribute(bgAttr, l.styles.Annotation.bg),
+				Msg: msg,
+			})
+		}
+	}
+	l.onCursor = false
+	l.inSelectionBar = false
+	l.SetDirty(false)
+	if pdebug.Enabled {
+		pdebug.Printf("ListArea.Draw: Written total of %d lines (%d cached)", written+cached, cached)
+	}
+}
 
-		for _, m := range matches {
-			if m[0] > index {
-				c := line[index:m[0]]
-				n := l.screen.Print(PrintArgs{
-					X:       prev,
-					Y:       y,
-					XOffset: xOffset,
-					Fg:      fgAttr,
-					Bg:      bgAttr,
-					Msg:     c,
-				})
-				prev += n
-				index += len(c)
-			}
-			c := line[m[0]:m[1]]
+// drawLine draws the text of a line, highlighting the portions of it
+// that matched the query or the SearchInResults pattern
+func (l *ListArea) drawLine(state *Peco, target line.Line, line string, x, y, xOffset int, fgAttr, bgAttr termbox.Attribute) {
+	if rx := state.SearchPattern(); rx != nil {
+		if found := rx.FindAllStringIndex(line, -1); len(found) > 0 {
+			l.drawSearchMatches(target, line, found, x, y, xOffset, fgAttr, bgAttr)
+			return
+		}
+	}
+
+	ix, ok := target.(MatchIndexer)
+	if !ok {
+		l.print(PrintArgs{
+			X:       x,
+			Y:       y,
+			XOffset: xOffset,
+			Fg:      fgAttr,
+			Bg:      bgAttr,
+			Msg:     line,
+			Fill:    true,
+		})
+		return
+	}
+
+	matches := ix.Indices()
+	prev := x
+	index := 0
 
-			n := l.screen.Print(PrintArgs{
+	for i, m := range matches {
+		if m[0] > index {
+			c := line[index:m[0]]
+			n := l.print(PrintArgs{
 				X:       prev,
 				Y:       y,
 				XOffset: xOffset,
-				Fg:      l.styles.Matched.fg,
-				Bg:      mergeAttribute(bgAttr, l.styles.Matched.bg),
+				Fg:      fgAttr,
+				Bg:      bgAttr,
 				Msg:     c,
-				Fill:    true,
 			})
 			prev += n
 			index += len(c)
 		}
+		c := line[m[0]:m[1]]
+		fg, bg := l.styles.matchedColors(matchTerm(target, i), bgAttr, l.onCursor)
+
+		n := l.print(PrintArgs{
+			X:       prev,
+			Y:       y,
+			XOffset: xOffset,
+			Fg:      fg,
+			Bg:      bg,
+			Msg:     c,
+			Fill:    true,
+		})
+		prev += n
+		index += len(c)
+	}
 
-		m := matches[len(matches)-1]
-		if m[0] > index {
-			l.screen.Print(PrintArgs{
-				X:       prev,
-				Y:       y,
-				XOffset: xOffset,
-				Fg:      l.styles.Query.fg,
-				Bg:      mergeAttribute(bgAttr, l.styles.Query.bg),
-				Msg:     line[m[0]:m[1]],
-				Fill:    true,
-			})
-		} else if len(line) > m[1] {
-			l.screen.Print(PrintArgs{
-				X:       prev,
-				Y:       y,
-				XOffset: xOffset,
-				Fg:      fgAttr,
-				Bg:      bgAttr,
-				Msg:     line[m[1]:len(line)],
-				Fill:    true,
-			})
+	m := matches[len(matches)-1]
+	if m[0] > index {
+		l.print(PrintArgs{
+			X:       prev,
+			Y:       y,
+			XOffset: xOffset,
+			Fg:      l.styles.Query.fg,
+			Bg:      mergeAttribute(bgAttr, l.styles.Query.bg),
+			Msg:     line[m[0]:m[1]],
+			Fill:    true,
+		})
+	} else if len(line) > m[1] {
+		l.print(PrintArgs{
+			X:       prev,
+			Y:       y,
+			XOffset: xOffset,
+			Fg:      fgAttr,
+			Bg:      bgAttr,
+			Msg:     line[m[1]:len(line)],
+			Fill:    true,
+		})
+	}
+}
+
+// drawSearchMatches draws a line that contains matches against the
+// SearchInResults pattern. These are highlighted using the
+// SearchMatched style, on top of the usual query matches
+func (l *ListArea) drawSearchMatches(target line.Line, line string, found [][]int, x, y, xOffset int, fgAttr, bgAttr termbox.Attribute) {
+	// kinds holds the ordinal of the query term for matched bytes
+	const (
+		plain    = -1
+		searched = -2
+	)
+
+	kinds := make([]int, len(line))
+	for i := range kinds {
+		kinds[i] = plain
+	}
+	if ix, ok := target.(MatchIndexer); ok {
+		for n, m := range ix.Indices() {
+			term := matchTerm(target, n)
+			for i := m[0]; i < m[1] && i < len(kinds); i++ {
+				kinds[i] = term
+			}
 		}
 	}
-	l.SetDirty(false)
-	if pdebug.Enabled {
-		pdebug.Printf("ListArea.Draw: Written total of %d lines (%d cached)", written+cached, cached)
+	for _, m := range found {
+		for i := m[0]; i < m[1]; i++ {
+			kinds[i] = searched
+		}
+	}
+
+	for start := 0; start < len(line); {
+		end := start + 1
+		for end < len(line) && kinds[end] == kinds[start] {
+			end++
+		}
+
+		fg, bg := fgAttr, bgAttr
+		switch kinds[start] {
+		case plain:
+		case searched:
+			fg = l.styles.SearchMatched.fg
+			bg = mergeAttribute(bgAttr, l.styles.SearchMatched.bg)
+		default:
+			fg, bg = l.styles.matchedColors(kinds[start], bgAttr, l.onCursor)
+		}
+
+		x += l.print(PrintArgs{
+			X:       x,
+			Y:       y,
+			XOffset: xOffset,
+			Fg:      fg,
+			Bg:      bg,
+			Msg:     line[start:end],
+			Fill:    end == len(line),
+		})
+		start = end
 	}
 }
 
@@ -609,9 +1007,16 @@ func maxOf(a, b int) int {
 	return b
 }
 
+func minOf(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
 // NewDefaultLayout creates a new Layout in the default format (top-down)
 func NewDefaultLayout(state *Peco) *BasicLayout {
-	return &BasicLayout{
+	l := &BasicLayout{
 		StatusBar: NewStatusBar(state.Screen(), AnchorBottom, 0+extraOffset, state.Styles()),
 		// The prompt is at the top
 		prompt: NewUserPrompt(state.Screen(), AnchorTop, 0, state.Prompt(), state.Styles()),
@@ -619,11 +1024,14 @@ func NewDefaultLayout(state *Peco) *BasicLayout {
 		// It's also displayed top-to-bottom order
 		list: NewListArea(state.Screen(), AnchorTop, 1, true, state.Styles()),
 	}
+	l.list.SetLineStyler(state.LineStyler())
+	l.list.SetLineRenderer(state.LineRenderer())
+	return l
 }
 
 // NewBottomUpLayout creates a new Layout in bottom-up format
 func NewBottomUpLayout(state *Peco) *BasicLayout {
-	return &BasicLayout{
+	l := &BasicLayout{
 		StatusBar: NewStatusBar(state.Screen(), AnchorBottom, 0+extraOffset, state.Styles()),
 		// The prompt is at the bottom, above the status bar
 		prompt: NewUserPrompt(state.Screen(), AnchorBottom, 1+extraOffset, state.Prompt(), state.Styles()),
@@ -631,6 +1039,9 @@ func NewBottomUpLayout(state *Peco) *BasicLayout {
 		// It's displayed in bottom-to-top order
 		list: NewListArea(state.Screen(), AnchorBottom, 2+extraOffset, false, state.Styles()),
 	}
+	l.list.SetLineStyler(state.LineStyler())
+	l.list.SetLineRenderer(state.LineRenderer())
+	return l
 }
 
 func (l *BasicLayout) PurgeDisplayCache() {
@@ -645,6 +1056,13 @@ func (l *BasicLayout) CalculatePage(state *Peco, perPage int) error {
 	}
 	buf := state.CurrentLineBuffer()
 	loc := state.Location()
+
+	// Group headers can't be selected, so the cursor is moved off a
+	// header that the lines have been rearranged to put under it
+	if cur, err := buf.LineAt(loc.LineNumber()); err == nil && isGroupHeader(cur) && loc.LineNumber()+1 < buf.Size() {
+		loc.SetLineNumber(loc.LineNumber() + 1)
+	}
+
 	loc.SetPage((loc.LineNumber() / perPage) + 1)
 	loc.SetOffset((loc.Page() - 1) * perPage)
 	loc.SetPerPage(perPage)
@@ -680,11 +1098,26 @@ func (l *BasicLayout) DrawScreen(state *Peco, options *DrawOptions) {
 	}
 
 	perPage := l.linesPerPage()
+	page := state.Location().Page()
+
+	// In follow mode, the cursor stays on the newest line as the input
+	// grows. Filtered results are not followed, as they are not
+	// necessarily in the order that the lines were read
+	if state.Following() && state.Query().Len() == 0 {
+		if n := state.CurrentLineBuffer().Size(); n > 0 {
+			state.Location().SetLineNumber(n - 1)
+		}
+	}
 
 	if err := l.CalculatePage(state, perPage); err != nil {
 		return
 	}
 
+	if options != nil && len(options.Lines) > 0 && state.Location().Page() != page {
+		// Every row shows a different line now
+		options = nil
+	}
+
 	l.DrawPrompt(state)
 	l.list.Draw(state, l, perPage, options)
 
@@ -751,20 +1184,40 @@ func verticalScroll(state *Peco, l *BasicLayout, p PagingRequest) bool {
 		}
 	}()
 
+	count := 1
+	if cpr, ok := p.(CountedPagingRequest); ok && cpr.Count > 1 {
+		count = cpr.Count
+	}
+
+	// Moving by more than a line at a time stops at either end of
+	// the buffer, instead of wrapping around
+	clamp := count > 1
+
 	lpp := l.linesPerPage()
+	hpp := lpp / 2
+	if hpp < 1 {
+		hpp = 1
+	}
+
 	if l.list.sortTopDown {
 		switch p.Type() {
 		case ToLineAbove:
-			lineno--
+			lineno -= count
 		case ToLineBelow:
-			lineno++
+			lineno += count
 		case ToScrollPageDown:
-			lineno += lpp
-			if loc.Page() == loc.MaxPage()-1 && lcur < lineno && (lcur-lineBefore) < lpp {
+			lineno += lpp * count
+			if loc.Page() == loc.MaxPage()-1 && lcur < lineno && (lcur-lineBefore) < lpp*count {
 				lineno = lcur - 1
 			}
 		case ToScrollPageUp:
-			lineno -= lpp
+			lineno -= lpp * count
+		case ToScrollHalfPageDown:
+			lineno += hpp * count
+			clamp = true
+		case ToScrollHalfPageUp:
+			lineno -= hpp * count
+			clamp = true
 		case ToLineInPage:
 			lineno = loc.PerPage()*(loc.Page()-1) + p.(JumpToLineRequest).Line()
 		case ToScrollFirstItem:
@@ -775,27 +1228,42 @@ func verticalScroll(state *Peco, l *BasicLayout, p PagingRequest) bool {
 	} else {
 		switch p.Type() {
 		case ToLineAbove:
-			lineno++
+			lineno += count
 		case ToLineBelow:
-			lineno--
+			lineno -= count
 		case ToScrollPageDown:
-			lineno -= lpp
+			lineno -= lpp * count
 		case ToScrollPageUp:
-			lineno += lpp
+			lineno += lpp * count
+		case ToScrollHalfPageDown:
+			lineno -= hpp * count
+			clamp = true
+		case ToScrollHalfPageUp:
+			lineno += hpp * count
+			clamp = true
 		case ToLineInPage:
 			lineno = loc.PerPage()*(loc.Page()-1) - p.(JumpToLineRequest).Line()
 		}
 	}
 
-	if lineno < 0 {
-		if lcur > 0 {
-			// Go to last page, if possible
-			lineno = lcur - 1
-		} else {
+	step := 1
+	if lineno < lineBefore {
+		step = -1
+	}
+
+	if clamp && lcur > 0 {
+		if lineno < 0 {
 			lineno = 0
+		} else if lineno >= lcur {
+			lineno = lcur - 1
 		}
-	} else if lcur > 0 && lineno >= lcur {
-		lineno = 0
+	}
+	lineno = wrapLineNumber(lineno, lcur)
+
+	// Group headers can't be selected, so don't let the cursor
+	// rest on one. Keep moving in the direction we were going
+	if l, err := buf.LineAt(lineno); err == nil && isGroupHeader(l) {
+		lineno = wrapLineNumber(lineno+step, lcur)
 	}
 
 	// XXX DO NOT RETURN UNTIL YOU SET THE LINE NUMBER HERE
@@ -857,6 +1325,21 @@ func verticalScroll(state *Peco, l *BasicLayout, p PagingRequest) bool {
 	return true
 }
 
+// wrapLineNumber makes sure that lineno stays within a buffer
+// of size lcur, wrapping around at both ends
+func wrapLineNumber(lineno, lcur int) int {
+	if lineno < 0 {
+		if lcur > 0 {
+			// Go to last page, if possible
+			return lcur - 1
+		}
+		return 0
+	} else if lcur > 0 && lineno >= lcur {
+		return 0
+	}
+	return lineno
+}
+
 // horizontalScroll scrolls screen horizontal
 func horizontalScroll(state *Peco, l *BasicLayout, p PagingRequest) bool {
 	width, _ := state.screen.Size()
@@ -872,7 +1355,5 @@ func horizontalScroll(state *Peco, l *BasicLayout, p PagingRequest) bool {
 		return false
 	}
 
-	l.list.SetDirty(true)
-
 	return true
 }
@@ -1,11 +1,15 @@
 package peco
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 	"unicode/utf8"
 
 	"github.com/mattn/go-runewidth"
 	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/line"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestLayoutType(t *testing.T) {
@@ -80,6 +84,137 @@ func TestPrintScreen(t *testing.T) {
 	verify("日本語")
 }
 
+func TestPrintEscapesNonPrintable(t *testing.T) {
+	screen := NewMemoryScreen(40, 1)
+	escape := Style{fg: termbox.ColorRed, bg: termbox.ColorDefault}
+	n := screen.Print(PrintArgs{
+		Fg:     termbox.ColorDefault,
+		Bg:     termbox.ColorDefault,
+		Msg:    "a\x00b\xffc\u0085d",
+		Escape: &escape,
+	})
+
+	if !assert.Equal(t, `a\x00b\xffc\u0085d`, strings.TrimRight(screen.Line(0), " "), "non-printable bytes should be escaped") {
+		return
+	}
+	if !assert.Equal(t, 18, n, "Print should return the width of the escaped string") {
+		return
+	}
+	if !assert.Equal(t, termbox.ColorDefault, screen.Cell(0, 0).Fg, "printable characters should use Fg") {
+		return
+	}
+	if !assert.Equal(t, termbox.ColorRed, screen.Cell(1, 0).Fg, "escape sequences should use the Escape style") {
+		return
+	}
+}
+
+func TestPrintWideRunes(t *testing.T) {
+	print := func(x int, msg string) string {
+		screen := NewMemoryScreen(6, 1)
+		screen.Print(PrintArgs{X: x, XOffset: -x, Msg: msg})
+		return screen.Line(0)
+	}
+
+	assert.Equal(t, "日本語", print(0, "日本語"), "wide runes should cover two cells each")
+	assert.Equal(t, " 本語", print(-1, "日本語"), "a wide rune cut at the left edge should be left blank")
+	assert.Equal(t, " 日本", print(1, "日本語"), "a wide rune cut at the right edge should be left blank")
+	assert.Equal(t, "ex", print(0, "e\u0301x"), "combining characters should not take a cell")
+	assert.Equal(t, "a   b", print(0, "a\tb"), "tabs should extend to the next multiple of 4")
+	assert.Equal(t, 4, displayWidth("e\u0301日x", 0), "combining characters should have no width")
+	assert.Equal(t, 5, displayWidth("a\tb", 0), "tabs should be as wide as they are drawn")
+}
+
+func TestHorizontalScrollWideRunes(t *testing.T) {
+	state := newPeco()
+	screen := NewMemoryScreen(8, 4)
+	state.screen = screen
+	buf := NewMemoryBuffer()
+	buf.lines = append(buf.lines,
+		line.NewRaw(0, "日本語のテキスト", false),
+		line.NewRaw(1, "ascii only line", false),
+	)
+	state.currentLineBuffer = buf
+
+	l := NewDefaultLayout(state)
+	state.Location().SetColumn(3)
+	l.DrawScreen(state, nil)
+
+	assert.Equal(t, " 語のテ", screen.Line(1), "wide runes should stay aligned to their columns when scrolled")
+	assert.Equal(t, "ii only", screen.Line(2), "narrow runes should be scrolled by the same number of columns")
+
+	state.Location().SetColumn(100)
+	l.DrawScreen(state, nil)
+	assert.Equal(t, 16-8, state.Location().Column(), "scrolling should stop at the display width of the widest line")
+}
+
+func TestMatchedSelected(t *testing.T) {
+	state := newPeco()
+	screen := NewMemoryScreen(20, 4)
+	state.screen = screen
+	buf := NewMemoryBuffer()
+	buf.lines = append(buf.lines,
+		line.NewMatched(line.NewRaw(0, "foo bar", false), [][]int{{0, 3}}),
+		line.NewMatched(line.NewRaw(1, "foo baz", false), [][]int{{0, 3}}),
+	)
+	state.currentLineBuffer = buf
+	state.styles.Init()
+	state.styles.MatchedSelected = &Style{fg: termbox.ColorYellow, bg: termbox.ColorDefault}
+
+	l := NewDefaultLayout(state)
+	l.DrawScreen(state, nil)
+
+	cell := screen.Cell(0, 1)
+	if !assert.Equal(t, termbox.ColorYellow, cell.Fg, "matches on the cursor line should use MatchedSelected") {
+		return
+	}
+	if !assert.Equal(t, state.styles.Selected.bg, cell.Bg, "MatchedSelected without a background should keep that of Selected") {
+		return
+	}
+	if !assert.Equal(t, state.styles.Matched.fg, screen.Cell(0, 2).Fg, "matches on other lines should use Matched") {
+		return
+	}
+}
+
+func TestDiffScreen(t *testing.T) {
+	dummy := NewDummyScreen()
+	screen := NewDiffScreen(dummy)
+	w, h := screen.Size()
+
+	draw := func(msg string) int {
+		dummy.interceptor.reset()
+		screen.Print(PrintArgs{Msg: msg, Fill: true})
+		screen.Flush()
+		return len(dummy.interceptor.events["SetCell"])
+	}
+
+	if !assert.Equal(t, w*h, draw("hello"), "the first frame should be drawn in full") {
+		return
+	}
+	if !assert.Equal(t, 0, draw("hello"), "unchanged cells should not be drawn") {
+		return
+	}
+	if !assert.Equal(t, 1, draw("hallo"), "only the changed cell should be drawn") {
+		return
+	}
+	if !assert.Equal(t, 1, draw("日llo"), "the wide character should be drawn") {
+		return
+	}
+	if !assert.Equal(t, 2, draw("hallo"), "the cell covered by the wide character should be redrawn") {
+		return
+	}
+
+	screen.Invalidate()
+	if !assert.Equal(t, w*h, draw("hallo"), "the frame should be drawn in full after Invalidate") {
+		return
+	}
+
+	dummy.width++
+	screen.Size()
+	if !assert.Equal(t, (w+1)*h, draw("hallo"), "the frame should be drawn in full after resizing") {
+		return
+	}
+}
+
 func TestStatusBar(t *testing.T) {
 	screen := NewDummyScreen()
 	st := NewStatusBar(screen, AnchorBottom, 0, NewStyleSet())
@@ -127,3 +262,138 @@ func TestMergeAttribute(t *testing.T) {
 	}
 
 }
+
+func TestVerticalScrollCount(t *testing.T) {
+	state := newPeco()
+	buf := NewMemoryBuffer()
+	for i := 0; i < 100; i++ {
+		buf.lines = append(buf.lines, line.NewRaw(uint64(i), fmt.Sprintf("line %d", i), false))
+	}
+	state.currentLineBuffer = buf
+
+	l := NewDefaultLayout(state)
+	hpp := l.linesPerPage() / 2
+
+	tests := []struct {
+		request  PagingRequest
+		expected int
+	}{
+		{CountedPagingRequest{Request: ToLineBelow, Count: 5}, 5},
+		{ToLineAbove, 4},
+		{ToScrollHalfPageDown, 4 + hpp},
+		{ToScrollHalfPageUp, 4},
+		{CountedPagingRequest{Request: ToScrollHalfPageUp, Count: 3}, 0},
+		{CountedPagingRequest{Request: ToLineBelow, Count: 1000}, 99},
+		{ToLineBelow, 0},
+	}
+
+	for i, test := range tests {
+		verticalScroll(state, l, test.request)
+		if !assert.Equal(t, test.expected, state.Location().LineNumber(), "line number after request %d should match", i) {
+			return
+		}
+	}
+}
+
+func TestDisplayCacheEntry(t *testing.T) {
+	raw := line.NewRaw(1, "foo bar", false)
+	drawn := displayCacheEntry{
+		line: line.NewMatched(raw, [][]int{{0, 3}}),
+		id:   raw.ID(),
+	}
+
+	tests := []struct {
+		name     string
+		entry    displayCacheEntry
+		expected bool
+	}{
+		{"same line", drawn, true},
+		{"same matches", displayCacheEntry{line: line.NewMatched(raw, [][]int{{0, 3}}), id: raw.ID()}, true},
+		{"different matches", displayCacheEntry{line: line.NewMatched(raw, [][]int{{4, 7}}), id: raw.ID()}, false},
+		{"unmatched", displayCacheEntry{line: raw, id: raw.ID()}, false},
+		{"scrolled", displayCacheEntry{line: drawn.line, id: raw.ID(), column: 4}, false},
+		{"new style generation", displayCacheEntry{line: drawn.line, id: raw.ID(), styleGen: 1}, false},
+		{"selected", displayCacheEntry{line: drawn.line, id: raw.ID(), fg: termbox.ColorRed}, false},
+		{"restyled", displayCacheEntry{line: drawn.line, id: raw.ID(), bg: termbox.ColorBlue}, false},
+	}
+	for _, test := range tests {
+		if !assert.Equal(t, test.expected, test.entry.isDrawn(drawn), "%s: isDrawn should match", test.name) {
+			return
+		}
+	}
+
+	assert.False(t, drawn.isDrawn(displayCacheEntry{}), "rows without a cached line should be drawn")
+
+	foo := &groupHeader{key: "foo"}
+	header := displayCacheEntry{line: foo, id: foo.ID()}
+	assert.True(t, header.isDrawn(header), "the same header should not be redrawn")
+	bar := &groupHeader{key: "bar"}
+	assert.False(t, displayCacheEntry{line: bar, id: bar.ID()}.isDrawn(header), "another header should be drawn")
+}
+
+func TestStyleGenerationCommonPrefix(t *testing.T) {
+	state := newPeco()
+	state.stripCommonPrefix = true
+	src := NewSource("-", strings.NewReader(""), false, nil, 0, false)
+	src.TrackCommonPrefix(true)
+	state.source = src
+	src.Append(line.NewRaw(1, "/usr/lib/foo", false))
+	src.Append(line.NewRaw(2, "/usr/lib/bar", false))
+
+	l := NewListArea(state.screen, AnchorTop, 1, true, &state.styles)
+	l.updateStyleGeneration(state)
+	if !assert.False(t, l.updateStyleGeneration(state), "nothing should have changed") {
+		return
+	}
+
+	// The lines that were drawn without the old prefix are out of date
+	src.Append(line.NewRaw(3, "/usr/bin/baz", false))
+	assert.True(t, l.updateStyleGeneration(state), "a new common prefix should start a new style generation")
+}
+
+func TestPartialDraw(t *testing.T) {
+	state := newPeco()
+	buf := NewMemoryBuffer()
+	for i := 0; i < 100; i++ {
+		buf.lines = append(buf.lines, line.NewRaw(uint64(i), fmt.Sprintf("line %d", i), false))
+	}
+	state.currentLineBuffer = buf
+	screen := state.screen.(*dummyScreen)
+
+	l := NewDefaultLayout(state)
+	l.DrawScreen(state, nil)
+
+	// drawnRows returns the rows that were drawn on since the last call
+	drawnRows := func() map[int]bool {
+		rows := map[int]bool{}
+		screen.m.Lock()
+		for _, args := range screen.events["SetCell"] {
+			rows[args[1].(int)] = true
+		}
+		screen.m.Unlock()
+		screen.reset()
+		return rows
+	}
+	drawnRows()
+
+	before := state.Location().LineNumber()
+	if !assert.True(t, l.MovePage(state, ToLineBelow), "MovePage should succeed") {
+		return
+	}
+	l.DrawScreen(state, &DrawOptions{Lines: []int{before, state.Location().LineNumber()}})
+	// The prompt, followed by the rows of lines 0 and 1
+	if !assert.Equal(t, map[int]bool{0: true, 1: true, 2: true}, drawnRows(), "only the prompt and the rows the cursor moved between should be drawn") {
+		return
+	}
+
+	// Rows that are asked for are redrawn even if they are unchanged
+	l.DrawScreen(state, &DrawOptions{Lines: []int{5}})
+	if !assert.Equal(t, map[int]bool{0: true, 6: true}, drawnRows(), "only the prompt and the requested row should be drawn") {
+		return
+	}
+
+	// Moving to the next page changes every row
+	state.Location().SetLineNumber(l.linesPerPage())
+	l.DrawScreen(state, &DrawOptions{Lines: []int{0, l.linesPerPage()}})
+	assert.Len(t, drawnRows(), l.linesPerPage()+1, "every row should be drawn on a new page")
+}
@@ -0,0 +1,74 @@
+package peco
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// goroutineStacks returns the stack traces of all running goroutines,
+// keyed by their IDs
+func goroutineStacks() map[string]string {
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	stacks := make(map[string]string)
+	for _, stack := range strings.Split(string(buf), "\n\n") {
+		// Each stack starts with a line such as "goroutine 42 [select]:"
+		fields := strings.Fields(stack)
+		if len(fields) < 2 || fields[0] != "goroutine" {
+			continue
+		}
+		stacks[fields[1]] = strings.TrimSpace(stack)
+	}
+	return stacks
+}
+
+// leakedGoroutines returns the stack traces of the goroutines started
+// by peco that are running, but were not in baseline. Goroutines that
+// are on their way out are given until grace has passed to finish
+func leakedGoroutines(baseline map[string]string, grace time.Duration) []string {
+	deadline := time.Now().Add(grace)
+	for {
+		var leaked []string
+		for id, stack := range goroutineStacks() {
+			if _, ok := baseline[id]; ok {
+				continue
+			}
+			if !strings.Contains(stack, "github.com/peco/peco") {
+				continue
+			}
+			leaked = append(leaked, stack)
+		}
+
+		if len(leaked) == 0 || time.Now().After(deadline) {
+			sort.Strings(leaked)
+			return leaked
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// reportLeakedGoroutines implements --debug-leak-check. The goroutines
+// started by peco since baseline was taken, that are still running,
+// are printed to stderr
+func (p *Peco) reportLeakedGoroutines(baseline map[string]string) {
+	leaked := leakedGoroutines(baseline, leakCheckGrace)
+	if len(leaked) == 0 {
+		return
+	}
+
+	fmt.Fprintf(p.Stderr, "peco: %d goroutine(s) still running after exit:\n", len(leaked))
+	for _, stack := range leaked {
+		fmt.Fprintf(p.Stderr, "\n%s\n", stack)
+	}
+}
@@ -0,0 +1,97 @@
+package peco
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+func TestLeakedGoroutines(t *testing.T) {
+	baseline := goroutineStacks()
+
+	stop := make(chan struct{})
+	go func() { <-stop }()
+
+	leaked := leakedGoroutines(baseline, 0)
+	if assert.Len(t, leaked, 1, "the goroutine should be reported") {
+		assert.Contains(t, leaked[0], "TestLeakedGoroutines", "the stack of the goroutine should be reported")
+	}
+
+	close(stop)
+	assert.Empty(t, leakedGoroutines(baseline, time.Second), "goroutines that have returned should not be reported")
+}
+
+func TestRunLeavesNoGoroutines(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ignore := goleak.IgnoreCurrent()
+
+	var stderr bytes.Buffer
+	p := newPeco()
+	p.Argv = []string{"peco", "--debug-leak-check", "--query", "b"}
+	p.Stdin = bytes.NewBufferString("foo\nbar\nbaz\n")
+	p.Stderr = &stderr
+
+	runCtx, stop := context.WithCancel(ctx)
+	errCh := startPeco(runCtx, t, p, 3, 2)
+
+	// Keep the filter busy while peco exits
+	p.Query().Set("ba")
+	p.ExecQuery(nil)
+	stop()
+
+	select {
+	case <-ctx.Done():
+		t.Fatalf("timed out waiting for peco to exit")
+	case <-errCh:
+	}
+	goleak.VerifyNone(t, ignore)
+	assert.Empty(t, stderr.String(), "--debug-leak-check should not report anything")
+}
+
+// endlessReader produces lines forever
+type endlessReader struct{}
+
+func (endlessReader) Read(b []byte) (int, error) {
+	n := copy(b, strings.Repeat("line\n", len(b)/5))
+	return n, nil
+}
+
+func TestRunExitsWhileReading(t *testing.T) {
+	for i := 0; i < 30; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+		p := newPeco()
+		p.Argv = []string{}
+		p.Stdin = endlessReader{}
+
+		runCtx, stop := context.WithCancel(ctx)
+		errCh := make(chan error, 1)
+		go func() { errCh <- p.Run(runCtx) }()
+
+		select {
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for peco to be ready")
+		case <-p.Ready():
+		}
+		for p.source.Size() < 1000 && ctx.Err() == nil {
+			time.Sleep(time.Millisecond)
+		}
+
+		// The input is still being read when peco exits, and the ID
+		// generator may stop before the source does
+		stop()
+		select {
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for peco to exit (iteration %d)", i)
+		case <-errCh:
+		}
+		cancel()
+	}
+}
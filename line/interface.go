@@ -39,7 +39,7 @@ type Line interface {
 type Raw struct {
 	id            uint64
 	buf           string
-	sepLoc        int
+	sepLoc        int32 // accessed atomically. see separator()
 	displayString string
 	dirty         bool
 }
@@ -48,6 +48,7 @@ type Raw struct {
 type Matched struct {
 	Line
 	indices [][]int
+	terms   []int
 }
 
 
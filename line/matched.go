@@ -2,7 +2,14 @@ package line
 
 // NewMatched creates a new Matched
 func NewMatched(rl Line, matches [][]int) *Matched {
-	return &Matched{rl, matches}
+	return &Matched{Line: rl, indices: matches}
+}
+
+// NewMatchedTerms creates a new Matched, recording the ordinal of the
+// query term that produced each of the matches. terms must be the same
+// length as matches
+func NewMatchedTerms(rl Line, matches [][]int, terms []int) *Matched {
+	return &Matched{Line: rl, indices: matches, terms: terms}
 }
 
 // Indices returns the indices in the buffer that matched
@@ -10,3 +17,12 @@ func (ml Matched) Indices() [][]int {
 	return ml.indices
 }
 
+// Term returns the ordinal of the query term that produced the n-th
+// match returned by Indices. If the filter did not record this
+// information, 0 is returned
+func (ml Matched) Term(n int) int {
+	if n < 0 || n >= len(ml.terms) {
+		return 0
+	}
+	return ml.terms[n]
+}
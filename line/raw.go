@@ -2,11 +2,16 @@ package line
 
 import (
 	"strings"
+	"sync/atomic"
 
 	"github.com/google/btree"
 	"github.com/peco/peco/internal/util"
 )
 
+// sepUnknown is the value of Raw.sepLoc until the line has been
+// searched for the null character
+const sepUnknown = -2
+
 // NewRaw creates a new Raw. The `enableSep` flag tells
 // it if we should search for a null character to split the
 // string to display and the string to emit upon selection of
@@ -20,14 +25,26 @@ func NewRaw(id uint64, v string, enableSep bool) *Raw {
 		dirty:         false,
 	}
 
-	if !enableSep {
-		return rl
+	// The search is deferred until the line is first displayed or
+	// emitted, so that reading large inputs is not slowed down
+	if enableSep {
+		rl.sepLoc = sepUnknown
 	}
+	return rl
+}
 
-	if i := strings.IndexByte(rl.buf, '\000'); i != -1 {
-		rl.sepLoc = i
+// separator returns the location of the null character that splits
+// the string to display and the string to emit, or -1 if there is
+// none. The result of the search is cached. Lines may be read from
+// several goroutines at once, but they all find the same location,
+// so it does not matter which one stores it
+func (rl *Raw) separator() int {
+	i := atomic.LoadInt32(&rl.sepLoc)
+	if i == sepUnknown {
+		i = int32(strings.IndexByte(rl.buf, '\000'))
+		atomic.StoreInt32(&rl.sepLoc, i)
 	}
-	return rl
+	return int(i)
 }
 
 // Less implements the btree.Item interface
@@ -41,7 +58,7 @@ func (rl *Raw) ID() uint64 {
 }
 
 // IsDirty returns true if this line must be redrawn on the terminal
-func (rl Raw) IsDirty() bool {
+func (rl *Raw) IsDirty() bool {
 	return rl.dirty
 }
 
@@ -51,27 +68,25 @@ func (rl *Raw) SetDirty(b bool) {
 }
 
 // Buffer returns the raw buffer. May contain null
-func (rl Raw) Buffer() string {
+func (rl *Raw) Buffer() string {
 	return rl.buf
 }
 
 // DisplayString returns the string to be displayed
-func (rl Raw) DisplayString() string {
+func (rl *Raw) DisplayString() string {
 	if rl.displayString != "" {
 		return rl.displayString
 	}
 
-	if i := rl.sepLoc; i > -1 {
-		rl.displayString = util.StripANSISequence(rl.buf[:i])
-	} else {
-		rl.displayString = util.StripANSISequence(rl.buf)
+	if i := rl.separator(); i > -1 {
+		return util.StripANSISequence(rl.buf[:i])
 	}
-	return rl.displayString
+	return util.StripANSISequence(rl.buf)
 }
 
 // Output returns the string to be displayed *after peco is done
-func (rl Raw) Output() string {
-	if i := rl.sepLoc; i > -1 {
+func (rl *Raw) Output() string {
+	if i := rl.separator(); i > -1 {
 		return rl.buf[i+1:]
 	}
 	return rl.buf
@@ -0,0 +1,102 @@
+package peco
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/peco/peco/line"
+)
+
+// matchIndicesJSON is a line printed by --print-indices=json
+type matchIndicesJSON struct {
+	Line  string   `json:"line"`
+	Bytes [][2]int `json:"bytes"`
+	Runes [][2]int `json:"runes"`
+}
+
+// currentMatches returns the ranges that matched the current query in
+// each line of the current results, keyed by the ID of the line.
+// Selected lines that no longer match have no entry
+func (p *Peco) currentMatches() map[uint64][][]int {
+	matches := make(map[uint64][][]int)
+	b := p.CurrentLineBuffer()
+	for i := 0; i < b.Size(); i++ {
+		l, err := b.LineAt(i)
+		if err != nil {
+			continue
+		}
+		if mi, ok := l.(MatchIndexer); ok {
+			if indices := mi.Indices(); len(indices) > 0 {
+				matches[l.ID()] = indices
+			}
+		}
+	}
+	return matches
+}
+
+// mergeMatchIndices sorts the ranges in indices, and merges those that
+// overlap. Only the first pair of each element is used, as the rest
+// are submatches
+func mergeMatchIndices(indices [][]int, max int) [][2]int {
+	ranges := make([][2]int, 0, len(indices))
+	for _, m := range indices {
+		if len(m) < 2 || m[0] < 0 || m[1] > max || m[0] >= m[1] {
+			continue
+		}
+		ranges = append(ranges, [2]int{m[0], m[1]})
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && r[0] < merged[n-1][1] {
+			if r[1] > merged[n-1][1] {
+				merged[n-1][1] = r[1]
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// formatMatchIndices formats a line for --print-indices. The ranges
+// are offsets into the displayed part of the line, end exclusive, in
+// both bytes and runes
+func formatMatchIndices(format string, l line.Line, indices [][]int) string {
+	display := l.DisplayString()
+	byteRanges := mergeMatchIndices(indices, len(display))
+	runeRanges := make([][2]int, len(byteRanges))
+	for i, r := range byteRanges {
+		runeRanges[i] = [2]int{
+			utf8.RuneCountInString(display[:r[0]]),
+			utf8.RuneCountInString(display[:r[1]]),
+		}
+	}
+
+	if format == indicesJSON {
+		buf, err := json.Marshal(matchIndicesJSON{
+			Line:  l.Output(),
+			Bytes: byteRanges,
+			Runes: runeRanges,
+		})
+		if err != nil {
+			return l.Output()
+		}
+		return string(buf)
+	}
+
+	return l.Output() + "\t" + formatRanges(byteRanges) + "\t" + formatRanges(runeRanges)
+}
+
+// formatRanges formats ranges as comma separated start-end pairs
+func formatRanges(ranges [][2]int) string {
+	s := make([]string, len(ranges))
+	for i, r := range ranges {
+		s[i] = strconv.Itoa(r[0]) + "-" + strconv.Itoa(r[1])
+	}
+	return strings.Join(s, ",")
+}
@@ -0,0 +1,37 @@
+package peco
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/peco/peco/line"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatMatchIndices(t *testing.T) {
+	l := line.NewMatched(line.NewRaw(0, "bänana", false), [][]int{{5, 7}, {3, 5, 3, 4}, {4, 6}})
+	assert.Equal(t, "bänana\t3-7\t2-6", formatMatchIndices(indicesTSV, l, l.Indices()), "overlapping ranges should be merged")
+	assert.Equal(t, `{"line":"bänana","bytes":[[3,7]],"runes":[[2,6]]}`, formatMatchIndices(indicesJSON, l, l.Indices()), "JSON should contain both kinds of ranges")
+
+	raw := line.NewRaw(1, "apple", false)
+	assert.Equal(t, "apple\t\t", formatMatchIndices(indicesTSV, raw, nil), "lines without matches should have empty ranges")
+	assert.Equal(t, `{"line":"apple","bytes":[],"runes":[]}`, formatMatchIndices(indicesJSON, raw, nil), "lines without matches should have empty lists")
+}
+
+func TestPrintIndices(t *testing.T) {
+	p := newPeco()
+	p.printIndices = indicesTSV
+	var out bytes.Buffer
+	p.Stdout = &out
+
+	// The first line was selected under a previous query, and does not
+	// match the current one
+	buf := NewMemoryBuffer()
+	buf.lines = append(buf.lines, line.NewMatched(line.NewRaw(1, "banana", false), [][]int{{1, 3}}))
+	p.currentLineBuffer = buf
+	p.Selection().Add(line.NewMatched(line.NewRaw(0, "apple", false), [][]int{{0, 1}}))
+	p.Selection().Add(buf.lines[0])
+
+	p.PrintResults()
+	assert.Equal(t, "apple\t\t\nbanana\t1-3\t1-3\n", out.String(), "ranges should be those of the current query")
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/jessevdk/go-flags"
 	"github.com/pkg/errors"
@@ -32,6 +33,80 @@ func (options CLIOptions) Validate() error {
 			return errors.New("unknown layout: '" + options.OptLayout + "'")
 		}
 	}
+
+	if options.OptMinSelect < 0 || options.OptMaxSelect < 0 || options.OptSelectExact < 0 {
+		return errors.New("number of lines to select must not be negative")
+	}
+
+	switch options.OptRenderOnce {
+	case "", renderText, renderANSI:
+	default:
+		return errors.New("unknown format for --render-once: '" + options.OptRenderOnce + "'")
+	}
+
+	switch options.OptDumpKeymap {
+	case "", keymapDumpText, keymapDumpJSON:
+	default:
+		return errors.New("unknown format for --dump-keymap: '" + options.OptDumpKeymap + "'")
+	}
+
+	switch options.OptPrintIndices {
+	case "", indicesTSV, indicesJSON:
+	default:
+		return errors.New("unknown format for --print-indices: '" + options.OptPrintIndices + "'")
+	}
+
+	if !isValidColors(options.OptColors) {
+		return errors.New("unknown value for --colors: '" + options.OptColors + "'")
+	}
+
+	switch options.OptOutputMode {
+	case "", outputTruncate, outputAppend:
+	default:
+		return errors.New("unknown value for --output-mode: '" + options.OptOutputMode + "'")
+	}
+
+	if _, _, err := parseTmuxModes(options.OptTmux); err != nil {
+		return err
+	}
+
+	if options.OptSourceCmd != "" && len(options.OptInput) > 0 {
+		return errors.New("--source-cmd cannot be used with --input")
+	}
+
+	if options.OptPrintNewOnly && options.OptSelectionFile == "" {
+		return errors.New("--print-new-only requires --selection-file")
+	}
+
+	if options.OptMatchColumn < 0 {
+		return errors.New("--match-column must not be negative")
+	}
+
+	if options.OptMaxLineWidth < 0 {
+		return errors.New("--max-line-width must not be negative")
+	}
+
+	if options.OptMaxQueryLength < 0 {
+		return errors.New("--max-query-length must not be negative")
+	}
+
+	if v := options.OptTimeout; v != "" {
+		if d, err := time.ParseDuration(v); err != nil || d < 0 {
+			return errors.New("invalid duration for --timeout: '" + v + "'")
+		}
+	}
+
+	if options.OptDimOlderThan < 0 {
+		return errors.New("--dim-older-than must not be negative")
+	}
+
+	if options.OptSelectExact > 0 && (options.OptMinSelect > 0 || options.OptMaxSelect > 0) {
+		return errors.New("--select-exact cannot be used with --min-select or --max-select")
+	}
+
+	if max := options.OptMaxSelect; max > 0 && options.OptMinSelect > max {
+		return errors.New("--min-select must not be greater than --max-select")
+	}
 	return nil
 }
 
@@ -0,0 +1,112 @@
+package peco
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"time"
+
+	"github.com/lestrrat-go/pdebug"
+	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/internal/i18n"
+	"github.com/peco/peco/line"
+	"github.com/pkg/errors"
+)
+
+// formatResult returns l as it is printed when accepted. matches
+// holds the matched ranges of each line for --print-indices. Notes
+// are not added to JSON lines, which would no longer be valid
+func (p *Peco) formatResult(l line.Line, matches map[uint64][][]int) string {
+	if p.printIndices != "" {
+		s := formatMatchIndices(p.printIndices, l, matches[l.ID()])
+		if p.printIndices == indicesJSON {
+			return s
+		}
+		return p.annotateResult(s, l)
+	}
+	return p.annotateResult(l.Output(), l)
+}
+
+// annotateResult appends the note attached to l to s, with
+// --annotate-output
+func (p *Peco) annotateResult(s string, l line.Line) string {
+	if !p.annotateOutput {
+		return s
+	}
+	if note := p.Annotation(l); note != "" {
+		return s + "\t" + note
+	}
+	return s
+}
+
+// writeOutput writes buf to the file given by --output, if any. With
+// --output-mode truncate, the first write replaces the contents of
+// the file, and later ones append to it, so that nothing is lost
+// within a session
+func (p *Peco) writeOutput(buf []byte) error {
+	if p.output == "" {
+		return nil
+	}
+
+	p.outputMutex.Lock()
+	defer p.outputMutex.Unlock()
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if !p.outputWritten && p.outputMode != outputAppend {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(p.output, flags, 0666)
+	if err != nil {
+		return errors.Wrap(err, "failed to open output file")
+	}
+	p.outputWritten = true
+
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return errors.Wrap(err, "failed to write output file")
+	}
+	return errors.Wrap(f.Close(), "failed to close output file")
+}
+
+// doAppendSelectionToFile writes the selected lines, or the line under
+// the cursor, to the file given by --output without finishing, so that
+// lines can be collected over several rounds of selecting. The
+// selection is cleared afterwards
+func doAppendSelectionToFile(ctx context.Context, state *Peco, _ termbox.Event) {
+	if pdebug.Enabled {
+		g := pdebug.Marker("doAppendSelectionToFile")
+		defer g.End()
+	}
+
+	if state.output == "" {
+		state.SendStatusAndClear(ctx, StatusWarn, i18n.T("No output file specified"), 2*time.Second)
+		return
+	}
+
+	var matches map[uint64][][]int
+	if state.printIndices != "" {
+		matches = state.currentMatches()
+	}
+
+	var buf bytes.Buffer
+	var n int
+	state.ascendSelection(selectedOrCurrent(state), func(l line.Line) bool {
+		buf.WriteString(state.formatResult(l, matches))
+		buf.WriteByte(state.outputSeparator())
+		n++
+		return true
+	})
+	if n == 0 {
+		state.SendStatusAndClear(ctx, StatusWarn, i18n.T("No lines selected"), 2*time.Second)
+		return
+	}
+
+	if err := state.writeOutput(buf.Bytes()); err != nil {
+		state.SendStatusAndClear(ctx, StatusError, err.Error(), 2*time.Second)
+		return
+	}
+
+	state.Selection().Reset()
+	state.Hub().SendDraw(ctx, nil)
+	state.SendStatusAndClear(ctx, StatusInfo, i18n.Sprintf("Appended %d lines to %s", n, state.output), 2*time.Second)
+}
@@ -0,0 +1,70 @@
+package peco
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/line"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutputFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peco-output-")
+	if !assert.NoError(t, err, "creating temporary directory should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "picked.txt")
+	read := func() string {
+		buf, err := ioutil.ReadFile(filename)
+		assert.NoError(t, err, "reading output file should succeed")
+		return string(buf)
+	}
+
+	run := func(mode string) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		if !assert.NoError(t, ioutil.WriteFile(filename, []byte("old\n"), 0644), "writing output file should succeed") {
+			return
+		}
+
+		p := newPeco()
+		var out bytes.Buffer
+		p.Argv = []string{"--output", filename, "--output-mode", mode}
+		p.Stdin = bytes.NewBufferString("foo\nbar\nbaz\n")
+		go p.Run(ctx)
+		<-p.Ready()
+		<-p.source.SetupDone()
+		p.Stdout = &out
+
+		lineAt := func(i int) line.Line {
+			l, _ := p.source.LineAt(i)
+			return l
+		}
+		p.Selection().Add(lineAt(0))
+		p.Selection().Add(lineAt(2))
+		doAppendSelectionToFile(ctx, p, termbox.Event{})
+		assert.Equal(t, 0, p.Selection().Len(), "selection should be cleared once appended")
+
+		// Nothing is selected, so the line under the cursor is used
+		p.Location().SetLineNumber(1)
+		doAppendSelectionToFile(ctx, p, termbox.Event{})
+
+		p.Selection().Add(lineAt(1))
+		p.PrintResults()
+		assert.Equal(t, "bar\n", out.String(), "accepted lines should still be printed to stdout")
+	}
+
+	run(outputTruncate)
+	assert.Equal(t, "foo\nbaz\nbar\nbar\n", read(), "the first write should replace the file, and later ones append to it")
+
+	run(outputAppend)
+	assert.Equal(t, "old\nfoo\nbaz\nbar\nbar\n", read(), "existing contents should be kept in append mode")
+}
@@ -1,62 +1,92 @@
 package peco
 
 func (l *Location) SetColumn(n int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
 	l.col = n
 }
 
-func (l Location) Column() int {
+func (l *Location) Column() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
 	return l.col
 }
 
 func (l *Location) SetLineNumber(n int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
 	l.lineno = n
 }
 
-func (l Location) LineNumber() int {
+func (l *Location) LineNumber() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
 	return l.lineno
 }
 
 func (l *Location) SetOffset(n int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
 	l.offset = n
 }
 
-func (l Location) Offset() int {
+func (l *Location) Offset() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
 	return l.offset
 }
 
 func (l *Location) SetPerPage(n int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
 	l.perPage = n
 }
 
-func (l Location) PerPage() int {
+func (l *Location) PerPage() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
 	return l.perPage
 }
 
 func (l *Location) SetPage(n int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
 	l.page = n
 }
 
-func (l Location) Page() int {
+func (l *Location) Page() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
 	return l.page
 }
 
 func (l *Location) SetTotal(n int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
 	l.total = n
 }
 
-func (l Location) Total() int {
+func (l *Location) Total() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
 	return l.total
 }
 
 func (l *Location) SetMaxPage(n int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
 	l.maxPage = n
 }
 
-func (l Location) MaxPage() int {
+func (l *Location) MaxPage() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
 	return l.maxPage
 }
 
-func (l Location) PageCrop() PageCrop {
+func (l *Location) PageCrop() PageCrop {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
 	return PageCrop{
 		perPage:     l.perPage,
 		currentPage: l.page,
@@ -0,0 +1,84 @@
+package peco
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/lestrrat-go/pdebug"
+	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/internal/i18n"
+	"github.com/peco/peco/internal/util"
+	"github.com/peco/peco/line"
+	"github.com/pkg/errors"
+)
+
+// pagerCommand returns the command used by peco.ViewInPager, taken
+// from $PAGER. Defaults to less, or more on Windows
+func pagerCommand() string {
+	if v := os.Getenv("PAGER"); v != "" {
+		return v
+	}
+	if runtime.GOOS == "windows" {
+		return "more"
+	}
+	return "less"
+}
+
+// viewInPager writes lines, as they were read, to the stdin of the
+// pager, and waits for the user to quit it. The screen is suspended
+// in the meantime
+func viewInPager(state *Peco, lines []line.Line) error {
+	var stdin bytes.Buffer
+	for _, l := range lines {
+		stdin.WriteString(l.Buffer())
+		stdin.WriteByte('\n')
+	}
+
+	cmd := util.Shell(pagerCommand())
+	cmd.Stdin = &stdin
+
+	// The pager reads its keys from the terminal by itself, but our
+	// stdout may be a pipe that the results are printed to
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0); err == nil {
+		defer tty.Close()
+		cmd.Stdout, cmd.Stderr = tty, tty
+	}
+
+	state.screen.Suspend()
+	err := cmd.Run()
+	state.screen.Resume()
+	if err != nil {
+		return errors.Wrap(err, "failed to run pager")
+	}
+	return nil
+}
+
+// doViewInPager displays the selected lines, or the line under the
+// cursor, in $PAGER, so that lines too long for the screen can be
+// read in full without leaving peco
+func doViewInPager(ctx context.Context, state *Peco, _ termbox.Event) {
+	if pdebug.Enabled {
+		g := pdebug.Marker("doViewInPager")
+		defer g.End()
+	}
+
+	var lines []line.Line
+	state.ascendSelection(selectedOrCurrent(state), func(l line.Line) bool {
+		lines = append(lines, l)
+		return true
+	})
+	if len(lines) == 0 {
+		state.SendStatusAndClear(ctx, StatusWarn, i18n.T("No lines selected"), 2*time.Second)
+		return
+	}
+
+	err := viewInPager(state, lines)
+	state.Hub().SendDraw(ctx, &DrawOptions{DisableCache: true})
+	if err != nil {
+		state.SendStatusAndClear(ctx, StatusError, err.Error(), 2*time.Second)
+	}
+}
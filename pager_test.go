@@ -0,0 +1,54 @@
+package peco
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/peco/peco/internal/util"
+	"github.com/peco/peco/line"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestViewInPager(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires /bin/sh")
+	}
+
+	dir, err := ioutil.TempDir("", "peco-test-")
+	if !assert.NoError(t, err, "ioutil.TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "paged")
+	old, ok := os.LookupEnv("PAGER")
+	os.Setenv("PAGER", "cat > "+util.ShellQuote(out))
+	defer func() {
+		if ok {
+			os.Setenv("PAGER", old)
+		} else {
+			os.Unsetenv("PAGER")
+		}
+	}()
+
+	state := newPeco()
+	lines := []line.Line{
+		line.NewRaw(0, "foo\x00displayed", true),
+		line.NewRaw(1, "bar", false),
+	}
+	if !assert.NoError(t, viewInPager(state, lines), "viewInPager should succeed") {
+		return
+	}
+
+	buf, err := ioutil.ReadFile(out)
+	if !assert.NoError(t, err, "the pager should be run") {
+		return
+	}
+	assert.Equal(t, "foo\x00displayed\nbar\n", string(buf), "the lines should be paged as they were read")
+
+	os.Setenv("PAGER", "exit 1")
+	assert.Error(t, viewInPager(state, lines), "failures should be reported")
+}
@@ -9,9 +9,14 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 
@@ -19,8 +24,10 @@ import (
 
 	"github.com/google/btree"
 	"github.com/lestrrat-go/pdebug"
+	"github.com/mattn/go-runewidth"
 	"github.com/peco/peco/filter"
 	"github.com/peco/peco/hub"
+	"github.com/peco/peco/internal/i18n"
 	"github.com/peco/peco/internal/util"
 	"github.com/peco/peco/line"
 	"github.com/peco/peco/pipeline"
@@ -85,11 +92,14 @@ func (is *Inputseq) Reset() {
 
 func newIDGen() *idgen {
 	return &idgen{
-		ch: make(chan uint64),
+		ch:   make(chan uint64),
+		done: make(chan struct{}),
 	}
 }
 
 func (ig *idgen) Run(ctx context.Context) {
+	defer close(ig.done)
+
 	var i uint64
 	for ; ; i++ {
 		select {
@@ -105,8 +115,15 @@ func (ig *idgen) Run(ctx context.Context) {
 	}
 }
 
+// Next returns a new ID. Once Run has returned, because peco is
+// exiting, it returns 0 instead of waiting for an ID that never comes
 func (ig *idgen) Next() uint64 {
-	return <-ig.ch
+	select {
+	case id := <-ig.ch:
+		return id
+	case <-ig.done:
+		return 0
+	}
 }
 
 func New() *Peco {
@@ -117,10 +134,12 @@ func New() *Peco {
 		Stdout:            os.Stdout,
 		currentLineBuffer: NewMemoryBuffer(), // XXX revisit this
 		idgen:             newIDGen(),
-		queryExecDelay:    50 * time.Millisecond,
 		readyCh:           make(chan struct{}),
-		screen:            NewTermbox(),
+		screen:            NewDiffScreen(NewTermbox()),
 		selection:         NewSelection(),
+		hidden:            NewHiddenLines(),
+		sorter:            NewLineSorter(""),
+		sessionID:         newSessionID(),
 		maxScanBufferSize: bufio.MaxScanTokenSize,
 	}
 }
@@ -133,10 +152,94 @@ func (p *Peco) Screen() Screen {
 	return p.screen
 }
 
+// SetScreen sets the Screen that peco draws on, and receives events
+// from. Must be called before Run
+func (p *Peco) SetScreen(s Screen) {
+	p.screen = s
+}
+
+// EventsHandled returns the number of input events that have been
+// received from the screen and handled so far
+func (p *Peco) EventsHandled() uint64 {
+	return atomic.LoadUint64(&p.eventsHandled)
+}
+
+// IsIdle returns true if peco has finished reading its input, and
+// has no pending work: no deferred input events, no queries waiting
+// to be executed or running, and no messages waiting to be processed.
+// It is meant to be used by tests that need to wait for the screen to
+// settle, without resorting to sleeping
+func (p *Peco) IsIdle() bool {
+	src := p.inputSource()
+	if src == nil {
+		return false
+	}
+
+	select {
+	case <-src.SetupDone():
+	default:
+		return false
+	}
+	return !p.hasPendingWork()
+}
+
+// hasPendingWork returns true if there are deferred input events,
+// queries waiting to be executed or running, or messages waiting to be
+// processed. Unlike IsIdle, the input may still be being read
+func (p *Peco) hasPendingWork() bool {
+	if atomic.LoadInt32(&p.pendingInput) > 0 || p.IsQueryRunning() {
+		return true
+	}
+
+	p.queryExecMutex.Lock()
+	waiting := p.queryExecTimer != nil
+	p.queryExecMutex.Unlock()
+	if waiting {
+		return true
+	}
+
+	if h, ok := p.Hub().(interface{ Idle() bool }); ok && !h.Idle() {
+		return true
+	}
+	return false
+}
+
 func (p *Peco) Styles() *StyleSet {
 	return &p.styles
 }
 
+// LineStyler returns the LineStyler used to style each line in the
+// list, or nil if there is none
+func (p *Peco) LineStyler() LineStyler {
+	return p.lineStyler
+}
+
+// LineRenderer returns the LineRenderer used to change the text
+// displayed for each line in the list
+func (p *Peco) LineRenderer() LineRenderer {
+	return p.lineRenderer
+}
+
+// SetLineRenderer sets the LineRenderer used to change the text
+// displayed for each line in the list. It must be called before Run,
+// and takes precedence over the LineRenderer specified in the config
+func (p *Peco) SetLineRenderer(r LineRenderer) {
+	p.lineRenderer = r
+}
+
+// Tracer returns the pipeline.Tracer that is notified of the
+// progress of queries, if any
+func (p *Peco) Tracer() pipeline.Tracer {
+	return p.tracer
+}
+
+// SetTracer sets the pipeline.Tracer that is notified of the progress
+// of queries, e.g. to export their timings to a tracing system. It
+// must be called before Run, and takes precedence over --trace
+func (p *Peco) SetTracer(t pipeline.Tracer) {
+	p.tracer = t
+}
+
 func (p *Peco) Use256Color() bool {
 	return p.use256Color
 }
@@ -145,6 +248,43 @@ func (p *Peco) Prompt() string {
 	return p.prompt
 }
 
+// RPrompt returns the template used to draw the right-hand side
+// of the prompt line
+func (p *Peco) RPrompt() string {
+	return p.rprompt
+}
+
+// IsQueryRunning returns true if there is a query being processed
+// by the filter
+func (p *Peco) IsQueryRunning() bool {
+	return atomic.LoadInt32(&p.runningQueries) > 0
+}
+
+// IsQueryInvalid returns true if the current query was rejected by
+// the filter, e.g. because it is not a valid regular expression
+func (p *Peco) IsQueryInvalid() bool {
+	return atomic.LoadInt32(&p.queryInvalid) == 1
+}
+
+// setQueryError records whether the current query was rejected by the
+// filter, and displays err in the status bar. The message is truncated
+// to fit on the screen, and stays until the query becomes valid
+func (p *Peco) setQueryError(ctx context.Context, err error) {
+	if err == nil {
+		if atomic.CompareAndSwapInt32(&p.queryInvalid, 1, 0) {
+			p.SendStatus(ctx, StatusInfo, "")
+		}
+		return
+	}
+
+	atomic.StoreInt32(&p.queryInvalid, 1)
+	msg := i18n.Sprintf("Invalid query: %s", errors.Cause(err))
+	if w, _ := p.screen.Size(); w > 0 {
+		msg = runewidth.Truncate(msg, w, "...")
+	}
+	p.SendStatus(ctx, StatusError, msg)
+}
+
 func (p *Peco) Inputseq() *Inputseq {
 	return &p.inputseq
 }
@@ -215,12 +355,193 @@ func (p *Peco) ToggleSingleKeyJumpMode() {
 	go p.Hub().SendDraw(context.Background(), &DrawOptions{DisableCache: true})
 }
 
+// Following returns true while the view sticks to the newest lines
+// of the input, as long as the query is empty
+func (p *Peco) Following() bool {
+	return atomic.LoadInt32(&p.following) == 1
+}
+
+// SetFollowing enables or disables follow mode
+func (p *Peco) SetFollowing(b bool) {
+	var v int32
+	if b {
+		v = 1
+	}
+	atomic.StoreInt32(&p.following, v)
+}
+
+func (p *Peco) CountPrefixMode() bool {
+	return p.countPrefixMode
+}
+
+// SetCountPrefixMode enables or disables count prefix mode. Either
+// way, any count that has been entered so far is discarded
+func (p *Peco) SetCountPrefixMode(b bool) {
+	p.countPrefixMode = b
+	p.countPrefix = 0
+}
+
+// AppendCountPrefix adds a digit to the count prefix being entered,
+// and returns the resulting count
+func (p *Peco) AppendCountPrefix(d int) int {
+	p.countPrefix = p.countPrefix*10 + d
+	return p.countPrefix
+}
+
+// consumeCountPrefix returns the count prefix entered by the user,
+// or 1 if there is none, and leaves count prefix mode
+func (p *Peco) consumeCountPrefix() int {
+	n := p.countPrefix
+	p.SetCountPrefixMode(false)
+	if n <= 0 {
+		return 1
+	}
+	return n
+}
+
+// SendStatus displays msg in the status bar, unless messages of the
+// given level are suppressed. An empty msg clears the status bar, and
+// is never suppressed
+func (p *Peco) SendStatus(ctx context.Context, level StatusLevel, msg string) {
+	p.SendStatusAndClear(ctx, level, msg, 0)
+}
+
+// SendStatusAndClear is like SendStatus, but clears the message after
+// clearDelay has passed
+func (p *Peco) SendStatusAndClear(ctx context.Context, level StatusLevel, msg string, clearDelay time.Duration) {
+	if msg != "" && level < p.minStatusLevel() {
+		return
+	}
+	p.Hub().SendStatusMsgAndClear(ctx, msg, clearDelay)
+}
+
+// How often the standard error of custom filters is displayed, and for
+// how long
+const (
+	filterStderrInterval   = 500 * time.Millisecond
+	filterStderrClearDelay = 5 * time.Second
+)
+
+func newStatusThrottle(interval time.Duration, send func(string)) *statusThrottle {
+	return &statusThrottle{
+		interval: interval,
+		send:     send,
+	}
+}
+
+// Send passes msg to the send function of t, unless the previous
+// message was sent too recently. In that case, msg is sent later,
+// unless another message arrives in the meantime
+func (t *statusThrottle) Send(msg string) {
+	t.mutex.Lock()
+	if wait := t.interval - time.Since(t.last); wait > 0 {
+		t.pending = msg
+		if t.timer == nil {
+			t.timer = time.AfterFunc(wait, t.flush)
+		}
+		t.mutex.Unlock()
+		return
+	}
+	t.last = time.Now()
+	t.mutex.Unlock()
+
+	t.send(msg)
+}
+
+func (t *statusThrottle) flush() {
+	t.mutex.Lock()
+	msg := t.pending
+	t.pending = ""
+	t.timer = nil
+	t.last = time.Now()
+	t.mutex.Unlock()
+
+	t.send(msg)
+}
+
+func (p *Peco) minStatusLevel() StatusLevel {
+	if p.quiet || p.config.SuppressStatusMsg {
+		return StatusWarn
+	}
+	return StatusInfo
+}
+
+// SearchMode returns true while typed characters go to the
+// SearchInResults pattern instead of the query
+func (p *Peco) SearchMode() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.searchMode
+}
+
+// SetSearchMode enables or disables the mode where typed characters
+// go to the SearchInResults pattern instead of the query
+func (p *Peco) SetSearchMode(b bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.searchMode = b
+}
+
+// KeymapLayer returns the name of the active keymap layer, or an
+// empty string if only the default key bindings are in effect
+func (p *Peco) KeymapLayer() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.keymapLayer
+}
+
+// SetKeymapLayer sets the active keymap layer
+func (p *Peco) SetKeymapLayer(name string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.keymapLayer = name
+}
+
+func (p *Peco) SearchQuery() *Query {
+	return &p.searchQuery
+}
+
+// SearchPattern returns the pattern used to highlight lines within
+// the results, or nil if there is none
+func (p *Peco) SearchPattern() *regexp.Regexp {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.searchPattern
+}
+
+// SetSearchPattern sets the pattern to highlight within the results.
+// The pattern is matched literally. As with the SmartCase filter, it
+// is case insensitive unless it contains an upper case character.
+// An empty pattern removes the highlight
+func (p *Peco) SetSearchPattern(s string) {
+	var rx *regexp.Regexp
+	if s != "" {
+		expr := regexp.QuoteMeta(s)
+		if !util.ContainsUpper(s) {
+			expr = "(?i)" + expr
+		}
+		rx = regexp.MustCompile(expr)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.searchPattern = rx
+}
+
 func (p *Peco) SingleKeyJumpIndex(ch rune) (uint, bool) {
 	n, ok := p.singleKeyJumpPrefixMap[ch]
 	return n, ok
 }
 
 func (p *Peco) Source() pipeline.Source {
+	return p.inputSource()
+}
+
+// inputSource returns the source that the input is read into, or nil
+// if it has not been set up yet
+func (p *Peco) inputSource() *Source {
+	p.sourceMutex.Lock()
+	defer p.sourceMutex.Unlock()
 	return p.source
 }
 
@@ -232,8 +553,91 @@ func (p *Peco) Query() *Query {
 	return &p.query
 }
 
+// QueryExecDelay returns how long peco waits for more keystrokes
+// before running the query. Unless QueryExecutionDelay is specified in
+// the config file, it adapts to how long queries take
 func (p *Peco) QueryExecDelay() time.Duration {
-	return p.queryExecDelay
+	if d := p.queryExecDelay; d != 0 {
+		return d
+	}
+
+	var lines int
+	if s := p.inputSource(); s != nil {
+		lines = s.Size()
+	}
+	return adaptiveQueryExecDelay(p.QueryDuration(), lines)
+}
+
+// smallInputLines is the number of lines under which queries are run
+// without delay, until it is known how long they take
+const smallInputLines = 100000
+
+// adaptiveQueryExecDelay returns how long to wait for more keystrokes
+// before running a query, given how long the last query took. Waiting
+// for half as long lets a burst of keystrokes be run as a single query,
+// without the wait being noticeable next to the query itself. Short
+// waits are skipped altogether, so that small inputs feel instant
+func adaptiveQueryExecDelay(last time.Duration, lines int) time.Duration {
+	if last <= 0 {
+		if lines < smallInputLines {
+			return 0
+		}
+		return DefaultQueryExecDelay
+	}
+
+	d := last / 2
+	switch {
+	case d < 5*time.Millisecond:
+		return 0
+	case d > MaxQueryExecDelay:
+		return MaxQueryExecDelay
+	}
+	return d
+}
+
+// QueryDuration returns how long the last query that ran to
+// completion took, or zero if no query has yet
+func (p *Peco) QueryDuration() time.Duration {
+	return time.Duration(atomic.LoadInt64(&p.queryDuration))
+}
+
+func (p *Peco) recordQueryDuration(d time.Duration) {
+	if pdebug.Enabled {
+		pdebug.Printf("query took %s", d)
+	}
+	atomic.StoreInt64(&p.queryDuration, int64(d))
+}
+
+// QueryLatencyBudget returns how long the results of the previous
+// query are kept on screen while a new query is running
+func (p *Peco) QueryLatencyBudget() time.Duration {
+	return p.queryLatencyBudget
+}
+
+// PaintLatency returns the time between the last query being
+// typed and its results first being painted on the screen
+func (p *Peco) PaintLatency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&p.paintLatency))
+}
+
+func (p *Peco) recordPaintLatency(started time.Time) {
+	d := time.Since(started)
+	if pdebug.Enabled {
+		pdebug.Printf("query results painted %s after the query was typed", d)
+	}
+	atomic.StoreInt64(&p.paintLatency, int64(d))
+}
+
+func (p *Peco) queryStarted() time.Time {
+	p.queryStartedMutex.Lock()
+	defer p.queryStartedMutex.Unlock()
+	return p.queryStartedAt
+}
+
+func (p *Peco) setQueryStarted(t time.Time) {
+	p.queryStartedMutex.Lock()
+	defer p.queryStartedMutex.Unlock()
+	p.queryStartedAt = t
 }
 
 func (p *Peco) Caret() *Caret {
@@ -278,11 +682,32 @@ func (p *Peco) Setup() (err error) {
 		return errors.Wrap(err, "failed to parse command line")
 	}
 
+	if isDoctorCommand(p.args) {
+		return p.doctor(opts.OptRcfile, p.args[2])
+	}
+
+	if v := opts.OptReplay; v != "" {
+		if err := p.setupReplay(&opts, v); err != nil {
+			return errors.Wrap(err, "failed to setup replay")
+		}
+		defer p.removeReplayConfig()
+	}
+
 	// Read config
 	if !p.skipReadConfig { // This can only be set via test
 		if err := readConfig(&p.config, opts.OptRcfile); err != nil {
 			return errors.Wrap(err, "failed to setup configuration")
 		}
+
+		if opts.OptProjectConfig || p.config.ProjectConfig {
+			if err := readProjectConfig(&p.config); err != nil {
+				return errors.Wrap(err, "failed to setup project configuration")
+			}
+		}
+	}
+
+	if p.replay != nil {
+		disableCommands(&p.config)
 	}
 
 	// Take Args, Config, Options, and apply the configuration to
@@ -291,24 +716,160 @@ func (p *Peco) Setup() (err error) {
 		return errors.Wrap(err, "failed to apply configuration")
 	}
 
+	if v := opts.OptDumpKeymap; v != "" {
+		if err := p.keymap.dump(p.Stdout, v); err != nil {
+			return errors.Wrap(err, "failed to dump keymap")
+		}
+		return makeIgnorable(errors.New("user asked to dump the keymap"))
+	}
+
+	if opts.OptPopup {
+		// Outside tmux and kitty, peco runs as usual
+		if terminal := popupTerminal(os.Getenv); terminal != "" {
+			exe, err := os.Executable()
+			if err != nil {
+				return errors.Wrap(err, "failed to locate peco executable")
+			}
+			return p.runInPopup(terminal, exe)
+		}
+	}
+
 	// XXX p.Keymap et al should be initialized around here
 	p.hub = hub.New(5)
 
 	return nil
 }
 
-func (p *Peco) selectOneAndExitIfPossible() {
-	// TODO: mutex
-	// If we have only one line, we just want to bail out
-	// printing that one line as the result
-	if b := p.CurrentLineBuffer(); b.Size() == 1 {
-		if l, err := b.LineAt(0); err == nil {
-			p.resultCh = make(chan line.Line)
+// selectOneAndExitIfPossible implements --select-1 and --exit-0,
+// and returns true if peco is exiting. It must only be called after
+// all of the input has been read, and the initial query has been
+// applied to it
+func (p *Peco) selectOneAndExitIfPossible() bool {
+	b := p.CurrentLineBuffer()
+	switch {
+	case p.exitZero && b.Size() == 0:
+		// If nothing matched, bail out with a failure
+		p.Exit(setExitStatus(makeIgnorable(errors.New("no lines matched")), 1))
+		return true
+	case p.selectOneAndExit:
+		// If we have only one line, we just want to bail out
+		// printing that one line as the result
+		if l, ok := onlyLine(b); ok {
+			p.Selection().Add(l)
 			p.Exit(errCollectResults{})
-			p.resultCh <- l
-			close(p.resultCh)
+			return true
+		}
+	}
+	return false
+}
+
+// onlyLine returns the line in b, if it is the only one. Group headers
+// are not lines, and are not counted
+func onlyLine(b Buffer) (line.Line, bool) {
+	var only line.Line
+	for i := 0; i < b.Size(); i++ {
+		l, err := b.LineAt(i)
+		if err != nil || isGroupHeader(l) {
+			continue
+		}
+		if only != nil {
+			return nil, false
+		}
+		only = l
+	}
+	return only, only != nil
+}
+
+// renderOnceAndExit implements --render-once. It draws a single
+// frame, prints it to stdout and exits
+func (p *Peco) renderOnceAndExit() {
+	s, ok := p.screen.(*MemoryScreen)
+	if !ok {
+		p.Exit(errors.New("--render-once requires an in-memory screen"))
+		return
+	}
+
+	// In batch mode, this waits until the frame has been drawn
+	p.Hub().Batch(context.Background(), func(ctx context.Context) {
+		p.Hub().SendDraw(ctx, &DrawOptions{DisableCache: true})
+	}, false)
+
+	frame := s.String()
+	if p.renderOnce == renderANSI {
+		frame = s.ANSI()
+	}
+	if _, err := io.WriteString(p.Stdout, frame); err != nil {
+		p.Exit(errors.Wrap(err, "failed to write rendered frame"))
+		return
+	}
+	p.Exit(makeIgnorable(errors.New("rendered a single frame")))
+}
+
+// selectAllAndExit implements --no-tty. All of the lines that matched
+// the initial query are printed, as if the user had selected them
+func (p *Peco) selectAllAndExit() {
+	b := p.CurrentLineBuffer()
+	if b.Size() == 0 {
+		p.Exit(setExitStatus(makeIgnorable(errors.New("no lines matched")), 1))
+		return
+	}
+
+	sel := p.Selection()
+	sel.SetLimit(0)
+	for i := 0; i < b.Size(); i++ {
+		if l, err := b.LineAt(i); err == nil {
+			sel.Add(l)
 		}
 	}
+	p.Exit(errCollectResults{})
+}
+
+// cancel makes peco exit because it was canceled. The exit status
+// depends on --on-cancel. cause must be errUserCanceled, or wrap it,
+// so that the OnCancel hook is run
+func (p *Peco) cancel(cause error) {
+	err := makeIgnorable(cause)
+	if p.onCancel == errorKey {
+		err = setExitStatus(err, 1)
+	}
+	p.Exit(err)
+}
+
+// cancelOnIdle implements --timeout. peco is canceled once there
+// has been no input for the given duration
+func (p *Peco) cancelOnIdle(ctx context.Context) {
+	atomic.StoreInt64(&p.lastInputAt, time.Now().UnixNano())
+
+	timer := time.NewTimer(p.idleTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&p.lastInputAt)))
+		if idle < p.idleTimeout {
+			timer.Reset(p.idleTimeout - idle)
+			continue
+		}
+		p.cancel(errors.Wrapf(errUserCanceled, "no input for %s", p.idleTimeout))
+		return
+	}
+}
+
+// renderOnceSize returns the size of the screen used by --render-once,
+// which can be specified via $COLUMNS and $LINES
+func renderOnceSize() (int, int) {
+	width, height := 80, 24
+	if v, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && v > 0 {
+		width = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("LINES")); err == nil && v > 0 {
+		height = v
+	}
+	return width, height
 }
 
 func (p *Peco) Run(ctx context.Context) (err error) {
@@ -325,6 +886,13 @@ func (p *Peco) Run(ctx context.Context) (err error) {
 		return errors.Wrap(err, "failed to setup peco")
 	}
 
+	// This is deferred first, so that it runs once everything else
+	// has been torn down
+	if p.leakCheck {
+		baseline := goroutineStacks()
+		defer p.reportLeakedGoroutines(baseline)
+	}
+
 	var _cancelOnce sync.Once
 	var _cancel func()
 	ctx, _cancel = context.WithCancel(ctx)
@@ -337,8 +905,22 @@ func (p *Peco) Run(ctx context.Context) (err error) {
 		})
 	}
 
+	// shutdown stops the goroutines started below, and waits for them
+	// to return. The hub is closed so that none of them is left
+	// waiting for messages to be processed
+	shutdown := func() {
+		cancel()
+		// The input may have been reloaded with another context
+		p.stopSource()
+		if h, ok := p.Hub().(interface{ Close() }); ok {
+			h.Close()
+		}
+		p.goroutines.Wait()
+	}
+	defer shutdown()
+
 	// start the ID generator
-	go p.idgen.Run(ctx)
+	p.spawn(func() { p.idgen.Run(ctx) })
 
 	// remember this cancel func so p.Exit works (XXX requires locking?)
 	p.cancelFunc = cancel
@@ -347,30 +929,108 @@ func (p *Peco) Run(ctx context.Context) (err error) {
 		p.Exit(errors.New("received signal: " + sig.String()))
 	}))
 
-	go sigH.Loop(ctx, cancel)
+	p.spawn(func() { sigH.Loop(ctx, cancel) })
+
+	if p.idleTimeout > 0 {
+		p.spawn(func() { p.cancelOnIdle(ctx) })
+	}
+
+	if p.trace != "" && p.tracer == nil {
+		f, err := os.Create(p.trace)
+		if err != nil {
+			return errors.Wrap(err, "failed to create trace file")
+		}
+		defer f.Close()
+		p.tracer = newJSONTracer(f)
+	}
 
 	// SetupSource is done AFTER other components are ready, otherwise
 	// we can't draw onto the screen while we are reading a really big
 	// buffer.
 	// Setup source buffer
-	src, err := p.SetupSource(ctx)
-	if err != nil {
+	if _, err := p.SetupSource(ctx); err != nil {
 		return errors.Wrap(err, "failed to setup input source")
 	}
-	p.source = src
 
-	go func() {
-		<-p.source.Ready()
+	// peco.ReloadInput replaces the source, and closes the old one
+	defer func() { p.inputSource().Close() }()
+
+	// The summary is printed after the screen is closed, which is
+	// deferred below
+	if p.summary {
+		started := time.Now()
+		defer func() { p.printSummary(time.Since(started)) }()
+	}
+
+	// The session is written once everything has been read and
+	// handled, but before the source is closed
+	if p.recorder != nil {
+		defer func() {
+			if err := p.recorder.Write(p.record, p.inputSource()); err != nil {
+				fmt.Fprintf(p.Stderr, "Error: %s\n", err)
+			}
+		}()
+	}
+
+	// Likewise, the cancel hook is run once the screen is closed
+	defer func() {
+		if err := p.runCancelHook(); err != nil {
+			fmt.Fprintf(p.Stderr, "Error: %s\n", err)
+		}
+	}()
+
+	// initialQueryDone is closed once the initial query, if any, has
+	// been applied to the input
+	initialQueryDone := make(chan struct{})
+
+	p.spawn(func() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.inputSource().Ready():
+		}
+		p.runStartHook(ctx)
+
 		// screen.Init must be called within Run() because we
 		// want to make sure to call screen.Close() after getting
 		// out of Run()
-		p.screen.Init(&p.config)
-		go NewInput(p, p.Keymap(), p.screen.PollEvent(ctx, &p.config)).Loop(ctx, cancel)
-		go NewView(p).Loop(ctx, cancel)
-		go NewFilter(p).Loop(ctx, cancel)
+		if err := p.screen.Init(&p.config); err != nil {
+			p.Exit(errors.Wrap(err, "failed to initialize screen"))
+			return
+		}
+		if p.recorder != nil {
+			p.recorder.Start(p.screen.Size())
+		}
+		if err := p.setTitle(); err != nil {
+			p.SendStatusAndClear(ctx, StatusError, err.Error(), 2*time.Second)
+		}
+		events := p.screen.PollEvent(ctx, &p.config)
+		if len(p.keys) > 0 {
+			// The keys are typed once the initial query is in place,
+			// so that they edit it rather than being overwritten
+			events = p.injectKeys(ctx, events, initialQueryDone)
+		}
+		input := NewInput(p, p.Keymap(), events)
+		p.spawn(func() { input.Loop(ctx, cancel) })
+		p.spawn(func() { NewView(p).Loop(ctx, cancel) })
+		p.spawn(func() { NewFilter(p).Loop(ctx, cancel) })
+		if p.replay != nil {
+			p.spawn(func() { p.replaySession(ctx) })
+		}
+	})
+
+	// The title is restored once nothing can set it anymore
+	defer func() {
+		if err := p.restoreTitle(); err != nil {
+			fmt.Fprintf(p.Stderr, "Error: %s\n", err)
+		}
 	}()
 	defer p.screen.Close()
 
+	// Deferred after screen.Close so that it runs before it: nothing
+	// may draw on the screen once it is closed
+	defer shutdown()
+
 	if p.Query().Len() <= 0 {
 		// Re-set the source only if there are no queries
 		p.ResetCurrentLineBuffer()
@@ -381,16 +1041,54 @@ func (p *Peco) Run(ctx context.Context) (err error) {
 	}
 
 	// If this is enabled, we need to check if we have 1 line only
-	// in the buffer. If we do, we select that line and bail out
-	if p.selectOneAndExit {
-		go func() {
+	// (or none, for --exit-0) in the buffer. If we do, we select that
+	// line and bail out
+	if p.selectOneAndExit || p.exitZero || p.renderOnce != "" || p.noTTY {
+		p.spawn(func() {
 			// Wait till source has read all lines. We should not wait
 			// source.Ready(), because Ready returns as soon as we get
 			// a line, where as SetupDone waits until we're completely
 			// done reading the input
-			<-p.source.SetupDone()
-			p.selectOneAndExitIfPossible()
-		}()
+			select {
+			case <-ctx.Done():
+				return
+			case <-p.inputSource().SetupDone():
+			}
+
+			// The filter may still be working on the initial query,
+			// in which case the current buffer is incomplete
+			select {
+			case <-ctx.Done():
+				return
+			case <-initialQueryDone:
+			}
+
+			if len(p.keys) > 0 {
+				// The results are those of the query that --keys
+				// typed, unless the keys have already finished peco
+				if !p.waitForKeys(ctx) {
+					return
+				}
+			} else if p.Query().String() != p.initialQuery {
+				// If the user has already changed the query, the
+				// results are no longer for the initial query
+				return
+			}
+			if p.selectOneAndExitIfPossible() {
+				return
+			}
+			if p.renderOnce != "" {
+				p.renderOnceAndExit()
+				return
+			}
+			if p.noTTY {
+				p.selectAllAndExit()
+			}
+		})
+	}
+
+	if p.initialMatch != nil {
+		p.spawn(func() { p.moveToInitialMatch(ctx) })
 	}
 
 	readyOnce.Do(func() { close(p.readyCh) })
@@ -398,22 +1096,22 @@ func (p *Peco) Run(ctx context.Context) (err error) {
 	// This has tobe AFTER close(p.readyCh), otherwise the query is
 	// ignored by us (queries are not run until peco thinks it's ready)
 	if q := p.initialQuery; q != "" {
+		q, _ = p.truncateQuery(q)
 		p.Query().Set(q)
 		p.Caret().SetPos(utf8.RuneCountInString(q))
 	}
 
 	if p.Query().Len() > 0 {
-		go func() {
-			<-p.source.Ready()
-
-			// iff p.selectOneAndExit is true, we should check after exec query is run
-			// if we only have one item
-			if p.selectOneAndExit {
-				p.ExecQuery(p.selectOneAndExitIfPossible)
-			} else {
-				p.ExecQuery(nil)
+		p.spawn(func() {
+			select {
+			case <-ctx.Done():
+				return
+			case <-p.inputSource().Ready():
 			}
-		}()
+			p.ExecQuery(func() { close(initialQueryDone) })
+		})
+	} else {
+		close(initialQueryDone)
 	}
 
 	// Alright, done everything we need to do automatically. We'll let
@@ -425,6 +1123,71 @@ func (p *Peco) Run(ctx context.Context) (err error) {
 	return p.Err()
 }
 
+// spawn runs f in a new goroutine, which Run waits for before it
+// returns. f must return once the context of Run is canceled
+func (p *Peco) spawn(f func()) {
+	p.goroutines.Add(1)
+	go func() {
+		defer p.goroutines.Done()
+		f()
+	}()
+}
+
+// moveToInitialMatch positions the cursor on the first line in the
+// source that matches --initial-match. The source may still be reading
+// its input, so lines are checked as they arrive. It gives up once all
+// input has been read. The cursor is moved by the view, on the line
+// that is displayed, unless the user has moved it in the meantime
+func (p *Peco) moveToInitialMatch(ctx context.Context) {
+	rx := p.initialMatch
+	src := p.inputSource()
+	start := anchorCursor(ctx, p)
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	var tracker bufferTracker
+	for {
+		var done bool
+		select {
+		case <-src.SetupDone():
+			done = true
+		default:
+		}
+
+		lines, _, added, ok := tracker.update(src)
+		if !ok {
+			added = lines
+		}
+		for _, l := range added {
+			if !rx.MatchString(l.DisplayString()) {
+				continue
+			}
+
+			req := restoreCursorRequest{
+				anchor: &cursorAnchor{id: l.ID(), moves: start.moves, valid: true},
+				buffer: p.CurrentLineBuffer(),
+				sticky: true,
+			}
+			p.Hub().Batch(ctx, func(ctx context.Context) {
+				p.Hub().SendPaging(ctx, req)
+				p.Hub().SendDraw(ctx, nil)
+			}, false)
+			return
+		}
+
+		if done {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 func (p *Peco) parseCommandLine(opts *CLIOptions, args *[]string, argv []string) error {
 	remaining, err := opts.parse(argv)
 	if err != nil {
@@ -458,10 +1221,67 @@ func (p *Peco) SetupSource(ctx context.Context) (s *Source, err error) {
 		defer g.End()
 	}
 
+	src, err := p.newInputSource()
+	if err != nil {
+		return nil, err
+	}
+
+	// Block until we receive something from `in`
+	if pdebug.Enabled {
+		pdebug.Printf("Blocking until we read something in source...")
+	}
+
+	p.startSource(ctx, src)
+	<-src.Ready()
+
+	return src, nil
+}
+
+// startSource makes src the input, and starts reading it in the
+// background until ctx is canceled or the input is replaced. The
+// previous input, if any, stops being read. It is returned so that
+// the caller can close it
+func (p *Peco) startSource(ctx context.Context, src *Source) *Source {
+	ctx, cancel := context.WithCancel(ctx)
+	p.sourceMutex.Lock()
+	old, cancelOld := p.source, p.cancelSource
+	p.source, p.cancelSource = src, cancel
+	p.sourceMutex.Unlock()
+
+	if cancelOld != nil {
+		cancelOld()
+	}
+	p.spawn(func() { src.Setup(ctx, p) })
+	return old
+}
+
+// stopSource stops reading the input, and kills its command if any
+func (p *Peco) stopSource() {
+	p.sourceMutex.Lock()
+	cancel := p.cancelSource
+	p.sourceMutex.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// newInputSource creates the source that reads the input: the output
+// of --source-cmd, the --input streams, the file given as argument, or
+// stdin, in that order of precedence
+func (p *Peco) newInputSource() (*Source, error) {
 	var in io.Reader
 	var filename string
 	var isInfinite bool
 	switch {
+	case p.sourceCmd != "":
+		if pdebug.Enabled {
+			pdebug.Printf("Using the output of %s as input", p.sourceCmd)
+		}
+	case len(p.inputs) > 0:
+		if pdebug.Enabled {
+			pdebug.Printf("Using %v as input", p.inputs)
+		}
 	case len(p.args) > 1:
 		f, err := os.Open(p.args[1])
 		if err != nil {
@@ -487,16 +1307,26 @@ func (p *Peco) SetupSource(ctx context.Context) (s *Source, err error) {
 		return nil, errors.New("you must supply something to work with via filename or stdin")
 	}
 
-	src := NewSource(filename, in, isInfinite, p.idgen, p.bufferSize, p.enableSep)
-
-	// Block until we receive something from `in`
-	if pdebug.Enabled {
-		pdebug.Printf("Blocking until we read something in source...")
+	var src *Source
+	switch {
+	case p.sourceCmd != "":
+		src = NewCommandSource(p.sourceCmd, p.idgen, p.bufferSize, p.enableSep)
+	case len(p.inputs) > 0:
+		var err error
+		src, err = NewMultiSource(p.inputs, p.idgen, p.bufferSize, p.enableSep)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		src = NewSource(filename, in, isInfinite, p.idgen, p.bufferSize, p.enableSep)
+	}
+	src.SetNullSeparated(p.read0)
+	src.TrackCommonPrefix(p.stripCommonPrefix)
+	if p.spillToDisk && p.bufferSize > 0 {
+		if err := src.SpillToDisk(); err != nil {
+			return nil, errors.Wrap(err, "failed to setup spill file")
+		}
 	}
-
-	go src.Setup(ctx, p)
-	<-src.Ready()
-
 	return src, nil
 }
 
@@ -510,6 +1340,21 @@ func readConfig(cfg *Config, filename string) error {
 	return nil
 }
 
+// readProjectConfig reads .peco/config.json in the current directory
+// on top of cfg, if it exists
+func readProjectConfig(cfg *Config) error {
+	dir, err := os.Getwd()
+	if err != nil {
+		return errors.Wrap(err, "failed to get current directory")
+	}
+
+	file, err := locateProjectConfig(dir)
+	if err != nil {
+		return nil
+	}
+	return readConfig(cfg, file)
+}
+
 func (p *Peco) ApplyConfig(opts CLIOptions) error {
 	// If layoutType is not set and is set in the config, set it
 	if p.layoutType == "" {
@@ -520,21 +1365,49 @@ func (p *Peco) ApplyConfig(opts CLIOptions) error {
 		}
 	}
 
+	i18n.SetLanguage(i18n.Detect(p.config.Language))
+	for _, key := range p.config.deprecated {
+		fmt.Fprintln(p.Stderr, i18n.Sprintf("%s is deprecated. Use %s", key.name, key.replacement))
+	}
+	p.config.deprecated = nil
+
+	if v := p.config.QueryExecutionDelay; v != 0 {
+		p.queryExecDelay = time.Duration(v) * time.Millisecond
+	}
+
+	p.queryLatencyBudget = DefaultQueryLatencyBudget
+	if v := p.config.QueryLatencyBudget; v != 0 {
+		p.queryLatencyBudget = time.Duration(v) * time.Millisecond
+	}
+
 	p.maxScanBufferSize = 256
 	if v := p.config.MaxScanBufferSize; v > 0 {
 		p.maxScanBufferSize = v
 	}
 
 	if v := opts.OptExec; len(v) > 0 {
-		p.execOnFinish = v
+		p.execOnFinish = CommandConfig{Line: v}
+	} else {
+		p.execOnFinish = p.config.Exec
 	}
 
 	p.enableSep = opts.OptEnableNullSep
+	if p.enableSep && opts.OptRead0 {
+		return errors.New("--null and --read0 cannot be used together")
+	}
 
 	if i := opts.OptInitialIndex; i >= 0 {
 		p.Location().SetLineNumber(i)
 	}
 
+	if v := opts.OptInitialMatch; v != "" {
+		rx, err := regexp.Compile(v)
+		if err != nil {
+			return errors.Wrap(err, "failed to compile --initial-match expression")
+		}
+		p.initialMatch = rx
+	}
+
 	if v := opts.OptLayout; v != "" {
 		p.layoutType = v
 	}
@@ -546,30 +1419,155 @@ func (p *Peco) ApplyConfig(opts CLIOptions) error {
 		p.prompt = v
 	}
 
+	p.rprompt = p.config.RPrompt
+
 	p.use256Color = p.config.Use256Color
 
+	// The screen reads the colors from the config when it is
+	// initialized
+	if v := opts.OptColors; v != "" {
+		p.config.Colors = v
+	}
+
 	p.onCancel = successKey
 	if opts.OptOnCancel == errorKey || p.config.OnCancel == errorKey {
 		p.onCancel = errorKey
 	}
 	p.bufferSize = opts.OptBufferSize
+	p.spillToDisk = opts.OptSpillToDisk
+	p.selectionBar = opts.OptSelectionBar || p.config.SelectionBar
+	p.stripCommonPrefix = opts.OptStripPrefix || p.config.StripCommonPrefix
+	if v := opts.OptMaxLineWidth; v > 0 {
+		p.maxLineWidth = v
+	} else if v := p.config.MaxLineWidth; v > 0 {
+		p.maxLineWidth = v
+	}
+	if v := opts.OptMaxQueryLength; v > 0 {
+		p.maxQueryLength = v
+	} else if v := p.config.MaxQueryLength; v > 0 {
+		p.maxQueryLength = v
+	}
 	if v := opts.OptSelectionPrefix; len(v) > 0 {
 		p.selectionPrefix = v
 	} else {
 		p.selectionPrefix = p.config.SelectionPrefix
 	}
 	p.selectOneAndExit = opts.OptSelect1
+	p.exitZero = opts.OptExit0
+	p.minSelect = opts.OptMinSelect
+	p.maxSelect = opts.OptMaxSelect
+	if v := opts.OptSelectExact; v > 0 {
+		p.minSelect = v
+		p.maxSelect = v
+	}
+	p.selection.SetLimit(p.maxSelect)
 	p.printQuery = opts.OptPrintQuery
+	p.printIndices = opts.OptPrintIndices
+	p.print0 = opts.OptPrint0
+	p.read0 = opts.OptRead0
+	p.quiet = opts.OptQuiet
+	if v := opts.OptRenderOnce; v != "" {
+		// Nobody is going to see status messages come and go
+		p.renderOnce = v
+		p.quiet = true
+		p.screen = NewMemoryScreen(renderOnceSize())
+	}
+	if name := opts.OptFrecency; name != "" {
+		if !isValidSelectionSetName(name) {
+			return errors.Errorf("invalid --frecency name: %s", name)
+		}
+		dir, err := frecencyDir(&p.config)
+		if err != nil {
+			return errors.Wrap(err, "failed to locate frecency directory")
+		}
+		f, err := LoadFrecency(filepath.Join(dir, name))
+		if err != nil {
+			return errors.Wrap(err, "failed to load frecency database")
+		}
+		p.frecency = f
+	}
+	if opts.OptNoTTY {
+		// There is no terminal to read key strokes from, nor to draw
+		// on, so the matching lines are printed right away
+		p.noTTY = true
+		p.quiet = true
+		p.screen = NewMemoryScreen(renderOnceSize())
+	}
+	p.summary = opts.OptSummary
+	p.uniqueOutput = opts.OptUniqueOutput
+	if v := opts.OptSelectionFile; v != "" {
+		if err := p.loadSelectionFile(v); err != nil {
+			return err
+		}
+	}
+	p.printNewOnly = opts.OptPrintNewOnly
+	switch v := opts.OptSelectionOrder; v {
+	case "", selectionOrderInput, selectionOrderPicked:
+		p.selectionOrder = v
+	default:
+		return errors.Errorf("invalid --selection-order: %s", v)
+	}
+	p.inputs = opts.OptInput
+	p.sourceCmd = opts.OptSourceCmd
+	if v := opts.OptKeys; v != "" {
+		keys, err := parseKeys(v)
+		if err != nil {
+			return err
+		}
+		p.keys = keys
+	}
+	if v := opts.OptTimeout; v != "" {
+		// Already validated by CLIOptions.Validate
+		p.idleTimeout, _ = time.ParseDuration(v)
+	}
+	p.trace = opts.OptTrace
+	p.leakCheck = opts.OptDebugLeakCheck
+	p.output = opts.OptOutput
+	p.outputMode = opts.OptOutputMode
+	p.annotateOutput = opts.OptAnnotateOutput
+	// Already validated by CLIOptions.Validate
+	p.copyToTmux, p.tmuxOpen, _ = parseTmuxModes(opts.OptTmux)
+	if v := opts.OptAnnotations; v != "" {
+		notes, err := readAnnotations(v)
+		if err != nil {
+			return err
+		}
+		p.annotationsFile = v
+		p.savedAnnotations = notes
+	}
+	if v := opts.OptRecord; v != "" {
+		p.record = v
+		p.recorder = NewSessionRecorder(p.Argv[1:], recordedConfig(opts.OptRcfile), opts.OptRecordHash)
+	}
+	if s := p.replay; s != nil {
+		// The screen has the size of the recorded one, so that lines
+		// are laid out the same way
+		p.screen = NewMemoryScreen(s.Width, s.Height)
+	}
 	p.initialQuery = opts.OptQuery
 	p.initialFilter = opts.OptInitialFilter
 	if len(p.initialFilter) <= 0 {
 		p.initialFilter = p.config.InitialFilter
 	}
-	if len(p.initialFilter) <= 0 {
-		p.initialFilter = opts.OptInitialMatcher
+	if v := opts.OptInitialMatcher; len(v) > 0 {
+		fmt.Fprintln(p.Stderr, i18n.Sprintf("%s is deprecated. Use %s", "--initial-matcher", "--initial-filter"))
+		if len(p.initialFilter) <= 0 {
+			p.initialFilter = v
+		}
 	}
 	p.fuzzyLongestSort = p.config.FuzzyLongestSort
 
+	p.matchColumn = opts.OptMatchColumn
+	p.columnDelimiter = opts.OptColumnDelimiter
+
+	if v := opts.OptGroupBy; len(v) > 0 {
+		rx, err := regexp.Compile(v)
+		if err != nil {
+			return errors.Wrap(err, "failed to compile --group-by expression")
+		}
+		p.groupBy = rx
+	}
+
 	if err := p.populateFilters(); err != nil {
 		return errors.Wrap(err, "failed to populate filters")
 	}
@@ -590,9 +1588,66 @@ func (p *Peco) ApplyConfig(opts CLIOptions) error {
 		return errors.Wrap(err, "failed to populate single key jump configuration")
 	}
 
+	if err := p.populateLineStyler(opts); err != nil {
+		return errors.Wrap(err, "failed to populate line styler")
+	}
+
+	if err := p.populateLineRenderer(); err != nil {
+		return errors.Wrap(err, "failed to populate line renderer")
+	}
+
+	if _, err := newCollator(p.config.SortCollation); err != nil {
+		return errors.Wrap(err, "failed to populate sort collation")
+	}
+	p.sorter = NewLineSorter(p.config.SortCollation)
+
 	return nil
 }
 
+func (p *Peco) populateLineStyler(opts CLIOptions) error {
+	minutes := p.config.Timestamp.DimOlderThan
+	if v := opts.OptDimOlderThan; v > 0 {
+		minutes = v
+	}
+	if minutes <= 0 {
+		return nil
+	}
+
+	d, err := newTimestampDimmer(p.config.Timestamp.Patterns, time.Duration(minutes)*time.Minute)
+	if err != nil {
+		return errors.Wrap(err, "failed to create timestamp dimmer")
+	}
+	p.lineStyler = d
+	return nil
+}
+
+func (p *Peco) populateLineRenderer() error {
+	r := p.lineRenderer
+	if r == nil {
+		var err error
+		r, err = newLineRenderer(p.config.LineRenderer)
+		if err != nil {
+			return errors.Wrap(err, "failed to create line renderer")
+		}
+	}
+
+	if p.stripCommonPrefix {
+		r = NewStripPrefixLineRenderer(p.commonPrefix, r)
+	}
+	p.lineRenderer = r
+	return nil
+}
+
+// commonPrefix returns the prefix shared by all of the lines that have
+// been read, for --strip-common-prefix
+func (p *Peco) commonPrefix() string {
+	src := p.inputSource()
+	if src == nil {
+		return ""
+	}
+	return src.CommonPrefix()
+}
+
 func (p *Peco) populateInitialFilter() error {
 	if v := p.initialFilter; len(v) > 0 {
 		if err := p.filters.SetCurrentByName(v); err != nil {
@@ -619,24 +1674,96 @@ func (p *Peco) populateSingleKeyJump() error {
 	return nil
 }
 
+// newBuiltinFilters creates the built-in filters, in their default
+// order
+func newBuiltinFilters(fuzzyLongestSort bool) []filter.Filter {
+	return []filter.Filter{
+		filter.NewIgnoreCase(),
+		filter.NewCaseSensitive(),
+		filter.NewSmartCase(),
+		filter.NewRegexp(),
+		filter.NewFuzzy(fuzzyLongestSort),
+		filter.NewComposite(fuzzyLongestSort),
+	}
+}
+
+// filterOrder returns the names of the filters to use, in order,
+// according to the Filters config. Custom filters that are not
+// listed are appended, sorted by name
+func filterOrder(builtin, custom, names []string) ([]string, error) {
+	sort.Strings(custom)
+	if len(names) == 0 {
+		return append(append([]string{}, builtin...), custom...), nil
+	}
+
+	known := make(map[string]bool)
+	for _, name := range builtin {
+		known[name] = true
+	}
+	for _, name := range custom {
+		known[name] = true
+	}
+
+	listed := make(map[string]bool)
+	order := make([]string, 0, len(names)+len(custom))
+	for _, name := range names {
+		if !known[name] {
+			return nil, errors.Errorf("unknown filter '%s'", name)
+		}
+		if listed[name] {
+			return nil, errors.Errorf("filter '%s' is listed more than once", name)
+		}
+		listed[name] = true
+		order = append(order, name)
+	}
+	for _, name := range custom {
+		if !listed[name] {
+			order = append(order, name)
+		}
+	}
+	return order, nil
+}
+
 func (p *Peco) populateFilters() error {
-	p.filters.Add(filter.NewIgnoreCase())
-	p.filters.Add(filter.NewCaseSensitive())
-	p.filters.Add(filter.NewSmartCase())
-	p.filters.Add(filter.NewRegexp())
-	p.filters.Add(filter.NewFuzzy(p.fuzzyLongestSort))
+	filters := make(map[string]filter.Filter)
+	var builtin, custom []string
+	for _, f := range newBuiltinFilters(p.fuzzyLongestSort) {
+		filters[f.String()] = f
+		builtin = append(builtin, f.String())
+	}
 
+	// Custom filters are run in the background, so whatever they print
+	// to stderr is displayed in the status bar, where it does not mess
+	// up the screen. Misbehaving commands may print a lot, hence the
+	// throttle
+	p.filterStderr = newStatusThrottle(filterStderrInterval, func(msg string) {
+		p.SendStatusAndClear(context.Background(), StatusError, msg, filterStderrClearDelay)
+	})
 	for name, c := range p.config.CustomFilter {
 		f := filter.NewExternalCmd(name, c.Cmd, c.Args, c.BufferThreshold, p.idgen, p.enableSep)
-		p.filters.Add(f)
+		f.SetIncremental(c.Incremental)
+		f.SetEnv(p.commandEnv)
+		f.SetStderr(p.filterStderr.Send)
+		if c.FlushInterval != 0 {
+			f.SetFlushInterval(time.Duration(c.FlushInterval) * time.Millisecond)
+		}
+		filters[name] = f
+		custom = append(custom, name)
+	}
+
+	order, err := filterOrder(builtin, custom, p.config.Filters)
+	if err != nil {
+		return errors.Wrap(err, "invalid Filters")
+	}
+	for _, name := range order {
+		p.filters.Add(filters[name])
 	}
 
 	return nil
 }
 
 func (p *Peco) populateKeymap() error {
-	// Create a new keymap object
-	k := NewKeymap(p.config.Keymap, p.config.Action)
+	k := newConfigKeymap(&p.config)
 	if err := k.ApplyKeybinding(); err != nil {
 		return errors.Wrap(err, "failed to apply key bindings")
 	}
@@ -644,6 +1771,25 @@ func (p *Peco) populateKeymap() error {
 	return nil
 }
 
+// newConfigKeymap creates a Keymap from the key bindings, actions and
+// layers in cfg. The bindings still need to be applied
+func newConfigKeymap(cfg *Config) Keymap {
+	actions := make(map[string][]string)
+	commands := make(map[string]CommandConfig)
+	for name, a := range cfg.Action {
+		if !a.Exec.IsEmpty() {
+			commands[name] = a.Exec
+			continue
+		}
+		actions[name] = a.Actions
+	}
+
+	k := NewKeymap(cfg.Keymap, actions)
+	k.Exec = commands
+	k.Layers = cfg.Layers
+	return k
+}
+
 func (p *Peco) populateStyles() error {
 	p.styles = p.config.Style
 	return nil
@@ -662,28 +1808,66 @@ func (p *Peco) SetCurrentLineBuffer(b Buffer) {
 		g := pdebug.Marker("Peco.SetCurrentLineBuffer %s", reflect.TypeOf(b).String())
 		defer g.End()
 	}
+	switch b.(type) {
+	case *GroupedBuffer, *PinnedBuffer, *FrecencyBuffer, *SortedBuffer:
+		// Already decorated, possibly by a previous call
+	default:
+		b = NewHiddenBuffer(b, p.hidden)
+		if f := p.frecency; f != nil {
+			b = NewFrecencyBuffer(b, f)
+		}
+		// Once toggled, sorting takes precedence over frecency
+		b = NewSortedBuffer(b, p.sorter)
+		if rx := p.groupBy; rx != nil {
+			b = NewGroupedBuffer(b, rx)
+		}
+	}
 	p.currentLineBuffer = b
 	go p.Hub().SendDraw(context.Background(), nil)
 }
 
+// ResetCurrentLineBuffer displays all of the lines of the input, or
+// of the snapshot being browsed
 func (p *Peco) ResetCurrentLineBuffer() {
-	p.SetCurrentLineBuffer(p.source)
+	defer p.showResults(nil)
+	if s := p.Snapshot(); s != nil {
+		p.SetCurrentLineBuffer(s)
+		return
+	}
+	p.SetCurrentLineBuffer(p.inputSource())
 }
 
 func (p *Peco) sendQuery(ctx context.Context, q string, nextFunc func()) {
 	if pdebug.Enabled {
-		g := pdebug.Marker("sending query to filter goroutine (q=%v, isInfinite=%t)", q, p.source.IsInfinite())
+		g := pdebug.Marker("sending query to filter goroutine (q=%v, isInfinite=%t)", q, p.inputSource().IsInfinite())
 		defer g.End()
 	}
 
-	if p.source.IsInfinite() {
-		// If the source is a stream, we can't do batch mode, and hence
-		// we can't guarantee proper timing. But... okay, we simulate
-		// something like it
-		p.Hub().SendQuery(ctx, q)
-		if nextFunc != nil {
-			time.AfterFunc(time.Second, nextFunc)
+	if tq, err := p.config.QueryTransform.Apply(ctx, q); err != nil {
+		p.SendStatus(ctx, StatusError, err.Error())
+	} else {
+		q = tq
+	}
+
+	// Only filters that split the query into terms ignore some of them
+	if ts, ok := p.Filters().Current().(filter.TermSplitter); ok {
+		if n := ts.CountTerms(q); n > filter.MaxTerms {
+			p.SendStatusAndClear(ctx, StatusWarn, i18n.Sprintf("Only the first %d of %d terms are matched", filter.MaxTerms, n), 2*time.Second)
+		}
+	}
+
+	if p.inputSource().IsInfinite() {
+		// If the source is a stream, the query does not finish until
+		// the stream does, so we can't wait for it here. If somebody
+		// needs to know when it's done, wait in the background
+		if nextFunc == nil {
+			p.Hub().SendQuery(ctx, q)
+			return
 		}
+		go p.Hub().Batch(context.Background(), func(ctx context.Context) {
+			p.Hub().SendQuery(ctx, q)
+			nextFunc()
+		}, false)
 	} else {
 		// No delay, execute immediately
 		p.Hub().Batch(context.Background(), func(ctx context.Context) {
@@ -724,7 +1908,9 @@ func (p *Peco) ExecQuery(nextFunc func()) bool {
 		if pdebug.Enabled {
 			pdebug.Printf("empty query, reset buffer")
 		}
+		anchor := anchorCursor(context.Background(), p)
 		p.ResetCurrentLineBuffer()
+		restoreCursor(context.Background(), p, p.CurrentLineBuffer(), anchor)
 
 		hub.Batch(context.Background(), func(ctx context.Context) {
 			hub.SendDraw(ctx, &DrawOptions{DisableCache: true})
@@ -735,6 +1921,8 @@ func (p *Peco) ExecQuery(nextFunc func()) bool {
 		return true
 	}
 
+	p.setQueryStarted(time.Now())
+
 	delay := p.QueryExecDelay()
 	if delay <= 0 {
 		if pdebug.Enabled {
@@ -778,6 +1966,104 @@ func (p *Peco) ExecQuery(nextFunc func()) bool {
 	return true
 }
 
+// outputSeparator returns the byte used to terminate each line
+// that peco emits as its result
+func (p *Peco) outputSeparator() byte {
+	if p.print0 {
+		return '\000'
+	}
+	return '\n'
+}
+
+// selectionCountOnFinish returns the number of lines that would be
+// emitted if the user finished now. When nothing is selected the
+// current line is used, so that counts as one
+func (p *Peco) selectionCountOnFinish() int {
+	if n := p.Selection().Len(); n > 0 {
+		return n
+	}
+
+	if _, err := p.CurrentLineBuffer().LineAt(p.Location().LineNumber()); err == nil {
+		return 1
+	}
+	return 0
+}
+
+// checkSelectionCount returns an error if the number of lines that
+// would be emitted does not satisfy --min-select / --max-select
+func (p *Peco) checkSelectionCount() error {
+	n := p.selectionCountOnFinish()
+	if p.minSelect > 0 && p.minSelect == p.maxSelect && n != p.minSelect {
+		return errors.Errorf("select exactly %d lines (%d selected)", p.minSelect, n)
+	}
+	if p.minSelect > 0 && n < p.minSelect {
+		return errors.Errorf("select at least %d lines (%d selected)", p.minSelect, n)
+	}
+	if p.maxSelect > 0 && n > p.maxSelect {
+		return errors.Errorf("select at most %d lines (%d selected)", p.maxSelect, n)
+	}
+	return nil
+}
+
+// printSummary prints a line describing the session to stderr, for
+// --summary
+func (p *Peco) printSummary(elapsed time.Duration) {
+	matched := 0
+	b := p.CurrentLineBuffer()
+	for i := 0; i < b.Size(); i++ {
+		if l, err := b.LineAt(i); err == nil && !isGroupHeader(l) {
+			matched++
+		}
+	}
+
+	// If nothing is selected, the line under the cursor is printed
+	selected := p.Selection().Len()
+	if selected == 0 && util.IsCollectResultsError(p.Err()) && matched > 0 {
+		selected = 1
+	}
+
+	fmt.Fprintf(p.Stderr, "peco: read=%d matched=%d selected=%d query=%s elapsed=%s\n",
+		p.inputSource().LinesRead(), matched, selected, strconv.Quote(p.Query().String()), elapsed.Round(time.Millisecond))
+}
+
+// ascendSelection calls f with each line in sel, in the order
+// specified by --selection-order, until f returns false. With
+// --unique-output, lines whose output has already been passed to f
+// are skipped, and with --print-new-only, so are the lines listed in
+// --selection-file
+func (p *Peco) ascendSelection(sel *Selection, f func(line.Line) bool) {
+	if p.printNewOnly {
+		next := f
+		f = func(l line.Line) bool {
+			if p.isInSelectionFile(l) {
+				return true
+			}
+			return next(l)
+		}
+	}
+
+	if p.uniqueOutput {
+		seen := make(map[string]struct{})
+		next := f
+		f = func(l line.Line) bool {
+			out := l.Output()
+			if _, ok := seen[out]; ok {
+				return true
+			}
+			seen[out] = struct{}{}
+			return next(l)
+		}
+	}
+
+	if p.selectionOrder == selectionOrderPicked {
+		sel.AscendPicked(f)
+		return
+	}
+	sel.Ascend(func(it btree.Item) bool {
+		return f(it.(line.Line))
+	})
+}
+
 func (p *Peco) PrintResults() {
 	if pdebug.Enabled {
 		g := pdebug.Marker("Peco.PrintResults")
@@ -792,8 +2078,8 @@ func (p *Peco) PrintResults() {
 	p.SetResultCh(make(chan line.Line))
 	go func() {
 		defer close(p.resultCh)
-		p.selection.Ascend(func(it btree.Item) bool {
-			p.ResultCh() <- it.(line.Line)
+		p.ascendSelection(p.selection, func(l line.Line) bool {
+			p.ResultCh() <- l
 			return true
 		})
 	}()
@@ -803,13 +2089,36 @@ func (p *Peco) PrintResults() {
 	if pdebug.Enabled {
 		pdebug.Printf("--print-query was %t", p.printQuery)
 	}
+	sep := p.outputSeparator()
 	if p.printQuery {
 		buf.WriteString(p.Query().String())
-		buf.WriteByte('\n')
+		buf.WriteByte(sep)
+	}
+	var matches map[uint64][][]int
+	if p.printIndices != "" {
+		matches = p.currentMatches()
 	}
+	var results []line.Line
 	for line := range p.ResultCh() {
-		buf.WriteString(line.Output())
-		buf.WriteByte('\n')
+		buf.WriteString(p.formatResult(line, matches))
+		buf.WriteByte(sep)
+		results = append(results, line)
+	}
+
+	if err := p.runAcceptHook(results); err != nil {
+		fmt.Fprintf(p.Stderr, "Error: %s\n", err)
+	}
+	if p.copyToTmux && len(results) > 0 && p.insideTmux() {
+		if err := copyToTmux(results); err != nil {
+			fmt.Fprintf(p.Stderr, "Error: %s\n", err)
+		}
 	}
 	p.Stdout.Write(buf.Bytes())
+	if err := p.writeOutput(buf.Bytes()); err != nil {
+		fmt.Fprintf(p.Stderr, "Error: %s\n", err)
+	}
+
+	if err := p.recordFrecency(results); err != nil {
+		fmt.Fprintf(p.Stderr, "Error: %s\n", err)
+	}
 }
@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
 	"runtime"
 	"sync"
 	"testing"
@@ -17,6 +20,7 @@ import (
 	"github.com/peco/peco/hub"
 	"github.com/peco/peco/internal/util"
 	"github.com/peco/peco/line"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -86,6 +90,42 @@ func newPeco() *Peco {
 	return state
 }
 
+// startPeco runs p until ctx is done, and waits until it has read n
+// lines of input and displays m lines, i.e. until the initial query has
+// been run. The returned channel receives the error returned by Run
+func startPeco(ctx context.Context, t *testing.T, p *Peco, n, m int) <-chan error {
+	errCh := make(chan error, 1)
+	go func() { errCh <- p.Run(ctx) }()
+
+	select {
+	case <-ctx.Done():
+		t.Fatalf("timed out waiting for peco to be ready")
+	case <-p.Ready():
+	}
+	waitLines(ctx, p, n, m)
+	return errCh
+}
+
+// waitLines waits until p has read n lines of input and displays m lines
+func waitLines(ctx context.Context, p *Peco, n, m int) {
+	for (p.source.Size() != n || p.CurrentLineBuffer().Size() != m) && ctx.Err() == nil {
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// execQuery runs query and waits for its results, which it returns
+func execQuery(ctx context.Context, t *testing.T, p *Peco, query string) Buffer {
+	p.Query().Set(query)
+	doneCh := make(chan struct{})
+	p.ExecQuery(func() { close(doneCh) })
+	select {
+	case <-ctx.Done():
+		t.Fatalf("timed out waiting for query '%s'", query)
+	case <-doneCh:
+	}
+	return p.CurrentLineBuffer()
+}
+
 type dummyScreen struct {
 	*interceptor
 	width  int
@@ -409,6 +449,64 @@ func TestGHIssue367(t *testing.T) {
 	}
 }
 
+func TestExitZero(t *testing.T) {
+	run := func(t *testing.T, input string, args ...string) (error, string) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		p := newPeco()
+		p.Argv = args
+		p.Stdin = bytes.NewBufferString(input)
+		var out bytes.Buffer
+		p.Stdout = &out
+
+		err := p.Run(ctx)
+		if !assert.NoError(t, ctx.Err(), "timeout reached") {
+			return err, ""
+		}
+		if util.IsCollectResultsError(err) {
+			p.PrintResults()
+		}
+		return err, out.String()
+	}
+
+	t.Run("Initial query matches nothing", func(t *testing.T) {
+		// With --select-1 alone, the single line in the input used to
+		// be selected before the query had a chance to filter it out
+		err, _ := run(t, "foo\n", "--query", "bar", "--select-1", "--exit-0")
+		if !assert.True(t, util.IsIgnorableError(err), "error should be ignorable") {
+			return
+		}
+		st, ok := util.GetExitStatus(err)
+		if !assert.True(t, ok, "exit status should be set") {
+			return
+		}
+		assert.Equal(t, 1, st, "exit status should be 1")
+	})
+	t.Run("Empty input", func(t *testing.T) {
+		err, _ := run(t, "", "--exit-0")
+		st, ok := util.GetExitStatus(err)
+		if !assert.True(t, ok, "exit status should be set") {
+			return
+		}
+		assert.Equal(t, 1, st, "exit status should be 1")
+	})
+	t.Run("Initial query matches one line", func(t *testing.T) {
+		err, out := run(t, "foo\nbar\nbaz\n", "--query", "ar", "--select-1", "--exit-0")
+		if !assert.True(t, util.IsCollectResultsError(err), "isCollectResultsError") {
+			return
+		}
+		assert.Equal(t, "bar\n", out, "output should match")
+	})
+	t.Run("Group headers are not counted", func(t *testing.T) {
+		err, out := run(t, "foo.go:1\n", "--group-by", "^([^:]+):", "--select-1")
+		if !assert.True(t, util.IsCollectResultsError(err), "isCollectResultsError") {
+			return
+		}
+		assert.Equal(t, "foo.go:1\n", out, "output should match")
+	})
+}
+
 func TestPrintQuery(t *testing.T) {
 	t.Run("Match and print query", func(t *testing.T) {
 		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
@@ -489,3 +587,442 @@ func TestPrintQuery(t *testing.T) {
 		}
 	})
 }
+
+func TestPrint0(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	p := newPeco()
+	p.Argv = []string{"--print0", "--print-query", "--query", "oo", "--select-1"}
+	p.Stdin = bytes.NewBufferString("foo\n")
+	var out bytes.Buffer
+	p.Stdout = &out
+
+	resultCh := make(chan error)
+	go func() {
+		defer close(resultCh)
+		select {
+		case <-ctx.Done():
+			return
+		case resultCh <- p.Run(ctx):
+			return
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		t.Errorf("timeout reached")
+		return
+	case err := <-resultCh:
+		if !assert.True(t, util.IsCollectResultsError(err), "isCollectResultsError") {
+			return
+		}
+		p.PrintResults()
+	}
+
+	if !assert.Equal(t, "oo\000foo\000", out.String(), "output should match") {
+		return
+	}
+}
+
+func TestQueryTransform(t *testing.T) {
+	ctx := context.Background()
+	var qt QueryTransformConfig
+	q, err := qt.Apply(ctx, "foo")
+	if !assert.NoError(t, err, "Apply should succeed") {
+		return
+	}
+	if !assert.Equal(t, "foo", q, "query should be left untouched") {
+		return
+	}
+
+	qt.Template = "^$QUERY"
+	q, err = qt.Apply(ctx, "foo")
+	if !assert.NoError(t, err, "Apply should succeed") {
+		return
+	}
+	if !assert.Equal(t, "^foo", q, "query should be rewritten") {
+		return
+	}
+
+	if _, err := exec.LookPath("sleep"); err != nil {
+		return
+	}
+	qt = QueryTransformConfig{Cmd: "sleep", Args: []string{"5"}}
+	timeout, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	q, err = qt.Apply(timeout, "foo")
+	if !assert.Error(t, err, "Apply should fail once ctx is done") {
+		return
+	}
+	if !assert.True(t, time.Since(start) < 5*time.Second, "command should be killed once ctx is done") {
+		return
+	}
+	assert.Equal(t, "foo", q, "query should be left untouched")
+}
+
+func TestSelectionCountLimits(t *testing.T) {
+	t.Run("validate", func(t *testing.T) {
+		var opts CLIOptions
+		opts.OptSelectExact = 2
+		opts.OptMinSelect = 1
+		if !assert.Error(t, opts.Validate(), "--select-exact with --min-select should fail") {
+			return
+		}
+
+		opts = CLIOptions{OptMinSelect: 3, OptMaxSelect: 2}
+		if !assert.Error(t, opts.Validate(), "--min-select > --max-select should fail") {
+			return
+		}
+	})
+
+	t.Run("select-exact", func(t *testing.T) {
+		p := newPeco()
+		if !assert.NoError(t, p.ApplyConfig(CLIOptions{OptSelectExact: 2}), "p.ApplyConfig should succeed") {
+			return
+		}
+		if !assert.Equal(t, 2, p.minSelect, "p.minSelect should be 2") {
+			return
+		}
+		if !assert.Equal(t, 2, p.maxSelect, "p.maxSelect should be 2") {
+			return
+		}
+
+		p.currentLineBuffer = NewMemoryBuffer()
+		if !assert.Error(t, p.checkSelectionCount(), "empty buffer should not satisfy --select-exact") {
+			return
+		}
+
+		p.Selection().Add(line.NewRaw(0, "foo", false))
+		if !assert.Error(t, p.checkSelectionCount(), "1 line should not satisfy --select-exact 2") {
+			return
+		}
+
+		p.Selection().Add(line.NewRaw(1, "bar", false))
+		p.Selection().Add(line.NewRaw(2, "baz", false))
+		if !assert.Equal(t, 2, p.Selection().Len(), "selection should be capped at 2") {
+			return
+		}
+		if !assert.NoError(t, p.checkSelectionCount(), "2 lines should satisfy --select-exact 2") {
+			return
+		}
+	})
+}
+
+func TestInitialMatch(t *testing.T) {
+	run := func(t *testing.T, args []string, expected int) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		p := newPeco()
+		p.Argv = args
+		p.Stdin = bytes.NewBufferString("bar\nfoo\nbaz\nbax\n")
+		go p.Run(ctx)
+
+		<-p.Ready()
+
+		for p.Location().LineNumber() != expected {
+			select {
+			case <-ctx.Done():
+				t.Errorf("timed out waiting for the cursor to move to the matching line (currently at %d)", p.Location().LineNumber())
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+
+		time.Sleep(300 * time.Millisecond)
+		assert.Equal(t, expected, p.Location().LineNumber(), "cursor should stay on the matching line")
+	}
+
+	t.Run("Input", func(t *testing.T) {
+		run(t, []string{"--initial-match", "^baz"}, 2)
+	})
+	t.Run("Query", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		p := newPeco()
+		p.Argv = []string{"--query", "ba"}
+		p.Stdin = bytes.NewBufferString("bar\nfoo\nbaz\nbax\n")
+		go p.Run(ctx)
+
+		<-p.Ready()
+		<-p.inputSource().SetupDone()
+		for p.CurrentLineBuffer().Size() != 3 && ctx.Err() == nil {
+			time.Sleep(5 * time.Millisecond)
+		}
+
+		// baz is the third line of the input, but the second one
+		// that is displayed
+		p.initialMatch = regexp.MustCompile("^baz")
+		p.moveToInitialMatch(ctx)
+		assert.Equal(t, 1, p.Location().LineNumber(), "cursor should move to the matching line that is displayed")
+	})
+}
+
+type statusRecorderHub struct {
+	nullHub
+	messages []string
+}
+
+func (h *statusRecorderHub) SendStatusMsgAndClear(_ context.Context, msg string, _ time.Duration) {
+	h.messages = append(h.messages, msg)
+}
+
+func TestQuiet(t *testing.T) {
+	ctx := context.Background()
+
+	p := newPeco()
+	if !assert.NoError(t, p.ApplyConfig(CLIOptions{OptQuiet: true}), "p.ApplyConfig should succeed") {
+		return
+	}
+
+	h := &statusRecorderHub{}
+	p.hub = h
+
+	p.SendStatus(ctx, StatusInfo, "Running query...")
+	p.SendStatus(ctx, StatusWarn, "No Selection")
+	p.SendStatus(ctx, StatusError, "failed")
+	p.SendStatus(ctx, StatusInfo, "")
+
+	if !assert.Equal(t, []string{"No Selection", "failed", ""}, h.messages, "info messages should be suppressed") {
+		return
+	}
+}
+
+func TestNoTTY(t *testing.T) {
+	run := func(t *testing.T, query string) (string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		p := newPeco()
+		p.Argv = []string{"--no-tty", "--query", query}
+		p.Stdin = bytes.NewBufferString("apple\nbanana\ncherry\nmango\n")
+		var out bytes.Buffer
+		p.Stdout = &out
+
+		err := p.Run(ctx)
+		if !assert.NoError(t, ctx.Err(), "timeout reached") {
+			return "", err
+		}
+		if util.IsCollectResultsError(err) {
+			p.PrintResults()
+		}
+		return out.String(), err
+	}
+
+	t.Run("matched", func(t *testing.T) {
+		out, err := run(t, "an")
+		if !assert.True(t, util.IsCollectResultsError(err), "isCollectResultsError") {
+			return
+		}
+		assert.Equal(t, "banana\nmango\n", out, "all matching lines should be printed")
+	})
+	t.Run("no match", func(t *testing.T) {
+		_, err := run(t, "xyz")
+		if !assert.True(t, util.IsIgnorableError(err), "error should be ignorable") {
+			return
+		}
+		st, ok := util.GetExitStatus(err)
+		assert.True(t, ok, "exit status should be set")
+		assert.Equal(t, 1, st, "exit status should be 1")
+	})
+}
+
+func TestSummary(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	p := newPeco()
+	p.Argv = []string{"--no-tty", "--summary", "--query", "an"}
+	p.Stdin = bytes.NewBufferString("apple\nbanana\ncherry\nmango\n")
+	var out, errOut bytes.Buffer
+	p.Stdout = &out
+	p.Stderr = &errOut
+
+	err := p.Run(ctx)
+	if !assert.NoError(t, ctx.Err(), "timeout reached") {
+		return
+	}
+	if !assert.True(t, util.IsCollectResultsError(err), "isCollectResultsError") {
+		return
+	}
+	p.PrintResults()
+
+	assert.Equal(t, "banana\nmango\n", out.String(), "summary should not be printed to stdout")
+	assert.Regexp(t, `^peco: read=4 matched=2 selected=2 query="an" elapsed=\S+\n$`, errOut.String(), "summary should be printed to stderr")
+}
+
+func TestRenderOnce(t *testing.T) {
+	for _, name := range []string{"COLUMNS", "LINES"} {
+		if v, ok := os.LookupEnv(name); ok {
+			defer os.Setenv(name, v)
+		} else {
+			defer os.Unsetenv(name)
+		}
+	}
+	os.Setenv("COLUMNS", "30")
+	os.Setenv("LINES", "4")
+
+	run := func(t *testing.T, args ...string) string {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		p := newPeco()
+		p.Argv = args
+		p.Stdin = bytes.NewBufferString("apple\nbanana\ncherry\n")
+		var out bytes.Buffer
+		p.Stdout = &out
+
+		err := p.Run(ctx)
+		if !assert.NoError(t, ctx.Err(), "timeout reached") {
+			return ""
+		}
+		if !assert.True(t, util.IsIgnorableError(err), "error should be ignorable") {
+			return ""
+		}
+		return out.String()
+	}
+
+	t.Run("text", func(t *testing.T) {
+		expected := "QUERY> an IgnoreCase [1 (1/1)]\n" +
+			"banana\n" +
+			"\n" +
+			"\n"
+		assert.Equal(t, expected, run(t, "--render-once", "--query", "an"), "rendered frame should match")
+	})
+	t.Run("ansi", func(t *testing.T) {
+		expected := "QUERY> \x1b[0;7m \x1b[0m  IgnoreCase [3 (1/2)]\n" +
+			"\x1b[0;4;45mapple                         \x1b[0m\n" +
+			"banana\n" +
+			"\n"
+		assert.Equal(t, expected, run(t, "--render-once=ansi"), "rendered frame should match")
+	})
+	t.Run("selection bar", func(t *testing.T) {
+		expected := "QUERY> an\x1b[0;7m \x1b[0mIgnoreCase [1 (1/1)]\n" +
+			"\x1b[0;4;7;45mb\x1b[0;7;36;45manan\x1b[0;4;7;45ma                        \x1b[0m\n" +
+			"\n" +
+			"\n"
+		assert.Equal(t, expected, run(t, "--render-once=ansi", "--selection-bar", "--query", "an"), "cursor line should be reversed across the full width")
+	})
+	t.Run("wide characters", func(t *testing.T) {
+		s := NewMemoryScreen(10, 1)
+		s.Print(PrintArgs{Msg: "日本語", Fg: termbox.ColorRed})
+		assert.Equal(t, "日本語\n", s.String(), "wide characters should cover two cells")
+		assert.Equal(t, "\x1b[0;31m日本語\x1b[0m\n", s.ANSI(), "wide characters should cover two cells")
+	})
+}
+
+func TestQueryExecDelay(t *testing.T) {
+	assert.Equal(t, time.Duration(0), adaptiveQueryExecDelay(0, 1000), "queries on small inputs should run right away")
+	assert.Equal(t, DefaultQueryExecDelay, adaptiveQueryExecDelay(0, 5000000), "queries on large inputs should wait until their duration is known")
+	assert.Equal(t, time.Duration(0), adaptiveQueryExecDelay(4*time.Millisecond, 5000000), "fast queries should run right away")
+	assert.Equal(t, 100*time.Millisecond, adaptiveQueryExecDelay(200*time.Millisecond, 5000000), "delay should scale with the duration of the last query")
+	assert.Equal(t, MaxQueryExecDelay, adaptiveQueryExecDelay(5*time.Second, 5000000), "delay should be capped")
+
+	state := newPeco()
+	assert.Equal(t, time.Duration(0), state.QueryExecDelay(), "delay should be adaptive by default")
+	state.recordQueryDuration(300 * time.Millisecond)
+	assert.Equal(t, 150*time.Millisecond, state.QueryExecDelay())
+
+	state.config.QueryExecutionDelay = 30
+	if !assert.NoError(t, state.ApplyConfig(CLIOptions{}), "ApplyConfig should succeed") {
+		return
+	}
+	assert.Equal(t, 30*time.Millisecond, state.QueryExecDelay(), "configured delay should take precedence")
+}
+
+func TestStatusThrottle(t *testing.T) {
+	msgs := make(chan string, 10)
+	throttle := newStatusThrottle(100*time.Millisecond, func(msg string) { msgs <- msg })
+
+	throttle.Send("first")
+	throttle.Send("second")
+	throttle.Send("third")
+
+	assert.Equal(t, "first", <-msgs, "first message should be sent right away")
+	select {
+	case msg := <-msgs:
+		assert.Equal(t, "third", msg, "only the latest of the held back messages should be sent")
+	case <-time.After(time.Second):
+		t.Errorf("held back message should be sent once the interval has passed")
+	}
+	select {
+	case msg := <-msgs:
+		t.Errorf("unexpected message %q", msg)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestUniqueOutput(t *testing.T) {
+	run := func(unique bool) string {
+		p := newPeco()
+		p.uniqueOutput = unique
+		var out bytes.Buffer
+		p.Stdout = &out
+
+		for i, s := range []string{"foo", "bar", "foo", "baz", "bar"} {
+			p.Selection().Add(line.NewRaw(uint64(i), s, false))
+		}
+		p.PrintResults()
+		return out.String()
+	}
+
+	assert.Equal(t, "foo\nbar\nfoo\nbaz\nbar\n", run(false), "all selected lines should be printed")
+	assert.Equal(t, "foo\nbar\nbaz\n", run(true), "each distinct line should be printed once")
+}
+
+func TestIdleTimeout(t *testing.T) {
+	run := func(t *testing.T, args ...string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		p := newPeco()
+		p.Argv = append([]string{"peco"}, args...)
+		p.Stdin = bytes.NewBufferString("apple\nbanana\n")
+		err := p.Run(ctx)
+		assert.NoError(t, ctx.Err(), "peco should time out before the test does")
+		return err
+	}
+
+	err := run(t, "--timeout", "100ms")
+	assert.True(t, util.IsIgnorableError(err), "timing out should be ignorable")
+	assert.Equal(t, errUserCanceled, errors.Cause(err), "timing out should be a cancel")
+	_, ok := util.GetExitStatus(err)
+	assert.False(t, ok, "timing out should succeed by default")
+
+	err = run(t, "--timeout", "100ms", "--on-cancel", "error")
+	st, _ := util.GetExitStatus(err)
+	assert.Equal(t, 1, st, "timing out should fail with --on-cancel error")
+}
+
+func TestFilterOrder(t *testing.T) {
+	builtin := []string{"IgnoreCase", "Regexp", "Fuzzy"}
+	custom := []string{"Migemo", "Awk"}
+
+	order, err := filterOrder(builtin, custom, nil)
+	if assert.NoError(t, err, "default order should be accepted") {
+		assert.Equal(t, []string{"IgnoreCase", "Regexp", "Fuzzy", "Awk", "Migemo"}, order, "all filters should be used by default")
+	}
+
+	order, err = filterOrder(builtin, custom, []string{"Fuzzy", "Migemo", "Regexp"})
+	if assert.NoError(t, err, "known filters should be accepted") {
+		assert.Equal(t, []string{"Fuzzy", "Migemo", "Regexp", "Awk"}, order, "listed filters should come first, followed by unlisted custom filters")
+	}
+
+	_, err = filterOrder(builtin, custom, []string{"Fuzzy", "Fuzy"})
+	assert.Error(t, err, "unknown filters should be rejected")
+	_, err = filterOrder(builtin, custom, []string{"Fuzzy", "Fuzzy"})
+	assert.Error(t, err, "duplicate filters should be rejected")
+
+	state := New()
+	state.config.Filters = []string{"Fuzzy", "Regexp"}
+	if !assert.NoError(t, state.populateFilters(), "populating filters should succeed") {
+		return
+	}
+	assert.Equal(t, 2, state.Filters().Size(), "only the listed filters should be registered")
+	assert.Equal(t, "Fuzzy", state.Filters().Current().String(), "the first listed filter should be current")
+	state.Filters().Rotate()
+	assert.Equal(t, "Regexp", state.Filters().Current().String(), "filters should rotate in the listed order")
+}
@@ -0,0 +1,61 @@
+package pecotest
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/nsf/termbox-go"
+)
+
+// Measure sends each event to peco in turn, and measures how long it
+// takes for peco to settle after each of them, i.e. to handle the
+// event, run the query if the event changed it, and draw the results.
+// This includes the delay before queries are run
+func (d *Driver) Measure(ctx context.Context, events ...termbox.Event) (Latencies, error) {
+	latencies := make(Latencies, 0, len(events))
+	for _, ev := range events {
+		start := time.Now()
+		d.SendEvent(ev)
+		if err := d.WaitIdle(ctx); err != nil {
+			return latencies, err
+		}
+		latencies = append(latencies, time.Since(start))
+	}
+	return latencies, nil
+}
+
+// KeyEvents returns the key presses that type s, as sent by Type
+func KeyEvents(s string) []termbox.Event {
+	var events []termbox.Event
+	for _, r := range s {
+		if r == ' ' {
+			events = append(events, termbox.Event{Type: termbox.EventKey, Key: termbox.KeySpace})
+			continue
+		}
+		events = append(events, termbox.Event{Type: termbox.EventKey, Ch: r})
+	}
+	return events
+}
+
+// Percentile returns the latency below which p percent of the
+// latencies fall, using the nearest-rank method. It returns zero if
+// there are no latencies
+func (l Latencies) Percentile(p float64) time.Duration {
+	if len(l) == 0 {
+		return 0
+	}
+
+	sorted := append(Latencies(nil), l...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	switch {
+	case rank < 1:
+		rank = 1
+	case rank > len(sorted):
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
+}
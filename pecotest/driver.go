@@ -0,0 +1,191 @@
+package pecotest
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/nsf/termbox-go"
+	"github.com/peco/peco"
+	"github.com/peco/peco/internal/util"
+	"github.com/pkg/errors"
+)
+
+// DefaultPollInterval is how often WaitIdle checks if peco has
+// settled, unless specified by WithPollInterval
+const DefaultPollInterval = time.Millisecond
+
+// WithArgs specifies the command line arguments passed to peco, not
+// including the program name
+func WithArgs(args ...string) Option {
+	return func(d *Driver) {
+		d.args = args
+	}
+}
+
+// WithConfig specifies the contents of the configuration file that
+// peco reads. By default an empty configuration is used, so that the
+// user's own configuration does not affect the results
+func WithConfig(config string) Option {
+	return func(d *Driver) {
+		d.config = config
+	}
+}
+
+// WithSize specifies the size of the Screen. The default is 80x25
+func WithSize(width, height int) Option {
+	return func(d *Driver) {
+		d.width = width
+		d.height = height
+	}
+}
+
+// WithPollInterval specifies how often WaitIdle checks if peco has
+// settled. This is also the resolution of the latencies measured by
+// Measure
+func WithPollInterval(interval time.Duration) Option {
+	return func(d *Driver) {
+		d.poll = interval
+	}
+}
+
+// New creates a new Driver that reads lines from input
+func New(input io.Reader, options ...Option) *Driver {
+	d := &Driver{
+		config: "{}",
+		done:   make(chan struct{}),
+		height: 25,
+		input:  input,
+		poll:   DefaultPollInterval,
+		width:  80,
+	}
+	for _, option := range options {
+		option(d)
+	}
+	d.screen = NewScreen(d.width, d.height)
+	return d
+}
+
+// Start runs peco in the background, and returns once it is ready
+// to accept events
+func (d *Driver) Start(ctx context.Context) error {
+	f, err := ioutil.TempFile("", "pecotest-*.json")
+	if err != nil {
+		return errors.Wrap(err, "failed to create config file")
+	}
+	d.rcfile = f.Name()
+	_, err = f.WriteString(d.config)
+	f.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to write config file")
+	}
+
+	p := peco.New()
+	p.Argv = append([]string{"peco", "--rcfile", d.rcfile}, d.args...)
+	p.Stdin = d.input
+	p.Stdout = &d.output
+	p.Stderr = ioutil.Discard
+	p.SetScreen(d.screen)
+	d.peco = p
+
+	ctx, d.cancel = context.WithCancel(ctx)
+	go func() {
+		defer close(d.done)
+		d.err = p.Run(ctx)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-d.done:
+		return d.err
+	case <-p.Ready():
+	}
+	return nil
+}
+
+// Peco returns the peco instance being driven
+func (d *Driver) Peco() *peco.Peco {
+	return d.peco
+}
+
+// Screen returns the Screen that peco draws on
+func (d *Driver) Screen() *Screen {
+	return d.screen
+}
+
+// SendEvent sends an event to peco. It blocks until peco receives it
+func (d *Driver) SendEvent(ev termbox.Event) {
+	atomic.AddUint64(&d.sent, 1)
+	d.screen.SendEvent(ev)
+}
+
+// SendKey sends a key press, such as termbox.KeyEnter, to peco
+func (d *Driver) SendKey(key termbox.Key, mod termbox.Modifier) {
+	d.SendEvent(termbox.Event{Type: termbox.EventKey, Key: key, Mod: mod})
+}
+
+// Type sends each character in s to peco as a key press
+func (d *Driver) Type(s string) {
+	for _, ev := range KeyEvents(s) {
+		d.SendEvent(ev)
+	}
+}
+
+// WaitIdle blocks until peco has read all of its input, handled all
+// of the events sent so far, and finished filtering and drawing
+func (d *Driver) WaitIdle(ctx context.Context) error {
+	ticker := time.NewTicker(d.poll)
+	defer ticker.Stop()
+
+	for {
+		if d.peco.EventsHandled() >= atomic.LoadUint64(&d.sent) && d.peco.IsIdle() {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "timed out waiting for peco to become idle")
+		case <-d.done:
+			return errors.New("peco exited before becoming idle")
+		case <-ticker.C:
+		}
+	}
+}
+
+// Wait blocks until peco exits. If peco exited because the user
+// selected lines, the result is available via Output, and Wait
+// returns nil
+func (d *Driver) Wait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "timed out waiting for peco to exit")
+	case <-d.done:
+	}
+
+	if util.IsCollectResultsError(d.err) {
+		d.peco.PrintResults()
+		return nil
+	}
+	return d.err
+}
+
+// Output returns what peco has written to its standard output
+func (d *Driver) Output() string {
+	return d.output.String()
+}
+
+// Close stops peco, and releases resources held by the Driver
+func (d *Driver) Close() error {
+	if d.cancel != nil {
+		d.cancel()
+		<-d.done
+	}
+	if d.rcfile != "" {
+		return os.Remove(d.rcfile)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package pecotest_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/pecotest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDriver(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	d := pecotest.New(strings.NewReader("apple\nbanana\ncherry\n"), pecotest.WithSize(40, 10))
+	defer d.Close()
+
+	if !assert.NoError(t, d.Start(ctx), "Start should succeed") {
+		return
+	}
+	if !assert.NoError(t, d.WaitIdle(ctx), "WaitIdle should succeed") {
+		return
+	}
+
+	screen := d.Screen()
+	assert.True(t, strings.HasPrefix(screen.Line(0), "QUERY>"), "prompt should be drawn")
+	assert.Equal(t, "apple", screen.Line(1), "first line should be drawn")
+	assert.Equal(t, "cherry", screen.Line(3), "third line should be drawn")
+
+	d.Type("an")
+	if !assert.NoError(t, d.WaitIdle(ctx), "WaitIdle should succeed") {
+		return
+	}
+	assert.Equal(t, "banana", screen.Line(1), "only the matching line should be drawn")
+	assert.Equal(t, "", screen.Line(2), "non-matching lines should be cleared")
+	assert.NotEqual(t, termbox.ColorCyan, screen.Cell(0, 1).Fg, "unmatched characters should not be highlighted")
+	assert.Equal(t, termbox.ColorCyan, screen.Cell(1, 1).Fg, "matched characters should be highlighted")
+
+	d.SendKey(termbox.KeyEnter, 0)
+	if !assert.NoError(t, d.Wait(ctx), "Wait should succeed") {
+		return
+	}
+	assert.Equal(t, "banana\n", d.Output(), "selected line should be printed")
+}
+
+func TestMeasure(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	d := pecotest.New(strings.NewReader("apple\nbanana\ncherry\n"), pecotest.WithPollInterval(100*time.Microsecond))
+	defer d.Close()
+
+	if !assert.NoError(t, d.Start(ctx), "Start should succeed") {
+		return
+	}
+	if !assert.NoError(t, d.WaitIdle(ctx), "WaitIdle should succeed") {
+		return
+	}
+
+	latencies, err := d.Measure(ctx, pecotest.KeyEvents("an")...)
+	if !assert.NoError(t, err, "Measure should succeed") {
+		return
+	}
+	assert.Len(t, latencies, 2, "there should be a latency for each event")
+	assert.Equal(t, "banana", d.Screen().Line(1), "events should have been handled")
+}
+
+func TestPercentile(t *testing.T) {
+	var l pecotest.Latencies
+	assert.Equal(t, time.Duration(0), l.Percentile(50), "percentile of nothing should be zero")
+
+	for i := 10; i > 0; i-- {
+		l = append(l, time.Duration(i)*time.Millisecond)
+	}
+	assert.Equal(t, 5*time.Millisecond, l.Percentile(50))
+	assert.Equal(t, 9*time.Millisecond, l.Percentile(90))
+	assert.Equal(t, 10*time.Millisecond, l.Percentile(99))
+	assert.Equal(t, 10*time.Millisecond, l.Percentile(100))
+	assert.Equal(t, 1*time.Millisecond, l.Percentile(0))
+	assert.Equal(t, 10*time.Millisecond, l[0], "latencies should not be sorted in place")
+
+	l = nil
+	for i := 1; i <= 13; i++ {
+		l = append(l, time.Duration(i)*time.Millisecond)
+	}
+	assert.Equal(t, 13*time.Millisecond, l.Percentile(95), "rank should be rounded up")
+}
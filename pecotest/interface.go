@@ -0,0 +1,45 @@
+// Package pecotest provides a headless driver for peco, so that peco
+// itself, as well as programs that wrap peco, can be tested without
+// a terminal.
+package pecotest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"time"
+
+	"github.com/peco/peco"
+)
+
+// Cell is a single character cell on the Screen
+type Cell = peco.Cell
+
+// Screen is an in-memory implementation of peco.Screen. It records
+// the cells that are drawn, and delivers events sent via SendEvent
+type Screen = peco.MemoryScreen
+
+// Driver runs peco against a Screen, and lets you interact with it
+type Driver struct {
+	sent   uint64 // accessed atomically, keep 64-bit aligned
+	args   []string
+	cancel context.CancelFunc
+	config string
+	done   chan struct{}
+	err    error
+	height int
+	input  io.Reader
+	output bytes.Buffer
+	peco   *peco.Peco
+	poll   time.Duration
+	rcfile string
+	screen *Screen
+	width  int
+}
+
+// Latencies are the times taken for peco to settle after each of a
+// series of events, as measured by Driver.Measure
+type Latencies []time.Duration
+
+// Option configures a Driver
+type Option func(*Driver)
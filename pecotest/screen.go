@@ -0,0 +1,8 @@
+package pecotest
+
+import "github.com/peco/peco"
+
+// NewScreen creates a new Screen of the given size
+func NewScreen(width, height int) *Screen {
+	return peco.NewMemoryScreen(width, height)
+}
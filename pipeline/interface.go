@@ -2,6 +2,7 @@ package pipeline
 
 import (
 	"sync"
+	"time"
 
 	"context"
 )
@@ -43,13 +44,37 @@ type Destination interface {
 	Acceptor
 }
 
+// Tracer can be registered to a Pipeline to receive notifications
+// about the data going through it, so that the performance of each
+// stage can be measured. Methods may be called from several
+// goroutines at once, so implementations should be safe for
+// concurrent use, and return quickly
+type Tracer interface {
+	// OnSourceStart is called when the source starts sending data
+	OnSourceStart(ctx context.Context)
+
+	// OnChunk is called when an Acceptor has processed a chunk of
+	// size values, which took elapsed
+	OnChunk(ctx context.Context, size int, elapsed time.Duration)
+
+	// OnFilterDone is called when all data has reached the
+	// destination. elapsed is the time since the source started
+	OnFilterDone(ctx context.Context, elapsed time.Duration)
+
+	// OnBufferSwap is called when the results of the pipeline
+	// replace the ones that are displayed. size is the number of
+	// results available at that time
+	OnBufferSwap(ctx context.Context, size int)
+}
+
 // Pipeline is encapsulates a chain of `Source`, `ProcNode`s, and `Destination`
 type Pipeline struct {
-	done  chan struct{}
-	mutex sync.Mutex
-	nodes []Acceptor
-	src   Source
-	dst   Destination
+	done   chan struct{}
+	mutex  sync.Mutex
+	nodes  []Acceptor
+	src    Source
+	dst    Destination
+	tracer Tracer
 }
 
 type Output interface {
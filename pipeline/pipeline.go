@@ -106,6 +106,31 @@ func (p *Pipeline) SetDestination(d Destination) {
 	p.dst = d
 }
 
+// SetTracer sets the Tracer that is notified of the progress of the
+// pipeline. Specifying nil removes the tracer.
+// If called during `Run`, this method will block.
+func (p *Pipeline) SetTracer(t Tracer) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.tracer = t
+}
+
+type tracerKey struct{}
+
+// NewTracerContext returns a context that carries t, so that
+// Acceptors can report their progress to it
+func NewTracerContext(ctx context.Context, t Tracer) context.Context {
+	return context.WithValue(ctx, tracerKey{}, t)
+}
+
+// TracerFromContext returns the Tracer carried by ctx, or nil if
+// there is none
+func TracerFromContext(ctx context.Context) Tracer {
+	t, _ := ctx.Value(tracerKey{}).(Tracer)
+	return t
+}
+
 // Run starts the processing. Mutator methods for `Pipeline` cannot be
 // called while `Run` is running.
 func (p *Pipeline) Run(ctx context.Context) (err error) {
@@ -131,6 +156,12 @@ func (p *Pipeline) Run(ctx context.Context) (err error) {
 	p.src.Reset()
 	p.dst.Reset()
 
+	// The Acceptors get hold of the tracer through the context
+	tracer := p.tracer
+	if tracer != nil {
+		ctx = NewTracerContext(ctx, tracer)
+	}
+
 	// Setup the Acceptors, effectively chaining all nodes
 	// starting from the destination, working all the way
 	// up to the Source
@@ -146,10 +177,17 @@ func (p *Pipeline) Run(ctx context.Context) (err error) {
 
 	// And now tell the Source to send the values so data chugs
 	// through the pipeline
+	started := time.Now()
+	if tracer != nil {
+		tracer.OnSourceStart(ctx)
+	}
 	go p.src.Start(ctx, prevCh)
 
 	// Wait till we're done
 	<-p.dst.Done()
+	if tracer != nil {
+		tracer.OnFilterDone(ctx, time.Since(started))
+	}
 
 	return nil
 }
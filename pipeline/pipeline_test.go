@@ -6,6 +6,7 @@ import (
 	"io"
 	"regexp"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -135,3 +136,67 @@ barfoo
 	p.Run(ctx)
 	t.Logf("%#v", dst.lines)
 }
+
+type recordingTracer struct {
+	mutex  sync.Mutex
+	events []string
+}
+
+func (t *recordingTracer) record(ev string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.events = append(t.events, ev)
+}
+
+func (t *recordingTracer) OnSourceStart(context.Context) { t.record("start") }
+func (t *recordingTracer) OnChunk(_ context.Context, size int, _ time.Duration) {
+	t.record(fmt.Sprintf("chunk %d", size))
+}
+func (t *recordingTracer) OnFilterDone(context.Context, time.Duration) { t.record("done") }
+func (t *recordingTracer) OnBufferSwap(context.Context, int)           { t.record("swap") }
+
+// tracingNode passes values through, reporting each as a chunk
+type tracingNode struct{}
+
+func (tracingNode) Accept(ctx context.Context, in chan interface{}, out ChanOutput) {
+	defer out.SendEndMark("end of tracingNode")
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case v := <-in:
+			if err, ok := v.(error); ok && IsEndMark(err) {
+				return
+			}
+			if t := TracerFromContext(ctx); t != nil {
+				t.OnChunk(ctx, 1, 0)
+			}
+			out.Send(v)
+		}
+	}
+}
+
+func TestTracer(t *testing.T) {
+	tracer := &recordingTracer{}
+	dst := NewReceiver()
+
+	p := New()
+	p.SetSource(NewLineFeeder(strings.NewReader("foo\nbar\n")))
+	p.Add(tracingNode{})
+	p.SetDestination(dst)
+	p.SetTracer(tracer)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := p.Run(ctx); err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+
+	expected := []string{"start", "chunk 1", "chunk 1", "done"}
+	if fmt.Sprint(tracer.events) != fmt.Sprint(expected) {
+		t.Errorf("expected events %v, got %v", expected, tracer.events)
+	}
+	if TracerFromContext(ctx) != nil {
+		t.Errorf("contexts without a tracer should return nil")
+	}
+}
@@ -0,0 +1,70 @@
+package peco
+
+import (
+	"context"
+	"runtime"
+
+	"github.com/lestrrat-go/pdebug"
+)
+
+// newWorkerPool creates a pool of n goroutines that run the jobs
+// submitted to it. If n is not positive, the number of CPUs is used
+func newWorkerPool(n int) *workerPool {
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	return &workerPool{
+		jobs: make(chan func()),
+		size: n,
+	}
+}
+
+// Size returns the number of goroutines in the pool
+func (wp *workerPool) Size() int {
+	return wp.size
+}
+
+// Run starts the goroutines of the pool. They are kept running across
+// queries, until ctx is canceled
+func (wp *workerPool) Run(ctx context.Context) {
+	wp.wg.Add(wp.size)
+	for i := 0; i < wp.size; i++ {
+		go func() {
+			defer wp.wg.Done()
+			wp.work(ctx)
+		}()
+	}
+}
+
+// Wait blocks until all of the goroutines of the pool have returned
+func (wp *workerPool) Wait() {
+	wp.wg.Wait()
+}
+
+func (wp *workerPool) work(ctx context.Context) {
+	if pdebug.Enabled {
+		g := pdebug.Marker("worker goroutine")
+		defer g.End()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-wp.jobs:
+			job()
+		}
+	}
+}
+
+// Submit passes job to an idle goroutine in the pool, blocking until
+// there is one. It returns false if ctx is canceled before the job
+// could be submitted
+func (wp *workerPool) Submit(ctx context.Context, job func()) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case wp.jobs <- job:
+		return true
+	}
+}
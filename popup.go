@@ -0,0 +1,156 @@
+package peco
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/lestrrat-go/pdebug"
+	"github.com/peco/peco/internal/tmux"
+	"github.com/peco/peco/internal/util"
+	"github.com/pkg/errors"
+)
+
+// kittyProgram is the kitty executable, which opens the popup with
+// its remote control
+var kittyProgram = "kitty"
+
+// popupTerminal returns the terminal that --popup can open a popup in,
+// judging by the environment that getenv reads, or "" if there is none
+func popupTerminal(getenv func(string) string) string {
+	switch {
+	case tmux.Inside(getenv):
+		return popupTmux
+	case getenv("KITTY_WINDOW_ID") != "":
+		return popupKitty
+	}
+	return ""
+}
+
+// popupArgv returns argv, the command line of peco, without --popup,
+// so that peco runs as usual in the popup
+func popupArgv(argv []string) []string {
+	args := make([]string, 0, len(argv))
+	for i, arg := range argv {
+		if arg == "--" {
+			return append(args, argv[i:]...)
+		}
+		if arg != "--popup" {
+			args = append(args, arg)
+		}
+	}
+	return args
+}
+
+// popupScript returns the shell command line that runs argv in the
+// popup. Its input is read from stdin, if not empty, and its output
+// and exit status are written to files in dir, as the popup has no
+// way to hand them back
+func popupScript(argv []string, stdin, dir string) string {
+	words := make([]string, len(argv))
+	for i, arg := range argv {
+		words[i] = util.ShellQuote(arg)
+	}
+
+	script := strings.Join(words, " ")
+	if stdin != "" {
+		script += " < " + util.ShellQuote(stdin)
+	}
+	status := util.ShellQuote(filepath.Join(dir, "status"))
+	return script +
+		" > " + util.ShellQuote(filepath.Join(dir, "stdout")) +
+		" 2> " + util.ShellQuote(filepath.Join(dir, "stderr")) +
+		"; echo $? > " + status + ".tmp; mv " + status + ".tmp " + status
+}
+
+// runInPopup implements --popup. exe, the peco executable, is run with
+// the same command line, less --popup, in a popup opened by terminal.
+// The input of peco is passed through to it, and its output is copied
+// back. The returned error makes peco exit with the same status
+func (p *Peco) runInPopup(terminal, exe string) (err error) {
+	if pdebug.Enabled {
+		g := pdebug.Marker("Peco.runInPopup %s", terminal).BindError(&err)
+		defer g.End()
+	}
+
+	dir, err := ioutil.TempDir("", "peco-popup-")
+	if err != nil {
+		return errors.Wrap(err, "failed to create directory for popup")
+	}
+	defer os.RemoveAll(dir)
+
+	// The input is passed through a named pipe, so that peco in the
+	// popup can start before all of it has been read
+	var stdin string
+	if p.sourceCmd == "" && len(p.inputs) == 0 && len(p.args) <= 1 && !util.IsTty(p.Stdin) {
+		stdin = filepath.Join(dir, "stdin")
+		if err := mkfifo(stdin); err != nil {
+			return errors.Wrap(err, "failed to create pipe for popup")
+		}
+		go func() {
+			f, err := os.OpenFile(stdin, os.O_WRONLY, 0)
+			if err != nil {
+				return
+			}
+			defer f.Close()
+			io.Copy(f, p.Stdin)
+		}()
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return errors.Wrap(err, "failed to get working directory")
+	}
+
+	argv := popupArgv(p.Argv)
+	argv[0] = exe
+	script := popupScript(argv, stdin, dir)
+	switch terminal {
+	case popupTmux:
+		width, height := p.config.Popup.Width, p.config.Popup.Height
+		if width == "" {
+			width = defaultPopupSize
+		}
+		if height == "" {
+			height = defaultPopupSize
+		}
+		err = tmux.DisplayPopup(cwd, width, height, script)
+	case popupKitty:
+		// kitty overlays cover the whole window, whatever the size.
+		// launch returns right away, unless told to wait for peco
+		err = exec.Command(kittyProgram, "@", "launch", "--type=overlay", "--wait-for-child-to-exit", "--cwd="+cwd, "/bin/sh", "-c", script).Run()
+		err = errors.Wrap(err, "kitty @ launch failed")
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to open popup")
+	}
+
+	// The popup has closed. If peco did not get to write its exit
+	// status, the popup was closed from outside, which is a cancel
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "status"))
+	if err != nil {
+		err = makeIgnorable(errors.Wrap(errUserCanceled, "popup was closed"))
+		if p.onCancel == errorKey {
+			err = setExitStatus(err, 1)
+		}
+		return err
+	}
+	status, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return errors.Wrap(err, "failed to read exit status of popup")
+	}
+
+	for _, f := range []struct {
+		name string
+		w    io.Writer
+	}{{"stdout", p.Stdout}, {"stderr", p.Stderr}} {
+		if buf, err := ioutil.ReadFile(filepath.Join(dir, f.name)); err == nil {
+			f.w.Write(buf)
+		}
+	}
+	return setExitStatus(makeIgnorable(errors.New("peco ran in a popup")), status)
+}
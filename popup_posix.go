@@ -0,0 +1,10 @@
+// +build !windows
+
+package peco
+
+import "syscall"
+
+// mkfifo creates a named pipe at path
+func mkfifo(path string) error {
+	return syscall.Mkfifo(path, 0600)
+}
@@ -0,0 +1,100 @@
+package peco
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/peco/peco/internal/tmux"
+	"github.com/peco/peco/internal/util"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPopupArgv(t *testing.T) {
+	assert.Equal(t,
+		[]string{"peco", "--query", "foo", "--", "--popup"},
+		popupArgv([]string{"peco", "--popup", "--query", "foo", "--", "--popup"}),
+		"--popup should be removed, except after --",
+	)
+
+	env := map[string]string{}
+	getenv := func(k string) string { return env[k] }
+	assert.Equal(t, "", popupTerminal(getenv), "there is no popup outside tmux and kitty")
+	env["KITTY_WINDOW_ID"] = "1"
+	assert.Equal(t, popupKitty, popupTerminal(getenv))
+	env["TMUX"] = "/tmp/tmux-1000/default,1,0"
+	assert.Equal(t, popupTmux, popupTerminal(getenv), "tmux comes first, as it may run inside kitty")
+}
+
+func TestRunInPopup(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires /bin/sh")
+	}
+
+	dir, err := ioutil.TempDir("", "peco-test-")
+	if !assert.NoError(t, err, "ioutil.TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// tmux runs the command line of the popup as it is, and peco
+	// echoes its input, and lists its arguments on stderr
+	writeScript := func(name, body string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	oldTmux := tmux.Program
+	defer func() { tmux.Program = oldTmux }()
+	tmux.Program = writeScript("tmux", `echo "$@" > `+util.ShellQuote(filepath.Join(dir, "args"))+`; for a; do last=$a; done; /bin/sh -c "$last"`)
+	exe := writeScript("peco", `cat; echo "$@" >&2; exit 3`)
+
+	var stdout, stderr bytes.Buffer
+	state := newPeco()
+	state.Argv = []string{"peco", "--popup", "--query", "it's"}
+	state.args = []string{"peco"}
+	state.Stdin = strings.NewReader("foo\nbar\n")
+	state.Stdout = &stdout
+	state.Stderr = &stderr
+	state.config.Popup.Height = "20"
+
+	err = state.runInPopup(popupTmux, exe)
+	if !assert.True(t, util.IsIgnorableError(err), "peco should exit once the popup closes") {
+		return
+	}
+	status, ok := util.GetExitStatus(err)
+	assert.True(t, ok, "the exit status should be set")
+	assert.Equal(t, 3, status, "the exit status of the popup should be kept")
+	assert.Equal(t, "foo\nbar\n", stdout.String(), "the input should be passed through")
+	assert.Equal(t, "--query it's\n", stderr.String(), "the arguments should be passed on, without --popup")
+
+	args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	if !assert.NoError(t, err, "tmux should be run") {
+		return
+	}
+	assert.True(t, strings.HasPrefix(string(args), "display-popup -E -d "), "a popup should be displayed")
+	assert.Contains(t, string(args), " -w 80% -h 20 ", "the popup should be sized by the config")
+
+	// The popup is closed before peco exits
+	tmux.Program = writeScript("tmux", `exit 0`)
+	state = newPeco()
+	state.Argv = []string{"peco", "--popup"}
+	state.args = []string{"peco"}
+	state.Stdin = strings.NewReader("foo\n")
+	state.onCancel = errorKey
+	err = state.runInPopup(popupTmux, exe)
+	if !assert.True(t, util.IsIgnorableError(err), "peco should exit once the popup closes") {
+		return
+	}
+	assert.Equal(t, errUserCanceled, errors.Cause(err), "closing the popup should be a cancel")
+	status, ok = util.GetExitStatus(err)
+	assert.True(t, ok, "the exit status should be set")
+	assert.Equal(t, 1, status, "the exit status should follow --on-cancel")
+}
@@ -0,0 +1,9 @@
+package peco
+
+import "github.com/pkg/errors"
+
+// mkfifo fails, as there are no named pipes in the file system on
+// Windows. Neither can tmux nor kitty be remote controlled from it
+func mkfifo(path string) error {
+	return errors.New("--popup is not supported on Windows")
+}
@@ -1,5 +1,75 @@
 package peco
 
+import (
+	"context"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/peco/peco/internal/util"
+	"github.com/pkg/errors"
+)
+
+// queryTransformTimeout is how long the query transform command may
+// take. It is run every time the query changes, so a command that
+// hangs must not keep the query from being matched
+const queryTransformTimeout = time.Second
+
+// Apply rewrites the query `q` according to the configuration.
+// If neither Cmd nor Template is specified, `q` is returned as is
+func (qt QueryTransformConfig) Apply(ctx context.Context, q string) (string, error) {
+	if qt.Cmd != "" {
+		args := append([]string(nil), qt.Args...)
+		if len(args) == 0 {
+			args = []string{"$QUERY"}
+		}
+		for i, v := range args {
+			if v == "$QUERY" {
+				args[i] = q
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, queryTransformTimeout)
+		defer cancel()
+		out, err := exec.CommandContext(ctx, qt.Cmd, args...).Output()
+		if err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				return q, errors.Errorf("query transform command timed out after %s", queryTransformTimeout)
+			}
+			return q, errors.Wrap(err, "failed to execute query transform command")
+		}
+		q = strings.TrimRight(string(out), "\r\n")
+	}
+
+	if t := qt.Template; t != "" {
+		q = strings.Replace(t, "$QUERY", q, -1)
+	}
+	return q, nil
+}
+
+// truncateQuery cuts q short at --max-query-length characters. ok is
+// false if q was too long
+func (p *Peco) truncateQuery(q string) (string, bool) {
+	max := p.maxQueryLength
+	if max <= 0 || utf8.RuneCountInString(q) <= max {
+		return q, true
+	}
+	return string([]rune(q)[:max]), false
+}
+
+// queryCounter returns the length of the query, along with the limit
+// set by --max-query-length, as displayed in the prompt
+func queryCounter(state *Peco) string {
+	max := state.maxQueryLength
+	if max <= 0 {
+		return ""
+	}
+	return strconv.Itoa(state.Query().Len()) + "/" + strconv.Itoa(max)
+}
+
 func (q *Query) Set(s string) {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
@@ -87,6 +157,23 @@ func (q *Query) RuneAt(where int) rune {
 	return q.query[where]
 }
 
+// NextGraphemeBoundary returns the position after the user-perceived
+// character that starts at pos. Characters such as emoji sequences or
+// letters with combining marks may span multiple runes
+func (q *Query) NextGraphemeBoundary(pos int) int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return util.NextGraphemeBoundary(q.query, pos)
+}
+
+// PrevGraphemeBoundary returns the position of the user-perceived
+// character that precedes pos
+func (q *Query) PrevGraphemeBoundary(pos int) int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return util.PrevGraphemeBoundary(q.query, pos)
+}
+
 func (q *Query) InsertAt(ch rune, where int) {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
@@ -103,3 +190,154 @@ func (q *Query) InsertAt(ch rune, where int) {
 	copy(buf[where+1:], sq[where:])
 	q.query = buf
 }
+
+// TransposeChars swaps the user-perceived character before pos with
+// the one at pos, like readline's transpose-chars. At the end of the
+// query, the last two characters are swapped. It returns the new
+// position of the caret, which is after the swapped characters, and
+// false if there was nothing to swap
+func (q *Query) TransposeChars(pos int) (int, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	l := len(q.query)
+	if pos <= 0 || l < 2 {
+		return pos, false
+	}
+	if pos > l {
+		pos = l
+	}
+
+	// a is the character before b, which is the one at pos (or the
+	// last one, if pos is at the end)
+	bStart, bEnd := pos, util.NextGraphemeBoundary(q.query, pos)
+	if pos == l {
+		bStart, bEnd = util.PrevGraphemeBoundary(q.query, l), l
+	}
+	aStart := util.PrevGraphemeBoundary(q.query, bStart)
+	if aStart == bStart {
+		return pos, false
+	}
+
+	q.query = swapRunes(q.query, aStart, bStart, bStart, bEnd)
+	return bEnd, true
+}
+
+// TransposeWords swaps the word before pos with the word at or after
+// pos, like readline's transpose-words. At the end of the query, the
+// last two words are swapped. Words are separated by white space. It
+// returns the new position of the caret, which is after the swapped
+// words, and false if there was nothing to swap
+func (q *Query) TransposeWords(pos int) (int, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	r := q.query
+	l := len(r)
+	if pos > l {
+		pos = l
+	}
+
+	// Find the second word: the one that pos is in, or the next one
+	start2 := pos
+	for start2 > 0 && start2 < l && !unicode.IsSpace(r[start2-1]) && !unicode.IsSpace(r[start2]) {
+		start2--
+	}
+	for start2 < l && unicode.IsSpace(r[start2]) {
+		start2++
+	}
+	if start2 == l {
+		// No word after pos, so use the last one
+		for start2 > 0 && unicode.IsSpace(r[start2-1]) {
+			start2--
+		}
+		for start2 > 0 && !unicode.IsSpace(r[start2-1]) {
+			start2--
+		}
+	}
+	end2 := start2
+	for end2 < l && !unicode.IsSpace(r[end2]) {
+		end2++
+	}
+
+	// Find the first word, which is the one before the second word
+	end1 := start2
+	for end1 > 0 && unicode.IsSpace(r[end1-1]) {
+		end1--
+	}
+	start1 := end1
+	for start1 > 0 && !unicode.IsSpace(r[start1-1]) {
+		start1--
+	}
+	if start1 == end1 || start2 == end2 {
+		return pos, false
+	}
+
+	q.query = swapRunes(r, start1, end1, start2, end2)
+	return end2, true
+}
+
+// swapRunes returns a copy of r, with r[aStart:aEnd] and r[bStart:bEnd]
+// swapped. The first range must come before the second one
+func swapRunes(r []rune, aStart, aEnd, bStart, bEnd int) []rune {
+	buf := make([]rune, 0, len(r))
+	buf = append(buf, r[:aStart]...)
+	buf = append(buf, r[bStart:bEnd]...)
+	buf = append(buf, r[aEnd:bStart]...)
+	buf = append(buf, r[aStart:aEnd]...)
+	buf = append(buf, r[bEnd:]...)
+	return buf
+}
+
+// UpcaseWord converts the query from pos to the end of the current
+// or next word to upper case. It returns the new position of the
+// caret, which is at the end of the word, and false if there was no
+// word to convert
+func (q *Query) UpcaseWord(pos int) (int, bool) {
+	return q.changeWordCase(pos, func(_ int, r rune) rune {
+		return unicode.ToUpper(r)
+	})
+}
+
+// DowncaseWord is like UpcaseWord, but converts to lower case
+func (q *Query) DowncaseWord(pos int) (int, bool) {
+	return q.changeWordCase(pos, func(_ int, r rune) rune {
+		return unicode.ToLower(r)
+	})
+}
+
+// CapitalizeWord is like UpcaseWord, but only converts the first
+// letter to upper case, and the rest of the word to lower case
+func (q *Query) CapitalizeWord(pos int) (int, bool) {
+	return q.changeWordCase(pos, func(i int, r rune) rune {
+		if i == 0 {
+			return unicode.ToUpper(r)
+		}
+		return unicode.ToLower(r)
+	})
+}
+
+// changeWordCase applies fn to each rune from pos to the end of the
+// current or next word. fn is also given the index of the rune, not
+// counting white space before the word
+func (q *Query) changeWordCase(pos int, fn func(int, rune) rune) (int, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	l := len(q.query)
+	start := pos
+	for start < l && unicode.IsSpace(q.query[start]) {
+		start++
+	}
+	if start >= l {
+		return pos, false
+	}
+
+	buf := append([]rune(nil), q.query...)
+	end := start
+	for ; end < l && !unicode.IsSpace(buf[end]); end++ {
+		buf[end] = fn(end-start, buf[end])
+	}
+	q.query = buf
+	return end, true
+}
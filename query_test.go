@@ -0,0 +1,112 @@
+package peco
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/nsf/termbox-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryGraphemeBoundary(t *testing.T) {
+	// "e" + combining acute accent, a family emoji made of ZWJ sequences,
+	// a flag made of two regional indicators, and a thumbs up with a
+	// skin tone modifier
+	var q Query
+	q.Set("ae\u0301\U0001F468\u200d\U0001F469\u200d\U0001F467\U0001F1EF\U0001F1F5\U0001F44D\U0001F3FDz")
+
+	boundaries := []int{0, 1, 3, 8, 10, 12, 13}
+	for i := 0; i < len(boundaries)-1; i++ {
+		if !assert.Equal(t, boundaries[i+1], q.NextGraphemeBoundary(boundaries[i]), "next boundary from %d", boundaries[i]) {
+			return
+		}
+		if !assert.Equal(t, boundaries[i], q.PrevGraphemeBoundary(boundaries[i+1]), "previous boundary from %d", boundaries[i+1]) {
+			return
+		}
+	}
+
+	// Deleting backwards from the end of the family emoji removes
+	// the whole sequence
+	q.DeleteRange(q.PrevGraphemeBoundary(8), 8)
+	if !assert.Equal(t, "ae\u0301\U0001F1EF\U0001F1F5\U0001F44D\U0001F3FDz", q.String(), "the whole cluster should be deleted") {
+		return
+	}
+}
+
+func TestQueryEditing(t *testing.T) {
+	type edit func(*Query, int) (int, bool)
+	tests := []struct {
+		name     string
+		edit     edit
+		query    string
+		pos      int
+		expected string
+		caret    int
+		changed  bool
+	}{
+		{"TransposeChars", (*Query).TransposeChars, "abcd", 2, "acbd", 3, true},
+		{"TransposeChars at end", (*Query).TransposeChars, "abcd", 4, "abdc", 4, true},
+		{"TransposeChars at beginning", (*Query).TransposeChars, "abcd", 0, "abcd", 0, false},
+		{"TransposeChars with clusters", (*Query).TransposeChars, "ae\u0301z", 1, "e\u0301az", 3, true},
+		{"TransposeWords", (*Query).TransposeWords, "foo bar baz", 4, "bar foo baz", 7, true},
+		{"TransposeWords in word", (*Query).TransposeWords, "foo bar baz", 5, "bar foo baz", 7, true},
+		{"TransposeWords in space", (*Query).TransposeWords, "foo  bar", 4, "bar  foo", 8, true},
+		{"TransposeWords at end", (*Query).TransposeWords, "foo bar baz ", 12, "foo baz bar ", 11, true},
+		{"TransposeWords with one word", (*Query).TransposeWords, "foo", 3, "foo", 3, false},
+		{"UpcaseWord", (*Query).UpcaseWord, "foo bar", 0, "FOO bar", 3, true},
+		{"UpcaseWord in word", (*Query).UpcaseWord, "foo bar", 1, "fOO bar", 3, true},
+		{"UpcaseWord before word", (*Query).UpcaseWord, "foo bar", 3, "foo BAR", 7, true},
+		{"UpcaseWord at end", (*Query).UpcaseWord, "foo ", 4, "foo ", 4, false},
+		{"DowncaseWord", (*Query).DowncaseWord, "FOO BAR", 4, "FOO bar", 7, true},
+		{"CapitalizeWord", (*Query).CapitalizeWord, "fOO bAR", 0, "Foo bAR", 3, true},
+		{"CapitalizeWord before word", (*Query).CapitalizeWord, "fOO bAR", 3, "fOO Bar", 7, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var q Query
+			q.Set(test.query)
+			caret, changed := test.edit(&q, test.pos)
+			assert.Equal(t, test.expected, q.String(), "query should be edited")
+			assert.Equal(t, test.caret, caret, "caret should be moved")
+			assert.Equal(t, test.changed, changed, "whether the query was changed")
+		})
+	}
+}
+
+func TestMaxQueryLength(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	state := newPeco()
+	state.Argv = []string{"--max-query-length", "3", "--query", "abcdef"}
+	state.Stdin = bytes.NewBufferString("abc\nxyz\n")
+	go state.Run(ctx)
+	<-state.Ready()
+	<-state.source.SetupDone()
+
+	if !assert.Equal(t, "abc", state.Query().String(), "the initial query should be cut short") {
+		return
+	}
+
+	state.Query().Set("ab")
+	state.Caret().SetPos(2)
+	for _, ch := range "cd" {
+		doAcceptChar(ctx, state, termbox.Event{Ch: ch})
+	}
+	if !assert.Equal(t, "abc", state.Query().String(), "characters past the limit should be rejected") {
+		return
+	}
+	if !assert.Equal(t, "3/3", queryCounter(state), "the counter should show the length and the limit") {
+		return
+	}
+
+	q, ok := state.truncateQuery("日本語です")
+	if !assert.False(t, ok, "long queries should be reported") {
+		return
+	}
+	if !assert.Equal(t, "日本語", q, "queries should be cut at characters, not bytes") {
+		return
+	}
+}
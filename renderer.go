@@ -0,0 +1,259 @@
+package peco
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mattn/go-runewidth"
+	"github.com/peco/peco/line"
+	"github.com/pkg/errors"
+)
+
+// Names of the line renderers that can be specified in the config file
+const (
+	DefaultLineRendererName     = "Default"
+	ShortenPathLineRendererName = "ShortenPath"
+)
+
+// newLineRenderer creates the LineRenderer with the given name
+func newLineRenderer(name string) (LineRenderer, error) {
+	switch name {
+	case "", DefaultLineRendererName:
+		return DefaultLineRenderer{}, nil
+	case ShortenPathLineRendererName:
+		home, err := homedirFunc()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to find home directory")
+		}
+		return NewShortenPathLineRenderer(home), nil
+	}
+	return nil, errors.Errorf("unknown line renderer '%s'", name)
+}
+
+// RenderLine returns s and matches unchanged
+func (DefaultLineRenderer) RenderLine(_ line.Line, s string, matches [][]int) (string, [][]int) {
+	return s, matches
+}
+
+// NewShortenPathLineRenderer creates a ShortenPathLineRenderer that
+// replaces home with "~"
+func NewShortenPathLineRenderer(home string) *ShortenPathLineRenderer {
+	return &ShortenPathLineRenderer{home: strings.TrimSuffix(home, "/")}
+}
+
+// RenderLine replaces the home directory with "~" wherever it appears
+// at the beginning of a word, and is followed by a "/" or the end of
+// the word
+func (r *ShortenPathLineRenderer) RenderLine(_ line.Line, s string, matches [][]int) (string, [][]int) {
+	if r.home == "" {
+		return s, matches
+	}
+
+	var buf strings.Builder
+	// replaced holds the start offsets in s of the occurrences
+	// of home that were replaced
+	var replaced []int
+	for i := 0; i < len(s); {
+		if r.isHomeAt(s, i) {
+			replaced = append(replaced, i)
+			buf.WriteByte('~')
+			i += len(r.home)
+			continue
+		}
+		buf.WriteByte(s[i])
+		i++
+	}
+
+	if len(replaced) == 0 {
+		return s, matches
+	}
+
+	// translate an offset in s to an offset in the rendered string.
+	// Matches that overlap with a replaced home directory are
+	// stretched to cover the "~" that replaced it
+	translate := func(off int, end bool) int {
+		shift := 0
+		for _, start := range replaced {
+			switch {
+			case off <= start:
+				return off - shift
+			case off < start+len(r.home):
+				if end {
+					return start - shift + 1
+				}
+				return start - shift
+			}
+			shift += len(r.home) - 1
+		}
+		return off - shift
+	}
+
+	rendered := make([][]int, len(matches))
+	for i, m := range matches {
+		rendered[i] = []int{translate(m[0], false), translate(m[1], true)}
+	}
+	return buf.String(), rendered
+}
+
+// strippedPrefixMarker replaces the prefix hidden by a
+// StripPrefixLineRenderer
+const strippedPrefixMarker = "…"
+
+// NewStripPrefixLineRenderer creates a StripPrefixLineRenderer that
+// hides the prefix returned by prefix, and renders the rest with next
+func NewStripPrefixLineRenderer(prefix func() string, next LineRenderer) *StripPrefixLineRenderer {
+	return &StripPrefixLineRenderer{prefix: prefix, next: next}
+}
+
+// RenderLine replaces the prefix with strippedPrefixMarker. Matches
+// within the prefix are moved onto the marker
+func (r *StripPrefixLineRenderer) RenderLine(l line.Line, s string, matches [][]int) (string, [][]int) {
+	prefix := r.prefix()
+	if prefix == "" || !strings.HasPrefix(s, prefix) {
+		return r.next.RenderLine(l, s, matches)
+	}
+
+	translate := func(off int, end bool) int {
+		switch {
+		case off >= len(prefix):
+			return off - len(prefix) + len(strippedPrefixMarker)
+		case end && off > 0:
+			return len(strippedPrefixMarker)
+		}
+		return 0
+	}
+
+	stripped := make([][]int, len(matches))
+	for i, m := range matches {
+		stripped[i] = []int{translate(m[0], false), translate(m[1], true)}
+	}
+	return r.next.RenderLine(l, strippedPrefixMarker+s[len(prefix):], stripped)
+}
+
+func (r *ShortenPathLineRenderer) isHomeAt(s string, i int) bool {
+	if !strings.HasPrefix(s[i:], r.home) {
+		return false
+	}
+	if i > 0 && !isPathBoundary(s[i-1]) {
+		return false
+	}
+	if end := i + len(r.home); end < len(s) && s[end] != '/' && !isPathBoundary(s[end]) {
+		return false
+	}
+	return true
+}
+
+func isPathBoundary(c byte) bool {
+	switch c {
+	case ' ', '\t', ':', '=', '"', '\'':
+		return true
+	}
+	return false
+}
+
+// renderedLine wraps a line.Line so that it is displayed using
+// the string returned by a LineRenderer
+type renderedLine struct {
+	line.Line
+	display string
+}
+
+// renderedMatchedLine is a renderedLine whose match indices have
+// been translated by a LineRenderer
+type renderedMatchedLine struct {
+	renderedLine
+	indices [][]int
+}
+
+func (l renderedLine) DisplayString() string {
+	return l.display
+}
+
+func (l renderedMatchedLine) Indices() [][]int {
+	return l.indices
+}
+
+func (l renderedMatchedLine) Term(n int) int {
+	return matchTerm(l.Line, n)
+}
+
+// renderLine applies r to target. The returned line, when drawn,
+// shows the rendered string with the match highlights moved along
+func renderLine(r LineRenderer, target line.Line) line.Line {
+	ix, ok := target.(MatchIndexer)
+	if !ok {
+		display, _ := r.RenderLine(target, target.DisplayString(), nil)
+		return renderedLine{Line: target, display: display}
+	}
+
+	display, indices := r.RenderLine(target, target.DisplayString(), ix.Indices())
+	return renderedMatchedLine{
+		renderedLine: renderedLine{Line: target, display: display},
+		indices:      indices,
+	}
+}
+
+// truncationMarker is drawn at the end of lines that were cut short
+// because of --max-line-width
+const truncationMarker = "…"
+
+// truncateLine cuts the displayed string of target short, so that it
+// fits in max columns along with truncationMarker. start is the column
+// at which the line is drawn, which decides the width of tabs. It
+// returns the truncated line and the width of its displayed string,
+// or target as it is and false if it fits. Matching and output are
+// not affected, as only the displayed string changes
+func truncateLine(target line.Line, max, start int) (line.Line, int, bool) {
+	limit := max - runewidth.StringWidth(truncationMarker)
+	if limit < 0 {
+		limit = 0
+	}
+
+	// Widths are computed the same way as screenPrint draws the line
+	s := target.DisplayString()
+	var w, cut, cutWidth int
+	for i := 0; i < len(s); {
+		c, n := utf8.DecodeRuneInString(s[i:])
+		var cw int
+		if seq := escapeSequence(c, s[i:i+n]); seq != "" {
+			cw = len(seq)
+		} else if c == '\t' {
+			cw = 4 - (start+w)%4
+		} else {
+			cw = runewidth.RuneWidth(c)
+		}
+
+		if w+cw > max {
+			return truncatedLine(target, cut), cutWidth, true
+		}
+
+		w += cw
+		i += n
+		if w <= limit {
+			cut = i
+			cutWidth = w
+		}
+	}
+	return target, w, false
+}
+
+// truncatedLine returns target, displayed only up to the byte offset
+// cut of its displayed string. Matches after the cut become empty
+// ranges
+func truncatedLine(target line.Line, cut int) line.Line {
+	display := target.DisplayString()[:cut]
+	ix, ok := target.(MatchIndexer)
+	if !ok {
+		return renderedLine{Line: target, display: display}
+	}
+
+	matches := ix.Indices()
+	indices := make([][]int, len(matches))
+	for i, m := range matches {
+		indices[i] = []int{minOf(m[0], cut), minOf(m[1], cut)}
+	}
+	return renderedMatchedLine{
+		renderedLine: renderedLine{Line: target, display: display},
+		indices:      indices,
+	}
+}
@@ -0,0 +1,153 @@
+package peco
+
+import (
+	"testing"
+
+	"github.com/peco/peco/line"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShortenPathLineRenderer(t *testing.T) {
+	r := NewShortenPathLineRenderer("/home/peco")
+
+	tests := []struct {
+		name    string
+		input   string
+		matches [][]int
+		display string
+		expect  [][]int
+	}{
+		{
+			name:    "no home directory",
+			input:   "/usr/share/peco",
+			matches: [][]int{{11, 15}},
+			display: "/usr/share/peco",
+			expect:  [][]int{{11, 15}},
+		},
+		{
+			name:    "home directory at the beginning",
+			input:   "/home/peco/src/main.go",
+			matches: [][]int{{15, 19}},
+			display: "~/src/main.go",
+			expect:  [][]int{{6, 10}},
+		},
+		{
+			name:    "match within the home directory",
+			input:   "/home/peco/src",
+			matches: [][]int{{6, 12}},
+			display: "~/src",
+			expect:  [][]int{{0, 3}},
+		},
+		{
+			name:    "multiple occurrences",
+			input:   "cp /home/peco/a /home/peco",
+			matches: [][]int{{0, 2}, {14, 15}},
+			display: "cp ~/a ~",
+			expect:  [][]int{{0, 2}, {5, 6}},
+		},
+		{
+			name:    "not a path boundary",
+			input:   "/home/pecorino/a",
+			display: "/home/pecorino/a",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			display, matches := r.RenderLine(line.NewRaw(0, test.input, false), test.input, test.matches)
+			if !assert.Equal(t, test.display, display, "display string should match") {
+				return
+			}
+			if !assert.Equal(t, test.expect, matches, "match indices should be translated") {
+				return
+			}
+		})
+	}
+}
+
+func TestTruncateLine(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		matches   [][]int
+		max       int
+		display   string
+		width     int
+		truncated bool
+		expect    [][]int
+	}{
+		{
+			name:    "short line",
+			input:   "peco",
+			max:     4,
+			display: "peco",
+			width:   4,
+		},
+		{
+			name:      "long line",
+			input:     "hello, world",
+			matches:   [][]int{{0, 5}, {7, 12}},
+			max:       6,
+			display:   "hello",
+			width:     5,
+			truncated: true,
+			expect:    [][]int{{0, 5}, {5, 5}},
+		},
+		{
+			name:      "wide characters",
+			input:     "日本語です",
+			matches:   [][]int{{3, 9}},
+			max:       6,
+			display:   "日本",
+			width:     4,
+			truncated: true,
+			expect:    [][]int{{3, 6}},
+		},
+		{
+			name:      "escaped characters",
+			input:     "a\x01bcdef",
+			max:       6,
+			display:   "a\x01",
+			width:     5,
+			truncated: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var l line.Line = line.NewRaw(0, test.input, false)
+			if test.matches != nil {
+				l = line.NewMatched(l, test.matches)
+			}
+
+			truncated, width, ok := truncateLine(l, test.max, 0)
+			if !assert.Equal(t, test.truncated, ok, "line should be truncated if it does not fit") {
+				return
+			}
+			assert.Equal(t, test.display, truncated.DisplayString(), "display string should match")
+			assert.Equal(t, test.width, width, "width should match")
+			assert.Equal(t, test.input, truncated.Output(), "output should not be truncated")
+			if test.expect != nil {
+				assert.Equal(t, test.expect, truncated.(MatchIndexer).Indices(), "match indices should be clipped")
+			}
+		})
+	}
+}
+
+func TestStripPrefixLineRenderer(t *testing.T) {
+	prefix := "/src/peco/"
+	r := NewStripPrefixLineRenderer(func() string { return prefix }, DefaultLineRenderer{})
+	l := line.NewRaw(0, "/src/peco/layout.go", false)
+
+	// "peco" is within the prefix, "go" is after it
+	display, matches := r.RenderLine(l, l.DisplayString(), [][]int{{5, 9}, {17, 19}})
+	assert.Equal(t, "…layout.go", display, "prefix should be replaced with the marker")
+	assert.Equal(t, [][]int{{0, len("…")}, {len("…") + 7, len("…") + 9}}, matches, "matches should be moved along")
+
+	display, _ = r.RenderLine(l, "/other/file", nil)
+	assert.Equal(t, "/other/file", display, "lines without the prefix should be displayed as is")
+
+	prefix = ""
+	display, _ = r.RenderLine(l, l.DisplayString(), nil)
+	assert.Equal(t, "/src/peco/layout.go", display, "nothing should be hidden without a prefix")
+}
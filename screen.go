@@ -2,6 +2,8 @@ package peco
 
 import (
 	"context"
+	"fmt"
+	"unicode"
 	"unicode/utf8"
 
 	pdebug "github.com/lestrrat-go/pdebug"
@@ -11,9 +13,19 @@ import (
 )
 
 func (t *Termbox) Init(cfg *Config) error {
+	// termbox reads key strokes from /dev/tty, even when the input
+	// is piped. Check that it can be opened, so that we can explain
+	// what went wrong if it can't
+	if err := checkTTY(); err != nil {
+		return err
+	}
+
 	if err := termbox.Init(); err != nil {
 		return errors.Wrap(err, "failed to initialized termbox")
 	}
+	t.mutex.Lock()
+	t.initialized = true
+	t.mutex.Unlock()
 
 	return t.PostInit(cfg)
 }
@@ -29,6 +41,16 @@ func (t *Termbox) Close() error {
 	if pdebug.Enabled {
 		pdebug.Printf("Termbox: Close")
 	}
+
+	// termbox.Interrupt blocks forever if termbox was never
+	// initialized, e.g. because there is no terminal
+	t.mutex.Lock()
+	initialized := t.initialized
+	t.mutex.Unlock()
+	if !initialized {
+		return nil
+	}
+
 	termbox.Interrupt()
 	termbox.Close()
 	return nil
@@ -89,7 +111,11 @@ func (t *Termbox) PollEvent(ctx context.Context, cfg *Config) chan termbox.Event
 		for {
 			ev := termbox.PollEvent()
 			if ev.Type != termbox.EventInterrupt {
-				evCh <- ev
+				select {
+				case <-ctx.Done():
+					return
+				case evCh <- ev:
+				}
 				continue
 			}
 
@@ -130,6 +156,7 @@ func (t *Termbox) Resume() {
 func (t *Termbox) SetCell(x, y int, ch rune, fg, bg termbox.Attribute) {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
+	fg, bg = degradeColors(t.colors, fg, bg)
 	termbox.SetCell(x, y, ch, fg, bg)
 }
 
@@ -148,12 +175,61 @@ type PrintArgs struct {
 	Bg      termbox.Attribute
 	Msg     string
 	Fill    bool
+
+	// Escape, if non-nil, is the style used to draw non-printable
+	// bytes in Msg, which are rendered as escape sequences such as
+	// \x00. If nil, Fg and Bg are used
+	Escape *Style
 }
 
 func (t *Termbox) Print(args PrintArgs) int {
 	return screenPrint(t, args)
 }
 
+// PrintOnScreen prints args.Msg on t, cell by cell. It is exported so
+// that Screen implementations outside of this package can implement
+// Print the same way peco does
+func PrintOnScreen(t Screen, args PrintArgs) int {
+	return screenPrint(t, args)
+}
+
+// escapeSequence returns the printable representation of the
+// rune c, which was decoded from buf, if it is not safe to be
+// sent to the terminal as is. An empty string is returned for
+// printable runes
+func escapeSequence(c rune, buf string) string {
+	switch {
+	case c == utf8.RuneError && len(buf) == 1:
+		// invalid UTF-8 sequence
+		return fmt.Sprintf(`\x%02x`, buf[0])
+	case c == '\t':
+		return ""
+	case c < 0x80 && unicode.IsControl(c):
+		return fmt.Sprintf(`\x%02x`, c)
+	case unicode.IsControl(c):
+		return fmt.Sprintf(`\u%04x`, c)
+	}
+	return ""
+}
+
+// displayWidth returns the number of cells that screenPrint uses to
+// draw s, starting at column start
+func displayWidth(s string, start int) int {
+	var w int
+	for i := 0; i < len(s); {
+		c, n := utf8.DecodeRuneInString(s[i:])
+		if seq := escapeSequence(c, s[i:i+n]); seq != "" {
+			w += len(seq)
+		} else if c == '\t' {
+			w += 4 - (start+w)%4
+		} else {
+			w += runewidth.RuneWidth(c)
+		}
+		i += n
+	}
+	return w
+}
+
 func screenPrint(t Screen, args PrintArgs) int {
 	var written int
 
@@ -163,24 +239,49 @@ func screenPrint(t Screen, args PrintArgs) int {
 	x := args.X
 	y := args.Y
 	xOffset := args.XOffset
+	width, _ := t.Size()
 	for len(msg) > 0 {
 		c, w := utf8.DecodeRuneInString(msg)
-		if c == utf8.RuneError {
-			c = '?'
-			w = 1
+		if seq := escapeSequence(c, msg[:w]); seq != "" {
+			efg, ebg := fg, bg
+			if args.Escape != nil {
+				efg = args.Escape.fg
+				ebg = mergeAttribute(bg, args.Escape.bg)
+			}
+			for _, ec := range seq {
+				t.SetCell(x, y, ec, efg, ebg)
+				x++
+			}
+			written += len(seq)
+			msg = msg[w:]
+			continue
 		}
 		msg = msg[w:]
 		if c == '\t' {
 			// In case we found a tab, we draw it as 4 spaces
 			n := 4 - (x+xOffset)%4
-			for i := int(0); i <= n; i++ {
-				t.SetCell(int(x+i), int(y), ' ', fg, bg)
+			for i := 0; i < n; i++ {
+				t.SetCell(x+i, y, ' ', fg, bg)
 			}
 			written += n
 			x += n
 		} else {
-			t.SetCell(int(x), int(y), c, fg, bg)
-			n := int(runewidth.RuneWidth(c))
+			n := runewidth.RuneWidth(c)
+			switch {
+			case n == 0:
+				// Combining characters cannot be drawn in a cell of
+				// their own, and would replace the rune they belong
+				// to, so they are left out
+			case x < 0 && x+n > 0, x < width && x+n > width:
+				// Only a part of a wide rune is on the screen, which
+				// happens when scrolled horizontally. Terminals cannot
+				// draw that, so the visible cells are left blank
+				for i := 0; i < n; i++ {
+					t.SetCell(x+i, y, ' ', fg, bg)
+				}
+			default:
+				t.SetCell(x, y, c, fg, bg)
+			}
 			x += n
 			written += n
 		}
@@ -190,7 +291,6 @@ func screenPrint(t Screen, args PrintArgs) int {
 		return written
 	}
 
-	width, _ := t.Size()
 	for ; x < int(width); x++ {
 		t.SetCell(int(x), int(y), ' ', fg, bg)
 	}
@@ -0,0 +1,133 @@
+package peco
+
+import (
+	"github.com/mattn/go-runewidth"
+	"github.com/nsf/termbox-go"
+	"github.com/pkg/errors"
+)
+
+// NewDiffScreen creates a new DiffScreen that draws onto s
+func NewDiffScreen(s Screen) *DiffScreen {
+	return &DiffScreen{Screen: s}
+}
+
+func (s *DiffScreen) Init(cfg *Config) error {
+	if err := s.Screen.Init(cfg); err != nil {
+		return err
+	}
+	s.Invalidate()
+	return nil
+}
+
+// Resume resumes the underlying screen. The terminal may have been
+// modified while peco was suspended, so the next frame is drawn in
+// full
+func (s *DiffScreen) Resume() {
+	s.Screen.Resume()
+	s.Invalidate()
+}
+
+// SetTitle sets the title of the terminal, if the underlying screen
+// can
+func (s *DiffScreen) SetTitle(title string) error {
+	if ts, ok := s.Screen.(titledScreen); ok {
+		return ts.SetTitle(title)
+	}
+	return nil
+}
+
+// RestoreTitle restores the title of the terminal, if the underlying
+// screen can
+func (s *DiffScreen) RestoreTitle() error {
+	if ts, ok := s.Screen.(titledScreen); ok {
+		return ts.RestoreTitle()
+	}
+	return nil
+}
+
+// Invalidate forgets what has been flushed to the underlying screen,
+// so that the next call to Flush draws every cell
+func (s *DiffScreen) Invalidate() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.front = nil
+}
+
+// Size returns the size of the underlying screen. If it has changed
+// since the last call, the next frame is drawn in full
+func (s *DiffScreen) Size() (int, int) {
+	w, h := s.Screen.Size()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.resize(w, h)
+	return w, h
+}
+
+// resize must be called while holding the lock
+func (s *DiffScreen) resize(w, h int) {
+	if w == s.width && h == s.height && s.back != nil {
+		return
+	}
+	s.width, s.height = w, h
+	s.back = make([]Cell, w*h)
+	for i := range s.back {
+		s.back[i].Ch = ' '
+	}
+	s.front = nil
+}
+
+func (s *DiffScreen) contains(x, y int) bool {
+	return x >= 0 && x < s.width && y >= 0 && y < s.height
+}
+
+// SetCell records the contents of the cell. It is only sent to the
+// underlying screen on Flush, if it has changed
+func (s *DiffScreen) SetCell(x, y int, ch rune, fg, bg termbox.Attribute) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.back == nil || !s.contains(x, y) {
+		// We don't know the size of the screen (yet), so we can't
+		// keep track of this cell
+		s.Screen.SetCell(x, y, ch, fg, bg)
+		return
+	}
+	s.back[y*s.width+x] = Cell{Ch: ch, Fg: fg, Bg: bg}
+
+	// Remember that a wide character covers the cell to its right,
+	// so that the cell is redrawn once the wide character is gone
+	if runewidth.RuneWidth(ch) > 1 && s.contains(x+1, y) {
+		s.back[y*s.width+x+1] = Cell{Fg: fg, Bg: bg, wide: true}
+	}
+}
+
+func (s *DiffScreen) Print(args PrintArgs) int {
+	return screenPrint(s, args)
+}
+
+// Flush sends the cells that have changed since the last call to the
+// underlying screen, and flushes it
+func (s *DiffScreen) Flush() error {
+	s.mutex.Lock()
+	if s.back != nil {
+		full := s.front == nil
+		if full {
+			s.front = make([]Cell, len(s.back))
+		}
+		for i, c := range s.back {
+			if !full && c == s.front[i] {
+				continue
+			}
+			s.front[i] = c
+			if c.wide {
+				// Drawn by the wide character to its left
+				continue
+			}
+			s.Screen.SetCell(i%s.width, i/s.width, c.Ch, c.Fg, c.Bg)
+		}
+	}
+	s.mutex.Unlock()
+
+	return errors.Wrap(s.Screen.Flush(), "failed to flush screen")
+}
@@ -0,0 +1,266 @@
+package peco
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/mattn/go-runewidth"
+	"github.com/nsf/termbox-go"
+)
+
+// NewMemoryScreen creates a new MemoryScreen of the given size
+func NewMemoryScreen(width, height int) *MemoryScreen {
+	return &MemoryScreen{
+		width:  width,
+		height: height,
+		cells:  make([]Cell, width*height),
+		events: make(chan termbox.Event),
+	}
+}
+
+func (s *MemoryScreen) Init(*Config) error {
+	return nil
+}
+
+func (s *MemoryScreen) Close() error {
+	return nil
+}
+
+// SetTitle records title as the title of the screen, which can be
+// retrieved via Title
+func (s *MemoryScreen) SetTitle(title string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.titles = append(s.titles, title)
+	return nil
+}
+
+// RestoreTitle restores the title that was set before the last call
+// to SetTitle
+func (s *MemoryScreen) RestoreTitle() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if n := len(s.titles); n > 0 {
+		s.titles = s.titles[:n-1]
+	}
+	return nil
+}
+
+// Title returns the title of the screen, or "" if none has been set
+func (s *MemoryScreen) Title() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if n := len(s.titles); n > 0 {
+		return s.titles[n-1]
+	}
+	return ""
+}
+
+// Flush records the number of times the screen has been flushed,
+// which can be retrieved via Flushes
+func (s *MemoryScreen) Flush() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.flushes++
+	return nil
+}
+
+// Flushes returns the number of times the screen has been flushed
+func (s *MemoryScreen) Flushes() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.flushes
+}
+
+func (s *MemoryScreen) PollEvent(context.Context, *Config) chan termbox.Event {
+	return s.events
+}
+
+func (s *MemoryScreen) Print(args PrintArgs) int {
+	return screenPrint(s, args)
+}
+
+func (s *MemoryScreen) Resume() {}
+
+func (s *MemoryScreen) Suspend() {}
+
+// SetCell sets the contents of a cell. Cells outside of the screen
+// are silently ignored
+func (s *MemoryScreen) SetCell(x, y int, ch rune, fg, bg termbox.Attribute) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.contains(x, y) {
+		return
+	}
+	s.cells[y*s.width+x] = Cell{Ch: ch, Fg: fg, Bg: bg}
+
+	// Like a terminal, a wide character covers the cell to its right
+	if runewidth.RuneWidth(ch) > 1 && s.contains(x+1, y) {
+		s.cells[y*s.width+x+1] = Cell{Fg: fg, Bg: bg, wide: true}
+	}
+}
+
+func (s *MemoryScreen) SetCursor(x, y int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cursorX, s.cursorY = x, y
+}
+
+// Cursor returns the last position the cursor was set to
+func (s *MemoryScreen) Cursor() (int, int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.cursorX, s.cursorY
+}
+
+func (s *MemoryScreen) Size() (int, int) {
+	return s.width, s.height
+}
+
+// SendEvent delivers an event to whoever is reading from the channel
+// returned by PollEvent. It blocks until the event is received
+func (s *MemoryScreen) SendEvent(ev termbox.Event) {
+	s.events <- ev
+}
+
+func (s *MemoryScreen) contains(x, y int) bool {
+	return x >= 0 && x < s.width && y >= 0 && y < s.height
+}
+
+// Cell returns the cell at the given position
+func (s *MemoryScreen) Cell(x, y int) Cell {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.contains(x, y) {
+		return Cell{}
+	}
+	return s.cells[y*s.width+x]
+}
+
+// Line returns the text on row y, with trailing spaces removed
+func (s *MemoryScreen) Line(y int) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.line(y)
+}
+
+func (s *MemoryScreen) row(y int) []Cell {
+	return s.cells[y*s.width : (y+1)*s.width]
+}
+
+func (s *MemoryScreen) line(y int) string {
+	if y < 0 || y >= s.height {
+		return ""
+	}
+
+	var buf strings.Builder
+	for _, c := range s.row(y) {
+		switch {
+		case c.wide:
+		case c.Ch == 0:
+			buf.WriteByte(' ')
+		default:
+			buf.WriteRune(c.Ch)
+		}
+	}
+	return strings.TrimRight(buf.String(), " ")
+}
+
+// String returns the text on the screen, one line per row, without
+// any styles
+func (s *MemoryScreen) String() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var buf strings.Builder
+	for y := 0; y < s.height; y++ {
+		buf.WriteString(s.line(y))
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+// ANSI returns the contents of the screen, one line per row, with
+// the styles of each cell rendered as ANSI escape sequences
+func (s *MemoryScreen) ANSI() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var buf bytes.Buffer
+	for y := 0; y < s.height; y++ {
+		row := s.row(y)
+
+		// Trailing cells that are blank and unstyled are not rendered
+		end := len(row)
+		for ; end > 0; end-- {
+			c := row[end-1]
+			if (c.Ch != 0 && c.Ch != ' ') || c.Fg != termbox.ColorDefault || c.Bg != termbox.ColorDefault {
+				break
+			}
+		}
+
+		var fg, bg termbox.Attribute
+		for _, c := range row[:end] {
+			if c.wide {
+				continue
+			}
+			if c.Fg != fg || c.Bg != bg {
+				writeSGR(&buf, c.Fg, c.Bg)
+				fg, bg = c.Fg, c.Bg
+			}
+			if c.Ch == 0 {
+				buf.WriteByte(' ')
+			} else {
+				buf.WriteRune(c.Ch)
+			}
+		}
+		if fg != termbox.ColorDefault || bg != termbox.ColorDefault {
+			buf.WriteString("\x1b[0m")
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+var sgrAttributes = []struct {
+	attr termbox.Attribute
+	code string
+}{
+	{termbox.AttrBold, "1"},
+	{termbox.AttrDim, "2"},
+	{termbox.AttrCursive, "3"},
+	{termbox.AttrUnderline, "4"},
+	{termbox.AttrBlink, "5"},
+	{termbox.AttrReverse, "7"},
+	{termbox.AttrHidden, "8"},
+}
+
+// writeSGR writes the escape sequence that resets the current style,
+// and switches to the given one
+func writeSGR(buf *bytes.Buffer, fg, bg termbox.Attribute) {
+	codes := []string{"0"}
+	for _, a := range sgrAttributes {
+		if fg&a.attr != 0 {
+			codes = append(codes, a.code)
+		}
+	}
+
+	// termbox colors are offset by one, as 0 is the default color
+	const colorMask = 0x1ff
+	if c := int(fg & colorMask); c > 0 && c <= 8 {
+		codes = append(codes, strconv.Itoa(30+c-1))
+	} else if c > 8 {
+		codes = append(codes, "38;5;"+strconv.Itoa(c-1))
+	}
+	if c := int(bg & colorMask); c > 0 && c <= 8 {
+		codes = append(codes, strconv.Itoa(40+c-1))
+	} else if c > 8 {
+		codes = append(codes, "48;5;"+strconv.Itoa(c-1))
+	}
+
+	buf.WriteString("\x1b[" + strings.Join(codes, ";") + "m")
+}
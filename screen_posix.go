@@ -2,12 +2,53 @@
 
 package peco
 
-import "github.com/nsf/termbox-go"
+import (
+	"os"
+
+	"github.com/nsf/termbox-go"
+	"github.com/pkg/errors"
+)
+
+// checkTTY makes sure that the controlling terminal can be opened
+func checkTTY() error {
+	f, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return errors.Wrap(err, "failed to open /dev/tty. peco needs a terminal to read key strokes from, even when its input is piped (if you are using ssh, try ssh -t). Use --no-tty to print the lines matching --query without user interaction")
+	}
+	return f.Close()
+}
+
+// writeTTY writes s to the terminal. termbox has no way to send the
+// escape sequences that it does not use itself
+func writeTTY(s string) error {
+	f, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0)
+	if err != nil {
+		return errors.Wrap(err, "failed to open /dev/tty")
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(s); err != nil {
+		return errors.Wrap(err, "failed to write to /dev/tty")
+	}
+	return nil
+}
+
+// SetTitle saves the title of the terminal on its title stack, and
+// replaces it with title
+func (t *Termbox) SetTitle(title string) error {
+	return writeTTY(pushTitleSequence + titleSequence(title))
+}
+
+// RestoreTitle restores the title saved by SetTitle
+func (t *Termbox) RestoreTitle() error {
+	return writeTTY(popTitleSequence)
+}
 
 func (t *Termbox) PostInit(cfg *Config) error {
 	// This has no effect on Windows,
 	// because termbox.SetOutputMode always sets termbox.OutputNormal on Windows.
-	if cfg.Use256Color {
+	t.colors = detectColors(cfg.Colors, cfg.Use256Color, os.Getenv)
+	if t.colors == colors256 {
 		termbox.SetOutputMode(termbox.Output256)
 	}
 
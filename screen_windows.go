@@ -1,10 +1,32 @@
 package peco
 
-import "github.com/nsf/termbox-go"
+import (
+	"os"
+
+	"github.com/nsf/termbox-go"
+)
+
+// checkTTY is a no-op on Windows, where termbox uses the console
+func checkTTY() error {
+	return nil
+}
+
+// SetTitle is a no-op on Windows, as termbox drives the console
+// through its API instead of escape sequences
+func (t *Termbox) SetTitle(string) error {
+	return nil
+}
+
+// RestoreTitle is a no-op on Windows
+func (t *Termbox) RestoreTitle() error {
+	return nil
+}
 
 func (t *Termbox) PostInit(cfg *Config) error {
 	// Windows handle Esc/Alt self
 	termbox.SetInputMode(termbox.InputEsc | termbox.InputAlt)
 
+	t.colors = detectConsoleColors(cfg.Colors, os.Getenv)
+
 	return nil
 }
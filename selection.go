@@ -1,6 +1,9 @@
 package peco
 
 import (
+	"math"
+	"sort"
+
 	"github.com/google/btree"
 	"github.com/peco/peco/line"
 )
@@ -13,16 +16,46 @@ func NewSelection() *Selection {
 }
 
 // Add adds a new line to the selection. If the line already
-// exists in the selection, it is silently ignored
-func (s *Selection) Add(l line.Line) {
+// exists in the selection, if the line is a group header, or if
+// the selection has already reached its limit, it is ignored.
+// Add returns false only in the last case
+func (s *Selection) Add(l line.Line) bool {
+	if isGroupHeader(l) {
+		return true
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.limit > 0 && s.tree.Len() >= s.limit && !s.tree.Has(l) {
+		return false
+	}
+	if s.tree.ReplaceOrInsert(l) == nil {
+		s.seq++
+		s.picked[l.ID()] = s.seq
+	}
+	return true
+}
+
+// SetLimit sets the maximum number of lines that can be selected.
+// Specifying 0 removes the limit
+func (s *Selection) SetLimit(n int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.limit = n
+}
+
+// IsFull returns true if no more lines can be added to the selection
+func (s *Selection) IsFull() bool {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	s.tree.ReplaceOrInsert(l)
+	return s.limit > 0 && s.tree.Len() >= s.limit
 }
 
+// Copy adds the lines in the selection to dst, in the order they were
+// selected
 func (s *Selection) Copy(dst *Selection) {
-	s.Ascend(func(it btree.Item) bool {
-		dst.Add(it.(line.Line))
+	s.AscendPicked(func(l line.Line) bool {
+		dst.Add(l)
 		return true
 	})
 }
@@ -31,13 +64,16 @@ func (s *Selection) Copy(dst *Selection) {
 func (s *Selection) Remove(l line.Line) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	s.tree.Delete(l)
+	if s.tree.Delete(l) != nil {
+		delete(s.picked, l.ID())
+	}
 }
 
 func (s *Selection) Reset() {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	s.tree = btree.New(32)
+	s.picked = make(map[uint64]uint64)
 }
 
 func (s *Selection) Has(x line.Line) bool {
@@ -57,3 +93,94 @@ func (s *Selection) Ascend(i btree.ItemIterator) {
 	defer s.mutex.Unlock()
 	s.tree.Ascend(i)
 }
+
+// selectionPivot returns an item that compares the same as the line
+// whose ID is id, for the range queries on the tree
+func selectionPivot(id uint64) btree.Item {
+	return line.NewRaw(id, "", false)
+}
+
+// AscendGreaterOrEqual calls f with each line in the selection whose
+// ID is greater than or equal to id, in ascending order of IDs, until
+// f returns false. f must not modify the selection
+func (s *Selection) AscendGreaterOrEqual(id uint64, f func(line.Line) bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tree.AscendGreaterOrEqual(selectionPivot(id), func(it btree.Item) bool {
+		return f(it.(line.Line))
+	})
+}
+
+// DescendLessThan calls f with each line in the selection whose ID is
+// less than id, in descending order of IDs, until f returns false. f
+// must not modify the selection
+func (s *Selection) DescendLessThan(id uint64, f func(line.Line) bool) {
+	if id == 0 {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tree.DescendLessOrEqual(selectionPivot(id-1), func(it btree.Item) bool {
+		return f(it.(line.Line))
+	})
+}
+
+// Iterator returns a SelectionIterator positioned at the line whose ID
+// is id. The line itself does not need to be selected
+func (s *Selection) Iterator(id uint64) *SelectionIterator {
+	return &SelectionIterator{selection: s, id: id}
+}
+
+// Next moves to the first selected line after the current position,
+// and returns it. ok is false if there is none, in which case the
+// position does not change
+func (it *SelectionIterator) Next() (l line.Line, ok bool) {
+	if it.id == math.MaxUint64 {
+		return nil, false
+	}
+	it.selection.AscendGreaterOrEqual(it.id+1, func(found line.Line) bool {
+		l, ok = found, true
+		return false
+	})
+	if ok {
+		it.id = l.ID()
+	}
+	return l, ok
+}
+
+// Prev moves to the last selected line before the current position,
+// and returns it. ok is false if there is none, in which case the
+// position does not change
+func (it *SelectionIterator) Prev() (l line.Line, ok bool) {
+	it.selection.DescendLessThan(it.id, func(found line.Line) bool {
+		l, ok = found, true
+		return false
+	})
+	if ok {
+		it.id = l.ID()
+	}
+	return l, ok
+}
+
+// AscendPicked calls f with each line in the selection, in the order
+// they were selected, until f returns false
+func (s *Selection) AscendPicked(f func(line.Line) bool) {
+	s.mutex.Lock()
+	lines := make([]line.Line, 0, s.tree.Len())
+	s.tree.Ascend(func(it btree.Item) bool {
+		lines = append(lines, it.(line.Line))
+		return true
+	})
+	picked := s.picked
+	sort.SliceStable(lines, func(i, j int) bool {
+		return picked[lines[i].ID()] < picked[lines[j].ID()]
+	})
+	s.mutex.Unlock()
+
+	for _, l := range lines {
+		if !f(l) {
+			return
+		}
+	}
+}
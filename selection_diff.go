@@ -0,0 +1,80 @@
+package peco
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/google/btree"
+	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/internal/i18n"
+	"github.com/peco/peco/line"
+	"github.com/pkg/errors"
+)
+
+// loadSelectionFile reads the lines listed in the file given by
+// --selection-file. They are separated the same way as the output of
+// peco, so that the output of a previous session can be used. A file
+// that does not exist yet is treated as an empty list
+func (p *Peco) loadSelectionFile(filename string) error {
+	p.selectionFile = filename
+
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			p.selectionFileLines = make(map[string]struct{})
+			return nil
+		}
+		return errors.Wrap(err, "failed to open selection file")
+	}
+	defer f.Close()
+
+	lines, err := p.scanLineSet(f, p.print0)
+	if err != nil {
+		return errors.Wrap(err, "failed to read selection file")
+	}
+	p.selectionFileLines = lines
+	return nil
+}
+
+// isInSelectionFile returns true if the output of l is listed in the
+// file given by --selection-file
+func (p *Peco) isInSelectionFile(l line.Line) bool {
+	_, ok := p.selectionFileLines[l.Output()]
+	return ok
+}
+
+// diffSelection returns the number of distinct lines in sel that are
+// not listed, and the number of listed lines that are not in sel.
+// Lines are compared by their output
+func diffSelection(sel *Selection, listed map[string]struct{}) (added, removed int) {
+	selected := make(map[string]struct{})
+	sel.Ascend(func(it btree.Item) bool {
+		selected[it.(line.Line).Output()] = struct{}{}
+		return true
+	})
+
+	for out := range selected {
+		if _, ok := listed[out]; !ok {
+			added++
+		}
+	}
+	for out := range listed {
+		if _, ok := selected[out]; !ok {
+			removed++
+		}
+	}
+	return added, removed
+}
+
+// doDiffSelectionWithFile displays how the selection differs from the
+// lines listed in the file given by --selection-file
+func doDiffSelectionWithFile(ctx context.Context, state *Peco, _ termbox.Event) {
+	if state.selectionFile == "" {
+		state.SendStatusAndClear(ctx, StatusWarn, i18n.T("No selection file specified"), 2*time.Second)
+		return
+	}
+
+	added, removed := diffSelection(state.Selection(), state.selectionFileLines)
+	state.SendStatusAndClear(ctx, StatusInfo, i18n.Sprintf("%d added, %d removed compared to %s", added, removed, state.selectionFile), 2*time.Second)
+}
@@ -0,0 +1,49 @@
+package peco
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/peco/peco/line"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectionFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peco-selection-file-")
+	if !assert.NoError(t, err, "creating temporary directory should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "triaged")
+	if !assert.NoError(t, ioutil.WriteFile(filename, []byte("foo\nbar\nqux\n"), 0644), "writing selection file should succeed") {
+		return
+	}
+
+	p := newPeco()
+	var out bytes.Buffer
+	p.Stdout = &out
+	if !assert.NoError(t, p.loadSelectionFile(filename), "loading selection file should succeed") {
+		return
+	}
+	for i, s := range []string{"foo", "bar", "baz"} {
+		p.Selection().Add(line.NewRaw(uint64(i), s, false))
+	}
+
+	added, removed := diffSelection(p.Selection(), p.selectionFileLines)
+	assert.Equal(t, 1, added, "baz should be counted as added")
+	assert.Equal(t, 1, removed, "qux should be counted as removed")
+
+	p.printNewOnly = true
+	p.PrintResults()
+	assert.Equal(t, "baz\n", out.String(), "only lines that are not listed should be printed")
+
+	p = newPeco()
+	if !assert.NoError(t, p.loadSelectionFile(filepath.Join(dir, "missing")), "missing selection file should be accepted") {
+		return
+	}
+	assert.Empty(t, p.selectionFileLines, "missing selection file should be empty")
+}
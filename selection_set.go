@@ -0,0 +1,206 @@
+package peco
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/btree"
+	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/internal/i18n"
+	"github.com/peco/peco/line"
+	"github.com/pkg/errors"
+)
+
+// resolveSelectionSetAction resolves peco.SaveSelectionAs.<name>,
+// peco.LoadSelection.<name> and peco.MergeSelection.<name>. The second
+// return value is false if the action name is not one of these
+func resolveSelectionSetAction(name string) (Action, bool, error) {
+	var fn func(context.Context, *Peco, string)
+	var set string
+	switch {
+	case strings.HasPrefix(name, saveSelectionPrefix):
+		fn, set = doSaveSelection, strings.TrimPrefix(name, saveSelectionPrefix)
+	case strings.HasPrefix(name, loadSelectionPrefix):
+		fn, set = doLoadSelection, strings.TrimPrefix(name, loadSelectionPrefix)
+	case strings.HasPrefix(name, mergeSelectionPrefix):
+		fn, set = doMergeSelection, strings.TrimPrefix(name, mergeSelectionPrefix)
+	default:
+		return nil, false, nil
+	}
+
+	if !isValidSelectionSetName(set) {
+		return nil, true, errors.Errorf("could not resolve %s: invalid selection set name", name)
+	}
+
+	return ActionFunc(func(ctx context.Context, state *Peco, _ termbox.Event) {
+		fn(ctx, state, set)
+	}), true, nil
+}
+
+// isValidSelectionSetName returns true if name can be used as a
+// file name in SelectionSetDir
+func isValidSelectionSetName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+func doSaveSelection(ctx context.Context, state *Peco, name string) {
+	n, err := state.SaveSelectionSet(name)
+	if err != nil {
+		state.SendStatusAndClear(ctx, StatusError, err.Error(), 2*time.Second)
+		return
+	}
+	state.SendStatusAndClear(ctx, StatusInfo, i18n.Sprintf("Saved %d lines as '%s'", n, name), 500*time.Millisecond)
+}
+
+func doLoadSelection(ctx context.Context, state *Peco, name string) {
+	loadSelectionSet(ctx, state, name, false)
+}
+
+func doMergeSelection(ctx context.Context, state *Peco, name string) {
+	loadSelectionSet(ctx, state, name, true)
+}
+
+func loadSelectionSet(ctx context.Context, state *Peco, name string, merge bool) {
+	set, err := state.SelectionSet(name)
+	if err != nil {
+		state.SendStatusAndClear(ctx, StatusError, err.Error(), 2*time.Second)
+		return
+	}
+
+	sel := state.Selection()
+	if !merge {
+		sel.Reset()
+	}
+	full := false
+	set.Ascend(func(it btree.Item) bool {
+		l := it.(line.Line)
+		l.SetDirty(true)
+		if !sel.Add(l) {
+			full = true
+		}
+		return true
+	})
+	if full {
+		notifySelectionLimit(ctx, state)
+	}
+
+	msg := "Loaded '%s' (%d lines)"
+	if merge {
+		msg = "Merged '%s' (%d lines)"
+	}
+	state.SendStatusAndClear(ctx, StatusInfo, i18n.Sprintf(msg, name, set.Len()), 500*time.Millisecond)
+	state.Hub().SendDraw(ctx, &DrawOptions{DisableCache: true})
+}
+
+// SaveSelectionSet stores a copy of the current selection under name,
+// replacing any set previously saved under the same name. If
+// SelectionSetDir is specified in the config file, the set is also
+// written there, so that it can be loaded by later invocations of
+// peco. It returns the number of lines that were saved
+func (p *Peco) SaveSelectionSet(name string) (int, error) {
+	set := NewSelection()
+	p.Selection().Copy(set)
+
+	p.selectionSetsMutex.Lock()
+	if p.selectionSets == nil {
+		p.selectionSets = make(map[string]*Selection)
+	}
+	p.selectionSets[name] = set
+	p.selectionSetsMutex.Unlock()
+
+	dir := p.config.SelectionSetDir
+	if dir == "" {
+		return set.Len(), nil
+	}
+
+	// Lines are separated the same way as in the input, so that
+	// records read with --read0 may contain newlines
+	sep := byte('\n')
+	if p.read0 {
+		sep = 0
+	}
+	var buf bytes.Buffer
+	set.Ascend(func(it btree.Item) bool {
+		buf.WriteString(it.(line.Line).Buffer())
+		buf.WriteByte(sep)
+		return true
+	})
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return 0, errors.Wrap(err, "failed to create selection set directory")
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name), buf.Bytes(), 0600); err != nil {
+		return 0, errors.Wrapf(err, "failed to save selection set '%s'", name)
+	}
+	return set.Len(), nil
+}
+
+// SelectionSet returns the set of lines saved under name. Sets that
+// were not saved during this session are read from SelectionSetDir,
+// and consist of the lines in the input that are identical to the
+// ones that were saved
+func (p *Peco) SelectionSet(name string) (*Selection, error) {
+	p.selectionSetsMutex.Lock()
+	set, ok := p.selectionSets[name]
+	p.selectionSetsMutex.Unlock()
+	if ok {
+		return set, nil
+	}
+
+	dir := p.config.SelectionSetDir
+	if dir == "" {
+		return nil, errors.Errorf("no selection set named '%s'", name)
+	}
+
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.Errorf("no selection set named '%s'", name)
+		}
+		return nil, errors.Wrapf(err, "failed to load selection set '%s'", name)
+	}
+	defer f.Close()
+
+	saved, err := p.scanLineSet(f, p.read0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load selection set '%s'", name)
+	}
+
+	set = NewSelection()
+	src := p.inputSource()
+	for i := 0; i < src.Size(); i++ {
+		l, err := src.LineAt(i)
+		if err != nil {
+			continue
+		}
+		if _, ok := saved[l.Buffer()]; ok {
+			set.Add(l)
+		}
+	}
+	return set, nil
+}
+
+// scanLineSet returns the distinct lines in r. Lines are separated by
+// NUL instead of newlines if null is true
+func (p *Peco) scanLineSet(r io.Reader, null bool) (map[string]struct{}, error) {
+	lines := make(map[string]struct{})
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), p.maxScanBufferSize*1024)
+	if null {
+		scanner.Split(scanNull)
+	}
+	for scanner.Scan() {
+		lines[scanner.Text()] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
@@ -1,6 +1,8 @@
 package peco
 
 import (
+	"fmt"
+	"reflect"
 	"testing"
 
 	"github.com/peco/peco/line"
@@ -30,3 +32,122 @@ func TestSelection(t *testing.T) {
 		t.Errorf("expected Len = 1, got %d", s.Len())
 	}
 }
+
+func TestSelectionLimit(t *testing.T) {
+	s := NewSelection()
+	s.SetLimit(2)
+
+	alice := line.NewRaw(0, "Alice", false)
+	bob := line.NewRaw(1, "Bob", false)
+	s.Add(alice)
+	s.Add(bob)
+	if !s.IsFull() {
+		t.Errorf("expected selection to be full")
+	}
+
+	if s.Add(line.NewRaw(2, "Charlie", false)) {
+		t.Errorf("expected Add to reject a line once full")
+	}
+	if s.Len() != 2 {
+		t.Errorf("expected Len = 2, got %d", s.Len())
+	}
+
+	// re-adding an existing line is fine even when full
+	if !s.Add(alice) {
+		t.Errorf("expected Add to accept a line that is already selected")
+	}
+	if s.Len() != 2 {
+		t.Errorf("expected Len = 2, got %d", s.Len())
+	}
+
+	s.Remove(bob)
+	if s.IsFull() {
+		t.Errorf("expected selection not to be full")
+	}
+}
+
+func TestSelectionPickedOrder(t *testing.T) {
+	s := NewSelection()
+
+	lines := make([]line.Line, 4)
+	for i := range lines {
+		lines[i] = line.NewRaw(uint64(i), fmt.Sprintf("line %d", i), false)
+	}
+	for _, i := range []int{2, 0, 3, 1} {
+		s.Add(lines[i])
+	}
+	// Selecting a line again does not change its position, but
+	// deselecting and selecting it does
+	s.Add(lines[0])
+	s.Remove(lines[2])
+	s.Add(lines[2])
+
+	picked := func(s *Selection) []uint64 {
+		var ids []uint64
+		s.AscendPicked(func(l line.Line) bool {
+			ids = append(ids, l.ID())
+			return true
+		})
+		return ids
+	}
+
+	expected := []uint64{0, 3, 1, 2}
+	if got := picked(s); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected lines in the order they were picked %v, got %v", expected, got)
+	}
+
+	dst := NewSelection()
+	s.Copy(dst)
+	if got := picked(dst); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected copy to keep the order %v, got %v", expected, got)
+	}
+}
+
+func TestSelectionRange(t *testing.T) {
+	s := NewSelection()
+	for _, i := range []uint64{7, 2, 5, 9} {
+		s.Add(line.NewRaw(i, fmt.Sprintf("line %d", i), false))
+	}
+
+	collect := func(walk func(uint64, func(line.Line) bool), id uint64) []uint64 {
+		ids := []uint64{}
+		walk(id, func(l line.Line) bool {
+			ids = append(ids, l.ID())
+			return true
+		})
+		return ids
+	}
+
+	if got, expected := collect(s.AscendGreaterOrEqual, 5), []uint64{5, 7, 9}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected lines from 5 %v, got %v", expected, got)
+	}
+	if got, expected := collect(s.DescendLessThan, 7), []uint64{5, 2}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected lines before 7 %v, got %v", expected, got)
+	}
+	if got := collect(s.DescendLessThan, 0); len(got) != 0 {
+		t.Errorf("expected no lines before 0, got %v", got)
+	}
+
+	it := s.Iterator(6)
+	for _, expected := range []uint64{7, 9} {
+		l, ok := it.Next()
+		if !ok || l.ID() != expected {
+			t.Errorf("expected Next to return %d, got %v (%t)", expected, l, ok)
+		}
+	}
+	if _, ok := it.Next(); ok {
+		t.Errorf("expected Next to stop at the last line")
+	}
+
+	// Lines selected while iterating are visited too
+	s.Add(line.NewRaw(8, "line 8", false))
+	for _, expected := range []uint64{8, 7, 5, 2} {
+		l, ok := it.Prev()
+		if !ok || l.ID() != expected {
+			t.Errorf("expected Prev to return %d, got %v (%t)", expected, l, ok)
+		}
+	}
+	if _, ok := it.Prev(); ok {
+		t.Errorf("expected Prev to stop at the first line")
+	}
+}
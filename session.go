@@ -0,0 +1,300 @@
+package peco
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nsf/termbox-go"
+	"github.com/pkg/errors"
+)
+
+// sessionVersion is the version of the format written by --record.
+// --replay refuses sessions of other versions
+const sessionVersion = 1
+
+// NewSessionRecorder creates a new SessionRecorder
+func NewSessionRecorder(args []string, config string, hashLines bool) *SessionRecorder {
+	return &SessionRecorder{
+		session: Session{
+			Version: sessionVersion,
+			Args:    args,
+			Config:  config,
+			Hashed:  hashLines,
+		},
+		last: time.Now(),
+	}
+}
+
+// Start records the size of the screen, and resets the clock that
+// event delays are measured with. It is called once the screen has
+// been initialized
+func (r *SessionRecorder) Start(width, height int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.session.Width = width
+	r.session.Height = height
+	r.last = time.Now()
+}
+
+// Record appends an input event to the session
+func (r *SessionRecorder) Record(ev termbox.Event) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	sev := SessionEvent{
+		Delay: int64(now.Sub(r.last) / time.Millisecond),
+		Type:  ev.Type,
+		Key:   ev.Key,
+		Mod:   ev.Mod,
+	}
+	if ev.Ch != 0 {
+		sev.Ch = string(ev.Ch)
+	}
+	if ev.Type == termbox.EventResize {
+		sev.Width = ev.Width
+		sev.Height = ev.Height
+	}
+	r.session.Events = append(r.session.Events, sev)
+	r.last = now
+}
+
+// Write saves the session, along with the lines read from src, to
+// the given file
+func (r *SessionRecorder) Write(filename string, src *Source) error {
+	r.mutex.Lock()
+	s := r.session
+	r.mutex.Unlock()
+
+	s.Lines = make([]string, 0, src.Size())
+	for i := 0; i < src.Size(); i++ {
+		l, err := src.LineAt(i)
+		if err != nil {
+			continue
+		}
+		v := l.Buffer()
+		if s.Hashed {
+			sum := sha256.Sum256([]byte(v))
+			v = hex.EncodeToString(sum[:8])
+		}
+		s.Lines = append(s.Lines, v)
+	}
+
+	buf, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode session")
+	}
+
+	// The input may be sensitive, so the file is only readable by
+	// its owner
+	if err := ioutil.WriteFile(filename, append(buf, '\n'), 0600); err != nil {
+		return errors.Wrap(err, "failed to write session")
+	}
+	return nil
+}
+
+// readSession reads a session written by --record
+func readSession(filename string) (*Session, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read session")
+	}
+
+	var s Session
+	if err := json.Unmarshal(buf, &s); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode session %s", filename)
+	}
+	if s.Version != sessionVersion {
+		return nil, errors.Errorf("unsupported session version %d (expected %d)", s.Version, sessionVersion)
+	}
+	if s.Width <= 0 || s.Height <= 0 {
+		return nil, errors.Errorf("invalid screen size %dx%d in session", s.Width, s.Height)
+	}
+	return &s, nil
+}
+
+// Input returns the lines of the session as they were read
+func (s *Session) Input(read0 bool) string {
+	if len(s.Lines) == 0 {
+		return ""
+	}
+	if read0 {
+		return strings.Join(s.Lines, "\x00") + "\x00"
+	}
+	return strings.Join(s.Lines, "\n") + "\n"
+}
+
+// Event converts the recorded event back to a termbox event
+func (ev SessionEvent) Event() termbox.Event {
+	tev := termbox.Event{
+		Type:   ev.Type,
+		Key:    ev.Key,
+		Mod:    ev.Mod,
+		Width:  ev.Width,
+		Height: ev.Height,
+	}
+	if ev.Ch != "" {
+		tev.Ch, _ = utf8.DecodeRuneInString(ev.Ch)
+	}
+	return tev
+}
+
+// setupReplay implements --replay. The options and the config that
+// the session was recorded with replace the ones given on the command
+// line, and the recorded lines are read instead of the input. As the
+// session may come from someone else, the options that run commands or
+// write files are dropped, and so are the settings in its config (see
+// disableCommands)
+func (p *Peco) setupReplay(opts *CLIOptions, filename string) error {
+	s, err := readSession(filename)
+	if err != nil {
+		return err
+	}
+
+	var replayOpts CLIOptions
+	if err := p.parseCommandLine(&replayOpts, &p.args, append([]string{p.Argv[0]}, s.Args...)); err != nil {
+		return errors.Wrap(err, "failed to parse recorded command line")
+	}
+
+	// The recorded config is used instead of the local one, and the
+	// input comes from the session instead of files
+	replayOpts.OptRcfile = ""
+	replayOpts.OptProjectConfig = false
+	replayOpts.OptInput = nil
+	replayOpts.OptRecord = ""
+	replayOpts.OptReplay = ""
+	replayOpts.OptExec = ""
+	replayOpts.OptSourceCmd = ""
+	replayOpts.OptTmux = ""
+	replayOpts.OptPopup = false
+	replayOpts.OptOutput = ""
+	replayOpts.OptOutputMode = ""
+	replayOpts.OptAnnotations = ""
+	replayOpts.OptTrace = ""
+	replayOpts.OptSelectionFile = ""
+	replayOpts.OptPrintNewOnly = false
+	replayOpts.OptFrecency = ""
+	p.args = p.args[:1]
+	if s.Config != "" {
+		f, err := ioutil.TempFile("", "peco-replay-")
+		if err != nil {
+			return errors.Wrap(err, "failed to create temporary config file")
+		}
+		p.replayConfig = f.Name()
+		replayOpts.OptRcfile = f.Name()
+		_, err = f.WriteString(s.Config)
+		f.Close()
+		if err != nil {
+			return errors.Wrap(err, "failed to write temporary config file")
+		}
+	}
+
+	p.Stdin = strings.NewReader(s.Input(replayOpts.OptRead0))
+	p.replay = s
+	*opts = replayOpts
+	return nil
+}
+
+// disableCommands removes the settings of cfg that make peco run
+// commands or write files, for --replay. Actions that execute a
+// command are kept, so that the keys bound to them still resolve, but
+// they do nothing. Custom filters are forgotten along with their names
+func disableCommands(cfg *Config) {
+	custom := make(map[string]bool)
+	for name := range cfg.CustomMatcher {
+		custom[name] = true
+	}
+	for name := range cfg.CustomFilter {
+		custom[name] = true
+	}
+	filters := cfg.Filters[:0]
+	for _, name := range cfg.Filters {
+		if !custom[name] {
+			filters = append(filters, name)
+		}
+	}
+	cfg.Filters = filters
+	if custom[cfg.InitialFilter] {
+		cfg.InitialFilter = ""
+	}
+
+	cfg.Hooks = HooksConfig{}
+	cfg.CustomMatcher = nil
+	cfg.CustomFilter = nil
+	cfg.QueryTransform.Cmd = ""
+	cfg.QueryTransform.Args = nil
+	cfg.Exec = CommandConfig{}
+	cfg.SelectionSetDir = ""
+	cfg.FrecencyDir = ""
+	for name, a := range cfg.Action {
+		if !a.Exec.IsEmpty() {
+			cfg.Action[name] = ActionConfig{}
+		}
+	}
+}
+
+// replaySession sends the recorded events to the in-memory screen
+// with their original delays. Once they have all been handled, the
+// screen is printed to stdout and peco exits, unless the session
+// ended on its own
+func (p *Peco) replaySession(ctx context.Context) {
+	screen, ok := p.screen.(*MemoryScreen)
+	if !ok {
+		p.Exit(errors.New("--replay requires an in-memory screen"))
+		return
+	}
+
+	for _, ev := range p.replay.Events {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(ev.Delay) * time.Millisecond):
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case screen.events <- ev.Event():
+		}
+	}
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for p.EventsHandled() < uint64(len(p.replay.Events)) || !p.IsIdle() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+	p.renderOnceAndExit()
+}
+
+// recordedConfig returns the contents of the config file, so that it
+// can be stored in a session
+func recordedConfig(filename string) string {
+	if filename == "" {
+		return ""
+	}
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return ""
+	}
+	return string(buf)
+}
+
+// removeReplayConfig removes the temporary config file created by
+// --replay, if any
+func (p *Peco) removeReplayConfig() {
+	if p.replayConfig != "" {
+		os.Remove(p.replayConfig)
+		p.replayConfig = ""
+	}
+}
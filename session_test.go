@@ -0,0 +1,197 @@
+package peco
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/internal/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peco-session-")
+	if !assert.NoError(t, err, "creating temporary directory should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "session.json")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	screen := NewMemoryScreen(30, 4)
+	state := newPeco()
+	state.Argv = []string{"peco", "--record", filename}
+	state.Stdin = bytes.NewBufferString("apple\nbanana\ncherry\n")
+	state.screen = screen
+
+	done := make(chan error)
+	go func() { done <- state.Run(ctx) }()
+	<-state.Ready()
+	for _, ch := range "an" {
+		screen.SendEvent(termbox.Event{Type: termbox.EventKey, Ch: ch})
+	}
+	for state.EventsHandled() < 2 || !state.IsIdle() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	state.Exit(nil)
+	if !assert.NoError(t, <-done, "recording session should succeed") {
+		return
+	}
+
+	s, err := readSession(filename)
+	if !assert.NoError(t, err, "reading session should succeed") {
+		return
+	}
+	assert.Equal(t, []string{"apple", "banana", "cherry"}, s.Lines, "lines should be recorded")
+	assert.Len(t, s.Events, 2, "key events should be recorded")
+	assert.Equal(t, 30, s.Width, "screen size should be recorded")
+
+	state = newPeco()
+	state.Argv = []string{"peco", "--replay", filename}
+	var out bytes.Buffer
+	state.Stdout = &out
+	err = state.Run(ctx)
+	if !assert.NoError(t, ctx.Err(), "timeout reached") {
+		return
+	}
+	if !assert.True(t, util.IsIgnorableError(err), "replay should exit after printing the screen") {
+		return
+	}
+	expected := "QUERY> an IgnoreCase [1 (1/1)]\n" +
+		"banana\n" +
+		"\n" +
+		"\n"
+	assert.Equal(t, expected, out.String(), "replayed screen should match")
+}
+
+func TestReplayDisablesCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peco-session-")
+	if !assert.NoError(t, err, "creating temporary directory should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "session.json")
+
+	config := `{
+  "Hooks": {"OnStart": "touch started"},
+  "Exec": "cat",
+  "QueryTransform": {"Cmd": "echo", "Args": ["$QUERY"], "Template": "^$QUERY"},
+  "CustomFilter": {"Grep": {"Cmd": "grep", "Args": ["$QUERY"]}},
+  "Filters": ["Grep", "Regexp"],
+  "InitialFilter": "Grep",
+  "SelectionSetDir": "/tmp/sets",
+  "FrecencyDir": "/tmp/frecency",
+  "Action": {"open": {"Exec": "open"}, "both": ["peco.SelectUp", "peco.SelectDown"]}
+}`
+	s := Session{
+		Version: sessionVersion,
+		Args: []string{
+			"--exec", "cat", "--source-cmd", "ls", "--query", "foo",
+			"--output", filepath.Join(dir, "output"), "--output-mode", "append",
+			"--annotations", filepath.Join(dir, "annotations"),
+			"--trace", filepath.Join(dir, "trace"),
+		},
+		Config: config,
+		Width:  30,
+		Height: 4,
+	}
+	buf, err := json.Marshal(s)
+	if !assert.NoError(t, err, "encoding session should succeed") {
+		return
+	}
+	if !assert.NoError(t, ioutil.WriteFile(filename, buf, 0600), "writing session should succeed") {
+		return
+	}
+
+	state := newPeco()
+	state.Argv = []string{"peco", "--replay", filename}
+	var opts CLIOptions
+	if !assert.NoError(t, state.setupReplay(&opts, filename), "setupReplay should succeed") {
+		return
+	}
+	defer state.removeReplayConfig()
+	assert.Empty(t, opts.OptExec, "--exec should be dropped")
+	assert.Empty(t, opts.OptSourceCmd, "--source-cmd should be dropped")
+	assert.Empty(t, opts.OptOutput, "--output should be dropped")
+	assert.Empty(t, opts.OptOutputMode, "--output-mode should be dropped")
+	assert.Empty(t, opts.OptAnnotations, "--annotations should be dropped")
+	assert.Empty(t, opts.OptTrace, "--trace should be dropped")
+	assert.Equal(t, "foo", opts.OptQuery, "other options should be kept")
+
+	var cfg Config
+	if !assert.NoError(t, cfg.Init(), "initializing config should succeed") {
+		return
+	}
+	if !assert.NoError(t, cfg.ReadFilename(opts.OptRcfile), "reading recorded config should succeed") {
+		return
+	}
+	disableCommands(&cfg)
+	assert.Equal(t, HooksConfig{}, cfg.Hooks, "hooks should be dropped")
+	assert.True(t, cfg.Exec.IsEmpty(), "Exec should be dropped")
+	assert.Empty(t, cfg.QueryTransform.Cmd, "QueryTransform command should be dropped")
+	assert.Equal(t, "^$QUERY", cfg.QueryTransform.Template, "QueryTransform template should be kept")
+	assert.Empty(t, cfg.CustomFilter, "custom filters should be dropped")
+	assert.Equal(t, []string{"Regexp"}, cfg.Filters, "custom filters should not be listed")
+	assert.Empty(t, cfg.InitialFilter, "custom initial filter should be dropped")
+	assert.Empty(t, cfg.SelectionSetDir, "SelectionSetDir should be dropped")
+	assert.Empty(t, cfg.FrecencyDir, "FrecencyDir should be dropped")
+	assert.True(t, cfg.Action["open"].Exec.IsEmpty(), "actions should not execute commands")
+	assert.Equal(t, []string{"peco.SelectUp", "peco.SelectDown"}, cfg.Action["both"].Actions, "other actions should be kept")
+}
+
+func TestReplayDoesNotWriteOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peco-session-")
+	if !assert.NoError(t, err, "creating temporary directory should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "session.json")
+	output := filepath.Join(dir, "output")
+
+	// The session accepts the line under the cursor, which would be
+	// written to --output
+	s := Session{
+		Version: sessionVersion,
+		Args:    []string{"--output", output},
+		Width:   30,
+		Height:  4,
+		Lines:   []string{"foo"},
+		Events:  []SessionEvent{{Type: termbox.EventKey, Key: termbox.KeyEnter}},
+	}
+	buf, err := json.Marshal(s)
+	if !assert.NoError(t, err, "encoding session should succeed") {
+		return
+	}
+	if !assert.NoError(t, ioutil.WriteFile(filename, buf, 0600), "writing session should succeed") {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	state := newPeco()
+	state.Argv = []string{"peco", "--replay", filename}
+	var out bytes.Buffer
+	state.Stdout = &out
+	err = state.Run(ctx)
+	if !assert.NoError(t, ctx.Err(), "timeout reached") {
+		return
+	}
+	if !assert.True(t, util.IsCollectResultsError(err), "replayed session should accept the line") {
+		return
+	}
+	state.PrintResults()
+	if !assert.Equal(t, "foo\n", out.String(), "accepted line should be printed") {
+		return
+	}
+	_, err = os.Stat(output)
+	assert.True(t, os.IsNotExist(err), "--output should not be written")
+}
@@ -0,0 +1,222 @@
+package peco
+
+import (
+	"context"
+	"time"
+
+	"github.com/lestrrat-go/pdebug"
+	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/internal/i18n"
+	"github.com/peco/peco/line"
+	"github.com/peco/peco/pipeline"
+)
+
+// snapshotLines returns the lines that are currently held in memory.
+// Append only ever adds lines past the end of the slice, and skips
+// past old lines when they are dropped, so the returned lines never
+// change, and need not be copied
+func (s *Source) snapshotLines() []line.Line {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.lines[:len(s.lines):len(s.lines)]
+}
+
+// ID returns the number of the snapshot, starting from 1
+func (s *Snapshot) ID() int {
+	return s.id
+}
+
+// Taken returns when the snapshot was taken
+func (s *Snapshot) Taken() time.Time {
+	return s.taken
+}
+
+// Size returns the number of lines in the snapshot
+func (s *Snapshot) Size() int {
+	return bufferSize(s.lines)
+}
+
+// LineAt returns the line at index n
+func (s *Snapshot) LineAt(n int) (line.Line, error) {
+	return bufferLineAt(s.lines, n)
+}
+
+func (s *Snapshot) linesInRange(start, end int) []line.Line {
+	return bufferLinesInRange(s.lines, start, end)
+}
+
+// Start sends the lines of the snapshot, so that queries can be run
+// against it
+func (s *Snapshot) Start(ctx context.Context, out pipeline.ChanOutput) {
+	defer out.SendEndMark("end of snapshot")
+	for _, l := range s.lines {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			out.Send(l)
+		}
+	}
+}
+
+// Reset is a no-op, as snapshots never change
+func (s *Snapshot) Reset() {}
+
+// label returns the text displayed in the prompt while the snapshot
+// is being browsed
+func (s *Snapshot) label() string {
+	return i18n.Sprintf("Snapshot %d (%s)", s.id, s.taken.Format("15:04:05"))
+}
+
+// takeSnapshot saves the lines that have been read so far, without
+// interrupting the input. Only the last maxSnapshots are kept
+func (p *Peco) takeSnapshot() *Snapshot {
+	p.snapshotsMutex.Lock()
+	defer p.snapshotsMutex.Unlock()
+
+	p.snapshotSeq++
+	s := &Snapshot{
+		id:    p.snapshotSeq,
+		taken: time.Now(),
+		lines: p.inputSource().snapshotLines(),
+	}
+	p.snapshots = append(p.snapshots, s)
+	if len(p.snapshots) > maxSnapshots {
+		p.snapshots = append([]*Snapshot(nil), p.snapshots[len(p.snapshots)-maxSnapshots:]...)
+	}
+	return s
+}
+
+// Snapshot returns the snapshot being browsed, or nil if the live
+// input is displayed
+func (p *Peco) Snapshot() *Snapshot {
+	p.snapshotsMutex.Lock()
+	defer p.snapshotsMutex.Unlock()
+	return p.snapshot
+}
+
+// Snapshots returns the snapshots that have been taken, oldest first
+func (p *Peco) Snapshots() []*Snapshot {
+	p.snapshotsMutex.Lock()
+	defer p.snapshotsMutex.Unlock()
+	return append([]*Snapshot(nil), p.snapshots...)
+}
+
+// filterSource returns what queries are run against: the snapshot
+// being browsed, or the input
+func (p *Peco) filterSource() pipeline.Source {
+	if s := p.Snapshot(); s != nil {
+		return s
+	}
+	return p.inputSource()
+}
+
+// viewSnapshot displays the given snapshot instead of the input, or
+// the input if s is nil, and runs the current query against it
+func (p *Peco) viewSnapshot(ctx context.Context, s *Snapshot) {
+	p.snapshotsMutex.Lock()
+	p.snapshot = s
+	p.snapshotsMutex.Unlock()
+
+	if s != nil {
+		// The newest lines are not part of the snapshot
+		p.SetFollowing(false)
+	}
+
+	if p.ExecQuery(nil) {
+		return
+	}
+	p.Hub().SendDrawPrompt(ctx)
+}
+
+// adjacentSnapshot returns the snapshot before (dir < 0) or after
+// (dir > 0) the one being browsed, where the input comes after the
+// newest snapshot. ok is false if there is none
+func (p *Peco) adjacentSnapshot(dir int) (s *Snapshot, ok bool) {
+	p.snapshotsMutex.Lock()
+	defer p.snapshotsMutex.Unlock()
+
+	// The input counts as the position past the newest snapshot. A
+	// snapshot that has been dropped counts as older than the rest
+	i := len(p.snapshots)
+	if p.snapshot != nil {
+		i = -1
+		for j, v := range p.snapshots {
+			if v == p.snapshot {
+				i = j
+				break
+			}
+		}
+	}
+
+	i += dir
+	switch {
+	case i < 0 || i > len(p.snapshots):
+		return nil, false
+	case i == len(p.snapshots):
+		return nil, p.snapshot != nil
+	}
+	return p.snapshots[i], true
+}
+
+// doTakeSnapshot saves the lines read so far, so that they can be
+// browsed later with peco.PreviousSnapshot, while the input keeps
+// being read
+func doTakeSnapshot(ctx context.Context, state *Peco, e termbox.Event) {
+	if pdebug.Enabled {
+		g := pdebug.Marker("doTakeSnapshot")
+		defer g.End()
+	}
+
+	s := state.takeSnapshot()
+	state.SendStatusAndClear(ctx, StatusInfo, i18n.Sprintf("Took snapshot %d (%d lines)", s.ID(), s.Size()), 2*time.Second)
+}
+
+// doPreviousSnapshot displays the snapshot taken before the one being
+// browsed, or the newest snapshot if the input is displayed
+func doPreviousSnapshot(ctx context.Context, state *Peco, e termbox.Event) {
+	if pdebug.Enabled {
+		g := pdebug.Marker("doPreviousSnapshot")
+		defer g.End()
+	}
+
+	s, ok := state.adjacentSnapshot(-1)
+	if !ok {
+		state.SendStatusAndClear(ctx, StatusWarn, i18n.T("No older snapshot"), 2*time.Second)
+		return
+	}
+	state.viewSnapshot(ctx, s)
+}
+
+// doNextSnapshot displays the snapshot taken after the one being
+// browsed, or the input if it is the newest one
+func doNextSnapshot(ctx context.Context, state *Peco, e termbox.Event) {
+	if pdebug.Enabled {
+		g := pdebug.Marker("doNextSnapshot")
+		defer g.End()
+	}
+
+	s, ok := state.adjacentSnapshot(1)
+	if !ok {
+		state.SendStatusAndClear(ctx, StatusWarn, i18n.T("No newer snapshot"), 2*time.Second)
+		return
+	}
+	state.viewSnapshot(ctx, s)
+	if s == nil {
+		state.SendStatusAndClear(ctx, StatusInfo, i18n.T("Back to live input"), 2*time.Second)
+	}
+}
+
+// doReturnToLive displays the input again, after browsing snapshots
+func doReturnToLive(ctx context.Context, state *Peco, e termbox.Event) {
+	if pdebug.Enabled {
+		g := pdebug.Marker("doReturnToLive")
+		defer g.End()
+	}
+
+	if state.Snapshot() == nil {
+		return
+	}
+	state.viewSnapshot(ctx, nil)
+	state.SendStatusAndClear(ctx, StatusInfo, i18n.T("Back to live input"), 2*time.Second)
+}
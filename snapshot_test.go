@@ -0,0 +1,95 @@
+package peco
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/line"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSourceSnapshotLines(t *testing.T) {
+	s := NewSource("-", nil, false, nil, 3, false)
+	for i := 0; i < 2; i++ {
+		s.Append(line.NewRaw(uint64(i), fmt.Sprintf("line %d", i), false))
+	}
+
+	lines := s.snapshotLines()
+	for i := 2; i < 5; i++ {
+		s.Append(line.NewRaw(uint64(i), fmt.Sprintf("line %d", i), false))
+	}
+
+	if !assert.Len(t, lines, 2, "lines appended later should not be part of the snapshot") {
+		return
+	}
+	assert.Equal(t, "line 0", lines[0].DisplayString(), "lines dropped from the source should stay in the snapshot")
+	assert.Equal(t, "line 1", lines[1].DisplayString())
+	assert.Equal(t, 3, s.Size(), "the source should still be limited to its capacity")
+}
+
+func TestSnapshots(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	state := newPeco()
+	state.Argv = []string{}
+	state.Stdin = bytes.NewBufferString("foo 1\nbar 1\n")
+	go state.Run(ctx)
+	<-state.Ready()
+	<-state.source.SetupDone()
+
+	query := func(q string) {
+		ch := make(chan struct{})
+		state.Query().Set(q)
+		state.ExecQuery(func() { close(ch) })
+		<-ch
+	}
+	// The buffer is replaced asynchronously when the query is empty
+	waitSize := func(n int) bool {
+		for i := 0; i < 100 && state.CurrentLineBuffer().Size() != n; i++ {
+			time.Sleep(5 * time.Millisecond)
+		}
+		return assert.Equal(t, n, state.CurrentLineBuffer().Size())
+	}
+
+	doTakeSnapshot(ctx, state, termbox.Event{})
+	state.source.Append(line.NewRaw(2, "foo 2", false))
+	doTakeSnapshot(ctx, state, termbox.Event{})
+	state.source.Append(line.NewRaw(3, "foo 3", false))
+	if !assert.Len(t, state.Snapshots(), 2, "snapshots should be kept") {
+		return
+	}
+
+	doPreviousSnapshot(ctx, state, termbox.Event{})
+	if !assert.Equal(t, 2, state.Snapshot().ID(), "the newest snapshot should be browsed first") || !waitSize(3) {
+		return
+	}
+	doPreviousSnapshot(ctx, state, termbox.Event{})
+	if !assert.Equal(t, 1, state.Snapshot().ID(), "older snapshots should be browsed next") || !waitSize(2) {
+		return
+	}
+	doPreviousSnapshot(ctx, state, termbox.Event{})
+	assert.Equal(t, 1, state.Snapshot().ID(), "there should be nothing older than the first snapshot")
+	assert.Contains(t, rightPrompt(state), "Snapshot 1 (", "the snapshot should be shown in the prompt")
+
+	query("foo")
+	if !assert.Equal(t, 1, state.CurrentLineBuffer().Size(), "queries should run against the snapshot") {
+		return
+	}
+
+	doNextSnapshot(ctx, state, termbox.Event{})
+	doNextSnapshot(ctx, state, termbox.Event{})
+	if !assert.Nil(t, state.Snapshot(), "the input should come after the newest snapshot") {
+		return
+	}
+	query("foo")
+	assert.Equal(t, 3, state.CurrentLineBuffer().Size(), "queries should run against the input again")
+
+	doPreviousSnapshot(ctx, state, termbox.Event{})
+	doReturnToLive(ctx, state, termbox.Event{})
+	assert.Nil(t, state.Snapshot(), "ReturnToLive should display the input")
+}
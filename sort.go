@@ -0,0 +1,298 @@
+package peco
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lestrrat-go/pdebug"
+	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/internal/i18n"
+	"github.com/peco/peco/line"
+	"github.com/pkg/errors"
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+)
+
+// collator computes the keys that strings are sorted by. Keys compare
+// as strings do, in the order that the strings are sorted in
+type collator interface {
+	Key(s string) string
+}
+
+// codepointCollator sorts strings by their Unicode code points
+type codepointCollator struct{}
+
+func (codepointCollator) Key(s string) string {
+	return s
+}
+
+// localeCollator sorts strings by the rules of a language
+type localeCollator struct {
+	collator *collate.Collator
+	buf      collate.Buffer
+}
+
+func (c *localeCollator) Key(s string) string {
+	key := string(c.collator.KeyFromString(&c.buf, s))
+	c.buf.Reset()
+	return key
+}
+
+// newCollator creates the collator for the given SortCollation. The
+// collators are not safe for concurrent use
+func newCollator(name string) (collator, error) {
+	switch name {
+	case "", SortCollationCodepoint:
+		return codepointCollator{}, nil
+	case SortCollationLocale:
+		return &localeCollator{collator: collate.New(collationLocale())}, nil
+	}
+	return nil, errors.Errorf("unknown sort collation '%s'", name)
+}
+
+// collationLocale returns the language whose collation rules apply,
+// from the locale environment variables in the order that POSIX
+// gives them precedence. Locale names such as "sv_SE.UTF-8" are
+// converted to language tags ("sv-SE")
+func collationLocale() language.Tag {
+	for _, name := range []string{"LC_ALL", "LC_COLLATE", "LANG"} {
+		v := os.Getenv(name)
+		if v == "" {
+			continue
+		}
+		if i := strings.IndexAny(v, ".@"); i >= 0 {
+			v = v[:i]
+		}
+		if v == "C" || v == "POSIX" {
+			break
+		}
+		return language.Make(strings.Replace(v, "_", "-", -1))
+	}
+	return language.Und
+}
+
+// NewLineSorter creates a new LineSorter that compares lines using the
+// given SortCollation. Sorting is disabled until it is toggled
+func NewLineSorter(collation string) *LineSorter {
+	return &LineSorter{collation: collation}
+}
+
+// Toggle enables sorting if it is disabled, and vice versa. It returns
+// true if sorting is now enabled
+func (s *LineSorter) Toggle() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.enabled = !s.enabled
+	s.gen++
+	return s.enabled
+}
+
+// Enabled returns true if the lines are sorted
+func (s *LineSorter) Enabled() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.enabled
+}
+
+// state returns whether sorting is enabled, and a number that changes
+// each time it is toggled
+func (s *LineSorter) state() (bool, uint64) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.enabled, s.gen
+}
+
+// NewSortedBuffer creates a new SortedBuffer that sorts the lines in
+// `src` while `sorter` is enabled
+func NewSortedBuffer(src Buffer, sorter *LineSorter) *SortedBuffer {
+	return &SortedBuffer{
+		sorter: sorter,
+		src:    src,
+	}
+}
+
+// byKey sorts lines by their sort keys
+type byKey struct {
+	lines []line.Line
+	keys  []string
+}
+
+func (b byKey) Len() int {
+	return len(b.lines)
+}
+
+func (b byKey) Less(i, j int) bool {
+	return b.keys[i] < b.keys[j]
+}
+
+func (b byKey) Swap(i, j int) {
+	b.lines[i], b.lines[j] = b.lines[j], b.lines[i]
+	b.keys[i], b.keys[j] = b.keys[j], b.keys[i]
+}
+
+// sortLines returns lines sorted by their text, and their sort keys
+func (sb *SortedBuffer) sortLines(lines []line.Line) ([]line.Line, []string) {
+	sorted := append([]line.Line(nil), lines...)
+	keys := make([]string, len(sorted))
+	for i, l := range sorted {
+		keys[i] = sb.collator.Key(l.DisplayString())
+	}
+	sort.Stable(byKey{lines: sorted, keys: keys})
+	return sorted, keys
+}
+
+// rebuild sorts the lines again if sorting has been toggled since the
+// last time we looked at them. Lines that have been added to the
+// underlying buffer since then are sorted on their own, and merged
+// into the sorted lines, and those that have been dropped from it are
+// removed. While sorting is disabled, the lines of the underlying
+// buffer are used as is, and this returns false. Must be called with
+// the mutex held
+func (sb *SortedBuffer) rebuild() bool {
+	enabled, gen := sb.sorter.state()
+	if !enabled {
+		sb.lines = nil
+		sb.keys = nil
+		sb.tracker.reset()
+		return false
+	}
+
+	if sb.collator == nil {
+		// Already validated when the config was applied
+		sb.collator, _ = newCollator(sb.sorter.collation)
+		if sb.collator == nil {
+			sb.collator = codepointCollator{}
+		}
+	}
+
+	lines, dropped, added, ok := sb.tracker.update(sb.src)
+	if ok && gen == sb.gen {
+		if len(dropped) > 0 || len(added) > 0 {
+			sb.merge(dropped, added)
+		}
+		return true
+	}
+
+	sb.lines, sb.keys = sb.sortLines(lines)
+	sb.gen = gen
+	sb.ver = bufferVersion{gen: newBufferGen(), appended: len(sb.lines)}
+	return true
+}
+
+// merge removes the dropped lines from the sorted lines, and adds
+// the added ones in their place. Must be called with the mutex held
+func (sb *SortedBuffer) merge(dropped, added []line.Line) {
+	newLines, newKeys := sb.sortLines(added)
+
+	// If all of the new lines come last, they are simply appended
+	last := len(sb.keys) - 1
+	if len(dropped) == 0 && (last < 0 || len(newKeys) == 0 || sb.keys[last] <= newKeys[0]) {
+		sb.lines = append(sb.lines, newLines...)
+		sb.keys = append(sb.keys, newKeys...)
+		sb.ver.appended += len(newLines)
+		return
+	}
+
+	gone := make(map[uint64]struct{}, len(dropped))
+	for _, l := range dropped {
+		gone[l.ID()] = struct{}{}
+	}
+
+	n := len(sb.lines) - len(dropped) + len(newLines)
+	lines := make([]line.Line, 0, n)
+	keys := make([]string, 0, n)
+	for i, j := 0, 0; i < len(sb.lines) || j < len(newLines); {
+		if i < len(sb.lines) {
+			if _, ok := gone[sb.lines[i].ID()]; ok {
+				i++
+				continue
+			}
+		}
+
+		// Lines with the same text stay in the order they were read
+		if j >= len(newLines) || (i < len(sb.lines) && sb.keys[i] <= newKeys[j]) {
+			lines = append(lines, sb.lines[i])
+			keys = append(keys, sb.keys[i])
+			i++
+		} else {
+			lines = append(lines, newLines[j])
+			keys = append(keys, newKeys[j])
+			j++
+		}
+	}
+
+	sb.lines = lines
+	sb.keys = keys
+	sb.ver = bufferVersion{gen: newBufferGen(), appended: len(lines)}
+}
+
+// Size returns the number of lines in the buffer
+func (sb *SortedBuffer) Size() int {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	if !sb.rebuild() {
+		return sb.src.Size()
+	}
+	return bufferSize(sb.lines)
+}
+
+// LineAt returns the line at index `n`
+func (sb *SortedBuffer) LineAt(n int) (line.Line, error) {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	if !sb.rebuild() {
+		return sb.src.LineAt(n)
+	}
+	return bufferLineAt(sb.lines, n)
+}
+
+func (sb *SortedBuffer) linesInRange(start, end int) []line.Line {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	if !sb.rebuild() {
+		return sb.src.linesInRange(start, end)
+	}
+	return bufferLinesInRange(sb.lines, start, end)
+}
+
+// versionedLines returns the sorted lines, and their version
+func (sb *SortedBuffer) versionedLines() ([]line.Line, bufferVersion) {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	if !sb.rebuild() {
+		return versionedLines(sb.src)
+	}
+	n := len(sb.lines)
+	return sb.lines[:n:n], sb.ver
+}
+
+// release drops the sorted lines, and releases the buffer that this
+// SortedBuffer decorates
+func (sb *SortedBuffer) release() int {
+	sb.mutex.Lock()
+	sb.lines = nil
+	sb.keys = nil
+	sb.tracker.reset()
+	sb.mutex.Unlock()
+	return releaseBuffer(sb.src)
+}
+
+// doToggleSort sorts the lines by their text, using the collation set
+// by SortCollation, or restores the order of the input if they are
+// already sorted
+func doToggleSort(ctx context.Context, state *Peco, _ termbox.Event) {
+	if pdebug.Enabled {
+		g := pdebug.Marker("doToggleSort")
+		defer g.End()
+	}
+
+	if state.sorter.Toggle() {
+		state.SendStatusAndClear(ctx, StatusInfo, i18n.T("Sorted lines"), 2*time.Second)
+	} else {
+		state.SendStatusAndClear(ctx, StatusInfo, i18n.T("Lines in input order"), 2*time.Second)
+	}
+	state.Hub().SendDraw(ctx, &DrawOptions{DisableCache: true})
+}
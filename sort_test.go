@@ -0,0 +1,138 @@
+package peco
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/line"
+	"github.com/stretchr/testify/assert"
+)
+
+func bufferStrings(b Buffer) []string {
+	var lines []string
+	for i := 0; i < b.Size(); i++ {
+		l, err := b.LineAt(i)
+		if err != nil {
+			break
+		}
+		lines = append(lines, l.DisplayString())
+	}
+	return lines
+}
+
+func TestToggleSort(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	state := newPeco()
+	state.Argv = nil
+	state.Stdin = bytes.NewBufferString("b\nZ\na\né\n")
+	go state.Run(ctx)
+	<-state.Ready()
+	<-state.source.SetupDone()
+
+	doToggleSort(ctx, state, termbox.Event{})
+	if !assert.Equal(t, []string{"Z", "a", "b", "é"}, bufferStrings(state.CurrentLineBuffer()), "lines should be sorted by code point") {
+		return
+	}
+
+	doToggleSort(ctx, state, termbox.Event{})
+	assert.Equal(t, []string{"b", "Z", "a", "é"}, bufferStrings(state.CurrentLineBuffer()), "the order of the input should be restored")
+}
+
+func TestSortCollation(t *testing.T) {
+	for _, name := range []string{"LC_ALL", "LC_COLLATE", "LANG"} {
+		if v, ok := os.LookupEnv(name); ok {
+			defer os.Setenv(name, v)
+		} else {
+			defer os.Unsetenv(name)
+		}
+		os.Unsetenv(name)
+	}
+
+	_, err := newCollator("nosuchcollation")
+	assert.Error(t, err, "unknown collations should be rejected")
+
+	assert.Equal(t, "und", collationLocale().String(), "no locale should be used by default")
+	os.Setenv("LANG", "C.UTF-8")
+	assert.Equal(t, "und", collationLocale().String(), "the C locale should not be used")
+	os.Setenv("LC_COLLATE", "sv_SE.UTF-8")
+	assert.Equal(t, "sv-SE", collationLocale().String(), "LC_COLLATE should take precedence over LANG")
+	os.Setenv("LC_ALL", "de_DE.UTF-8@euro")
+	assert.Equal(t, "de-DE", collationLocale().String(), "LC_ALL should take precedence over LC_COLLATE")
+
+	src := NewMemoryBuffer()
+	for i, s := range []string{"b", "Z", "a", "é"} {
+		src.lines = append(src.lines, line.NewRaw(uint64(i), s, false))
+	}
+	sorter := NewLineSorter(SortCollationLocale)
+	b := NewSortedBuffer(src, sorter)
+	if !assert.Equal(t, []string{"b", "Z", "a", "é"}, bufferStrings(b), "lines should not be sorted until sorting is enabled") {
+		return
+	}
+	sorter.Toggle()
+	assert.Equal(t, []string{"a", "b", "é", "Z"}, bufferStrings(b), "lines should be sorted by the rules of the locale")
+}
+
+func TestSortedBufferFollowsSource(t *testing.T) {
+	src := NewSource("-", strings.NewReader(""), false, nil, 4, false)
+	sorter := NewLineSorter(SortCollationCodepoint)
+	sorter.Toggle()
+	b := NewSortedBuffer(src, sorter)
+	for i, s := range []string{"c", "a", "d"} {
+		src.Append(line.NewRaw(uint64(i), s, false))
+	}
+	if !assert.Equal(t, []string{"a", "c", "d"}, bufferStrings(b), "lines should be sorted") {
+		return
+	}
+
+	src.Append(line.NewRaw(3, "b", false))
+	if !assert.Equal(t, []string{"a", "b", "c", "d"}, bufferStrings(b), "new lines should be merged") {
+		return
+	}
+	src.Append(line.NewRaw(4, "a", false))
+	if !assert.Equal(t, []string{"a", "a", "b", "d"}, bufferStrings(b), "lines dropped from the source should be removed") {
+		return
+	}
+	l, _ := b.LineAt(0)
+	if !assert.Equal(t, uint64(1), l.ID(), "lines with the same text should keep the order of the input") {
+		return
+	}
+	src.Append(line.NewRaw(5, "e", false))
+	assert.Equal(t, []string{"a", "b", "d", "e"}, bufferStrings(b), "lines should follow the source once it is full")
+}
+
+func TestSortOverridesFrecency(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "peco-test-sort-")
+	if !assert.NoError(t, err, "TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	state := newPeco()
+	state.Argv = nil
+	state.Stdin = bytes.NewBufferString("b\nc\na\n")
+	state.frecency, err = LoadFrecency(filepath.Join(dir, "frecency.json"))
+	if !assert.NoError(t, err, "LoadFrecency should succeed") {
+		return
+	}
+	state.frecency.Add("c")
+	go state.Run(ctx)
+	<-state.Ready()
+	<-state.source.SetupDone()
+
+	if !assert.Equal(t, []string{"c", "b", "a"}, bufferStrings(state.CurrentLineBuffer()), "lines with a score should come first") {
+		return
+	}
+	doToggleSort(ctx, state, termbox.Event{})
+	assert.Equal(t, []string{"a", "b", "c"}, bufferStrings(state.CurrentLineBuffer()), "sorted lines should not be ranked")
+}
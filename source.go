@@ -2,28 +2,70 @@ package peco
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lestrrat-go/pdebug"
+	"github.com/peco/peco/internal/i18n"
 	"github.com/peco/peco/internal/util"
 	"github.com/peco/peco/line"
 	"github.com/peco/peco/pipeline"
+	"github.com/pkg/errors"
 )
 
 // Creates a new Source. Does not start processing the input until you
 // call Setup()
 func NewSource(name string, in io.Reader, isInfinite bool, idgen line.IDGenerator, capacity int, enableSep bool) *Source {
+	input := &sourceInput{
+		name:       name,
+		in:         in, // Note that this may be closed, so do not rely on it
+		isInfinite: isInfinite,
+	}
+	return newSource(name, []*sourceInput{input}, idgen, capacity, enableSep)
+}
+
+// NewMultiSource creates a new Source that reads lines from all of
+// the streams specified by specs at the same time (see ParseInputSpec).
+// Does not start processing the input until you call Setup()
+func NewMultiSource(specs []string, idgen line.IDGenerator, capacity int, enableSep bool) (*Source, error) {
+	inputs := make([]*sourceInput, len(specs))
+	for i, spec := range specs {
+		input, err := ParseInputSpec(spec)
+		if err != nil {
+			closeParsedInputs(inputs[:i])
+			return nil, err
+		}
+		inputs[i] = input
+	}
+	return newSource(strings.Join(specs, ","), inputs, idgen, capacity, enableSep), nil
+}
+
+// closeParsedInputs closes the files that ParseInputSpec opened for
+// inputs, when they are not going to be read after all
+func closeParsedInputs(inputs []*sourceInput) {
+	for _, input := range inputs {
+		if f, ok := input.in.(*os.File); ok && !input.isInfinite {
+			f.Close()
+		}
+	}
+}
+
+func newSource(name string, inputs []*sourceInput, idgen line.IDGenerator, capacity int, enableSep bool) *Source {
 	s := &Source{
 		name:       name,
 		capacity:   capacity,
 		enableSep:  enableSep,
+		gen:        newBufferGen(),
 		idgen:      idgen,
-		in:         in, // Note that this may be closed, so do not rely on it
-		inClosed:   false,
-		isInfinite: isInfinite,
+		inputs:     inputs,
 		ready:      make(chan struct{}),
 		setupDone:  make(chan struct{}),
 		ChanOutput: pipeline.ChanOutput(make(chan interface{})),
@@ -32,12 +74,269 @@ func NewSource(name string, in io.Reader, isInfinite bool, idgen line.IDGenerato
 	return s
 }
 
+// ParseInputSpec parses the value of --input, which is one of
+//
+//	fd:N       the file descriptor N, which is read until it is closed
+//	fifo:PATH  the named pipe at PATH, which is read until all writers
+//	           have closed it
+//	-          stdin
+//	PATH       the file at PATH
+func ParseInputSpec(spec string) (*sourceInput, error) {
+	input := &sourceInput{name: spec, isInfinite: true}
+	switch {
+	case strings.HasPrefix(spec, "fd:"):
+		fd, err := strconv.ParseUint(strings.TrimPrefix(spec, "fd:"), 10, 0)
+		if err != nil {
+			return nil, errors.Errorf("invalid input %s: expected a file descriptor number", spec)
+		}
+		input.in = os.NewFile(uintptr(fd), spec)
+	case strings.HasPrefix(spec, "fifo:"):
+		path := strings.TrimPrefix(spec, "fifo:")
+		if path == "" {
+			return nil, errors.Errorf("invalid input %s: expected a path", spec)
+		}
+		// Opening a named pipe blocks until somebody opens it for
+		// writing, so it is opened by Setup, without holding up the
+		// other inputs
+		input.open = func() (io.Reader, error) {
+			return os.Open(path)
+		}
+	case spec == "-":
+		input.in = os.Stdin
+	default:
+		f, err := os.Open(spec)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open file for input")
+		}
+		input.in = f
+		input.isInfinite = false
+	}
+	return input, nil
+}
+
 func (s *Source) Name() string {
 	return s.name
 }
 
+// IsInfinite returns true while any of the inputs that may never end,
+// such as stdin, is still being read
 func (s *Source) IsInfinite() bool {
-	return s.isInfinite && !s.inClosed
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, input := range s.inputs {
+		if input.isInfinite && !input.closed {
+			return true
+		}
+	}
+	return false
+}
+
+// Origin returns the name of the input that the line with the given
+// ID was read from
+func (s *Source) Origin(id uint64) string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if len(s.inputs) == 1 {
+		return s.inputs[0].name
+	}
+
+	// Find the last run that starts at or before id
+	i := sort.Search(len(s.origins), func(i int) bool {
+		return s.origins[i].from > id
+	})
+	if i == 0 {
+		return ""
+	}
+	return s.inputs[s.origins[i-1].input].name
+}
+
+// recordOrigin records that the line with the given ID, which must be
+// newer than any recorded before, was read from the n-th input
+func (s *Source) recordOrigin(id uint64, n int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if l := len(s.origins); l > 0 && s.origins[l-1].input == n {
+		return
+	}
+	s.origins = append(s.origins, originRun{from: id, input: n})
+}
+
+// openInput returns the reader of input, opening it first if needed
+func (s *Source) openInput(input *sourceInput) (io.Reader, error) {
+	s.mutex.RLock()
+	in := input.in
+	s.mutex.RUnlock()
+	if in != nil {
+		return in, nil
+	}
+
+	in, err := input.open()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open input %s", input.name)
+	}
+	s.mutex.Lock()
+	input.in = in
+	s.mutex.Unlock()
+	return in, nil
+}
+
+// closeInput closes input, unless it is a terminal, or it has already
+// been closed
+func (s *Source) closeInput(input *sourceInput) {
+	s.mutex.Lock()
+	in := input.in
+	if input.closed || in == nil || util.IsTty(in) {
+		s.mutex.Unlock()
+		return
+	}
+	closer, ok := in.(io.Closer)
+	if ok {
+		input.closed = true
+	}
+	s.mutex.Unlock()
+
+	if ok {
+		closer.Close()
+	}
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	atomic.AddInt64(&r.read, int64(n))
+	if r.total != nil {
+		atomic.AddInt64(&r.total.read, int64(n))
+	}
+	return n, err
+}
+
+// BytesRead returns the number of bytes read so far
+func (r *progressReader) BytesRead() int64 {
+	return atomic.LoadInt64(&r.read)
+}
+
+// SetNullSeparated makes the source read records terminated by NUL
+// (\0) instead of lines, so that they can contain newlines
+func (s *Source) SetNullSeparated(b bool) {
+	s.read0 = b
+}
+
+// scanNull is a bufio.SplitFunc that returns records terminated by
+// NUL. The last record does not need to be terminated
+func scanNull(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	// Request more data
+	return 0, nil, nil
+}
+
+// inputSize returns the size of in, if it is a regular file.
+// Otherwise it returns -1
+func inputSize(in io.Reader) int64 {
+	f, ok := in.(*os.File)
+	if !ok {
+		return -1
+	}
+
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return -1
+	}
+	return fi.Size()
+}
+
+// inputsSize returns the total size of inputs, if all of them are
+// regular files. Otherwise it returns -1
+func inputsSize(inputs []*sourceInput) int64 {
+	var total int64
+	for _, input := range inputs {
+		if input.in == nil {
+			return -1
+		}
+		size := inputSize(input.in)
+		if size < 0 {
+			return -1
+		}
+		total += size
+	}
+	return total
+}
+
+// progressMessage describes how much of the input has been read. If
+// the size of the input is not known, the number of lines is used
+// instead
+func progressMessage(read, size, lines int64) string {
+	if size <= 0 {
+		return i18n.Sprintf("%d lines", lines)
+	}
+	if read > size {
+		// The file may have grown while we are reading it
+		read = size
+	}
+	return strconv.FormatInt(read*100/size, 10) + "%"
+}
+
+// TrackCommonPrefix makes the source keep track of the prefix shared
+// by all of its lines, which is returned by CommonPrefix. It must be
+// called before Setup
+func (s *Source) TrackCommonPrefix(b bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.trackPrefix = b
+}
+
+// CommonPrefix returns the longest prefix shared by all of the lines
+// read so far that ends with a path separator or a space, so that
+// words are not cut in half. It is empty until two lines have been
+// read, as the prefix of a single line is meaningless
+func (s *Source) CommonPrefix() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.prefixLines < 2 {
+		return ""
+	}
+	return s.commonPrefix
+}
+
+// updateCommonPrefix narrows the common prefix down to what is shared
+// with a new line. It must be called with the mutex held
+func (s *Source) updateCommonPrefix(display string) {
+	prefix := display
+	if s.prefixLines > 0 {
+		prefix = s.commonPrefix
+		n := 0
+		for n < len(prefix) && n < len(display) && prefix[n] == display[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	s.commonPrefix = prefix[:strings.LastIndexAny(prefix, "/\\ \t")+1]
+	s.prefixLines++
+}
+
+// Progress returns how much of the input has been read, to be
+// displayed in the prompt. It is empty once all of the input has
+// been read
+func (s *Source) Progress() string {
+	select {
+	case <-s.setupDone:
+		return ""
+	default:
+	}
+
+	s.mutex.RLock()
+	in, size := s.progress, s.size
+	s.mutex.RUnlock()
+	if in == nil {
+		return ""
+	}
+	return progressMessage(in.BytesRead(), size, s.LinesRead())
 }
 
 // Setup reads from the input os.File.
@@ -46,7 +345,6 @@ func (s *Source) Setup(ctx context.Context, state *Peco) {
 		done := make(chan struct{})
 		refresh := make(chan struct{}, 1)
 		defer close(done)
-		defer close(refresh)
 		// And also, close the done channel so we can tell the consumers
 		// we have finished reading everything
 		defer close(s.setupDone)
@@ -55,17 +353,56 @@ func (s *Source) Setup(ctx context.Context, state *Peco) {
 			state.Hub().SendDraw(ctx, nil)
 		}
 
-		go func() {
-			ticker := time.NewTicker(100 * time.Millisecond)
-			defer ticker.Stop()
+		// Bytes read from all of the inputs are counted together
+		in := &progressReader{}
+		s.mutex.Lock()
+		s.progress = in
+		s.size = inputsSize(s.inputs)
+		s.mutex.Unlock()
+
+		settle := DefaultInputSettleInterval
+		if v := state.config.InputSettleInterval; v > 0 {
+			settle = time.Duration(v) * time.Millisecond
+		}
 
+		go func() {
+			// The screen is only redrawn when lines have been read.
+			// Lines that are read within the settle interval after
+			// the first one are drawn together, so that a busy input
+			// does not cause a redraw per line, and a quiet one does
+			// not cause any
+			var settled <-chan time.Time
+
+			// Meanwhile, the progress is displayed in the prompt
+			// along with a spinner, which only needs the prompt to
+			// be redrawn. An input that is kept open without writing
+			// anything does not make any progress, so the prompt is
+			// left alone until it does
+			var progress string
+			spin := time.NewTicker(spinnerInterval)
+			defer spin.Stop()
 			for {
 				select {
 				case <-done:
 					draw(state)
 					return
-				case <-ticker.C:
+				case <-refresh:
+					if settled == nil {
+						settled = time.After(settle)
+					}
+				case <-settled:
+					settled = nil
 					draw(state)
+				case <-spin.C:
+					// Nothing is displayed before the first line
+					select {
+					case <-s.ready:
+						if p := s.Progress(); p != progress {
+							progress = p
+							state.Hub().SendDrawPrompt(ctx)
+						}
+					default:
+					}
 				}
 			}
 		}()
@@ -78,7 +415,7 @@ func (s *Source) Setup(ctx context.Context, state *Peco) {
 		notifycb := func() {
 			// close the ready channel so others can be notified
 			// that there's at least 1 line in the buffer
-			state.Hub().SendStatusMsg(ctx, "")
+			state.SendStatus(ctx, StatusInfo, "")
 			close(s.ready)
 		}
 
@@ -90,44 +427,32 @@ func (s *Source) Setup(ctx context.Context, state *Peco) {
 		if pdebug.Enabled {
 			pdebug.Printf("Source: using buffer size of %dkb", state.maxScanBufferSize)
 		}
-		scanbuf := make([]byte, state.maxScanBufferSize*1024)
-		scanner := bufio.NewScanner(s.in)
-		scanner.Buffer(scanbuf, state.maxScanBufferSize*1024)
 		defer func() {
-			if util.IsTty(s.in) {
-				return
-			}
-			if closer, ok := s.in.(io.Closer); ok {
-				s.inClosed = true
-				closer.Close()
+			for _, input := range s.inputs {
+				s.closeInput(input)
 			}
 		}()
 
-		lines := make(chan string)
+		// Each input is scanned in its own goroutine. The lines are
+		// appended in the order that they arrive, and all of the
+		// inputs have been read once lines is closed
+		lines := make(chan sourceLine)
+		var wg sync.WaitGroup
+		for i, input := range s.inputs {
+			wg.Add(1)
+			go func(n int, input *sourceInput) {
+				defer wg.Done()
+				defer s.closeInput(input)
+				s.scanInput(ctx, state, n, input, in, lines)
+			}(i, input)
+		}
 		go func() {
-			var scanned int
-			if pdebug.Enabled {
-				defer func() { pdebug.Printf("Source scanned %d lines", scanned) }()
-			}
-
-			defer close(lines)
-			for scanner.Scan() {
-				newLine := scanner.Text()
-				select {
-				case <-ctx.Done():
-					if pdebug.Enabled {
-						pdebug.Printf("Bailing out of source setup text reader loop, because ctx was canceled")
-					}
-					return
-				case lines <- newLine:
-				}
-				scanned++
-			}
+			wg.Wait()
+			close(lines)
 		}()
 
-		state.Hub().SendStatusMsg(ctx, "Waiting for input...")
+		state.SendStatus(ctx, StatusInfo, i18n.T("Waiting for input..."))
 
-		readCount := 0
 		for loop := true; loop; {
 			select {
 			case <-ctx.Done():
@@ -144,18 +469,73 @@ func (s *Source) Setup(ctx context.Context, state *Peco) {
 					break
 				}
 
-				readCount++
-				s.Append(line.NewRaw(s.idgen.Next(), l, s.enableSep))
+				atomic.AddInt64(&s.linesRead, 1)
+				id := s.idgen.Next()
+				if ctx.Err() != nil {
+					// peco is exiting, in which case the ID may not
+					// be unique. The line is not needed anyway
+					return
+				}
+				if len(s.inputs) > 1 {
+					s.recordOrigin(id, l.input)
+				}
+				s.Append(line.NewRaw(id, l.text, s.enableSep))
 				notify.Do(notifycb)
+
+				// Let the draw goroutine know, unless it already
+				// has been told about a previous line
+				select {
+				case refresh <- struct{}{}:
+				default:
+				}
 			}
 		}
 
 		if pdebug.Enabled {
-			pdebug.Printf("Read all %d lines from source", readCount)
+			pdebug.Printf("Read all %d lines from source", s.LinesRead())
 		}
 	})
 }
 
+// scanInput sends the lines read from the n-th input to lines, until
+// it ends or ctx is canceled. The bytes read are counted by progress
+func (s *Source) scanInput(ctx context.Context, state *Peco, n int, input *sourceInput, progress *progressReader, lines chan<- sourceLine) {
+	var scanned int
+	if pdebug.Enabled {
+		defer func() { pdebug.Printf("Source scanned %d lines from %s", scanned, input.name) }()
+	}
+
+	r, err := s.openInput(input)
+	if err != nil {
+		state.SendStatusAndClear(ctx, StatusError, err.Error(), 2*time.Second)
+		return
+	}
+
+	// Setup may have given up while the input was being opened, in
+	// which case it is closed by the caller, without being read
+	if ctx.Err() != nil {
+		return
+	}
+
+	scanbuf := make([]byte, state.maxScanBufferSize*1024)
+	scanner := bufio.NewScanner(&progressReader{Reader: r, total: progress})
+	scanner.Buffer(scanbuf, state.maxScanBufferSize*1024)
+	if s.read0 {
+		scanner.Split(scanNull)
+	}
+	for scanner.Scan() {
+		select {
+		case <-ctx.Done():
+			if pdebug.Enabled {
+				pdebug.Printf("Bailing out of source setup text reader loop, because ctx was canceled")
+			}
+			return
+		case lines <- sourceLine{input: n, text: scanner.Text()}:
+		}
+		scanned++
+	}
+}
+
 // Start starts
 func (s *Source) Start(ctx context.Context, out pipeline.ChanOutput) {
 	var sent int
@@ -167,6 +547,22 @@ func (s *Source) Start(ctx context.Context, out pipeline.ChanOutput) {
 	}
 	defer out.SendEndMark("end of input")
 
+	// Lines that were spilled to disk are older than anything that
+	// is in memory, so send them first
+	s.mutex.RLock()
+	sf := s.spill
+	s.mutex.RUnlock()
+	if sf != nil {
+		err := sf.Each(ctx, s.enableSep, func(l line.Line) bool {
+			out.Send(l)
+			sent++
+			return true
+		})
+		if err != nil && pdebug.Enabled {
+			pdebug.Printf("Source: failed to read spilled lines: %s", err)
+		}
+	}
+
 	var resume bool
 	select {
 	case <-s.setupDone:
@@ -227,11 +623,34 @@ func (s *Source) Start(ctx context.Context, out pipeline.ChanOutput) {
 		case <-s.setupDone:
 			setupDone = true
 		default:
+			s.waitGrowth(ctx, upto)
 		}
 
 	}
 }
 
+// waitGrowth blocks until the buffer holds more than size lines, or
+// all input has been read, so that Start does not spin while waiting
+// for the input
+func (s *Source) waitGrowth(ctx context.Context, size int) {
+	s.mutex.Lock()
+	if bufferSize(s.lines) > size {
+		s.mutex.Unlock()
+		return
+	}
+	if s.grown == nil {
+		s.grown = make(chan struct{})
+	}
+	grown := s.grown
+	s.mutex.Unlock()
+
+	select {
+	case <-ctx.Done():
+	case <-s.setupDone:
+	case <-grown:
+	}
+}
+
 // Reset resets the state of the source object so that it
 // is ready to feed the filters
 func (s *Source) Reset() {
@@ -254,10 +673,16 @@ func (s *Source) SetupDone() <-chan struct{} {
 	return s.setupDone
 }
 
+// LinesRead returns the number of lines that have been read from the
+// input, including the ones that no longer fit in the buffer
+func (s *Source) LinesRead() int64 {
+	return atomic.LoadInt64(&s.linesRead)
+}
+
 func (s *Source) linesInRange(start, end int) []line.Line {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
-	return s.lines[start:end]
+	return bufferLinesInRange(s.lines, start, end)
 }
 
 func (s *Source) LineAt(n int) (line.Line, error) {
@@ -274,13 +699,82 @@ func (s *Source) Size() int {
 
 func (s *Source) Append(l line.Line) {
 	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
+	if s.trackPrefix {
+		s.updateCommonPrefix(l.DisplayString())
+	}
 	s.lines = append(s.lines, l)
+	if s.grown != nil {
+		close(s.grown)
+		s.grown = nil
+	}
+
+	var spilled []line.Line
 	if s.capacity > 0 && len(s.lines) > s.capacity {
 		diff := len(s.lines) - s.capacity
+		spilled = s.lines[:diff]
+
+		// The lines that are kept are not copied. They are left
+		// behind, along with the dropped ones, once append needs a
+		// larger array, which only happens every so many lines
+		s.lines = s.lines[diff:]
+		s.dropped += diff
+	}
+
+	sf := s.spill
+	if sf == nil || len(spilled) == 0 {
+		s.mutex.Unlock()
+		return
+	}
+
+	// Lines that no longer fit are moved to disk, without keeping
+	// the lines from being read meanwhile. The spill file is locked
+	// first, so that they are not missed by queries that start now
+	sf.mutex.Lock()
+	s.mutex.Unlock()
+	defer sf.mutex.Unlock()
+	for _, old := range spilled {
+		if err := sf.write(old); err != nil {
+			if pdebug.Enabled {
+				pdebug.Printf("Source: failed to spill line: %s", err)
+			}
+			break
+		}
+	}
+}
+
+// versionedLines returns the lines that are held in memory. Lines that
+// no longer fit are dropped from the beginning
+func (s *Source) versionedLines() ([]line.Line, bufferVersion) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	n := len(s.lines)
+	return s.lines[:n:n], bufferVersion{gen: s.gen, appended: s.dropped + n}
+}
+
+// SpillToDisk makes the source store lines that overflow its
+// capacity in a temporary file, instead of discarding them.
+// Spilled lines are no longer displayed when there is no query,
+// but are still matched against queries
+func (s *Source) SpillToDisk() error {
+	sf, err := newSpillFile()
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.spill = sf
+	return nil
+}
+
+// Close releases resources held by the source, such as the spill file
+func (s *Source) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-		// Golang's version of array realloc
-		s.lines = s.lines[diff:s.capacity:s.capacity]
+	if sf := s.spill; sf != nil {
+		s.spill = nil
+		return sf.Close()
 	}
+	return nil
 }
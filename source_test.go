@@ -2,12 +2,19 @@ package peco
 
 import (
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"context"
+	"github.com/peco/peco/line"
+	"github.com/peco/peco/pipeline"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -86,3 +93,389 @@ func TestSource(t *testing.T) {
 		}
 	}
 }
+
+func TestSourceSpillToDisk(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ig := newIDGen()
+	go ig.Run(ctx)
+
+	s := NewSource("-", strings.NewReader(""), false, ig, 3, false)
+	if !assert.NoError(t, s.SpillToDisk(), "s.SpillToDisk should succeed") {
+		return
+	}
+	defer s.Close()
+
+	lines := []string{"foo", "bar", "baz", "qux", "quux"}
+	for i, l := range lines {
+		s.Append(line.NewRaw(uint64(i), l, false))
+	}
+
+	if !assert.Equal(t, 3, s.Size(), "only 3 lines should be kept in memory") {
+		return
+	}
+	if !assert.Equal(t, 2, s.spill.Len(), "2 lines should be spilled to disk") {
+		return
+	}
+
+	// Pretend that we are done reading, so Start() does not wait for more
+	close(s.setupDone)
+
+	out := pipeline.ChanOutput(make(chan interface{}))
+	go s.Start(ctx, out)
+
+	var got []string
+	for v := range out.OutCh() {
+		l, ok := v.(line.Line)
+		if !ok {
+			break
+		}
+		got = append(got, l.DisplayString())
+	}
+
+	if !assert.Equal(t, lines, got, "spilled lines should be sent before lines in memory") {
+		return
+	}
+}
+
+func TestSourceDropsOldLines(t *testing.T) {
+	s := NewSource("-", strings.NewReader(""), false, nil, 100, false)
+
+	// The lines that are kept are only copied once in a while, when
+	// a larger array is needed
+	var copies int
+	var end *line.Line
+	for i := 0; i < 10000; i++ {
+		s.Append(line.NewRaw(uint64(i), strconv.Itoa(i), false))
+		if e := &s.lines[:cap(s.lines)][cap(s.lines)-1]; e != end {
+			end = e
+			copies++
+		}
+	}
+	assert.True(t, copies < 100, "lines should not be copied each time one is dropped (copied %d times)", copies)
+
+	if !assert.Equal(t, 100, s.Size(), "only 100 lines should be kept in memory") {
+		return
+	}
+	for i := 0; i < 100; i++ {
+		l, err := s.LineAt(i)
+		if !assert.NoError(t, err, "s.LineAt(%d) should succeed", i) {
+			return
+		}
+		if !assert.Equal(t, strconv.Itoa(9900+i), l.DisplayString(), "the last lines should be kept") {
+			return
+		}
+	}
+}
+
+func TestProgressMessage(t *testing.T) {
+	assert.Equal(t, "0%", progressMessage(0, 200, 0), "percentage should be displayed for files")
+	assert.Equal(t, "50%", progressMessage(100, 200, 10), "percentage should be displayed for files")
+	assert.Equal(t, "100%", progressMessage(300, 200, 10), "percentage should not exceed 100")
+	assert.Equal(t, "10 lines", progressMessage(100, -1, 10), "line count should be displayed for streams")
+
+	r := &progressReader{Reader: strings.NewReader("foo\nbar\n")}
+	io.Copy(ioutil.Discard, r)
+	assert.Equal(t, int64(8), r.BytesRead(), "all bytes should be counted")
+	assert.Equal(t, int64(-1), inputSize(r), "size of streams should be unknown")
+
+	f, err := ioutil.TempFile("", "peco-test-")
+	if !assert.NoError(t, err, "TempFile should succeed") {
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	f.WriteString("foo\nbar\n")
+	assert.Equal(t, int64(8), inputSize(f), "size of files should be known")
+}
+
+// drawCountingHub counts the number of draw requests
+type drawCountingHub struct {
+	nullHub
+	draws   int32
+	prompts int32
+}
+
+func (h *drawCountingHub) SendDraw(_ context.Context, _ interface{}) {
+	atomic.AddInt32(&h.draws, 1)
+}
+
+func (h *drawCountingHub) SendDrawPrompt(_ context.Context) {
+	atomic.AddInt32(&h.prompts, 1)
+}
+
+func TestSourceRedraw(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ig := newIDGen()
+	go ig.Run(ctx)
+
+	r, w := io.Pipe()
+	defer w.Close()
+
+	s := NewSource("-", r, true, ig, 0, false)
+	h := &drawCountingHub{}
+	p := New()
+	p.hub = h
+	p.config.InputSettleInterval = 10
+	go s.Setup(ctx, p)
+
+	io.WriteString(w, "foo\nbar\n")
+	<-s.Ready()
+	time.Sleep(100 * time.Millisecond)
+	draws := atomic.LoadInt32(&h.draws)
+	if !assert.True(t, draws > 0, "new lines should be drawn") {
+		return
+	}
+
+	// The progress is drawn on the first tick of the spinner
+	time.Sleep(2 * spinnerInterval)
+	prompts := atomic.LoadInt32(&h.prompts)
+	time.Sleep(200 * time.Millisecond)
+	if !assert.Equal(t, draws, atomic.LoadInt32(&h.draws), "nothing should be drawn while there is no input") {
+		return
+	}
+	if !assert.Equal(t, prompts, atomic.LoadInt32(&h.prompts), "the prompt should not be drawn while there is no input") {
+		return
+	}
+
+	io.WriteString(w, "baz\n")
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, atomic.LoadInt32(&h.draws) > draws, "new lines should be drawn")
+}
+
+func TestMultiSource(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ig := newIDGen()
+	go ig.Run(ctx)
+
+	dir, err := ioutil.TempDir("", "peco-test-")
+	if !assert.NoError(t, err, "creating temporary directory should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "file")
+	if !assert.NoError(t, ioutil.WriteFile(file, []byte("foo\nbar\n"), 0600), "writing input file should succeed") {
+		return
+	}
+
+	r, w, err := os.Pipe()
+	if !assert.NoError(t, err, "creating pipe should succeed") {
+		return
+	}
+	defer w.Close()
+	// Keeps r from being closed by its finalizer while it is read
+	// through the file descriptor
+	defer r.Close()
+
+	fd := "fd:" + strconv.Itoa(int(r.Fd()))
+	s, err := NewMultiSource([]string{file, fd}, ig, 0, false)
+	if !assert.NoError(t, err, "NewMultiSource should succeed") {
+		return
+	}
+	p := New()
+	p.hub = nullHub{}
+	go s.Setup(ctx, p)
+
+	<-s.Ready()
+	io.WriteString(w, "baz\n")
+
+	timeout := time.After(5 * time.Second)
+	for s.Size() != 3 {
+		select {
+		case <-timeout:
+			assert.Fail(t, "timed out waiting for the buffer to fill")
+			return
+		default:
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	origins := map[string]string{}
+	for i := 0; i < s.Size(); i++ {
+		l, err := s.LineAt(i)
+		if !assert.NoError(t, err, "LineAt should succeed") {
+			return
+		}
+		origins[l.DisplayString()] = s.Origin(l.ID())
+	}
+	assert.Equal(t, map[string]string{"foo": file, "bar": file, "baz": fd}, origins, "lines should be tagged with their input")
+	assert.True(t, s.IsInfinite(), "source should be infinite while the pipe is open")
+
+	select {
+	case <-s.SetupDone():
+		assert.Fail(t, "setup should not be done while the pipe is open")
+		return
+	default:
+	}
+
+	w.Close()
+	select {
+	case <-s.SetupDone():
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "timed out waiting for setup to be done")
+		return
+	}
+	assert.False(t, s.IsInfinite(), "source should not be infinite once all inputs are closed")
+
+	_, err = NewMultiSource([]string{"fd:x"}, ig, 0, false)
+	if !assert.Error(t, err, "invalid file descriptors should be rejected") {
+		return
+	}
+
+	// Files opened for the specs that come before an invalid one are
+	// closed again
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return
+	}
+	for i := 0; i < 10; i++ {
+		_, err = NewMultiSource([]string{file, "fd:x"}, ig, 0, false)
+		if !assert.Error(t, err, "invalid file descriptors should be rejected") {
+			return
+		}
+	}
+	after, err := ioutil.ReadDir("/proc/self/fd")
+	if !assert.NoError(t, err, "reading open file descriptors should succeed") {
+		return
+	}
+	assert.Equal(t, len(fds), len(after), "files should not be left open")
+}
+
+func TestSourceRead0(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ig := newIDGen()
+	go ig.Run(ctx)
+
+	s := NewSource("-", strings.NewReader("foo\nbar\x00\x00baz\r\x00qux"), false, ig, 0, false)
+	s.SetNullSeparated(true)
+	p := New()
+	p.hub = nullHub{}
+	s.Setup(ctx, p)
+
+	var records []string
+	for i := 0; i < s.Size(); i++ {
+		l, err := s.LineAt(i)
+		if !assert.NoError(t, err, "LineAt should succeed") {
+			return
+		}
+		records = append(records, l.Buffer())
+	}
+	assert.Equal(t, []string{"foo\nbar", "", "baz\r", "qux"}, records, "records should be split on NUL only, and kept intact")
+}
+
+func TestSourceWaitGrowth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ig := newIDGen()
+	go ig.Run(ctx)
+
+	s := NewSource("-", strings.NewReader(""), false, ig, 0, false)
+	s.Append(line.NewRaw(0, "foo", false))
+
+	returned := make(chan struct{})
+	go func() {
+		defer close(returned)
+		s.waitGrowth(ctx, 1)
+	}()
+
+	select {
+	case <-returned:
+		t.Fatalf("waitGrowth should wait until a line is appended")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.Append(line.NewRaw(1, "bar", false))
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("waitGrowth should return once a line is appended")
+	}
+
+	// It returns right away if the buffer has already grown
+	s.waitGrowth(ctx, 1)
+}
+
+func TestSourceSeparator(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ig := newIDGen()
+	go ig.Run(ctx)
+
+	s := NewSource("-", strings.NewReader("display 1\x00output 1\nplain\n"), false, ig, 0, true)
+	p := New()
+	p.hub = nullHub{}
+	s.Setup(ctx, p)
+
+	expected := [][2]string{{"display 1", "output 1"}, {"plain", "plain"}}
+	for i, e := range expected {
+		l, err := s.LineAt(i)
+		if !assert.NoError(t, err, "LineAt should succeed") {
+			return
+		}
+		// The separator is searched for by whichever of Output and
+		// DisplayString is called first
+		if !assert.Equal(t, e[1], l.Output(), "line %d should emit the part after the separator", i) {
+			return
+		}
+		if !assert.Equal(t, e[0], l.DisplayString(), "line %d should display the part before the separator", i) {
+			return
+		}
+	}
+}
+
+func TestSourceProgress(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ig := newIDGen()
+	go ig.Run(ctx)
+
+	r, w := io.Pipe()
+	s := NewSource("-", r, true, ig, 0, false)
+	p := New()
+	p.hub = nullHub{}
+	p.source = s
+	assert.Equal(t, "", s.Progress(), "nothing should be displayed before reading starts")
+
+	go s.Setup(ctx, p)
+	go io.WriteString(w, "foo\nbar\n")
+	<-s.Ready()
+	for s.LinesRead() < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, "2 lines", s.Progress(), "lines read should be displayed for streams")
+	assert.Regexp(t, `^[|/\\-] 2 lines`, rightPrompt(p), "spinner and progress should come first in the prompt")
+
+	w.Close()
+	<-s.SetupDone()
+	assert.Equal(t, "", s.Progress(), "nothing should be displayed once all input has been read")
+	assert.Equal(t, expandRPrompt(p.RPrompt(), p), rightPrompt(p), "prompt should be back to normal")
+}
+
+func TestSourceCommonPrefix(t *testing.T) {
+	s := NewSource("-", nil, false, nil, 0, false)
+	s.TrackCommonPrefix(true)
+
+	s.Append(line.NewRaw(0, "/home/peco/src/peco/layout.go", false))
+	assert.Equal(t, "", s.CommonPrefix(), "a single line should have no common prefix")
+
+	s.Append(line.NewRaw(1, "/home/peco/src/peco/source.go", false))
+	assert.Equal(t, "/home/peco/src/peco/", s.CommonPrefix(), "prefix should end at a path separator")
+
+	s.Append(line.NewRaw(2, "/home/peco/src/pecotest/driver.go", false))
+	assert.Equal(t, "/home/peco/src/", s.CommonPrefix(), "prefix should not cut names in half")
+
+	s.Append(line.NewRaw(3, "README.md", false))
+	assert.Equal(t, "", s.CommonPrefix(), "prefix should be empty once nothing is shared")
+}
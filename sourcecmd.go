@@ -0,0 +1,95 @@
+package peco
+
+import (
+	"context"
+	"io"
+	"os/exec"
+	"time"
+
+	"github.com/lestrrat-go/pdebug"
+	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/internal/i18n"
+	"github.com/peco/peco/internal/util"
+	"github.com/peco/peco/line"
+	"github.com/pkg/errors"
+)
+
+// NewCommandSource creates a new Source that reads the output of
+// command, which is run with the shell once Setup is called. The
+// command is killed once the source stops reading, if it is still
+// running. Does not start processing the input until you call Setup()
+func NewCommandSource(command string, idgen line.IDGenerator, capacity int, enableSep bool) *Source {
+	input := &sourceInput{
+		name: command,
+		open: func() (io.Reader, error) {
+			return startCommand(command)
+		},
+		// The command may keep producing output, as tail -f does
+		isInfinite: true,
+	}
+	return newSource(command, []*sourceInput{input}, idgen, capacity, enableSep)
+}
+
+// commandReader reads the output of a command that was started by
+// startCommand
+type commandReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+// startCommand runs command with the shell, and returns its output
+func startCommand(command string) (*commandReader, error) {
+	cmd := util.Shell(command)
+	setProcessGroup(cmd)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create pipe for command")
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "failed to run %s", command)
+	}
+	return &commandReader{ReadCloser: out, cmd: cmd}, nil
+}
+
+// Close kills the command, as nothing reads its output anymore, and
+// waits for it to exit
+func (r *commandReader) Close() error {
+	killCommand(r.cmd)
+	r.ReadCloser.Close()
+	r.cmd.Wait()
+	return nil
+}
+
+// reloadSource runs --source-cmd again, and replaces the input with
+// its output. The command that is still running, if any, is killed.
+// Selected lines remain selected
+func (p *Peco) reloadSource(ctx context.Context) error {
+	src, err := p.newInputSource()
+	if err != nil {
+		return err
+	}
+
+	old := p.startSource(ctx, src)
+	old.Close()
+
+	// The new lines are displayed, and matched against the query, as
+	// they are read
+	p.viewSnapshot(ctx, nil)
+	return nil
+}
+
+// doReloadInput implements peco.ReloadInput
+func doReloadInput(ctx context.Context, state *Peco, _ termbox.Event) {
+	if pdebug.Enabled {
+		g := pdebug.Marker("doReloadInput")
+		defer g.End()
+	}
+
+	if state.sourceCmd == "" {
+		state.SendStatusAndClear(ctx, StatusWarn, i18n.T("The input can only be reloaded with --source-cmd"), 2*time.Second)
+		return
+	}
+	if err := state.reloadSource(ctx); err != nil {
+		state.SendStatusAndClear(ctx, StatusError, err.Error(), 2*time.Second)
+	}
+}
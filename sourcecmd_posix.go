@@ -0,0 +1,26 @@
+// +build !windows
+
+package peco
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup makes cmd the leader of a new process group, so
+// that any processes it spawns can be killed along with it
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killCommand kills the process group of cmd. Commands such as
+// `sh -c "find . | sort"` run in child processes of the shell, which
+// would otherwise keep running
+func killCommand(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		cmd.Process.Kill()
+	}
+}
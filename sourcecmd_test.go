@@ -0,0 +1,84 @@
+package peco
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/internal/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSourceCmd(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires /bin/sh")
+	}
+
+	var options CLIOptions
+	_, err := options.parse([]string{"--source-cmd", "ls", "--input", "-"})
+	assert.Error(t, err, "--source-cmd should not be used with --input")
+
+	dir, err := ioutil.TempDir("", "peco-test-")
+	if !assert.NoError(t, err, "ioutil.TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "input")
+	if !assert.NoError(t, ioutil.WriteFile(input, []byte("first\n"), 0644), "ioutil.WriteFile should succeed") {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The command keeps running after printing the lines
+	command := "cat " + util.ShellQuote(input) + "; exec sleep 60"
+	p := newPeco()
+	p.Argv = []string{"peco", "--source-cmd", command}
+	p.Stdin = &bytes.Buffer{}
+
+	runCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	errCh := startPeco(runCtx, t, p, 1, 1)
+	assert.Equal(t, command, p.source.Name(), "the source should be named after the command")
+
+	process := func() *os.Process {
+		return p.inputSource().inputs[0].in.(*commandReader).cmd.Process
+	}
+	exited := func(proc *os.Process) bool {
+		return proc.Signal(syscall.Signal(0)) != nil
+	}
+	first := process()
+
+	if !assert.NoError(t, ioutil.WriteFile(input, []byte("second\nthird\n"), 0644), "ioutil.WriteFile should succeed") {
+		return
+	}
+	nameToActions["peco.ReloadInput"].Execute(runCtx, p, termbox.Event{})
+	waitLines(ctx, p, 2, 2)
+	l, err := p.CurrentLineBuffer().LineAt(0)
+	if assert.NoError(t, err, "LineAt should succeed") {
+		assert.Equal(t, "second", l.DisplayString(), "the output of the command should replace the input")
+	}
+
+	for !exited(first) && ctx.Err() == nil {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.True(t, exited(first), "the previous command should be killed")
+
+	second := process()
+	stop()
+	select {
+	case <-ctx.Done():
+		t.Fatalf("timed out waiting for peco to exit")
+	case <-errCh:
+	}
+	assert.True(t, exited(second), "the command should be killed once peco exits")
+}
@@ -0,0 +1,120 @@
+package peco
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/peco/peco/line"
+	"github.com/pkg/errors"
+)
+
+// newSpillFile creates a temporary file to hold lines that overflowed
+// the in-memory buffer
+func newSpillFile() (*spillFile, error) {
+	f, err := ioutil.TempFile("", "peco-spill-")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create spill file")
+	}
+
+	return &spillFile{
+		file: f,
+		w:    bufio.NewWriter(f),
+	}, nil
+}
+
+// Write appends a line to the spill file. Each line is stored as
+// its ID and the length of its raw buffer, both as uvarints, followed
+// by the raw buffer itself
+func (sf *spillFile) Write(l line.Line) error {
+	sf.mutex.Lock()
+	defer sf.mutex.Unlock()
+	return sf.write(l)
+}
+
+// write is Write, for when the mutex is already held
+func (sf *spillFile) write(l line.Line) error {
+	var hdr [2 * binary.MaxVarintLen64]byte
+	buf := l.Buffer()
+	n := binary.PutUvarint(hdr[:], l.ID())
+	n += binary.PutUvarint(hdr[n:], uint64(len(buf)))
+	if _, err := sf.w.Write(hdr[:n]); err != nil {
+		return errors.Wrap(err, "failed to write to spill file")
+	}
+	if _, err := sf.w.WriteString(buf); err != nil {
+		return errors.Wrap(err, "failed to write to spill file")
+	}
+	sf.size += int64(n + len(buf))
+	sf.count++
+	return nil
+}
+
+// Len returns the number of lines in the spill file
+func (sf *spillFile) Len() int {
+	sf.mutex.Lock()
+	defer sf.mutex.Unlock()
+	return sf.count
+}
+
+// Each reads back the lines that have been written so far, and calls
+// f for each of them until f returns false. Lines that are written
+// while Each is running are not visited
+func (sf *spillFile) Each(ctx context.Context, enableSep bool, f func(line.Line) bool) error {
+	sf.mutex.Lock()
+	err := sf.w.Flush()
+	size := sf.size
+	sf.mutex.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "failed to flush spill file")
+	}
+
+	rdr := bufio.NewReader(io.NewSectionReader(sf.file, 0, size))
+	var buf []byte
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		id, err := binary.ReadUvarint(rdr)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to read from spill file")
+		}
+
+		n, err := binary.ReadUvarint(rdr)
+		if err != nil {
+			return errors.Wrap(err, "failed to read from spill file")
+		}
+
+		if uint64(cap(buf)) < n {
+			buf = make([]byte, n)
+		}
+		buf = buf[:n]
+		if _, err := io.ReadFull(rdr, buf); err != nil {
+			return errors.Wrap(err, "failed to read from spill file")
+		}
+
+		if !f(line.NewRaw(id, string(buf), enableSep)) {
+			return nil
+		}
+	}
+}
+
+// Close closes and removes the spill file
+func (sf *spillFile) Close() error {
+	sf.mutex.Lock()
+	defer sf.mutex.Unlock()
+
+	name := sf.file.Name()
+	if err := sf.file.Close(); err != nil {
+		return errors.Wrap(err, "failed to close spill file")
+	}
+	return os.Remove(name)
+}
@@ -0,0 +1,79 @@
+package peco
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/internal/i18n"
+	"github.com/peco/peco/line"
+	"github.com/pkg/errors"
+)
+
+// resolveTermMatchAction resolves peco.NextTermMatch.N and
+// peco.PreviousTermMatch.N, where N is the 1-based ordinal of a query
+// term. The second return value is false if the action name is not
+// one of these
+func resolveTermMatchAction(name string) (Action, bool, error) {
+	var dir int
+	var arg string
+	switch {
+	case strings.HasPrefix(name, nextTermMatchPrefix):
+		dir = 1
+		arg = strings.TrimPrefix(name, nextTermMatchPrefix)
+	case strings.HasPrefix(name, previousTermMatchPrefix):
+		dir = -1
+		arg = strings.TrimPrefix(name, previousTermMatchPrefix)
+	default:
+		return nil, false, nil
+	}
+
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 {
+		return nil, true, errors.Errorf("could not resolve %s: term must be a number starting from 1", name)
+	}
+
+	return ActionFunc(func(ctx context.Context, state *Peco, _ termbox.Event) {
+		jumpToTermMatch(ctx, state, n-1, dir)
+	}), true, nil
+}
+
+// hasTermMatch returns true if any of the highlighted matches of l
+// was produced by the query term whose ordinal is term
+func hasTermMatch(l line.Line, term int) bool {
+	mi, ok := l.(MatchIndexer)
+	if !ok {
+		return false
+	}
+	for i := range mi.Indices() {
+		if matchTerm(l, i) == term {
+			return true
+		}
+	}
+	return false
+}
+
+// jumpToTermMatch moves the cursor to the next line, in the direction
+// of dir, in which the query term whose ordinal is term is
+// highlighted. The search wraps around at either end of the buffer
+func jumpToTermMatch(ctx context.Context, state *Peco, term, dir int) {
+	b := state.CurrentLineBuffer()
+	size := b.Size()
+	cur := state.Location().LineNumber()
+	for i := 1; i <= size; i++ {
+		n := ((cur+dir*i)%size + size) % size
+		l, err := b.LineAt(n)
+		if err != nil || isGroupHeader(l) {
+			continue
+		}
+		if hasTermMatch(l, term) {
+			recordJump(state)
+			state.Hub().SendPaging(ctx, ToScrollFirstItem)
+			state.Hub().SendPaging(ctx, JumpToLineRequest(n))
+			return
+		}
+	}
+	state.SendStatusAndClear(ctx, StatusWarn, i18n.Sprintf("No match for term %d", term+1), 2*time.Second)
+}
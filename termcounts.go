@@ -0,0 +1,78 @@
+package peco
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/peco/peco/filter"
+	"github.com/peco/peco/internal/i18n"
+	"github.com/peco/peco/line"
+	"github.com/peco/peco/pipeline"
+)
+
+// countTermMatches returns the number of lines that each of terms
+// matches on its own, when matched with f
+func countTermMatches(ctx context.Context, f filter.Filter, terms []string, lines []line.Line) []int {
+	counts := make([]int, len(terms))
+	for i, term := range terms {
+		out := make(chan interface{})
+		counted := make(chan int)
+		go func() {
+			var n int
+			for range out {
+				n++
+			}
+			counted <- n
+		}()
+		f.Apply(f.NewContext(ctx, term), lines, pipeline.ChanOutput(out))
+		close(out)
+		counts[i] = <-counted
+	}
+	return counts
+}
+
+// reportTermMatchCounts implements TermMatchCounts. It is called when
+// query matched no lines, and tells the user which of its terms did
+// not match anything or, if they all did, how many lines each matched
+func (p *Peco) reportTermMatchCounts(ctx context.Context, f filter.Filter, query string) {
+	ts, ok := f.(filter.TermSplitter)
+	if !ok {
+		return
+	}
+	terms := ts.Terms(query)
+	if len(terms) < 2 {
+		return
+	}
+	b, ok := p.filterSource().(Buffer)
+	if !ok {
+		return
+	}
+
+	// Hidden lines are not matched by the query either
+	var lines []line.Line
+	hidden := p.HiddenLines()
+	for _, l := range b.linesInRange(0, b.Size()) {
+		if hidden == nil || !hidden.Has(l.ID()) {
+			lines = append(lines, l)
+		}
+	}
+
+	counts := countTermMatches(ctx, f, terms, lines)
+	if ctx.Err() != nil {
+		// Another query has been run meanwhile
+		return
+	}
+	for i, n := range counts {
+		if n == 0 {
+			p.SendStatus(ctx, StatusWarn, i18n.Sprintf("0 matches: term '%s' matched 0 lines", terms[i]))
+			return
+		}
+	}
+
+	parts := make([]string, len(terms))
+	for i, term := range terms {
+		parts[i] = fmt.Sprintf("'%s' %d", term, counts[i])
+	}
+	p.SendStatus(ctx, StatusWarn, i18n.Sprintf("0 matches: no line matches all terms (%s)", strings.Join(parts, ", ")))
+}
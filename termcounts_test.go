@@ -0,0 +1,35 @@
+package peco
+
+import (
+	"context"
+	"testing"
+
+	"github.com/peco/peco/filter"
+	"github.com/peco/peco/line"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReportTermMatchCounts(t *testing.T) {
+	ctx := context.Background()
+
+	p := newPeco()
+	h := &statusRecorderHub{}
+	p.hub = h
+	p.snapshot = &Snapshot{
+		lines: []line.Line{
+			line.NewRaw(0, "foo", false),
+			line.NewRaw(1, "bar", false),
+			line.NewRaw(2, "foo2", false),
+		},
+	}
+
+	f := filter.NewIgnoreCase()
+	p.reportTermMatchCounts(ctx, f, "foo xyz")
+	p.reportTermMatchCounts(ctx, f, "foo bar")
+	p.reportTermMatchCounts(ctx, f, "xyz")
+	p.reportTermMatchCounts(ctx, filter.NewFuzzy(false), "foo xyz")
+	assert.Equal(t, []string{
+		"0 matches: term 'xyz' matched 0 lines",
+		"0 matches: no line matches all terms ('foo' 2, 'bar' 1)",
+	}, h.messages, "only queries with several terms should be explained, by filters that match each term")
+}
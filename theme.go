@@ -0,0 +1,220 @@
+package peco
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nsf/termbox-go"
+	"github.com/pkg/errors"
+)
+
+// builtinThemes are the themes that can be specified by name in
+// the Theme config key. Each theme is written the same way as the
+// Style section of the config file
+var builtinThemes = map[string]string{
+	"default": `{}`,
+	"dark": `{
+		"Basic": ["default", "on_default"],
+		"SavedSelection": ["black", "bold", "on_yellow"],
+		"Selected": ["white", "bold", "on_blue"],
+		"Query": ["yellow", "bold"],
+		"Matched": ["cyan", "bold"],
+		"MatchedSelected": ["yellow", "bold"],
+		"SearchMatched": ["black", "on_yellow"],
+		"Escaped": ["magenta"]
+	}`,
+	"light": `{
+		"Basic": ["default", "on_default"],
+		"SavedSelection": ["black", "on_cyan"],
+		"Selected": ["black", "underline", "on_yellow"],
+		"Query": ["blue", "bold"],
+		"Matched": ["red", "bold"],
+		"MatchedSelected": ["blue", "bold", "underline"],
+		"SearchMatched": ["white", "on_magenta"],
+		"Escaped": ["magenta"]
+	}`,
+	"solarized": `{
+		"Basic": ["#839496", "on_default"],
+		"SavedSelection": ["#002b36", "on_#2aa198"],
+		"Selected": ["#fdf6e3", "bold", "on_#073642"],
+		"Query": ["#b58900", "bold"],
+		"Matched": ["#268bd2", "bold"],
+		"MatchedSelected": ["#b58900", "bold"],
+		"SearchMatched": ["#002b36", "on_#b58900"],
+		"Escaped": ["#d33682"],
+		"MatchedPalette": [["#268bd2", "bold"], ["#859900", "bold"], ["#cb4b16", "bold"], ["#6c71c4", "bold"]]
+	}`,
+}
+
+// styleNames are the keys that may appear in a theme
+var styleNames = map[string]struct{}{
+	"Basic":           {},
+	"SavedSelection":  {},
+	"Selected":        {},
+	"Query":           {},
+	"Matched":         {},
+	"SearchMatched":   {},
+	"Escaped":         {},
+	"QueryError":      {},
+	"Truncated":       {},
+	"Annotation":      {},
+	"MatchedPalette":  {},
+	"MatchedSelected": {},
+}
+
+// ThemeNames returns the names of the built-in themes
+func ThemeNames() []string {
+	names := make([]string, 0, len(builtinThemes))
+	for name := range builtinThemes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadTheme creates a StyleSet from the theme called name. name is
+// either the name of a built-in theme, or the path to a theme file.
+// Relative paths are resolved against dir
+func LoadTheme(name, dir string) (*StyleSet, error) {
+	buf, ok := builtinThemes[name]
+	if !ok {
+		path := name
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read theme file %s", path)
+		}
+		buf = string(b)
+	}
+
+	if err := ValidateTheme([]byte(buf)); err != nil {
+		return nil, errors.Wrapf(err, "invalid theme %s", name)
+	}
+
+	ss := NewStyleSet()
+	if err := json.Unmarshal([]byte(buf), ss); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode theme %s", name)
+	}
+	return ss, nil
+}
+
+// ValidateTheme checks that buf contains a valid theme. Unlike the
+// Style section of the config file, where unknown values are
+// silently ignored, themes must only contain known style names,
+// colors and attributes
+func ValidateTheme(buf []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(buf, &raw); err != nil {
+		return errors.Wrap(err, "failed to decode theme")
+	}
+
+	for name, v := range raw {
+		if _, ok := styleNames[name]; !ok {
+			return errors.Errorf("unknown style '%s'", name)
+		}
+
+		var styles [][]string
+		if name == "MatchedPalette" {
+			if err := json.Unmarshal(v, &styles); err != nil {
+				return errors.Wrapf(err, "failed to decode style '%s'", name)
+			}
+		} else {
+			var style []string
+			if err := json.Unmarshal(v, &style); err != nil {
+				return errors.Wrapf(err, "failed to decode style '%s'", name)
+			}
+			styles = append(styles, style)
+		}
+
+		for _, style := range styles {
+			for _, s := range style {
+				if !isValidStyleString(s) {
+					return errors.Errorf("unknown color or attribute '%s' in style '%s'", s, name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func isValidStyleString(s string) bool {
+	if _, ok := stringToFg[s]; ok {
+		return true
+	}
+	if _, ok := stringToBg[s]; ok {
+		return true
+	}
+	if _, ok := stringToFgAttr[s]; ok {
+		return true
+	}
+	if _, ok := stringToBgAttr[s]; ok {
+		return true
+	}
+
+	s = strings.TrimPrefix(s, "on_")
+	if _, err := strconv.ParseUint(s, 10, 8); err == nil {
+		return true
+	}
+	_, ok := hexToAttribute(s)
+	return ok
+}
+
+// xtermLevels are the intensities used by the 6x6x6 color cube
+// of the xterm 256 color palette
+var xtermLevels = [6]int{0, 95, 135, 175, 215, 255}
+
+// hexToAttribute converts a 24-bit color written as #rrggbb to the
+// closest color in the xterm 256 color palette, as termbox cannot
+// mix 24-bit colors with the terminal's default colors
+func hexToAttribute(s string) (termbox.Attribute, bool) {
+	if len(s) != 7 || s[0] != '#' {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(s[1:], 16, 32)
+	if err != nil {
+		return 0, false
+	}
+	r, g, b := int(v>>16&0xFF), int(v>>8&0xFF), int(v&0xFF)
+
+	distance := func(r2, g2, b2 int) int {
+		return (r-r2)*(r-r2) + (g-g2)*(g-g2) + (b-b2)*(b-b2)
+	}
+
+	// Closest color in the color cube (16-231)
+	nearest := func(c int) int {
+		best := 0
+		for i, l := range xtermLevels {
+			if abs(c-l) < abs(c-xtermLevels[best]) {
+				best = i
+			}
+		}
+		return best
+	}
+	ri, gi, bi := nearest(r), nearest(g), nearest(b)
+	index := 16 + 36*ri + 6*gi + bi
+	best := distance(xtermLevels[ri], xtermLevels[gi], xtermLevels[bi])
+
+	// Closest color in the grayscale ramp (232-255)
+	for i := 0; i < 24; i++ {
+		l := 8 + 10*i
+		if d := distance(l, l, l); d < best {
+			best = d
+			index = 232 + i
+		}
+	}
+
+	return termbox.Attribute(index + 1), true
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,96 @@
+package peco
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nsf/termbox-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHexToAttribute(t *testing.T) {
+	tests := map[string]termbox.Attribute{
+		"#000000": 16 + 1,
+		"#ffffff": 231 + 1,
+		"#ff0000": 196 + 1,
+		"#268bd2": 32 + 1,
+		"#808080": 244 + 1,
+	}
+	for s, expected := range tests {
+		attr, ok := hexToAttribute(s)
+		if !assert.True(t, ok, "%s should be parsed", s) {
+			return
+		}
+		if !assert.Equal(t, expected, attr, "%s should be converted to the closest color", s) {
+			return
+		}
+	}
+
+	for _, s := range []string{"#fff", "ffffff", "#gggggg"} {
+		_, ok := hexToAttribute(s)
+		if !assert.False(t, ok, "%s should not be parsed", s) {
+			return
+		}
+	}
+}
+
+func TestValidateTheme(t *testing.T) {
+	for _, name := range ThemeNames() {
+		if !assert.NoError(t, ValidateTheme([]byte(builtinThemes[name])), "built-in theme %s should be valid", name) {
+			return
+		}
+	}
+
+	if !assert.NoError(t, ValidateTheme([]byte(`{"Matched": ["#268bd2", "bold", "on_235"], "MatchedPalette": [["red"], ["on_#002b36"]], "MatchedSelected": ["yellow"]}`)), "valid theme should be accepted") {
+		return
+	}
+	if !assert.Error(t, ValidateTheme([]byte(`{"Matchd": ["red"]}`)), "unknown styles should be rejected") {
+		return
+	}
+	if !assert.Error(t, ValidateTheme([]byte(`{"Matched": ["rde"]}`)), "unknown colors should be rejected") {
+		return
+	}
+}
+
+func TestConfigTheme(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peco-theme-")
+	if !assert.NoError(t, err, "TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	theme := `{"Matched": ["#ff0000"], "Query": ["green"]}`
+	if !assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "theme.json"), []byte(theme), 0644), "WriteFile should succeed") {
+		return
+	}
+	rc := `{"Theme": "theme.json", "Style": {"Query": ["blue"]}}`
+	rcfile := filepath.Join(dir, "config.json")
+	if !assert.NoError(t, ioutil.WriteFile(rcfile, []byte(rc), 0644), "WriteFile should succeed") {
+		return
+	}
+
+	var cfg Config
+	if !assert.NoError(t, cfg.Init(), "Config.Init should succeed") {
+		return
+	}
+	if !assert.NoError(t, cfg.ReadFilename(rcfile), "ReadFilename should succeed") {
+		return
+	}
+
+	if !assert.Equal(t, Style{fg: 196 + 1, bg: termbox.ColorDefault}, cfg.Style.Matched, "styles should be taken from the theme") {
+		return
+	}
+	if !assert.Equal(t, Style{fg: termbox.ColorBlue, bg: termbox.ColorDefault}, cfg.Style.Query, "Style should override the theme") {
+		return
+	}
+	if !assert.Equal(t, NewStyleSet().Selected, cfg.Style.Selected, "styles not in the theme should be the defaults") {
+		return
+	}
+
+	cfg.Theme = "nosuchtheme"
+	if !assert.Error(t, cfg.applyTheme([]byte(rc), dir), "unknown themes should be rejected") {
+		return
+	}
+}
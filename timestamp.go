@@ -0,0 +1,127 @@
+package peco
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/line"
+	"github.com/pkg/errors"
+)
+
+// DefaultTimestampPatterns are the timestamp formats that are looked
+// for when no patterns are configured
+var DefaultTimestampPatterns = []TimestampPattern{
+	// 2006-01-02T15:04:05Z07:00, optionally with fractional seconds
+	{
+		Pattern: `^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(?:\.\d+)?(?:Z|[+-]\d{2}:\d{2})`,
+		Layout:  time.RFC3339Nano,
+	},
+	// 2006-01-02 15:04:05, in local time
+	{
+		Pattern: `^\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}`,
+		Layout:  "2006-01-02 15:04:05",
+	},
+	// Jan _2 15:04:05, as written by syslog
+	{
+		Pattern: `^[A-Z][a-z]{2} [ \d]\d \d{2}:\d{2}:\d{2}`,
+		Layout:  time.Stamp,
+	},
+	// [02/Jan/2006:15:04:05 -0700], as written by web servers
+	{
+		Pattern: `^\S+ \S+ \S+ \[(\d{2}/[A-Z][a-z]{2}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4})\]`,
+		Layout:  "02/Jan/2006:15:04:05 -0700",
+	},
+}
+
+type timestampPattern struct {
+	rx      *regexp.Regexp
+	layout  string
+	hasDate bool
+}
+
+// layoutHasDate reports whether layout contains the month and the day,
+// as opposed to layouts such as "15:04:05" that only give a time of day
+func layoutHasDate(layout string) bool {
+	t, err := time.Parse(layout, time.Date(2, time.February, 3, 0, 0, 0, 0, time.UTC).Format(layout))
+	return err == nil && t.Month() == time.February && t.Day() == 3
+}
+
+// timestampDimmer is a LineStyler that dims lines that begin with a
+// timestamp older than a given age
+type timestampDimmer struct {
+	patterns []timestampPattern
+	age      time.Duration
+	now      func() time.Time
+}
+
+func newTimestampDimmer(patterns []TimestampPattern, age time.Duration) (*timestampDimmer, error) {
+	if len(patterns) == 0 {
+		patterns = DefaultTimestampPatterns
+	}
+
+	d := &timestampDimmer{
+		age: age,
+		now: time.Now,
+	}
+	for _, p := range patterns {
+		rx, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to compile timestamp pattern '%s'", p.Pattern)
+		}
+		d.patterns = append(d.patterns, timestampPattern{rx: rx, layout: p.Layout, hasDate: layoutHasDate(p.Layout)})
+	}
+	return d, nil
+}
+
+// Timestamp returns the time at the beginning of s, using the first
+// pattern that matches
+func (d *timestampDimmer) Timestamp(s string) (time.Time, bool) {
+	for _, p := range d.patterns {
+		m := p.rx.FindStringSubmatch(s)
+		if m == nil {
+			continue
+		}
+
+		v := m[0]
+		if len(m) > 1 {
+			v = m[1]
+		}
+
+		t, err := time.ParseInLocation(p.layout, v, time.Local)
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case !p.hasDate:
+			// Layouts such as "15:04:05" do not contain the date.
+			// Assume the most recent day that does not place t in
+			// the future
+			now := d.now().In(t.Location())
+			t = time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+			if t.After(now) {
+				t = t.AddDate(0, 0, -1)
+			}
+		case t.Year() == 0:
+			// Layouts such as time.Stamp do not contain the year.
+			// Assume the most recent year that does not place t in
+			// the future
+			now := d.now()
+			t = t.AddDate(now.Year(), 0, 0)
+			if t.After(now) {
+				t = t.AddDate(-1, 0, 0)
+			}
+		}
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+func (d *timestampDimmer) StyleLine(l line.Line, fg, bg termbox.Attribute) (termbox.Attribute, termbox.Attribute) {
+	t, ok := d.Timestamp(l.DisplayString())
+	if !ok || d.now().Sub(t) <= d.age {
+		return fg, bg
+	}
+	return fg | termbox.AttrDim, bg
+}
@@ -0,0 +1,106 @@
+package peco
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/line"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimestampDimmer(t *testing.T) {
+	now := time.Date(2018, time.March, 1, 12, 0, 0, 0, time.Local)
+
+	t.Run("default patterns", func(t *testing.T) {
+		d, err := newTimestampDimmer(nil, 10*time.Minute)
+		if !assert.NoError(t, err, "newTimestampDimmer should succeed") {
+			return
+		}
+		d.now = func() time.Time { return now }
+
+		fg, bg := termbox.ColorGreen, termbox.ColorBlack
+		tests := []struct {
+			input  string
+			dimmed bool
+		}{
+			{input: now.Add(-time.Hour).Format("2006-01-02 15:04:05") + " old", dimmed: true},
+			{input: now.Add(-time.Minute).Format("2006-01-02 15:04:05") + " new", dimmed: false},
+			{input: now.Add(-time.Hour).UTC().Format(time.RFC3339) + " old", dimmed: true},
+			{input: now.Add(-time.Minute).UTC().Format(time.RFC3339Nano) + " new", dimmed: false},
+			{input: now.Add(-time.Hour).Format(time.Stamp) + " old", dimmed: true},
+			{input: now.Add(-time.Minute).Format(time.Stamp) + " new", dimmed: false},
+			{input: `127.0.0.1 - - [` + now.Add(-time.Hour).Format("02/Jan/2006:15:04:05 -0700") + `] "GET / HTTP/1.1" 200`, dimmed: true},
+			{input: "no timestamp 2006-01-02 15:04:05", dimmed: false},
+		}
+
+		for _, tt := range tests {
+			gotFg, gotBg := d.StyleLine(line.NewRaw(0, tt.input, false), fg, bg)
+			if tt.dimmed {
+				assert.Equal(t, fg|termbox.AttrDim, gotFg, "%q should be dimmed", tt.input)
+			} else {
+				assert.Equal(t, fg, gotFg, "%q should not be dimmed", tt.input)
+			}
+			assert.Equal(t, bg, gotBg, "background should not change for %q", tt.input)
+		}
+	})
+
+	t.Run("syslog timestamps from last year", func(t *testing.T) {
+		d, err := newTimestampDimmer(nil, 10*time.Minute)
+		if !assert.NoError(t, err, "newTimestampDimmer should succeed") {
+			return
+		}
+		d.now = func() time.Time { return now }
+
+		ts, ok := d.Timestamp("Dec 31 23:00:00 host sshd[1]: hello")
+		if !assert.True(t, ok, "timestamp should be found") {
+			return
+		}
+		assert.Equal(t, 2017, ts.Year(), "timestamp should not be in the future")
+	})
+
+	t.Run("times of day", func(t *testing.T) {
+		patterns := []TimestampPattern{{Pattern: `^\d{2}:\d{2}:\d{2}`, Layout: "15:04:05"}}
+		d, err := newTimestampDimmer(patterns, 10*time.Minute)
+		if !assert.NoError(t, err, "newTimestampDimmer should succeed") {
+			return
+		}
+		d.now = func() time.Time { return now }
+
+		ts, ok := d.Timestamp("11:55:00 today")
+		if !assert.True(t, ok, "timestamp should be found") {
+			return
+		}
+		assert.Equal(t, now.Add(-5*time.Minute), ts, "timestamp should be placed today")
+
+		ts, ok = d.Timestamp("23:00:00 yesterday")
+		if !assert.True(t, ok, "timestamp should be found") {
+			return
+		}
+		assert.Equal(t, time.Date(2018, time.February, 28, 23, 0, 0, 0, time.Local), ts, "timestamp should not be in the future")
+
+		fg, _ := d.StyleLine(line.NewRaw(0, "11:55:00 recent", false), termbox.ColorGreen, termbox.ColorBlack)
+		assert.Equal(t, termbox.ColorGreen, fg, "recent times of day should not be dimmed")
+	})
+
+	t.Run("custom patterns", func(t *testing.T) {
+		patterns := []TimestampPattern{{Pattern: `^@(\d+:\d+)`, Layout: "15:04"}}
+		d, err := newTimestampDimmer(patterns, time.Minute)
+		if !assert.NoError(t, err, "newTimestampDimmer should succeed") {
+			return
+		}
+
+		ts, ok := d.Timestamp("@13:45 something happened")
+		if !assert.True(t, ok, "timestamp should be found") {
+			return
+		}
+		assert.Equal(t, 13, ts.Hour(), "capture group should be parsed")
+		assert.Equal(t, 45, ts.Minute(), "capture group should be parsed")
+
+		_, ok = d.Timestamp("2018-03-01 12:00:00 default patterns are not used")
+		assert.False(t, ok, "default patterns should not be used")
+
+		_, err = newTimestampDimmer([]TimestampPattern{{Pattern: `(`}}, time.Minute)
+		assert.Error(t, err, "invalid patterns should be rejected")
+	})
+}
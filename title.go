@@ -0,0 +1,55 @@
+package peco
+
+import (
+	"strings"
+	"unicode"
+)
+
+// titleSequence returns the escape sequence that sets the title of
+// the terminal (OSC 0). Control characters are dropped from title, as
+// they could end the sequence early
+func titleSequence(title string) string {
+	title = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, title)
+	return "\x1b]0;" + title + "\x07"
+}
+
+// terminalTitle returns the title of the terminal while peco runs,
+// which names the input unless it is stdin
+func (p *Peco) terminalTitle() string {
+	if name := p.inputSource().Name(); name != "" && name != "-" {
+		return "peco: " + name
+	}
+	return "peco"
+}
+
+// setTitle implements TerminalTitle, by setting the title of the
+// terminal if enabled and supported by the screen
+func (p *Peco) setTitle() error {
+	if !p.config.TerminalTitle {
+		return nil
+	}
+	ts, ok := p.screen.(titledScreen)
+	if !ok {
+		return nil
+	}
+	if err := ts.SetTitle(p.terminalTitle()); err != nil {
+		return err
+	}
+	p.titleSet = true
+	return nil
+}
+
+// restoreTitle restores the title of the terminal that was there
+// before setTitle, if it set one
+func (p *Peco) restoreTitle() error {
+	if !p.titleSet {
+		return nil
+	}
+	p.titleSet = false
+	return p.screen.(titledScreen).RestoreTitle()
+}
@@ -0,0 +1,43 @@
+package peco
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTitleSequence(t *testing.T) {
+	assert.Equal(t, "\x1b]0;peco: a.txt\x07", titleSequence("peco: a.txt"), "the title should be set with OSC 0")
+	assert.Equal(t, "\x1b]0;peco: ab\x07", titleSequence("peco: a\x07\x1bb"), "control characters should be dropped")
+}
+
+func TestTerminalTitle(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	screen := NewMemoryScreen(80, 10)
+	p := newPeco()
+	p.screen = screen
+	p.config.TerminalTitle = true
+	filename := p.Argv[1]
+
+	runCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	errCh := make(chan error, 1)
+	go func() { errCh <- p.Run(runCtx) }()
+
+	for screen.Title() == "" && ctx.Err() == nil {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, "peco: "+filename, screen.Title(), "the title should name the input")
+
+	stop()
+	select {
+	case <-ctx.Done():
+		t.Fatalf("timed out waiting for peco to exit")
+	case <-errCh:
+	}
+	assert.Equal(t, "", screen.Title(), "the title should be restored on exit")
+}
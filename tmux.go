@@ -0,0 +1,121 @@
+package peco
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lestrrat-go/pdebug"
+	"github.com/nsf/termbox-go"
+	"github.com/peco/peco/internal/i18n"
+	"github.com/peco/peco/internal/tmux"
+	"github.com/peco/peco/internal/util"
+	"github.com/peco/peco/line"
+	"github.com/pkg/errors"
+)
+
+// parseTmuxModes parses the value of --tmux, a comma separated list
+// of tmuxBuffer, and tmuxWindow or tmuxPane
+func parseTmuxModes(s string) (buffer bool, open string, err error) {
+	if s == "" {
+		return false, "", nil
+	}
+
+	for _, mode := range strings.Split(s, ",") {
+		switch mode = strings.TrimSpace(mode); mode {
+		case tmuxBuffer:
+			buffer = true
+		case tmuxWindow, tmuxPane:
+			if open != "" && open != mode {
+				return false, "", errors.New("--tmux accepts only one of '" + tmuxWindow + "' and '" + tmuxPane + "'")
+			}
+			open = mode
+		default:
+			return false, "", errors.New("unknown value for --tmux: '" + mode + "'")
+		}
+	}
+	return buffer, open, nil
+}
+
+// insideTmux returns true if peco is running inside tmux. --tmux is
+// ignored otherwise, so that the same command line works everywhere
+func (p *Peco) insideTmux() bool {
+	return tmux.Inside(os.Getenv)
+}
+
+// copyToTmux places the outputs of lines into a tmux paste buffer,
+// one per line. There is no newline after the last one, so that
+// pasting a single line into a shell does not run it
+func copyToTmux(lines []line.Line) error {
+	outputs := make([]string, len(lines))
+	for i, l := range lines {
+		outputs[i] = l.Output()
+	}
+	return tmux.SetBuffer(strings.Join(outputs, "\n"))
+}
+
+// tmuxCommandLine returns the shell command line that runs c with
+// lines, for a new tmux window or pane. As there is no way to pass
+// the stdin of peco on to tmux, the lines are written to the stdin
+// of the command by printf, separated as they would be for --exec
+func (p *Peco) tmuxCommandLine(c CommandConfig, lines []line.Line) string {
+	words := []string{"printf", fmt.Sprintf(`'%%s\%03o'`, p.outputSeparator())}
+	for _, l := range lines {
+		words = append(words, util.ShellQuote(l.Buffer()))
+	}
+	return strings.Join(words, " ") + " | " + c.shellLine(lines)
+}
+
+// openInTmux runs c with lines in a new tmux window or pane, as
+// specified by --tmux. The command gets the same PECO_ variables as
+// --exec does. As it outlives peco, it removes the file that lists
+// the IDs of lines itself
+func (p *Peco) openInTmux(c CommandConfig, lines []line.Line) error {
+	idsEnv, removeIDs, err := matchedIDsEnv(lines)
+	if err != nil {
+		return err
+	}
+	env := append(append(p.pecoEnv(),
+		`PECO_MATCHED_LINE_COUNT=`+strconv.Itoa(len(lines)),
+	), idsEnv...)
+
+	command := p.tmuxCommandLine(c, lines) + `; rm -f "$PECO_MATCHED_IDS_FILE"`
+	if p.tmuxOpen == tmuxPane {
+		err = tmux.SplitWindow(command, env)
+	} else {
+		err = tmux.NewWindow(command, env)
+	}
+	if err != nil {
+		removeIDs()
+	}
+	return err
+}
+
+// doTmuxBuffer places the selected lines, or the line under the
+// cursor, into a tmux paste buffer without finishing
+func doTmuxBuffer(ctx context.Context, state *Peco, _ termbox.Event) {
+	if pdebug.Enabled {
+		g := pdebug.Marker("doTmuxBuffer")
+		defer g.End()
+	}
+
+	if !state.insideTmux() {
+		state.SendStatusAndClear(ctx, StatusWarn, i18n.T("Not running inside tmux"), 2*time.Second)
+		return
+	}
+
+	_, lines := commandInput(state, selectedOrCurrent(state))
+	if len(lines) == 0 {
+		state.SendStatusAndClear(ctx, StatusWarn, i18n.T("No lines selected"), 2*time.Second)
+		return
+	}
+
+	if err := copyToTmux(lines); err != nil {
+		state.SendStatusAndClear(ctx, StatusError, err.Error(), 2*time.Second)
+		return
+	}
+	state.SendStatusAndClear(ctx, StatusInfo, i18n.Sprintf("Copied %d lines to the tmux buffer", len(lines)), 2*time.Second)
+}
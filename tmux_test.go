@@ -0,0 +1,119 @@
+package peco
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/peco/peco/filter"
+	"github.com/peco/peco/internal/tmux"
+	"github.com/peco/peco/internal/util"
+	"github.com/peco/peco/line"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTmuxModes(t *testing.T) {
+	buffer, open, err := parseTmuxModes("buffer, pane")
+	if !assert.NoError(t, err, "parseTmuxModes should succeed") {
+		return
+	}
+	assert.True(t, buffer, "buffer should be enabled")
+	assert.Equal(t, tmuxPane, open, "results should be opened in a pane")
+
+	buffer, open, err = parseTmuxModes("window")
+	if !assert.NoError(t, err, "parseTmuxModes should succeed") {
+		return
+	}
+	assert.False(t, buffer, "buffer should be disabled")
+	assert.Equal(t, tmuxWindow, open, "results should be opened in a window")
+
+	_, _, err = parseTmuxModes("window,pane")
+	assert.Error(t, err, "window and pane should be exclusive")
+	_, _, err = parseTmuxModes("session")
+	assert.Error(t, err, "unknown modes should be rejected")
+
+	var options CLIOptions
+	_, err = options.parse([]string{"--tmux", "clipboard"})
+	assert.Error(t, err, "--tmux should be validated")
+}
+
+func TestTmuxCommandLine(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires /bin/sh")
+	}
+
+	state := newPeco()
+	lines := []line.Line{
+		line.NewRaw(0, "it's", false),
+		line.NewRaw(1, "$HOME dir", false),
+	}
+
+	out, err := util.Shell(state.tmuxCommandLine(CommandConfig{Line: "cat"}, lines)).Output()
+	if !assert.NoError(t, err, "the command line should run") {
+		return
+	}
+	assert.Equal(t, "it's\n$HOME dir\n", string(out), "the lines should be written to stdin")
+
+	out, err = util.Shell(state.tmuxCommandLine(CommandConfig{Argv: []string{"printf", "[%s]", "{}"}}, lines)).Output()
+	if !assert.NoError(t, err, "the command line should run") {
+		return
+	}
+	assert.Equal(t, "[it's][$HOME dir]", string(out), "placeholders should be replaced with quoted lines")
+
+	state.print0 = true
+	out, err = util.Shell(state.tmuxCommandLine(CommandConfig{Line: "cat"}, lines)).Output()
+	if !assert.NoError(t, err, "the command line should run") {
+		return
+	}
+	assert.Equal(t, "it's\x00$HOME dir\x00", string(out), "lines should be separated as for --exec")
+}
+
+func TestOpenInTmux(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires /bin/sh")
+	}
+
+	dir, err := ioutil.TempDir("", "peco-test-tmux-")
+	if !assert.NoError(t, err, "TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// The fake tmux runs the command right away, with the variables
+	// given by -e in its environment
+	script := filepath.Join(dir, "tmux")
+	out := filepath.Join(dir, "out")
+	body := "#!/bin/sh\nshift\nwhile [ \"$1\" = -e ]; do export \"$2\"; shift 2; done\nsh -c \"$1\" > " + out + "\n"
+	if !assert.NoError(t, ioutil.WriteFile(script, []byte(body), 0755), "writing fake tmux should succeed") {
+		return
+	}
+	defer func(old string) { tmux.Program = old }(tmux.Program)
+	tmux.Program = script
+
+	state := newPeco()
+	state.Filters().Add(filter.NewIgnoreCase())
+	state.tmuxOpen = tmuxWindow
+	lines := []line.Line{
+		line.NewRaw(3, "foo", false),
+		line.NewRaw(5, "bar", false),
+	}
+	c := CommandConfig{Line: `echo "$PECO_MATCHED_LINE_COUNT $PECO_MATCHED_IDS"; echo "$PECO_MATCHED_IDS_FILE"`}
+	if !assert.NoError(t, state.openInTmux(c, lines), "openInTmux should succeed") {
+		return
+	}
+
+	buf, err := ioutil.ReadFile(out)
+	if !assert.NoError(t, err, "the command should run") {
+		return
+	}
+	outputs := strings.Split(strings.TrimSpace(string(buf)), "\n")
+	if !assert.Len(t, outputs, 2, "the command should print two lines") {
+		return
+	}
+	assert.Equal(t, "2 3 5", outputs[0], "the matched lines should be passed on to the command")
+	_, err = os.Stat(outputs[1])
+	assert.True(t, os.IsNotExist(err), "the file listing the IDs should be removed once the command exits")
+}
@@ -0,0 +1,75 @@
+package peco
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/peco/peco/filter"
+	"github.com/peco/peco/pipeline"
+)
+
+// Events written by --trace
+const (
+	traceSourceStart = "source_start"
+	traceChunk       = "chunk"
+	traceFilterDone  = "filter_done"
+	traceBufferSwap  = "buffer_swap"
+)
+
+// traceEventJSON is a line written by --trace
+type traceEventJSON struct {
+	Time    string  `json:"time"`
+	Event   string  `json:"event"`
+	Query   string  `json:"query,omitempty"`
+	Size    *int    `json:"size,omitempty"`
+	Elapsed float64 `json:"elapsed_ms,omitempty"`
+}
+
+// newJSONTracer creates a pipeline.Tracer that writes events to w
+func newJSONTracer(w io.Writer) *jsonTracer {
+	return &jsonTracer{enc: json.NewEncoder(w)}
+}
+
+func (t *jsonTracer) write(ctx context.Context, event string, size *int, elapsed time.Duration) {
+	ev := traceEventJSON{
+		Time:    time.Now().Format(time.RFC3339Nano),
+		Event:   event,
+		Size:    size,
+		Elapsed: float64(elapsed) / float64(time.Millisecond),
+	}
+	ev.Query, _ = filter.QueryFromContext(ctx)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.enc.Encode(ev)
+}
+
+// OnSourceStart implements pipeline.Tracer
+func (t *jsonTracer) OnSourceStart(ctx context.Context) {
+	t.write(ctx, traceSourceStart, nil, 0)
+}
+
+// OnChunk implements pipeline.Tracer
+func (t *jsonTracer) OnChunk(ctx context.Context, size int, elapsed time.Duration) {
+	t.write(ctx, traceChunk, &size, elapsed)
+}
+
+// OnFilterDone implements pipeline.Tracer
+func (t *jsonTracer) OnFilterDone(ctx context.Context, elapsed time.Duration) {
+	t.write(ctx, traceFilterDone, nil, elapsed)
+}
+
+// OnBufferSwap implements pipeline.Tracer
+func (t *jsonTracer) OnBufferSwap(ctx context.Context, size int) {
+	t.write(ctx, traceBufferSwap, &size, 0)
+}
+
+// traceFilteredChunk reports a chunk of size lines, which were filtered
+// since started, to the tracer of the pipeline, if any
+func traceFilteredChunk(ctx context.Context, size int, started time.Time) {
+	if t := pipeline.TracerFromContext(ctx); t != nil {
+		t.OnChunk(ctx, size, time.Since(started))
+	}
+}
@@ -0,0 +1,72 @@
+package peco
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peco-trace-")
+	if !assert.NoError(t, err, "creating temporary directory should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "trace.json")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	state := newPeco()
+	state.Argv = []string{"--trace", file}
+	state.Stdin = bytes.NewBufferString("foo\nbar\nfoobar\n")
+	go state.Run(ctx)
+	<-state.Ready()
+	for state.source.Size() < 3 {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	ch := make(chan struct{})
+	state.Query().Set("foo")
+	state.ExecQuery(func() { close(ch) })
+	<-ch
+
+	f, err := os.Open(file)
+	if !assert.NoError(t, err, "trace file should be created") {
+		return
+	}
+	defer f.Close()
+
+	var events []string
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var ev traceEventJSON
+		if !assert.NoError(t, json.Unmarshal(scanner.Bytes(), &ev), "each line should be a JSON object") {
+			return
+		}
+		if !assert.Equal(t, "foo", ev.Query, "events should be tagged with the query") {
+			return
+		}
+		events = append(events, ev.Event)
+		if ev.Event == traceChunk {
+			lines += *ev.Size
+		}
+	}
+
+	if !assert.NotEmpty(t, events, "events should be written") {
+		return
+	}
+	assert.Equal(t, traceSourceStart, events[0], "the source should start first")
+	assert.Contains(t, events, traceFilterDone, "the end of the query should be traced")
+	assert.Contains(t, events, traceBufferSwap, "displaying the results should be traced")
+	assert.Equal(t, 3, lines, "every line should be part of a chunk")
+}
@@ -5,6 +5,7 @@ import (
 
 	"context"
 	"github.com/peco/peco/hub"
+	"github.com/peco/peco/internal/i18n"
 )
 
 type statusMsgReq interface {
@@ -24,6 +25,18 @@ func (jlr JumpToLineRequest) Line() int {
 	return int(jlr)
 }
 
+func (cpr CountedPagingRequest) Type() PagingRequestType {
+	return cpr.Request
+}
+
+func (anchorCursorRequest) Type() PagingRequestType {
+	return toCursorAnchor
+}
+
+func (restoreCursorRequest) Type() PagingRequestType {
+	return toCursorAnchor
+}
+
 func NewView(state *Peco) *View {
 	var layout Layout
 	switch state.LayoutType() {
@@ -84,6 +97,9 @@ func (v *View) drawScreen(p hub.Payload, options *DrawOptions) {
 	defer p.Done()
 
 	v.layout.DrawScreen(v.state, options)
+	if options != nil && !options.queryStartedAt.IsZero() {
+		v.state.recordPaintLatency(options.queryStartedAt)
+	}
 }
 
 func (v *View) drawPrompt(p hub.Payload) {
@@ -95,7 +111,65 @@ func (v *View) drawPrompt(p hub.Payload) {
 func (v *View) movePage(p hub.Payload, r PagingRequest) {
 	defer p.Done()
 
-	if v.layout.MovePage(v.state, r) {
-		v.layout.DrawScreen(v.state, nil)
+	switch r := r.(type) {
+	case anchorCursorRequest:
+		v.anchorCursor(r)
+		return
+	case restoreCursorRequest:
+		v.restoreCursor(r)
+		return
+	}
+
+	// Moving the cursor pauses follow mode, like less +F
+	if v.state.Following() {
+		v.state.SetFollowing(false)
+		v.layout.PrintStatus(i18n.T("Follow mode off"), 2*time.Second)
+	}
+
+	before := v.state.Location().LineNumber()
+	if !v.layout.MovePage(v.state, r) {
+		return
+	}
+	v.cursorMoves++
+
+	// Moving the cursor by lines only changes the rows that it moved
+	// between, unless lines were selected in range mode along the way
+	var options *DrawOptions
+	switch r.Type() {
+	case ToLineAbove, ToLineBelow:
+		if !v.state.SelectionRangeStart().Valid() {
+			options = &DrawOptions{Lines: []int{before, v.state.Location().LineNumber()}}
+		}
+	}
+	v.layout.DrawScreen(v.state, options)
+}
+
+// anchorCursor remembers the line under the cursor in r.buffer
+func (v *View) anchorCursor(r anchorCursorRequest) {
+	l, err := r.buffer.LineAt(v.state.Location().LineNumber())
+	if err != nil {
+		*r.anchor = cursorAnchor{moves: v.cursorMoves}
+		return
+	}
+	*r.anchor = cursorAnchor{id: l.ID(), moves: v.cursorMoves, valid: true}
+}
+
+// restoreCursor moves the cursor to the line in r.buffer that was
+// under it when the anchor was taken or, if that line is not in the
+// buffer, to the line that was closest to it in the input. The cursor
+// is left alone if the user has moved it in the meantime, or if
+// r.buffer is no longer displayed
+func (v *View) restoreCursor(r restoreCursorRequest) {
+	a := *r.anchor
+	if r.sticky {
+		v.sticky = a
+	} else if v.sticky.valid && v.sticky.moves == v.cursorMoves {
+		a = v.sticky
+	}
+	if !a.valid || a.moves != v.cursorMoves || v.state.CurrentLineBuffer() != r.buffer {
+		return
+	}
+	if n := nearestLineIndex(r.buffer, a.id); n >= 0 {
+		v.state.Location().SetLineNumber(n)
 	}
 }